@@ -8,18 +8,142 @@ import (
 )
 
 type Empty struct{}
+
+// Auth carries the RPCSecret of tobab, every call has to provide it before anything is done
+type Auth struct {
+	Secret string
+}
+
+// SetSecret lets a client provide the secret for any call
+func (a *Auth) SetSecret(secret string) {
+	a.Secret = secret
+}
+
+type GetHostsIn struct {
+	Auth
+}
+
 type GetHostsOut struct {
 	Hosts []tobab.Host
 }
 type AddHostIn struct {
+	Auth
 	Host tobab.Host
 }
 
 type DeleteHostIn struct {
+	Auth
+	Hostname string
+}
+
+type DisableHostIn struct {
+	Auth
+	Hostname string
+}
+
+type EnableHostIn struct {
+	Auth
+	Hostname string
+}
+
+// SetMaintenanceIn starts or ends the maintenance of a host
+type SetMaintenanceIn struct {
+	Auth
+	Hostname    string
+	Maintenance bool
+}
+
+type ShowHostIn struct {
+	Auth
 	Hostname string
 }
 
+// ShowHostOut is a host as tobab uses it at runtime, after merging in the global defaults
+type ShowHostOut struct {
+	Host        tobab.Host
+	Enabled     bool
+	RBACMode    string
+	Timeouts    tobab.Timeouts
+	Certificate CertificateStatus
+}
+
+type CertificateStatus struct {
+	Managed   bool
+	Issuer    string    `json:",omitempty"`
+	NotBefore time.Time `json:",omitempty"`
+	NotAfter  time.Time `json:",omitempty"`
+	Error     string    `json:",omitempty"`
+}
+
+type RenewCertIn struct {
+	Auth
+	Hostname string
+}
+
+type RenewCertOut struct {
+	NotAfter time.Time
+}
+
+// PurgeCacheIn drops the cached responses of a host
+type PurgeCacheIn struct {
+	Auth
+	Hostname string
+}
+
+type PurgeCacheOut struct {
+	Purged int
+}
+
+type ArmCaptureIn struct {
+	Auth
+	Hostname string
+	Count    int
+	Timeout  time.Duration
+}
+
+type GetCapturesIn struct {
+	Auth
+	Hostname string
+}
+
+type GetCapturesOut struct {
+	Captures []Capture
+}
+
+// Capture is a single request/response pair of a host, secrets are redacted and bodies truncated
+type Capture struct {
+	Time            time.Time
+	Duration        time.Duration
+	Method          string
+	URL             string
+	Proto           string
+	RequestHeaders  map[string][]string
+	RequestBody     string
+	Status          int
+	ResponseHeaders map[string][]string
+	ResponseBody    string
+	Truncated       bool
+}
+
+type GetHealthIn struct {
+	Auth
+	Hostname string
+}
+
+type GetHealthOut struct {
+	Backends []BackendHealth
+}
+
+// BackendHealth is the state of a backend, LastCheck is only set for hosts with a HealthCheckPath
+type BackendHealth struct {
+	URL       string
+	Healthy   bool
+	LastCheck time.Time `json:",omitempty"`
+	Error     string    `json:",omitempty"`
+}
+
 type CreateTokenIn struct {
+	Auth
 	Email string
 	TTL   time.Duration
 }
@@ -28,10 +152,54 @@ type CreateTokenOut struct {
 	Token string
 }
 
+type ListTokensIn struct {
+	Auth
+}
+
+type ListTokensOut struct {
+	Tokens []tobab.IssuedToken
+}
+
 type ValidateTokenIn struct {
+	Auth
 	Token string
 }
 
 type ValidateTokenOut struct {
 	Token paseto.JSONToken
 }
+
+// CreateCredentialIn creates a basic auth credential for Username on a host, the password is generated
+type CreateCredentialIn struct {
+	Auth
+	Hostname string
+	Username string
+}
+
+type CreateCredentialOut struct {
+	Password string
+}
+
+type DeleteCredentialIn struct {
+	Auth
+	Hostname string
+	Username string
+}
+
+type RotateKeyIn struct {
+	Auth
+}
+
+// RotateKeyOut has the id of the new signing key, tokens signed with the previous key are accepted until
+// RetiredValidUntil
+type RotateKeyOut struct {
+	KeyID             string
+	RetiredValidUntil time.Time
+}
+
+// RevokeTokenIn revokes a single token by its ID, or all tokens of a user by email
+type RevokeTokenIn struct {
+	Auth
+	TokenID string
+	Email   string
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// acmeChallengeMiddleware answers ACME http challenges before any routing or authentication happens, so
+// certificate issuance is never blocked by a login redirect or a path rewrite of a host. Challenge requests
+// that can't be solved are answered with a 404 instead of being passed on.
+func acmeChallengeMiddleware(am *certmagic.ACMEManager) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !certmagic.LooksLikeHTTPChallenge(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !am.HandleHTTPChallenge(w, r) {
+				http.NotFound(w, r)
+			}
+		})
+	}
+}
+
+func acmeManager(magic *certmagic.Config) *certmagic.ACMEManager {
+	am, _ := magic.Issuer.(*certmagic.ACMEManager)
+	return am
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/gnur/tobab"
+	"github.com/gorilla/mux"
+)
+
+// challengeStorage is a certmagic.Storage that only knows about pending http challenges
+type challengeStorage map[string]string
+
+func (s challengeStorage) Load(key string) ([]byte, error) {
+	for domain, token := range s {
+		if strings.HasSuffix(key, "/"+domain+".json") {
+			return json.Marshal(map[string]string{"Domain": domain, "Token": token, "KeyAuth": token + ".keyauth"})
+		}
+	}
+	return nil, certmagic.ErrNotExist(nil)
+}
+func (s challengeStorage) Lock(context.Context, string) error     { return nil }
+func (s challengeStorage) Unlock(string) error                    { return nil }
+func (s challengeStorage) Store(string, []byte) error             { return nil }
+func (s challengeStorage) Delete(string) error                    { return nil }
+func (s challengeStorage) Exists(string) bool                     { return false }
+func (s challengeStorage) List(string, bool) ([]string, error)    { return nil, nil }
+func (s challengeStorage) Stat(string) (certmagic.KeyInfo, error) { return certmagic.KeyInfo{}, nil }
+
+func TestACMEChallengeMiddleware(t *testing.T) {
+	app := newTestApp(tobab.Config{}, tobab.Host{
+		Hostname: "private.example.com",
+		Backend:  "http://localhost:1234",
+		Type:     "http",
+		Globs:    []tobab.Glob{"*@example.com"},
+	})
+	r := mux.NewRouter()
+	r.Host("private.example.com").PathPrefix("/").Handler(okHandler)
+	r.Use(app.getRBACMiddleware())
+
+	magic := certmagic.NewDefault()
+	magic.Storage = challengeStorage{"private.example.com": "pending-token"}
+	am := certmagic.NewACMEManager(magic, certmagic.ACMEManager{})
+
+	tests := []struct {
+		name       string
+		am         *certmagic.ACMEManager
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "pending challenge is answered", am: am, path: "/.well-known/acme-challenge/pending-token", wantStatus: http.StatusOK, wantBody: "pending-token.keyauth"},
+		{name: "unknown challenge is not redirected", am: am, path: "/.well-known/acme-challenge/other-token", wantStatus: http.StatusNotFound},
+		{name: "challenge without acme manager", path: "/.well-known/acme-challenge/pending-token", wantStatus: http.StatusNotFound},
+		{name: "other well-known paths require login", am: am, path: "/.well-known/other", wantStatus: http.StatusFound},
+		{name: "regular paths require login", am: am, path: "/", wantStatus: http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			acmeChallengeMiddleware(tt.am)(r).ServeHTTP(w, httptest.NewRequest("GET", "http://private.example.com"+tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsroute53 "github.com/aws/aws-sdk-go/service/route53"
+	"github.com/gnur/tobab"
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/providers/dns/cloudflare"
+	"github.com/go-acme/lego/v3/providers/dns/route53"
+)
+
+const (
+	//dnsPropagationTimeout is how long the acme client waits for a challenge record to show up in dns
+	dnsPropagationTimeout  = 3 * time.Minute
+	dnsPropagationInterval = 5 * time.Second
+	dnsRecordTTL           = 120
+)
+
+// newDNSProvider returns the DNS-01 solver of the configured DNSProvider, or nil when none is configured.
+// Credentials that are not in the config are read from the same environment variables the aws and cloudflare
+// tools use.
+func newDNSProvider(cfg tobab.Config) (challenge.Provider, error) {
+	switch cfg.DNSProvider {
+	case "":
+		return nil, nil
+	case tobab.DNSProviderCloudflare:
+		token := configOrEnv(cfg.CloudflareAPIToken, "CLOUDFLARE_DNS_API_TOKEN")
+		if token == "" {
+			return nil, errors.New("the cloudflare dns provider needs an api token, set CloudflareAPIToken or $CLOUDFLARE_DNS_API_TOKEN")
+		}
+		//the token needs the Zone.Zone read and Zone.DNS edit permissions for the zones of the hosts
+		c := cloudflare.NewDefaultConfig()
+		c.AuthToken = token
+		c.TTL = dnsRecordTTL
+		c.PropagationTimeout = dnsPropagationTimeout
+		c.PollingInterval = dnsPropagationInterval
+		c.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+		p, err := cloudflare.NewDNSProviderConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case tobab.DNSProviderRoute53:
+		keyID := configOrEnv(cfg.Route53AccessKeyID, "AWS_ACCESS_KEY_ID")
+		secret := configOrEnv(cfg.Route53SecretAccessKey, "AWS_SECRET_ACCESS_KEY")
+		if keyID == "" || secret == "" {
+			return nil, errors.New("the route53 dns provider needs credentials, set Route53AccessKeyID and Route53SecretAccessKey or $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+		}
+		//the credentials of the config win over the credential chain of the aws sdk
+		sess, err := session.NewSession(aws.NewConfig().
+			WithCredentials(credentials.NewStaticCredentials(keyID, secret, os.Getenv("AWS_SESSION_TOKEN"))).
+			//route53 is a global service, its api is only in us-east-1
+			WithRegion("us-east-1").
+			WithMaxRetries(5))
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure the route53 client: %w", err)
+		}
+		c := route53.NewDefaultConfig()
+		c.HostedZoneID = configOrEnv(cfg.Route53HostedZoneID, "AWS_HOSTED_ZONE_ID")
+		c.TTL = dnsRecordTTL
+		c.PropagationTimeout = dnsPropagationTimeout
+		c.PollingInterval = dnsPropagationInterval
+		c.Client = awsroute53.New(sess)
+		p, err := route53.NewDNSProviderConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("dns provider '%s' is not supported", cfg.DNSProvider)
+}
+
+func configOrEnv(value, env string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/go-acme/lego/v3/challenge"
+)
+
+func TestNewDNSProvider_RequiresCredentials(t *testing.T) {
+	for _, env := range []string{"CLOUDFLARE_DNS_API_TOKEN", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		if v, ok := os.LookupEnv(env); ok {
+			defer os.Setenv(env, v)
+			os.Unsetenv(env)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		cfg     tobab.Config
+		wantErr bool
+	}{
+		{name: "no provider", cfg: tobab.Config{}},
+		{name: "cloudflare without token", cfg: tobab.Config{DNSProvider: tobab.DNSProviderCloudflare}, wantErr: true},
+		{name: "cloudflare", cfg: tobab.Config{DNSProvider: tobab.DNSProviderCloudflare, CloudflareAPIToken: "token"}},
+		{name: "route53 without secret", cfg: tobab.Config{DNSProvider: tobab.DNSProviderRoute53, Route53AccessKeyID: "id"}, wantErr: true},
+		{name: "route53", cfg: tobab.Config{DNSProvider: tobab.DNSProviderRoute53, Route53AccessKeyID: "id", Route53SecretAccessKey: "secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newDNSProvider(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newDNSProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	os.Setenv("CLOUDFLARE_DNS_API_TOKEN", "from-env")
+	defer os.Unsetenv("CLOUDFLARE_DNS_API_TOKEN")
+	if _, err := newDNSProvider(tobab.Config{DNSProvider: tobab.DNSProviderCloudflare}); err != nil {
+		t.Errorf("token was not read from the environment: %v", err)
+	}
+}
+
+func TestNewDNSProvider_Timeout(t *testing.T) {
+	for _, cfg := range []tobab.Config{
+		{DNSProvider: tobab.DNSProviderCloudflare, CloudflareAPIToken: "token"},
+		{DNSProvider: tobab.DNSProviderRoute53, Route53AccessKeyID: "id", Route53SecretAccessKey: "secret"},
+	} {
+		p, err := newDNSProvider(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", cfg.DNSProvider, err)
+		}
+		timeout, interval := p.(challenge.ProviderTimeout).Timeout()
+		if timeout != dnsPropagationTimeout || interval != dnsPropagationInterval {
+			t.Errorf("%s: Timeout() = %s, %s, want %s, %s", cfg.DNSProvider, timeout, interval, dnsPropagationTimeout, dnsPropagationInterval)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/markbates/pkger"
+)
+
+// assetFS serves files from the first filesystem that has them, directories are never exposed
+type assetFS []http.FileSystem
+
+func (fs assetFS) Open(name string) (http.File, error) {
+	for _, dir := range fs {
+		f, err := dir.Open(name)
+		if err != nil {
+			continue
+		}
+		stat, err := f.Stat()
+		if err != nil || stat.IsDir() {
+			f.Close()
+			continue
+		}
+		return f, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (app *Tobab) assetHandler() http.Handler {
+	var fs assetFS
+	if app.config.AssetsDir != "" {
+		fs = append(fs, http.Dir(app.config.AssetsDir))
+	}
+	fs = append(fs, pkger.Dir("/static"))
+
+	return http.StripPrefix("/static", http.FileServer(fs))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/sirupsen/logrus"
+)
+
+// auditLogger writes authentication events to the AuditLog file, or the database. It is separate from the
+// access log so the events can be kept for as long as compliance requires, without every request in between.
+type auditLogger struct {
+	logger *logrus.Entry
+	now    func() time.Time
+
+	mu sync.Mutex
+	//file is nil when the events go to db
+	file *os.File
+	db   tobab.Database
+}
+
+// newAuditLogger returns nil when AuditLog is empty, a nil logger drops every event
+func newAuditLogger(cfg tobab.Config, db tobab.Database, logger *logrus.Entry) (*auditLogger, error) {
+	if cfg.AuditLog == "" {
+		return nil, nil
+	}
+	l := &auditLogger{
+		logger: logger,
+		now:    time.Now,
+	}
+	if cfg.AuditLog == tobab.AuditLogDatabase {
+		l.db = db
+		return l, nil
+	}
+	f, err := os.OpenFile(cfg.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	return l, nil
+}
+
+// write stores e before it returns, an event that can't be stored is logged but doesn't fail the request
+func (l *auditLogger) write(e tobab.AuditEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	switch {
+	case l.file != nil:
+		err = l.writeFile(e)
+	case l.db != nil:
+		err = l.db.SaveAuditEvent(e)
+	default:
+		return
+	}
+	if err != nil {
+		l.logger.WithError(err).WithField("type", e.Type).WithField("user", e.User).WithField("host", e.Host).Error("unable to write audit event")
+	}
+}
+
+func (l *auditLogger) writeFile(e tobab.AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	//a crash right after a login shouldn't lose it
+	return l.file.Sync()
+}
+
+func (l *auditLogger) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			l.logger.WithError(err).Error("unable to close audit log")
+		}
+	}
+	//events of requests that are still running after shutdown are dropped instead of written to a closed file
+	l.file = nil
+	l.db = nil
+}
+
+// audit records an event of user on host, r is the request of the client and nil for events that don't come
+// from one, like tokens created with the cli
+func (app *Tobab) audit(r *http.Request, event, user, host, outcome, detail string) {
+	if app.auditLog == nil {
+		return
+	}
+	e := tobab.AuditEvent{
+		Time:    app.auditLog.now(),
+		Type:    event,
+		User:    user,
+		Host:    host,
+		Outcome: outcome,
+		Detail:  detail,
+	}
+	if r != nil {
+		if ip := clientIP(r, app.trustedProxies()); ip != nil {
+			e.ClientIP = ip.String()
+		}
+	}
+	app.auditLog.write(e)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+	"github.com/gorilla/mux"
+)
+
+func TestAuditLog_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tobab-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	cfg := tobab.Config{AuditLog: path}
+	app := newTestApp(cfg, tobab.Host{
+		Hostname: "app.example.com",
+		Type:     "http",
+		Globs:    []tobab.Glob{"*@example.com"},
+	})
+	app.auditLog, err = newAuditLogger(cfg, app.db, app.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0).UTC()
+	app.auditLog.now = func() time.Time { return now }
+
+	//allowed requests are in the access log, only the denied one is audited
+	for _, user := range []string{"alice@example.com", "eve@evil.com"} {
+		r := testRequest(t, app, "app.example.com", user)
+		r.RemoteAddr = "192.0.2.1:1234"
+		app.getRBACMiddleware()(okHandler).ServeHTTP(httptest.NewRecorder(), r)
+	}
+	router := mux.NewRouter()
+	app.setTobabRoutes(router)
+	r := testRequest(t, app, "login.example.com", "alice@example.com")
+	r.URL.Path = "/logout"
+	r.RemoteAddr = "192.0.2.2:1234"
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	app.auditLog.close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []tobab.AuditEvent
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e tobab.AuditEvent
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("line '%s' is not an event: %v", s.Text(), err)
+		}
+		events = append(events, e)
+	}
+	want := []tobab.AuditEvent{
+		{Time: now, Type: tobab.AuditDenied, User: "eve@evil.com", Host: "app.example.com", ClientIP: "192.0.2.1", Outcome: tobab.AuditFailure, Detail: "rbac_denied"},
+		{Time: now, Type: tobab.AuditLogout, User: "alice@example.com", Host: "login.example.com", ClientIP: "192.0.2.2", Outcome: tobab.AuditSuccess},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("audit log has %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i := range want {
+		if !events[i].Time.Equal(want[i].Time) {
+			t.Errorf("event %d time = %v, want %v", i, events[i].Time, want[i].Time)
+		}
+		events[i].Time = want[i].Time
+		if events[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+
+	//requests that are still running after the log is closed don't panic
+	r = testRequest(t, app, "app.example.com", "eve@evil.com")
+	app.getRBACMiddleware()(okHandler).ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestAuditLog_Database(t *testing.T) {
+	cfg := tobab.Config{AuditLog: tobab.AuditLogDatabase}
+	app := newTestApp(cfg)
+	var err error
+	app.auditLog, err = newAuditLogger(cfg, app.db, app.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.CreateToken(&clirpc.CreateTokenIn{Auth: testAuth, Email: "ci@example.com", TTL: time.Hour}, &clirpc.CreateTokenOut{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.CreateToken(&clirpc.CreateTokenIn{Auth: testAuth, Email: "ci@example.com", TTL: 48 * time.Hour}, &clirpc.CreateTokenOut{}); err == nil {
+		t.Fatal("expected an error for a ttl longer than the max age")
+	}
+
+	events := *app.db.(memDB).audit
+	if len(events) != 2 {
+		t.Fatalf("database has %d events, want 2: %+v", len(events), events)
+	}
+	for i, outcome := range []string{tobab.AuditSuccess, tobab.AuditFailure} {
+		e := events[i]
+		if e.Type != tobab.AuditTokenIssued || e.User != "ci@example.com" || e.Outcome != outcome || e.ClientIP != "" {
+			t.Errorf("event %d = %+v, want a token issued to ci@example.com with outcome %s", i, e, outcome)
+		}
+	}
+}
+
+func TestAuditLog_Disabled(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	l, err := newAuditLogger(app.config, app.db, app.logger)
+	if l != nil || err != nil {
+		t.Fatalf("newAuditLogger() without AuditLog = %v, %v, want nil", l, err)
+	}
+	r := testRequest(t, app, "login.example.com", "")
+	app.audit(r, tobab.AuditLogin, "alice@example.com", "login.example.com", tobab.AuditSuccess, "")
+	l.close()
+	if events := *app.db.(memDB).audit; len(events) != 0 {
+		t.Errorf("disabled audit log stored %d events", len(events))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultAuthFailureWindow = time.Minute
+
+// authFailureReason maps an error from extractUser to the reason label of the auth failure metric
+func authFailureReason(err error) string {
+	switch err {
+	case ErrExpiredToken:
+		return "expired_token"
+	case ErrUnknownUser:
+		return "unknown_user"
+	case ErrRevokedToken:
+		return "revoked_token"
+	default:
+		return "invalid_token"
+	}
+}
+
+// authFailure records a failed authentication, requests without any token are normal and should not be
+// passed to this
+func (app *Tobab) authFailure(host, reason string) {
+	//the host comes from the request, a value that isn't a valid label is only left out of the metrics
+	if c, err := app.metrics.authFailures.GetMetricWithLabelValues(host, reason); err == nil {
+		c.Inc()
+	}
+	app.authAlerts.record(host, reason)
+}
+
+// authFailureAlerter counts auth failures in fixed windows and alerts once per window that has more
+// failures than the threshold
+type authFailureAlerter struct {
+	threshold int
+	window    time.Duration
+	webhook   string
+	logger    *logrus.Entry
+	client    *http.Client
+	now       func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	alerted     bool
+	total       int
+	reasons     map[string]int
+	hosts       map[string]int
+}
+
+// newAuthFailureAlerter returns nil when no threshold is configured, a nil alerter never alerts
+func newAuthFailureAlerter(cfg tobab.Config, logger *logrus.Entry) *authFailureAlerter {
+	if cfg.AuthFailureThreshold <= 0 {
+		return nil
+	}
+	window := defaultAuthFailureWindow
+	if d, err := time.ParseDuration(cfg.AuthFailureWindow); err == nil && d > 0 {
+		window = d
+	}
+	return &authFailureAlerter{
+		threshold: cfg.AuthFailureThreshold,
+		window:    window,
+		webhook:   cfg.AuthFailureWebhook,
+		logger:    logger,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		now:       time.Now,
+	}
+}
+
+type authFailureAlert struct {
+	Message  string
+	Window   string
+	Failures int
+	Reasons  map[string]int
+	Hosts    map[string]int
+}
+
+func (a *authFailureAlerter) record(host, reason string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	now := a.now()
+	if now.Sub(a.windowStart) >= a.window {
+		a.windowStart = now
+		a.alerted = false
+		a.total = 0
+		a.reasons = map[string]int{}
+		a.hosts = map[string]int{}
+	}
+	a.total++
+	a.reasons[reason]++
+	a.hosts[host]++
+	if a.alerted || a.total <= a.threshold {
+		a.mu.Unlock()
+		return
+	}
+	a.alerted = true
+	alert := authFailureAlert{
+		Message:  "authentication failures exceeded the threshold",
+		Window:   a.window.String(),
+		Failures: a.total,
+		Reasons:  copyCounts(a.reasons),
+		Hosts:    copyCounts(a.hosts),
+	}
+	a.mu.Unlock()
+
+	a.logger.WithFields(logrus.Fields{
+		"failures":  alert.Failures,
+		"threshold": a.threshold,
+		"window":    alert.Window,
+		"reasons":   alert.Reasons,
+		"hosts":     alert.Hosts,
+	}).Error(alert.Message)
+	if a.webhook != "" {
+		go a.send(alert)
+	}
+}
+
+func (a *authFailureAlerter) send(alert authFailureAlert) {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		a.logger.WithError(err).Error("unable to encode auth failure alert")
+		return
+	}
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		a.logger.WithError(err).Error("unable to send auth failure alert")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		a.logger.WithField("status", resp.StatusCode).Error("auth failure webhook returned an error")
+	}
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	c := make(map[string]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/o1egl/paseto/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAuthFailureMetrics(t *testing.T) {
+	app := newTestApp(tobab.Config{}, tobab.Host{
+		Hostname: "app.example.com",
+		Backend:  "http://localhost:1234",
+		Type:     "http",
+		Globs:    []tobab.Glob{"*@example.com"},
+	})
+	expired, err := paseto.NewV2().Encrypt(app.key, paseto.JSONToken{Subject: "alice@example.com", Expiration: time.Now().Add(-time.Minute)}, footer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSubject, err := app.newToken("", "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		user       string
+		token      string
+		wantReason string
+	}{
+		{name: "anonymous is not a failure"},
+		{name: "allowed user is not a failure", user: "alice@example.com"},
+		{name: "denied user", user: "eve@evil.com", wantReason: "rbac_denied"},
+		{name: "expired token", token: expired, wantReason: "expired_token"},
+		{name: "tampered token", token: "v2.local.garbage", wantReason: "invalid_token"},
+		{name: "token without user", token: noSubject, wantReason: "unknown_user"},
+	}
+	reasons := []string{"rbac_denied", "expired_token", "invalid_token", "unknown_user"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.metrics = newMetrics()
+			r := testRequest(t, app, "app.example.com", tt.user)
+			if tt.token != "" {
+				r.AddCookie(&http.Cookie{Name: "X-Tobab-Token", Value: tt.token})
+			}
+			app.getRBACMiddleware()(okHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+			for _, reason := range reasons {
+				want := 0.0
+				if reason == tt.wantReason {
+					want = 1
+				}
+				if got := testutil.ToFloat64(app.metrics.authFailures.WithLabelValues("app.example.com", reason)); got != want {
+					t.Errorf("failures for %s = %v, want %v", reason, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthFailureAlerter(t *testing.T) {
+	alerts := make(chan authFailureAlert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert authFailureAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("unable to decode alert: %v", err)
+		}
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	app := newTestApp(tobab.Config{})
+	a := newAuthFailureAlerter(tobab.Config{AuthFailureThreshold: 2, AuthFailureWindow: "1m", AuthFailureWebhook: webhook.URL}, app.logger)
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	a.record("app.example.com", "rbac_denied")
+	a.record("app.example.com", "invalid_token")
+	select {
+	case <-alerts:
+		t.Fatalf("alert sent before the threshold was exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	a.record("other.example.com", "invalid_token")
+	a.record("other.example.com", "invalid_token")
+	select {
+	case alert := <-alerts:
+		if alert.Failures != 3 || alert.Reasons["invalid_token"] != 2 || alert.Hosts["other.example.com"] != 1 {
+			t.Errorf("unexpected alert: %+v", alert)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no alert sent after the threshold was exceeded")
+	}
+	select {
+	case <-alerts:
+		t.Fatalf("more than one alert sent in a single window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	//a new window starts counting from zero
+	now = now.Add(time.Minute)
+	a.record("app.example.com", "invalid_token")
+	if a.total != 1 || a.alerted {
+		t.Errorf("window was not reset, total = %d, alerted = %t", a.total, a.alerted)
+	}
+
+	if newAuthFailureAlerter(tobab.Config{}, app.logger) != nil {
+		t.Errorf("expected no alerter without a threshold")
+	}
+}
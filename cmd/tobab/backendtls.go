@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBackendCertWarnDays = 14
+	backendCertWarnInterval    = time.Hour
+)
+
+// backendTLSConfig returns the tls config used to connect to https backends, or nil when there are none.
+// Without a grace period the standard verification is used and VerifyConnection only warns about
+// certificates that expire soon. With a grace period tobab verifies the certificate itself, so an expired
+// but otherwise valid certificate can be allowed.
+func (app *Tobab) backendTLSConfig(h tobab.Host) (*tls.Config, error) {
+	https := false
+	for _, b := range h.AllBackends() {
+		u, err := backendURL(b.URL)
+		if err != nil {
+			return nil, err
+		}
+		https = https || u.Scheme == "https"
+	}
+	if !https {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if h.BackendCAFile != "" {
+		pool, err := loadCertPool(h.BackendCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	v := &backendVerifier{
+		app:    app,
+		host:   h.Hostname,
+		roots:  cfg.RootCAs,
+		grace:  duration(h.BackendCertGrace),
+		warnIn: time.Duration(h.BackendCertWarnDays) * 24 * time.Hour,
+		warned: map[string]time.Time{},
+	}
+	if v.warnIn <= 0 {
+		v.warnIn = defaultBackendCertWarnDays * 24 * time.Hour
+	}
+	if v.grace > 0 {
+		//verification happens in VerifyConnection
+		cfg.InsecureSkipVerify = true
+	}
+	cfg.VerifyConnection = v.verify
+	return cfg, nil
+}
+
+type backendVerifier struct {
+	app    *Tobab
+	host   string
+	roots  *x509.CertPool
+	grace  time.Duration
+	warnIn time.Duration
+
+	mu     sync.Mutex
+	warned map[string]time.Time
+}
+
+func (v *backendVerifier) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("backend did not present a certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+
+	if v.grace > 0 {
+		opts := x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         v.roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, c := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		_, err := leaf.Verify(opts)
+		if backendTLSErrorReason(err) == "expired" && time.Now().Before(leaf.NotAfter.Add(v.grace)) {
+			//only the expiry is forgiven, everything else has to be valid at the moment it expired
+			opts.CurrentTime = leaf.NotAfter
+			if _, verr := leaf.Verify(opts); verr == nil {
+				v.app.metrics.backendTLS.WithLabelValues(v.host, "expired_allowed").Inc()
+				v.app.logger.WithFields(logrus.Fields{
+					"host":       v.host,
+					"backend":    cs.ServerName,
+					"expired":    leaf.NotAfter,
+					"graceUntil": leaf.NotAfter.Add(v.grace),
+				}).Warning("allowing expired backend certificate during grace period")
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if left := time.Until(leaf.NotAfter); left > 0 && left < v.warnIn && v.shouldWarn(leaf) {
+		v.app.logger.WithFields(logrus.Fields{
+			"host":    v.host,
+			"backend": cs.ServerName,
+			"expires": leaf.NotAfter,
+		}).Warning("backend certificate expires soon")
+	}
+	return nil
+}
+
+// shouldWarn limits the expiry warning to once per backendCertWarnInterval for every certificate
+func (v *backendVerifier) shouldWarn(cert *x509.Certificate) bool {
+	key := cert.SerialNumber.String()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if last, ok := v.warned[key]; ok && time.Since(last) < backendCertWarnInterval {
+		return false
+	}
+	v.warned[key] = time.Now()
+	return true
+}
+
+// backendTLSErrorReason classifies certificate and handshake errors of a backend connection, it returns an
+// empty string for errors that are not tls related
+func backendTLSErrorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) {
+		if invalid.Reason == x509.Expired {
+			return "expired"
+		}
+		return "invalid"
+	}
+	var unknown x509.UnknownAuthorityError
+	if errors.As(err, &unknown) {
+		return "unknown_authority"
+	}
+	var hostname x509.HostnameError
+	if errors.As(err, &hostname) {
+		return "hostname"
+	}
+	var header tls.RecordHeaderError
+	if errors.As(err, &header) || strings.Contains(err.Error(), "tls: ") {
+		return "handshake"
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestBackendCertificates(t *testing.T) {
+	trusted := newTestCA(t, "backend ca")
+	untrusted := newTestCA(t, "other ca")
+	dir, err := ioutil.TempDir("", "tobab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "backend.pem")
+	if err := ioutil.WriteFile(caFile, trusted.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name       string
+		cert       tls.Certificate
+		grace      string
+		wantStatus int
+		wantReason string
+		wantWarn   string
+	}{
+		{name: "valid certificate", cert: trusted.issue(t, "localhost"), wantStatus: http.StatusOK},
+		{name: "expires soon", cert: trusted.issueValid(t, "localhost", now.Add(-time.Hour), now.Add(24*time.Hour)), wantStatus: http.StatusOK, wantWarn: "backend certificate expires soon"},
+		{name: "expired", cert: trusted.issueValid(t, "localhost", now.Add(-48*time.Hour), now.Add(-time.Hour)), wantStatus: http.StatusBadGateway, wantReason: "expired"},
+		{name: "expired within grace", cert: trusted.issueValid(t, "localhost", now.Add(-48*time.Hour), now.Add(-time.Hour)), grace: "24h", wantStatus: http.StatusOK, wantReason: "expired_allowed", wantWarn: "allowing expired backend certificate during grace period"},
+		{name: "expired after grace", cert: trusted.issueValid(t, "localhost", now.Add(-48*time.Hour), now.Add(-time.Hour)), grace: "10m", wantStatus: http.StatusBadGateway, wantReason: "expired"},
+		{name: "grace does not skip other checks", cert: untrusted.issue(t, "localhost"), grace: "24h", wantStatus: http.StatusBadGateway, wantReason: "unknown_authority"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewUnstartedServer(okHandler)
+			backend.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+			backend.TLS = &tls.Config{Certificates: []tls.Certificate{tt.cert}}
+			backend.StartTLS()
+			defer backend.Close()
+
+			app := newTestApp(tobab.Config{})
+			hook := test.NewLocal(app.logger.Logger)
+			proxy, err := app.generateProxy(tobab.Host{
+				Hostname:         "app.example.com",
+				Backend:          strings.Replace(backend.URL, "127.0.0.1", "localhost", 1),
+				BackendCAFile:    caFile,
+				BackendCertGrace: tt.grace,
+			})
+			if err != nil {
+				t.Fatalf("unable to create proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, httptest.NewRequest("GET", "https://app.example.com/", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			for _, reason := range []string{"expired", "expired_allowed", "unknown_authority"} {
+				want := 0.0
+				if reason == tt.wantReason {
+					want = 1
+				}
+				if got := testutil.ToFloat64(app.metrics.backendTLS.WithLabelValues("app.example.com", reason)); got != want {
+					t.Errorf("backend tls errors for %s = %v, want %v", reason, got, want)
+				}
+			}
+			warned := false
+			for _, e := range hook.AllEntries() {
+				if e.Level == logrus.WarnLevel && e.Message == tt.wantWarn {
+					warned = true
+				}
+			}
+			if tt.wantWarn != "" && !warned {
+				t.Errorf("expected warning %q", tt.wantWarn)
+			}
+		})
+	}
+}
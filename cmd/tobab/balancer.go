@@ -0,0 +1,269 @@
+package main
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+const (
+	//ringReplicas is the number of points per unit of weight a backend gets on the hash ring
+	ringReplicas = 100
+	//unhealthyFor is how long a backend is skipped after a failed request
+	unhealthyFor = 10 * time.Second
+)
+
+type backend struct {
+	//active is the number of requests in flight, used by the least-connections strategy. It is the first
+	//field so it is 64 bit aligned for atomic access
+	active int64
+
+	url    *url.URL
+	weight int
+	name   string
+
+	mu             sync.Mutex
+	unhealthyUntil time.Time
+	//checkFailed is set while the health check of the host fails for this backend
+	checkFailed bool
+	lastCheck   time.Time
+	lastError   string
+}
+
+func (b *backend) healthy(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.checkFailed && !now.Before(b.unhealthyUntil)
+}
+
+func (b *backend) markUnhealthy(until time.Time) {
+	b.mu.Lock()
+	b.unhealthyUntil = until
+	b.mu.Unlock()
+}
+
+// balancer picks the backend for a request according to the strategy of a host. Backends that failed a
+// request are skipped for a while, when all of them are unhealthy they are all used again.
+type balancer struct {
+	//next is the round robin position in order, first for the alignment atomic needs
+	next uint64
+
+	backends []*backend
+	strategy string
+	hashKey  string
+	now      func() time.Time
+	rand     func(n int) int
+	//trusted are the proxies of which the X-Forwarded-For is used for the ip hash key
+	trusted []*net.IPNet
+
+	order []*backend
+
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+func newBalancer(h tobab.Host) (*balancer, error) {
+	b := &balancer{
+		strategy: h.Strategy,
+		hashKey:  h.HashKey,
+		now:      time.Now,
+		rand:     rand.Intn,
+	}
+	for _, hb := range h.AllBackends() {
+		u, err := backendURL(hb.URL)
+		if err != nil {
+			return nil, err
+		}
+		weight := hb.Weight
+		if weight <= 0 || b.strategy == "" || b.strategy == tobab.StrategyRoundRobin {
+			weight = 1
+		}
+		b.backends = append(b.backends, &backend{url: u, weight: weight, name: hb.Name})
+	}
+
+	for _, be := range b.backends {
+		for i := 0; i < be.weight; i++ {
+			b.order = append(b.order, be)
+		}
+	}
+	if b.strategy == tobab.StrategyConsistentHash {
+		b.ring = buildRing(b.backends)
+	}
+	return b, nil
+}
+
+// backendURL parses the url of a backend, ws and wss backends are connected to with http and https, the
+// upgrade itself is done by the reverse proxy
+func backendURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	return u, nil
+}
+
+// buildRing places every backend on the ring multiple times, the points only depend on the backend url so
+// adding or removing a backend only moves the keys that hash close to its points
+func buildRing(backends []*backend) []ringPoint {
+	var ring []ringPoint
+	for _, be := range backends {
+		for i := 0; i < be.weight*ringReplicas; i++ {
+			ring = append(ring, ringPoint{
+				hash:    hashString(be.url.String() + "#" + strconv.Itoa(i)),
+				backend: be,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+func hashString(s string) uint32 {
+	return crc32.ChecksumIEEE([]byte(s))
+}
+
+// pick returns the backend for r
+func (b *balancer) pick(r *http.Request) *backend {
+	if be, ok := backendFromContext(r.Context()); ok {
+		return be
+	}
+	if len(b.backends) == 1 {
+		return b.backends[0]
+	}
+	now := b.now()
+	if b.strategy == tobab.StrategyConsistentHash {
+		if key := b.key(r); key != "" {
+			return b.lookup(key, now)
+		}
+	}
+	if b.strategy == tobab.StrategyLeastConnections {
+		return b.leastConnections(now)
+	}
+	return b.roundRobin(now)
+}
+
+// leastConnections returns the healthy backend with the fewest requests in flight, ties are broken round
+// robin so idle backends all get requests
+func (b *balancer) leastConnections(now time.Time) *backend {
+	start := atomic.AddUint64(&b.next, 1) - 1
+	var best *backend
+	for i := 0; i < len(b.backends); i++ {
+		be := b.backends[(start+uint64(i))%uint64(len(b.backends))]
+		if !be.healthy(now) {
+			continue
+		}
+		if best == nil || atomic.LoadInt64(&be.active) < atomic.LoadInt64(&best.active) {
+			best = be
+		}
+	}
+	if best == nil {
+		return b.backends[start%uint64(len(b.backends))]
+	}
+	return best
+}
+
+// countConnections picks the backend before the request is proxied, so the request can be counted as in
+// flight for that backend until the response is done
+func countConnections(bal *balancer, next http.Handler) http.Handler {
+	if bal.strategy != tobab.StrategyLeastConnections || len(bal.backends) == 1 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		be := bal.pick(r)
+		atomic.AddInt64(&be.active, 1)
+		defer atomic.AddInt64(&be.active, -1)
+		next.ServeHTTP(w, r.WithContext(withBackend(r.Context(), be)))
+	})
+}
+
+func (b *balancer) roundRobin(now time.Time) *backend {
+	start := atomic.AddUint64(&b.next, 1) - 1
+	for i := 0; i < len(b.order); i++ {
+		be := b.order[(start+uint64(i))%uint64(len(b.order))]
+		if be.healthy(now) {
+			return be
+		}
+	}
+	return b.order[start%uint64(len(b.order))]
+}
+
+// lookup walks the ring clockwise from the hash of key to the first healthy backend
+func (b *balancer) lookup(key string, now time.Time) *backend {
+	h := hashString(key)
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= h
+	})
+	for i := 0; i < len(b.ring); i++ {
+		be := b.ring[(start+i)%len(b.ring)].backend
+		if be.healthy(now) {
+			return be
+		}
+	}
+	return b.ring[start%len(b.ring)].backend
+}
+
+// key returns the value of the request that is hashed, requests without it are balanced round robin
+func (b *balancer) key(r *http.Request) string {
+	switch {
+	case b.hashKey == "ip":
+		return clientIP(r, b.trusted).String()
+	case b.hashKey == "user":
+		u, _ := userFromContext(r.Context())
+		return u
+	case strings.HasPrefix(b.hashKey, "cookie:"):
+		c, err := r.Cookie(strings.TrimPrefix(b.hashKey, "cookie:"))
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+	return ""
+}
+
+// available reports whether a request can be proxied, which is only false when the health check fails for
+// every backend
+func (b *balancer) available() bool {
+	for _, be := range b.backends {
+		be.mu.Lock()
+		failed := be.checkFailed
+		be.mu.Unlock()
+		if !failed {
+			return true
+		}
+	}
+	return false
+}
+
+// markUnhealthy skips the backend with this host for a while, it is called when a request to it failed
+func (b *balancer) markUnhealthy(host string) {
+	if len(b.backends) == 1 {
+		return
+	}
+	for _, be := range b.backends {
+		if be.url.Host == host {
+			be.markUnhealthy(b.now().Add(unhealthyFor))
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+func hashHost(backends ...string) tobab.Host {
+	h := tobab.Host{Strategy: tobab.StrategyConsistentHash, HashKey: "cookie:session"}
+	for _, b := range backends {
+		h.Backends = append(h.Backends, tobab.Backend{URL: b, Weight: 1})
+	}
+	return h
+}
+
+func pickFor(t *testing.T, b *balancer, key string) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: key})
+	return b.pick(r).url.Host
+}
+
+func TestBalancer_ConsistentHashDistribution(t *testing.T) {
+	b, err := newBalancer(hashHost("http://a:80", "http://b:80", "http://c:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		got := pickFor(t, b, key)
+		if again := pickFor(t, b, key); again != got {
+			t.Fatalf("key %s moved from %s to %s", key, got, again)
+		}
+		counts[got]++
+	}
+	for _, host := range []string{"a:80", "b:80", "c:80"} {
+		//every backend should get roughly a third of the keys
+		if counts[host] < 700 || counts[host] > 1300 {
+			t.Errorf("backend %s got %d of 3000 keys: %v", host, counts[host], counts)
+		}
+	}
+}
+
+func TestBalancer_ConsistentHashRemapping(t *testing.T) {
+	before, _ := newBalancer(hashHost("http://a:80", "http://b:80", "http://c:80"))
+	after, _ := newBalancer(hashHost("http://a:80", "http://b:80", "http://c:80", "http://d:80"))
+	removed, _ := newBalancer(hashHost("http://a:80", "http://c:80"))
+
+	const keys = 3000
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		old := pickFor(t, before, key)
+		if now := pickFor(t, after, key); now != old {
+			if now != "d:80" {
+				t.Fatalf("key %s moved from %s to %s instead of to the new backend", key, old, now)
+			}
+			moved++
+		}
+		if now := pickFor(t, removed, key); old != "b:80" && now != old {
+			t.Fatalf("key %s moved from %s to %s when an unrelated backend was removed", key, old, now)
+		}
+	}
+	//adding a fourth backend should move about a quarter of the keys
+	if moved < keys/8 || moved > keys/8*3 {
+		t.Errorf("%d of %d keys moved after adding a backend", moved, keys)
+	}
+}
+
+func TestBalancer_SkipsUnhealthy(t *testing.T) {
+	now := time.Now()
+	b, _ := newBalancer(hashHost("http://a:80", "http://b:80"))
+	b.now = func() time.Time { return now }
+
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("user-%d", i)
+		if pickFor(t, b, key) == "a:80" {
+			break
+		}
+	}
+
+	b.markUnhealthy("a:80")
+	if got := pickFor(t, b, key); got != "b:80" {
+		t.Errorf("unhealthy backend a was picked, got %s", got)
+	}
+
+	b.markUnhealthy("b:80")
+	if got := pickFor(t, b, key); got != "a:80" {
+		t.Errorf("with all backends unhealthy the key should use its own backend, got %s", got)
+	}
+
+	now = now.Add(unhealthyFor)
+	b.backends[1].markUnhealthy(time.Time{})
+	if got := pickFor(t, b, key); got != "a:80" {
+		t.Errorf("recovered backend a should get its keys back, got %s", got)
+	}
+}
+
+func TestBalancer_Weighted(t *testing.T) {
+	b, _ := newBalancer(tobab.Host{
+		Strategy: tobab.StrategyWeighted,
+		Backends: []tobab.Backend{
+			{URL: "http://a:80", Weight: 3},
+			{URL: "http://b:80", Weight: 1},
+		},
+	})
+	counts := map[string]int{}
+	for i := 0; i < 400; i++ {
+		counts[b.pick(httptest.NewRequest(http.MethodGet, "/", nil)).url.Host]++
+	}
+	if counts["a:80"] != 300 || counts["b:80"] != 100 {
+		t.Errorf("expected a 3:1 split, got %v", counts)
+	}
+}
+
+func TestBalancer_HashKeyFallsBackToRoundRobin(t *testing.T) {
+	b, _ := newBalancer(hashHost("http://a:80", "http://b:80"))
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		//no session cookie
+		counts[b.pick(httptest.NewRequest(http.MethodGet, "/", nil)).url.Host]++
+	}
+	if counts["a:80"] != 5 || counts["b:80"] != 5 {
+		t.Errorf("requests without a hash key should be spread evenly, got %v", counts)
+	}
+}
+
+func TestBalancer_IPHashKeyBehindProxy(t *testing.T) {
+	app := newTestApp(tobab.Config{TrustedProxies: []string{"10.0.0.1"}})
+	app.balancers = newBalancerRegistry()
+	h := hashHost("http://a:80", "http://b:80")
+	h.Hostname = "app.example.com"
+	h.HashKey = "ip"
+	if _, err := app.generateProxy(h); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := app.balancers.get(h.Hostname)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	if key := b.key(r); key != "192.0.2.1" {
+		t.Errorf("key behind a trusted proxy = %s, want the forwarded client ip", key)
+	}
+	r.RemoteAddr = "192.0.2.9:1234"
+	if key := b.key(r); key != "192.0.2.9" {
+		t.Errorf("key of a client that isn't a trusted proxy = %s, want its own ip", key)
+	}
+}
+
+func TestProxy_RoundRobin(t *testing.T) {
+	var backends []tobab.Backend
+	for _, name := range []string{"a", "b"} {
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+			w.Header().Set("X-Got-Forwarded-Host", r.Header.Get("X-Forwarded-Host"))
+			w.Header().Set("X-Got-Origin-Host", r.Header.Get("X-Origin-Host"))
+			w.Header().Set("X-Got-Host", r.Host)
+		}))
+		defer srv.Close()
+		backends = append(backends, tobab.Backend{URL: srv.URL})
+	}
+	proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{Hostname: "app.example.com", Backends: backends})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+		name := w.Header().Get("X-Backend")
+		counts[name]++
+
+		u := backends[0].URL
+		if name == "b" {
+			u = backends[1].URL
+		}
+		if host := strings.TrimPrefix(u, "http://"); w.Header().Get("X-Got-Host") != host {
+			t.Errorf("backend %s got Host %s, want %s", name, w.Header().Get("X-Got-Host"), host)
+		}
+		if got := w.Header().Get("X-Got-Forwarded-Host"); got != "127.0.0.1" {
+			t.Errorf("backend %s got X-Forwarded-Host %s", name, got)
+		}
+		if got := w.Header().Get("X-Got-Origin-Host"); got != "app.example.com" {
+			t.Errorf("backend %s got X-Origin-Host %s", name, got)
+		}
+	}
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Errorf("expected requests to be spread evenly, got %v", counts)
+	}
+}
+
+func TestProxy_DeadBackendIsSkipped(t *testing.T) {
+	live := httptest.NewServer(okHandler)
+	defer live.Close()
+	dead := httptest.NewServer(okHandler)
+	dead.Close()
+
+	proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{
+		Hostname: "app.example.com",
+		Backends: []tobab.Backend{{URL: dead.URL}, {URL: live.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed := 0
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+		if w.Code != http.StatusOK {
+			failed++
+		}
+	}
+	//only the first request finds out the backend is down
+	if failed != 1 {
+		t.Errorf("%d requests failed, expected only the first one to reach the dead backend", failed)
+	}
+}
+
+func TestBalancer_LeastConnections(t *testing.T) {
+	b, _ := newBalancer(tobab.Host{
+		Strategy: tobab.StrategyLeastConnections,
+		Backends: []tobab.Backend{{URL: "http://a:80"}, {URL: "http://b:80"}, {URL: "http://c:80"}},
+	})
+
+	release := make(chan struct{})
+	started := make(chan string)
+	handler := countConnections(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- b.pick(r).url.Host
+		<-release
+	}))
+	//two slow requests leave a single idle backend
+	busy := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		busy[<-started] = true
+	}
+	var idle string
+	for _, host := range []string{"a:80", "b:80", "c:80"} {
+		if !busy[host] {
+			idle = host
+		}
+	}
+	if len(busy) != 2 {
+		t.Fatalf("the slow requests should go to different backends, got %v", busy)
+	}
+	for i := 0; i < 3; i++ {
+		if got := b.pick(httptest.NewRequest(http.MethodGet, "/", nil)).url.Host; got != idle {
+			t.Errorf("expected the idle backend %s, got %s", idle, got)
+		}
+	}
+	close(release)
+}
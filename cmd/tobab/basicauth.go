@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gnur/tobab"
+)
+
+// newServicePassword returns a random password for a service credential
+func newServicePassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashServicePassword hashes a generated password. They are random and long enough that a plain hash can't be
+// brute forced, so unlike passwords people choose they don't need a slow hash, which would slow every request.
+func hashServicePassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkServiceCredential reports whether username and password are a credential of host
+func (app *Tobab) checkServiceCredential(host, username, password string) bool {
+	c, err := app.db.GetCredential(host, username)
+	if err != nil {
+		app.logger.WithError(err).WithField("host", host).WithField("user", username).Error("unable to load service credential")
+		return false
+	}
+	if c == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashServicePassword(password)), []byte(c.Hash)) == 1
+}
+
+// basicAuthChallenge asks the client for the credentials of a host
+func (app *Tobab) basicAuthChallenge(w http.ResponseWriter, r *http.Request, h *tobab.Host, msg string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, h.Hostname))
+	app.errorPage(w, r, msg, http.StatusUnauthorized)
+}
+
+// wantsHTML reports whether the client is a browser, which can be sent to the login page instead of being
+// asked for basic auth credentials
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func validServiceUsername(username string) error {
+	if username == "" {
+		return errors.New("a username is required")
+	}
+	if strings.ContainsAny(username, ": \t\r\n") {
+		return fmt.Errorf("'%s' is not a valid username, it can't contain a colon or whitespace", username)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+)
+
+func TestRBACMiddleware_BasicAuth(t *testing.T) {
+	cfg := tobab.Config{Groups: map[string][]tobab.Glob{"admins": {"deploy-bot"}}}
+	app := newTestApp(cfg,
+		tobab.Host{Hostname: "api.example.com", BasicAuth: true, Globs: []tobab.Glob{"*@example.com", "monitoring", "deploy-bot"}, AllowedGroups: []tobab.PathGroups{{Path: "/admin", Groups: []string{"admins"}}}},
+		tobab.Host{Hostname: "wiki.example.com", Globs: []tobab.Glob{"monitoring"}},
+	)
+	passwords := map[string]string{}
+	for _, user := range []string{"monitoring", "deploy-bot", "intruder"} {
+		var out clirpc.CreateCredentialOut
+		if err := app.CreateCredential(&clirpc.CreateCredentialIn{Auth: testAuth, Hostname: "api.example.com", Username: user}, &out); err != nil {
+			t.Fatalf("CreateCredential() error = %v", err)
+		}
+		passwords[user] = out.Password
+	}
+
+	tests := []struct {
+		name          string
+		host          string
+		path          string
+		user          string
+		password      string
+		browser       bool
+		wantStatus    int
+		wantUser      string
+		wantChallenge bool
+	}{
+		{name: "valid credential", user: "monitoring", wantStatus: http.StatusOK, wantUser: "monitoring"},
+		{name: "wrong password", user: "monitoring", password: "guess", wantStatus: http.StatusUnauthorized, wantChallenge: true},
+		{name: "unknown user", user: "nobody", password: "guess", wantStatus: http.StatusUnauthorized, wantChallenge: true},
+		{name: "credential without access", user: "intruder", wantStatus: http.StatusUnauthorized},
+		{name: "missing credentials", wantStatus: http.StatusUnauthorized, wantChallenge: true},
+		{name: "browsers log in", browser: true, wantStatus: http.StatusFound},
+		{name: "group path for a member", path: "/admin", user: "deploy-bot", wantStatus: http.StatusOK, wantUser: "deploy-bot"},
+		{name: "group path for others", path: "/admin", user: "monitoring", wantStatus: http.StatusForbidden},
+		{name: "host without basic auth", host: "wiki.example.com", user: "monitoring", wantStatus: http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotUser, gotAuth string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUser = r.Header.Get("X-Tobab-User")
+				gotAuth = r.Header.Get("Authorization")
+			})
+			host := tt.host
+			if host == "" {
+				host = "api.example.com"
+			}
+			r := httptest.NewRequest(http.MethodGet, "https://"+host+tt.path, nil)
+			if tt.user != "" {
+				password := tt.password
+				if password == "" {
+					password = passwords[tt.user]
+				}
+				r.SetBasicAuth(tt.user, password)
+			}
+			if tt.browser {
+				r.Header.Set("Accept", "text/html,application/xhtml+xml")
+			}
+			w := httptest.NewRecorder()
+			app.getRBACMiddleware()(next).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if gotUser != tt.wantUser {
+				t.Errorf("X-Tobab-User = %q, want %q", gotUser, tt.wantUser)
+			}
+			if gotAuth != "" {
+				t.Errorf("the credential was forwarded to the backend")
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); (challenge != "") != tt.wantChallenge {
+				t.Errorf("WWW-Authenticate = %q, want a challenge %t", challenge, tt.wantChallenge)
+			}
+		})
+	}
+}
+
+func TestServiceCredentials_RPC(t *testing.T) {
+	app := newTestApp(tobab.Config{},
+		tobab.Host{Hostname: "api.example.com", BasicAuth: true, Globs: []tobab.Glob{"monitoring"}},
+		tobab.Host{Hostname: "wiki.example.com", Globs: []tobab.Glob{"monitoring"}},
+	)
+	var out clirpc.CreateCredentialOut
+	if err := app.CreateCredential(&clirpc.CreateCredentialIn{Auth: testAuth, Hostname: "wiki.example.com", Username: "monitoring"}, &out); err == nil {
+		t.Error("created a credential for a host without basic auth")
+	}
+	if err := app.CreateCredential(&clirpc.CreateCredentialIn{Auth: testAuth, Hostname: "missing.example.com", Username: "monitoring"}, &out); err == nil {
+		t.Error("created a credential for a host that doesn't exist")
+	}
+	if err := app.CreateCredential(&clirpc.CreateCredentialIn{Auth: testAuth, Hostname: "api.example.com", Username: "bad:name"}, &out); err == nil {
+		t.Error("created a credential with a colon in the username")
+	}
+	if err := app.CreateCredential(&clirpc.CreateCredentialIn{Auth: testAuth, Hostname: "api.example.com", Username: "monitoring"}, &out); err != nil {
+		t.Fatalf("CreateCredential() error = %v", err)
+	}
+	stored, _ := app.db.GetCredential("api.example.com", "monitoring")
+	if stored == nil || stored.Hash == out.Password || stored.Hash != hashServicePassword(out.Password) {
+		t.Fatalf("stored credential = %+v, want only the hash of the password", stored)
+	}
+
+	if err := app.DeleteCredential(&clirpc.DeleteCredentialIn{Auth: testAuth, Hostname: "api.example.com", Username: "monitoring"}, &clirpc.Empty{}); err != nil {
+		t.Fatalf("DeleteCredential() error = %v", err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "https://api.example.com/", nil)
+	r.SetBasicAuth("monitoring", out.Password)
+	w := httptest.NewRecorder()
+	app.getRBACMiddleware()(okHandler).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status with a deleted credential = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
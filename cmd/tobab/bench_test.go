@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+// The benchmarks can be run with: go test ./cmd/tobab -run xxx -bench .
+//
+// Skipping token parsing for public hosts and only parsing it once for other hosts changed:
+//
+//	BenchmarkRBACMiddleware/public     16456 ns/op  3680 B/op  50 allocs/op  ->   3393 ns/op  1480 B/op  12 allocs/op
+//	BenchmarkRBACMiddleware/private    19074 ns/op  3712 B/op  51 allocs/op  ->  13586 ns/op  3600 B/op  48 allocs/op
+//	BenchmarkProxy/public             103277 ns/op 42776 B/op 122 allocs/op  ->  62086 ns/op 40497 B/op  81 allocs/op
+//	BenchmarkProxy/private            107414 ns/op 42809 B/op 123 allocs/op  ->  86074 ns/op 42697 B/op 120 allocs/op
+func benchmarkApp(b *testing.B) (*Tobab, *http.Cookie) {
+	app := newTestApp(tobab.Config{},
+		tobab.Host{Hostname: "public.example.com", Backend: "http://localhost:1234", Type: "http", Public: true},
+		tobab.Host{Hostname: "private.example.com", Backend: "http://localhost:1234", Type: "http", Globs: []tobab.Glob{"*@example.com"}},
+	)
+	token, err := app.newToken("alice@example.com", "bench", app.defaultAge)
+	if err != nil {
+		b.Fatalf("unable to create token: %v", err)
+	}
+	return app, &http.Cookie{Name: "X-Tobab-Token", Value: token}
+}
+
+func BenchmarkRBACMiddleware(b *testing.B) {
+	app, cookie := benchmarkApp(b)
+	handler := app.getRBACMiddleware()(okHandler)
+
+	for _, name := range []string{"public", "private"} {
+		host := name + ".example.com"
+		b.Run(name, func(b *testing.B) {
+			r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+			r.AddCookie(cookie)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), r.Clone(r.Context()))
+			}
+		})
+	}
+}
+
+func BenchmarkProxy(b *testing.B) {
+	app, cookie := benchmarkApp(b)
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+
+	for _, name := range []string{"public", "private"} {
+		host := name + ".example.com"
+		b.Run(name, func(b *testing.B) {
+			h, _ := app.db.GetHost(host)
+			h.Backend = backend.URL
+			proxy, err := app.generateProxy(*h)
+			if err != nil {
+				b.Fatalf("unable to create proxy: %v", err)
+			}
+			handler := app.getRBACMiddleware()(proxy)
+
+			r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+			r.AddCookie(cookie)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), r.Clone(r.Context()))
+			}
+		})
+	}
+}
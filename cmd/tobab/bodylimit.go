@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/gnur/tobab"
+)
+
+// bodyLimitMiddleware rejects requests with a body over MaxBodyBytes with a 413. A Content-Length over the limit
+// is rejected right away, other bodies are cut off by the proxy once the limit is read, so nothing is buffered.
+func (app *Tobab) bodyLimitMiddleware(h tobab.Host, next http.Handler) http.Handler {
+	if h.MaxBodyBytes <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > h.MaxBodyBytes {
+			app.errorPage(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, h.MaxBodyBytes), max: h.MaxBodyBytes}
+		r = r.WithContext(context.WithValue(r.Context(), bodyLimitKey, body))
+		r.Body = body
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody remembers that the limit was hit, the proxy only sees a failed read
+type limitedBody struct {
+	io.ReadCloser
+	max      int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.max {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// bodyTooLarge reports whether reading the body of the request failed because it was over MaxBodyBytes
+func bodyTooLarge(r *http.Request) bool {
+	b, ok := r.Context().Value(bodyLimitKey).(*limitedBody)
+	return ok && b.exceeded
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	var received int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		atomic.AddInt64(&received, n)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name        string
+		max         int64
+		size        int
+		chunked     bool
+		wantStatus  int
+		wantBackend bool
+	}{
+		{name: "no limit", size: 1 << 20, wantStatus: http.StatusOK, wantBackend: true},
+		{name: "under the limit", max: 100, size: 99, wantStatus: http.StatusOK, wantBackend: true},
+		{name: "at the limit", max: 100, size: 100, wantStatus: http.StatusOK, wantBackend: true},
+		{name: "content length over the limit", max: 100, size: 101, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked under the limit", max: 100, size: 100, chunked: true, wantStatus: http.StatusOK, wantBackend: true},
+		{name: "chunked over the limit", max: 100, size: 1 << 20, chunked: true, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt64(&received, 0)
+			h := tobab.Host{Hostname: "app.example.com", Type: "http", Backend: backend.URL, MaxBodyBytes: tt.max}
+			app := newTestApp(tobab.Config{})
+			proxy, err := app.generateProxy(h)
+			if err != nil {
+				t.Fatalf("unable to create proxy: %v", err)
+			}
+			var body io.Reader = strings.NewReader(strings.Repeat("a", tt.size))
+			if tt.chunked {
+				//hides the length from NewRequest
+				body = ioutil.NopCloser(body)
+			}
+			r := httptest.NewRequest(http.MethodPost, "https://app.example.com/upload", body)
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			app.bodyLimitMiddleware(h, proxy).ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			got := atomic.LoadInt64(&received)
+			if tt.wantBackend && got != int64(tt.size) {
+				t.Errorf("backend received %d bytes, want %d", got, tt.size)
+			}
+			if !tt.wantBackend && got > tt.max {
+				t.Errorf("backend received %d bytes of a body over the limit of %d", got, tt.max)
+			}
+			if tt.wantStatus == http.StatusRequestEntityTooLarge && testutil.ToFloat64(app.metrics.proxyErrors.WithLabelValues("app.example.com")) != 0 {
+				t.Error("a body over the limit was counted as a proxy error")
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const defaultBufferMaxBytes = 10 << 20
+
+// bufferModifier reads the complete backend response before anything is sent to the client, so a backend
+// failing halfway results in a 502 instead of a truncated body. Responses larger than maxBytes are streamed.
+func bufferModifier(maxBytes int64) func(*http.Response) error {
+	if maxBytes <= 0 {
+		maxBytes = defaultBufferMaxBytes
+	}
+	return func(resp *http.Response) error {
+		//the body of an upgraded connection is the connection itself, and the Content-Length of a response
+		//without a body is the one of the body it leaves out
+		if resp.ContentLength > maxBytes || bodylessResponse(resp) {
+			return nil
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+		if err != nil {
+			resp.Body.Close()
+			return err
+		}
+		if int64(len(body)) > maxBytes {
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return nil
+		}
+		resp.Body.Close()
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+}
+
+// bodylessResponse reports whether resp never has a body, whatever its headers say
+func bodylessResponse(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return true
+	}
+	switch {
+	case resp.StatusCode >= 100 && resp.StatusCode < 200:
+		return true
+	case resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestBufferResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			_, _ = w.Write([]byte(strings.Repeat("a", 100)))
+			return
+		}
+		//promise 100 bytes, send 10 and drop the connection
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("unable to hijack: %v", err)
+			return
+		}
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial...")
+		_ = buf.Flush()
+		conn.Close()
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		maxBytes   int64
+		wantStatus int
+		wantLength int
+	}{
+		{name: "complete response", path: "/ok", wantStatus: http.StatusOK, wantLength: 100},
+		{name: "larger than the buffer is streamed", path: "/ok", maxBytes: 10, wantStatus: http.StatusOK, wantLength: 100},
+		{name: "backend failure is a clean 502", path: "/fail", wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL, BufferResponse: true, BufferMaxBytes: tt.maxBytes})
+			if err != nil {
+				t.Fatalf("unable to create proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, httptest.NewRequest("GET", "https://app.example.com"+tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.Len() != tt.wantLength {
+				t.Errorf("body length = %d, want %d", w.Body.Len(), tt.wantLength)
+			}
+			if tt.wantStatus == http.StatusBadGateway && strings.Contains(w.Body.String(), "partial") {
+				t.Errorf("partial body was sent to the client")
+			}
+		})
+	}
+}
+
+func TestBufferModifier_Bodyless(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+	}{
+		{name: "head", method: http.MethodHead, status: http.StatusOK},
+		{name: "no content", method: http.MethodGet, status: http.StatusNoContent},
+		{name: "not modified", method: http.MethodGet, status: http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode:    tt.status,
+				Header:        http.Header{"Content-Length": {"1234"}},
+				ContentLength: 1234,
+				Body:          http.NoBody,
+				Request:       httptest.NewRequest(tt.method, "https://app.example.com/", nil),
+			}
+			if err := bufferModifier(0)(resp); err != nil {
+				t.Fatal(err)
+			}
+			if cl := resp.Header.Get("Content-Length"); cl != "1234" {
+				t.Errorf("Content-Length = %s, want the 1234 of the backend", cl)
+			}
+		})
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/muxlogger"
+)
+
+// cacheableStatus are the statuses that are cached when the backend gives them a lifetime
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheRegistry keeps the caches of the hosts with a CacheSizeMB, so they survive a reload and can be purged
+type cacheRegistry struct {
+	mu     sync.Mutex
+	caches map[string]*hostCache
+}
+
+type hostCache struct {
+	host  tobab.Host
+	cache *responseCache
+}
+
+func newCacheRegistry() *cacheRegistry {
+	return &cacheRegistry{caches: map[string]*hostCache{}}
+}
+
+// get returns the cache of h, it keeps its responses when h didn't change since the last reload
+func (cr *cacheRegistry) get(h tobab.Host) *responseCache {
+	if cr == nil {
+		return newResponseCache(h.CacheSizeMB << 20)
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if hc, ok := cr.caches[h.Hostname]; ok && reflect.DeepEqual(hc.host, h) {
+		return hc.cache
+	}
+	c := newResponseCache(h.CacheSizeMB << 20)
+	cr.caches[h.Hostname] = &hostCache{host: h, cache: c}
+	return c
+}
+
+// retain drops the caches of hosts that are not in hostnames anymore
+func (cr *cacheRegistry) retain(hostnames map[string]bool) {
+	if cr == nil {
+		return
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	for h := range cr.caches {
+		if !hostnames[h] {
+			delete(cr.caches, h)
+		}
+	}
+}
+
+// purge drops the responses of a host and returns how many there were
+func (cr *cacheRegistry) purge(hostname string) int {
+	if cr == nil {
+		return 0
+	}
+	cr.mu.Lock()
+	hc, ok := cr.caches[hostname]
+	cr.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return hc.cache.purge()
+}
+
+// responseCache is an LRU of responses of a single host, maxBytes limits the size of the headers and bodies
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	//lru has the most recently used entry in front
+	lru     *list.List
+	entries map[string]*list.Element
+	//urls has the request headers the responses of a url vary on
+	urls map[string]*cachedURL
+}
+
+type cachedURL struct {
+	vary    []string
+	entries int
+}
+
+type cacheEntry struct {
+	key    string
+	url    string
+	vary   []string
+	status int
+	header http.Header
+	body   []byte
+
+	stored     time.Time
+	initialAge time.Duration
+	lifetime   time.Duration
+}
+
+func newResponseCache(maxBytes int) *responseCache {
+	return &responseCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		urls:     map[string]*cachedURL{},
+	}
+}
+
+// maxEntryBytes keeps a single large response from evicting everything else
+func (c *responseCache) maxEntryBytes() int {
+	return c.maxBytes / 4
+}
+
+func (c *responseCache) get(r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u, ok := c.urls[cacheURL(r)]
+	if !ok {
+		return nil
+	}
+	el, ok := c.entries[cacheKey(cacheURL(r), u.vary, r)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (c *responseCache) set(e *cacheEntry) {
+	if e.size() > c.maxEntryBytes() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size()
+	u, ok := c.urls[e.url]
+	if !ok {
+		u = &cachedURL{}
+		c.urls[e.url] = u
+	}
+	//responses stored with another Vary can't be found anymore and age out of the lru
+	u.vary = e.vary
+	u.entries++
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) delete(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok && el.Value == e {
+		c.remove(el)
+	}
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+	if u := c.urls[e.url]; u != nil {
+		u.entries--
+		if u.entries == 0 {
+			delete(c.urls, e.url)
+		}
+	}
+}
+
+func (c *responseCache) purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len()
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+	c.urls = map[string]*cachedURL{}
+	c.size = 0
+	return n
+}
+
+func (e *cacheEntry) size() int {
+	n := len(e.key) + len(e.body)
+	for k, vs := range e.header {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.stored)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.age(now) < e.lifetime
+}
+
+func (e *cacheEntry) validators() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// serve writes the cached response, conditional requests of the client are answered with a 304
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request, now time.Time) {
+	for k, v := range e.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(e.age(now)/time.Second)))
+	if e.status == http.StatusOK {
+		modified, _ := http.ParseTime(e.header.Get("Last-Modified"))
+		http.ServeContent(w, r, "", modified, bytes.NewReader(e.body))
+		return
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// cacheMiddleware serves GET requests from the cache of the host while the response is fresh and revalidates
+// it with the backend when it is stale. It follows the rules of a shared cache, responses the backend marks
+// private, no-store or with a cookie are never stored, and neither are responses to logged in users unless
+// they are public.
+func (app *Tobab) cacheMiddleware(h tobab.Host, next http.Handler) http.Handler {
+	if h.CacheSizeMB <= 0 {
+		return next
+	}
+	cache := app.caches.get(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCC := parseCacheControl(r.Header)
+		if !cacheableRequest(r) || reqCC.has("no-store") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		e := cache.get(r)
+		if e != nil && e.fresh(now) && !mustRevalidate(r, reqCC, e.age(now)) {
+			muxlogger.SetField(r, "cache", "hit")
+			e.serve(w, r, now)
+			return
+		}
+
+		upstream := r
+		revalidate := e != nil && e.validators()
+		if revalidate {
+			//the client gets its 304 from the entry, the backend is asked whether the entry itself changed
+			upstream = r.Clone(r.Context())
+			upstream.Header.Del("If-None-Match")
+			upstream.Header.Del("If-Modified-Since")
+			if etag := e.header.Get("ETag"); etag != "" {
+				upstream.Header.Set("If-None-Match", etag)
+			}
+			if lm := e.header.Get("Last-Modified"); lm != "" {
+				upstream.Header.Set("If-Modified-Since", lm)
+			}
+		}
+		cw := &cacheWriter{ResponseWriter: w, header: http.Header{}, revalidating: revalidate, limit: cache.maxEntryBytes()}
+		next.ServeHTTP(cw, upstream)
+
+		if cw.notModified {
+			muxlogger.SetField(r, "cache", "revalidated")
+			header := e.header.Clone()
+			for k, v := range cw.stored {
+				if k != "Content-Length" {
+					header[k] = v
+				}
+			}
+			if updated := newCacheEntry(r, e.status, header, e.body, now); updated != nil {
+				cache.set(updated)
+				updated.serve(w, r, now)
+				return
+			}
+			//the backend doesn't allow storing it anymore, the response is still valid for this request
+			cache.delete(e)
+			e.serve(w, r, now)
+			return
+		}
+		muxlogger.SetField(r, "cache", "miss")
+		if cw.tooLarge || cw.err != nil {
+			return
+		}
+		if ne := newCacheEntry(r, cw.status, cw.stored, cw.body.Bytes(), now); ne != nil {
+			cache.set(ne)
+		}
+	})
+}
+
+// cacheableRequest reports whether r could be answered from the cache, ranges and upgrades always go to the
+// backend
+func cacheableRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Range") == "" && r.Header.Get("Upgrade") == ""
+}
+
+// mustRevalidate reports whether the client asked for a response that is newer than age
+func mustRevalidate(r *http.Request, reqCC cacheControl, age time.Duration) bool {
+	if reqCC.has("no-cache") {
+		return true
+	}
+	if len(reqCC) == 0 && strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") {
+		return true
+	}
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return true
+	}
+	return false
+}
+
+// newCacheEntry returns the entry for the response to r, or nil when the response can't be stored
+func newCacheEntry(r *http.Request, status int, header http.Header, body []byte, now time.Time) *cacheEntry {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" || header.Get("Trailer") != "" {
+		return nil
+	}
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return nil
+	}
+	//the backend gets the user, so it can respond differently to every user
+	authenticated := r.Header.Get("X-Tobab-User") != "" || r.Header.Get("Authorization") != ""
+	if authenticated && !cc.has("public") {
+		return nil
+	}
+	var vary []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+
+	e := &cacheEntry{
+		url:        cacheURL(r),
+		vary:       vary,
+		status:     status,
+		header:     header,
+		body:       append([]byte(nil), body...),
+		stored:     now,
+		initialAge: initialAge(header, now),
+	}
+	e.key = cacheKey(e.url, vary, r)
+	lifetime, explicit := freshnessLifetime(header, cc)
+	if cc.has("no-cache") {
+		lifetime = 0
+	}
+	if !explicit && !e.validators() {
+		return nil
+	}
+	e.lifetime = lifetime
+	if !e.fresh(now) && !e.validators() {
+		return nil
+	}
+	return e
+}
+
+// freshnessLifetime returns how long a response stays fresh in a shared cache, explicit is false when the
+// backend didn't say, those responses are only stored when they can be revalidated
+func freshnessLifetime(header http.Header, cc cacheControl) (lifetime time.Duration, explicit bool) {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d, true
+	}
+	if v := header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			//an invalid date means already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+// initialAge is the age of a response when it is stored, from the Age of caches in front of the backend or the
+// Date of the response
+func initialAge(header http.Header, now time.Time) time.Duration {
+	var age time.Duration
+	if date, err := http.ParseTime(header.Get("Date")); err == nil && now.After(date) {
+		age = now.Sub(date)
+	}
+	if s, err := strconv.Atoi(header.Get("Age")); err == nil && time.Duration(s)*time.Second > age {
+		age = time.Duration(s) * time.Second
+	}
+	return age
+}
+
+func cacheURL(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// cacheKey has the values of the request headers the response varies on, so each variant is a separate entry
+func cacheKey(url string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(url)
+	for _, name := range vary {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// cacheControl has the directives of Cache-Control headers by their lowercase name
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, value = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+			}
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				cc[name] = value
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns a directive like max-age as a duration, a value that isn't a number counts as 0
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheWriter sends the response of the backend to the client and keeps a copy for the cache. A 304 to a
+// revalidation isn't sent, the client gets the cached response instead.
+type cacheWriter struct {
+	http.ResponseWriter
+	//header is what the backend sets, stored is a copy from when the header was written
+	header       http.Header
+	stored       http.Header
+	status       int
+	wroteHeader  bool
+	revalidating bool
+	notModified  bool
+
+	body     bytes.Buffer
+	limit    int
+	tooLarge bool
+	err      error
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	if cw.wroteHeader && !cw.notModified {
+		//trailers are set after the header was written
+		return cw.ResponseWriter.Header()
+	}
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = code
+	cw.stored = cw.header.Clone()
+	if code == http.StatusNotModified && cw.revalidating {
+		cw.notModified = true
+		return
+	}
+	dst := cw.ResponseWriter.Header()
+	for k, v := range cw.header {
+		dst[k] = v
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified {
+		return len(b), nil
+	}
+	if !cw.tooLarge {
+		if cw.body.Len()+len(b) > cw.limit {
+			cw.tooLarge = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	n, err := cw.ResponseWriter.Write(b)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified {
+		return
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
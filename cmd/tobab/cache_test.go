@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+)
+
+// cacheBackend responds with header and counts the requests that reach it
+type cacheBackend struct {
+	header   http.Header
+	body     string
+	requests int
+	//conditional has the If-None-Match of the last request
+	conditional string
+}
+
+func (b *cacheBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.requests++
+	b.conditional = r.Header.Get("If-None-Match")
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	if etag := b.header.Get("ETag"); etag != "" && b.conditional == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write([]byte(b.body))
+}
+
+func cacheRequest(vary ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "https://app.example.com/data.json", nil)
+	for i := 0; i+1 < len(vary); i += 2 {
+		r.Header.Set(vary[i], vary[i+1])
+	}
+	return r
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		first      *http.Request
+		second     *http.Request
+		wantCached bool
+	}{
+		{name: "max-age", header: http.Header{"Cache-Control": {"max-age=60"}}, first: cacheRequest(), second: cacheRequest(), wantCached: true},
+		{name: "s-maxage", header: http.Header{"Cache-Control": {"s-maxage=60"}}, first: cacheRequest(), second: cacheRequest(), wantCached: true},
+		{name: "expires", header: http.Header{"Expires": {time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}}, first: cacheRequest(), second: cacheRequest(), wantCached: true},
+		{name: "expired", header: http.Header{"Expires": {time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)}}, first: cacheRequest(), second: cacheRequest()},
+		{name: "no lifetime", header: http.Header{}, first: cacheRequest(), second: cacheRequest()},
+		{name: "private", header: http.Header{"Cache-Control": {"private, max-age=60"}}, first: cacheRequest(), second: cacheRequest()},
+		{name: "no-store", header: http.Header{"Cache-Control": {"no-store"}}, first: cacheRequest(), second: cacheRequest()},
+		{name: "set-cookie", header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}}, first: cacheRequest(), second: cacheRequest()},
+		{name: "vary any", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, first: cacheRequest(), second: cacheRequest()},
+		{name: "same variant", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"accept-language"}}, first: cacheRequest("Accept-Language", "nl"), second: cacheRequest("Accept-Language", "nl"), wantCached: true},
+		{name: "other variant", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}, first: cacheRequest("Accept-Language", "nl"), second: cacheRequest("Accept-Language", "en")},
+		{name: "logged in user", header: http.Header{"Cache-Control": {"max-age=60"}}, first: cacheRequest("X-Tobab-User", "alice@example.com"), second: cacheRequest("X-Tobab-User", "alice@example.com")},
+		{name: "logged in user public", header: http.Header{"Cache-Control": {"public, max-age=60"}}, first: cacheRequest("X-Tobab-User", "alice@example.com"), second: cacheRequest("X-Tobab-User", "bob@example.com"), wantCached: true},
+		{name: "basic auth", header: http.Header{"Cache-Control": {"max-age=60"}}, first: cacheRequest("Authorization", "Basic Zm9vOmJhcg=="), second: cacheRequest("Authorization", "Basic Zm9vOmJhcg==")},
+		{name: "client no-cache", header: http.Header{"Cache-Control": {"max-age=60"}}, first: cacheRequest(), second: cacheRequest("Cache-Control", "no-cache")},
+		{name: "client no-store", header: http.Header{"Cache-Control": {"max-age=60"}}, first: cacheRequest("Cache-Control", "no-store"), second: cacheRequest()},
+		{name: "range", header: http.Header{"Cache-Control": {"max-age=60"}}, first: cacheRequest("Range", "bytes=0-1"), second: cacheRequest("Range", "bytes=0-1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tobab.Host{Hostname: "app.example.com", CacheSizeMB: 1}
+			backend := &cacheBackend{header: tt.header, body: `{"ok":true}`}
+			handler := newTestApp(tobab.Config{}).cacheMiddleware(h, backend)
+
+			handler.ServeHTTP(httptest.NewRecorder(), tt.first)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, tt.second)
+
+			if cached := backend.requests == 1; cached != tt.wantCached {
+				t.Errorf("second request served from the cache = %t, want %t", cached, tt.wantCached)
+			}
+			if w.Body.String() != backend.body {
+				t.Errorf("body = '%s', want '%s'", w.Body.String(), backend.body)
+			}
+			if tt.wantCached && w.Header().Get("Age") == "" {
+				t.Error("a cached response should have an Age")
+			}
+		})
+	}
+}
+
+func TestCacheMiddleware_Revalidate(t *testing.T) {
+	h := tobab.Host{Hostname: "app.example.com", CacheSizeMB: 1}
+	backend := &cacheBackend{header: http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}, "Content-Type": {"application/json"}}, body: `{"v":1}`}
+	handler := newTestApp(tobab.Config{}).cacheMiddleware(h, backend)
+
+	handler.ServeHTTP(httptest.NewRecorder(), cacheRequest())
+
+	//the backend only confirms the entry, the client still gets the full response
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, cacheRequest())
+	if backend.requests != 2 || backend.conditional != `"v1"` {
+		t.Errorf("backend got %d requests, the last with If-None-Match '%s', want 2 and a revalidation", backend.requests, backend.conditional)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != `{"v":1}` || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("revalidated response = %d %v '%s'", w.Code, w.Header(), w.Body.String())
+	}
+
+	//a client that has the response gets a 304
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, cacheRequest("If-None-Match", `"v1"`))
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("conditional request = %d '%s', want a 304", w.Code, w.Body.String())
+	}
+
+	//a changed response replaces the entry
+	backend.header.Set("ETag", `"v2"`)
+	backend.body = `{"v":2}`
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, cacheRequest("If-None-Match", `"v1"`))
+	if w.Code != http.StatusOK || w.Body.String() != `{"v":2}` {
+		t.Errorf("changed response = %d '%s', want the new response", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, cacheRequest("If-None-Match", `"v2"`))
+	if w.Code != http.StatusNotModified {
+		t.Errorf("conditional request for the new response = %d, want a 304", w.Code)
+	}
+}
+
+func TestResponseCache_Evict(t *testing.T) {
+	c := newResponseCache(1000)
+	now := time.Now()
+	add := func(path string, size int) {
+		r := httptest.NewRequest(http.MethodGet, "https://app.example.com"+path, nil)
+		e := newCacheEntry(r, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, []byte(strings.Repeat("x", size)), now)
+		c.set(e)
+	}
+	get := func(path string) bool {
+		return c.get(httptest.NewRequest(http.MethodGet, "https://app.example.com"+path, nil)) != nil
+	}
+
+	//a response is at most a quarter of the cache, so the fifth is one too many
+	for _, p := range []string{"/a", "/b", "/c", "/d"} {
+		add(p, 200)
+	}
+	//used, so /b is the least recently used one
+	get("/a")
+	add("/e", 200)
+	if !get("/a") || get("/b") || !get("/c") || !get("/e") {
+		t.Errorf("cache has /a %t /b %t /c %t /e %t, want /b evicted", get("/a"), get("/b"), get("/c"), get("/e"))
+	}
+	if c.size > c.maxBytes {
+		t.Errorf("cache size %d is over the max of %d", c.size, c.maxBytes)
+	}
+
+	add("/large", 300)
+	if get("/large") {
+		t.Error("a response larger than a quarter of the cache was stored")
+	}
+	if n := c.purge(); n != 4 || get("/a") || c.size != 0 {
+		t.Errorf("purge() = %d, size %d, want 4 responses dropped", n, c.size)
+	}
+}
+
+func TestPurgeCache(t *testing.T) {
+	cachedHost := tobab.Host{Hostname: "app.example.com", Backend: "http://10.0.0.1:8080", Type: "http", Public: true, CacheSizeMB: 1}
+	app := newTestApp(tobab.Config{}, cachedHost, tobab.Host{Hostname: "other.example.com", Backend: "http://10.0.0.1:8080", Type: "http", Public: true})
+	app.caches = newCacheRegistry()
+
+	backend := &cacheBackend{header: http.Header{"Cache-Control": {"max-age=60"}}, body: "ok"}
+	handler := app.cacheMiddleware(cachedHost, backend)
+	handler.ServeHTTP(httptest.NewRecorder(), cacheRequest())
+
+	//a reload without changes keeps the responses
+	cache := app.caches.get(cachedHost)
+	app.caches.retain(map[string]bool{cachedHost.Hostname: true})
+	if app.caches.get(cachedHost) != cache {
+		t.Fatal("a reload of an unchanged host dropped its cache")
+	}
+
+	var out clirpc.PurgeCacheOut
+	if err := app.PurgeCache(&clirpc.PurgeCacheIn{Auth: testAuth, Hostname: "app.example.com"}, &out); err != nil || out.Purged != 1 {
+		t.Fatalf("PurgeCache() = %d, %v, want 1 response purged", out.Purged, err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), cacheRequest())
+	if backend.requests != 2 {
+		t.Errorf("backend got %d requests, want the request after the purge to reach it", backend.requests)
+	}
+	if err := app.PurgeCache(&clirpc.PurgeCacheIn{Auth: testAuth, Hostname: "other.example.com"}, &out); err == nil {
+		t.Error("expected an error purging a host without a cache")
+	}
+	if err := app.PurgeCache(&clirpc.PurgeCacheIn{Auth: testAuth, Hostname: "missing.example.com"}, &out); err == nil {
+		t.Error("expected an error purging a host that doesn't exist")
+	}
+
+	changed := cachedHost
+	changed.Backend = "http://10.0.0.2:8080"
+	if app.caches.get(changed).purge() != 0 {
+		t.Error("a changed host kept the responses of its previous backend")
+	}
+}
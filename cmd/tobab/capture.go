@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+)
+
+const (
+	maxCaptureCount       = 100
+	maxCaptureBodyBytes   = 4 << 10
+	defaultCaptureTimeout = 10 * time.Minute
+)
+
+// redactedHeaders are never stored in a capture, the values are replaced. Query values and form bodies are
+// redacted as well, other bodies are stored as they are.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Tobab-Token"}
+
+// captureManager keeps the armed captures and the captured exchanges per host
+type captureManager struct {
+	mu    sync.Mutex
+	hosts map[string]*hostCapture
+}
+
+type hostCapture struct {
+	remaining int
+	until     time.Time
+	captures  []clirpc.Capture
+}
+
+func newCaptureManager() *captureManager {
+	return &captureManager{hosts: map[string]*hostCapture{}}
+}
+
+// arm starts capturing the next n requests of host, it disarms after n requests or when timeout has passed.
+// Captures of an earlier arm are discarded.
+func (m *captureManager) arm(host string, n int, timeout time.Duration) error {
+	if n <= 0 || n > maxCaptureCount {
+		return errors.New("capture count should be between 1 and 100")
+	}
+	if timeout <= 0 {
+		timeout = defaultCaptureTimeout
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hosts[strings.ToLower(host)] = &hostCapture{remaining: n, until: time.Now().Add(timeout)}
+	return nil
+}
+
+// claim reserves a capture slot for a request of host, it is cheap when nothing is armed
+func (m *captureManager) claim(host string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.hosts[strings.ToLower(host)]
+	if !ok || c.remaining <= 0 || time.Now().After(c.until) {
+		return false
+	}
+	c.remaining--
+	return true
+}
+
+func (m *captureManager) add(host string, capture clirpc.Capture) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.hosts[strings.ToLower(host)]
+	if !ok {
+		return
+	}
+	if len(c.captures) >= maxCaptureCount {
+		c.captures = c.captures[1:]
+	}
+	c.captures = append(c.captures, capture)
+}
+
+func (m *captureManager) get(host string) []clirpc.Capture {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.hosts[strings.ToLower(host)]
+	if !ok {
+		return nil
+	}
+	return append([]clirpc.Capture(nil), c.captures...)
+}
+
+// captureMiddleware records the request and response of requests while a capture is armed for the host
+func (app *Tobab) captureMiddleware(h tobab.Host, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.captures.claim(h.Hostname) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c := clirpc.Capture{
+			Time:           time.Now(),
+			Method:         r.Method,
+			URL:            redactURL(r.URL),
+			Proto:          r.Proto,
+			RequestHeaders: redactHeaders(r.Header),
+		}
+		if formBody(r) {
+			//forms carry passwords and the like, their fields can't be told apart from the harmless ones
+			c.RequestBody = "[redacted]"
+		} else if r.Body != nil && r.Body != http.NoBody {
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCaptureBodyBytes+1))
+			if err == nil {
+				if len(body) > maxCaptureBodyBytes {
+					c.Truncated = true
+				}
+				c.RequestBody = string(body[:min(len(body), maxCaptureBodyBytes)])
+				r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			}
+		}
+
+		cw := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cw, r)
+
+		c.Duration = time.Since(c.Time)
+		c.Status = cw.status
+		c.ResponseHeaders = redactHeaders(w.Header())
+		c.ResponseBody = cw.body.String()
+		c.Truncated = c.Truncated || cw.truncated
+		app.captures.add(h.Hostname, c)
+	})
+}
+
+func redactHeaders(header http.Header) map[string][]string {
+	redacted := make(map[string][]string, len(header))
+	for k, v := range header {
+		redacted[k] = append([]string(nil), v...)
+	}
+	for _, k := range redactedHeaders {
+		if _, ok := redacted[k]; ok {
+			redacted[k] = []string{"[redacted]"}
+		}
+	}
+	return redacted
+}
+
+// redactURL keeps the names of the query parameters but not their values, tokens and api keys often end up there
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	if redacted.RawQuery == "" {
+		return redacted.String()
+	}
+	params := strings.Split(redacted.RawQuery, "&")
+	for i, p := range params {
+		if name := strings.SplitN(p, "=", 2); len(name) == 2 {
+			params[i] = name[0] + "=[redacted]"
+		}
+	}
+	redacted.RawQuery = strings.Join(params, "&")
+	return redacted.String()
+}
+
+func formBody(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data"
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// captureWriter keeps the status and the first maxCaptureBodyBytes of the response
+type captureWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	cw.status = code
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if room := maxCaptureBodyBytes - cw.body.Len(); room > 0 {
+		cw.body.Write(b[:min(len(b), room)])
+		if len(b) > room {
+			cw.truncated = true
+		}
+	} else if len(b) > 0 {
+		cw.truncated = true
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.status = http.StatusSwitchingProtocols
+	return hijack(cw.ResponseWriter)
+}
+
+func (cw *captureWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+)
+
+func TestCaptureMiddleware(t *testing.T) {
+	host := tobab.Host{Hostname: "app.example.com", Backend: "http://localhost:1234", Type: "http", Public: true}
+	app := newTestApp(tobab.Config{}, host)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("echo:" + string(body)))
+	})
+	handler := app.captureMiddleware(host, backend)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "https://app.example.com/api?x=1", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("X-Request-Id", "abc")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	send("before arming")
+	if err := app.ArmCapture(&clirpc.ArmCaptureIn{Auth: testAuth, Hostname: "app.example.com", Count: 2}, &clirpc.Empty{}); err != nil {
+		t.Fatalf("unable to arm capture: %v", err)
+	}
+	large := strings.Repeat("a", maxCaptureBodyBytes+10)
+	w := send(large)
+	if w.Body.String() != "echo:"+large {
+		t.Fatalf("backend did not receive the complete body")
+	}
+	send("second")
+	send("after disarm")
+
+	var out clirpc.GetCapturesOut
+	if err := app.GetCaptures(&clirpc.GetCapturesIn{Auth: testAuth, Hostname: "app.example.com"}, &out); err != nil {
+		t.Fatalf("unable to get captures: %v", err)
+	}
+	if len(out.Captures) != 2 {
+		t.Fatalf("got %d captures, want 2", len(out.Captures))
+	}
+	first, second := out.Captures[0], out.Captures[1]
+	if !first.Truncated || len(first.RequestBody) != maxCaptureBodyBytes || len(first.ResponseBody) != maxCaptureBodyBytes {
+		t.Errorf("large bodies were not truncated: truncated = %t, request %d, response %d bytes", first.Truncated, len(first.RequestBody), len(first.ResponseBody))
+	}
+	if second.Truncated || second.RequestBody != "second" || second.ResponseBody != "echo:second" {
+		t.Errorf("unexpected capture: %+v", second)
+	}
+	if second.Method != "POST" || second.URL != "https://app.example.com/api?x=[redacted]" || second.Status != http.StatusCreated {
+		t.Errorf("unexpected request line or status: %s %s %d", second.Method, second.URL, second.Status)
+	}
+	if got := second.RequestHeaders["Authorization"]; len(got) != 1 || got[0] != "[redacted]" {
+		t.Errorf("Authorization was not redacted: %v", got)
+	}
+	if got := second.ResponseHeaders["Set-Cookie"]; len(got) != 1 || got[0] != "[redacted]" {
+		t.Errorf("Set-Cookie was not redacted: %v", got)
+	}
+	if got := second.RequestHeaders["X-Request-Id"]; len(got) != 1 || got[0] != "abc" {
+		t.Errorf("X-Request-Id = %v, want abc", got)
+	}
+
+	if err := app.ArmCapture(&clirpc.ArmCaptureIn{Auth: testAuth, Hostname: "missing.example.com", Count: 1}, &clirpc.Empty{}); err == nil {
+		t.Errorf("expected an error when arming an unknown host")
+	}
+	if err := app.ArmCapture(&clirpc.ArmCaptureIn{Auth: testAuth, Hostname: "app.example.com", Count: maxCaptureCount + 1}, &clirpc.Empty{}); err == nil {
+		t.Errorf("expected an error for too many captures")
+	}
+}
+
+func TestCaptureMiddleware_RedactsSecrets(t *testing.T) {
+	host := tobab.Host{Hostname: "app.example.com", Backend: "http://localhost:1234", Type: "http", Public: true}
+	app := newTestApp(tobab.Config{}, host)
+	var received string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+	})
+	handler := app.captureMiddleware(host, backend)
+	if err := app.ArmCapture(&clirpc.ArmCaptureIn{Auth: testAuth, Hostname: "app.example.com", Count: 2}, &clirpc.Empty{}); err != nil {
+		t.Fatalf("unable to arm capture: %v", err)
+	}
+
+	r := httptest.NewRequest("POST", "https://app.example.com/login?token=secret&debug", strings.NewReader("user=me&password=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if received != "user=me&password=secret" {
+		t.Errorf("backend received %q, want the complete form", received)
+	}
+	r = httptest.NewRequest("POST", "https://app.example.com/api", strings.NewReader(`{"name":"me"}`))
+	r.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var out clirpc.GetCapturesOut
+	if err := app.GetCaptures(&clirpc.GetCapturesIn{Auth: testAuth, Hostname: "app.example.com"}, &out); err != nil {
+		t.Fatalf("unable to get captures: %v", err)
+	}
+	if len(out.Captures) != 2 {
+		t.Fatalf("got %d captures, want 2", len(out.Captures))
+	}
+	form, api := out.Captures[0], out.Captures[1]
+	if form.URL != "https://app.example.com/login?token=[redacted]&debug" {
+		t.Errorf("URL = %s, the query values should be redacted", form.URL)
+	}
+	if form.RequestBody != "[redacted]" {
+		t.Errorf("form body = %q, want it redacted", form.RequestBody)
+	}
+	if api.RequestBody != `{"name":"me"}` {
+		t.Errorf("json body = %q, other bodies are stored as they are", api.RequestBody)
+	}
+}
+
+func TestCaptureTimeout(t *testing.T) {
+	m := newCaptureManager()
+	if err := m.arm("app.example.com", 10, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if m.claim("app.example.com") {
+		t.Errorf("capture should have disarmed after the timeout")
+	}
+}
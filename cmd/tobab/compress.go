@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gnur/tobab"
+	"github.com/gorilla/mux"
+)
+
+// defaultCompressionMinSize is the size below which compressing a response costs more than it saves
+const defaultCompressionMinSize = 1024
+
+// defaultCompressionExcludeTypes are formats that are compressed already, compressing them again only costs cpu
+var defaultCompressionExcludeTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"video/*",
+	"audio/*",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/octet-stream",
+}
+
+// compressMiddleware compresses responses with gzip or deflate for clients that accept it, except responses
+// with a content type in CompressionExcludeTypes and responses smaller than CompressionMinSize
+func compressMiddleware(cfg tobab.Config) mux.MiddlewareFunc {
+	exclude := cfg.CompressionExcludeTypes
+	if len(exclude) == 0 {
+		exclude = defaultCompressionExcludeTypes
+	}
+	minSize := cfg.CompressionMinSize
+	if minSize == 0 {
+		minSize = defaultCompressionMinSize
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var encoding string
+			switch {
+			case r.Header.Get("Upgrade") != "":
+				//the connection is taken over, there is no response body to compress
+			case acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip"):
+				encoding = "gzip"
+			case acceptsEncoding(r.Header.Get("Accept-Encoding"), "deflate"):
+				encoding = "deflate"
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+			if encoding == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, exclude: exclude, minSize: minSize, head: r.Method == http.MethodHead}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressWriter holds back the start of a response until it knows whether it is worth compressing, which is
+// once minSize bytes are written, the response is flushed or the content type says so
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	exclude  []string
+	minSize  int
+	head     bool
+
+	status  int
+	buf     []byte
+	decided bool
+	//compressor is nil when the response is sent as it is
+	compressor io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	if code < 200 {
+		//informational responses go out right away, the real one follows
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	if !cw.compressible() {
+		cw.start(false)
+		return
+	}
+	//with a known length and type there is no need to hold anything back
+	if n, err := strconv.Atoi(cw.Header().Get("Content-Length")); err == nil {
+		if n < cw.minSize {
+			cw.start(false)
+		} else if cw.Header().Get("Content-Type") != "" {
+			cw.start(true)
+		}
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.compressor != nil {
+			return cw.compressor.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minSize {
+		cw.start(cw.compressibleType())
+		if err := cw.writeBuffered(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// compressible reports whether the headers so far allow compressing the response
+func (cw *compressWriter) compressible() bool {
+	if cw.head || cw.Header().Get("Content-Encoding") != "" || cw.Header().Get("Content-Range") != "" {
+		return false
+	}
+	switch cw.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	ct := cw.Header().Get("Content-Type")
+	return ct == "" || !excludedType(ct, cw.exclude)
+}
+
+// compressibleType sniffs the content type when the handler didn't set one, like net/http would, because
+// sniffing the compressed body would give the wrong type
+func (cw *compressWriter) compressibleType() bool {
+	if cw.Header().Get("Content-Type") == "" {
+		if len(cw.buf) == 0 {
+			return false
+		}
+		cw.Header().Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	return !excludedType(cw.Header().Get("Content-Type"), cw.exclude)
+}
+
+// start sends the headers, with compress set the body goes through the compressor from now on
+func (cw *compressWriter) start(compress bool) {
+	cw.decided = true
+	if compress {
+		h := cw.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == "gzip" {
+			cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.compressor, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressWriter) writeBuffered() error {
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.compressor != nil {
+		_, err = cw.compressor.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush decides on a response that is still held back, streamed responses like server sent events can't wait
+// for minSize bytes
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		return
+	}
+	if !cw.decided {
+		cw.start(cw.compressibleType())
+		cw.writeBuffered()
+	}
+	if f, ok := cw.compressor.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack allows upgrading the connection, like for websockets
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	cw.decided = true
+	return h.Hijack()
+}
+
+// close sends a response that stayed below minSize as it is and finishes a compressed one
+func (cw *compressWriter) close() {
+	if cw.status == 0 {
+		return
+	}
+	if !cw.decided {
+		cw.start(false)
+		cw.writeBuffered()
+	}
+	if cw.compressor != nil {
+		cw.compressor.Close()
+	}
+}
+
+// excludedType reports whether the media type of contentType is in exclude, which has exact types and
+// wildcards like video/*
+func excludedType(contentType string, exclude []string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	for _, e := range exclude {
+		e = strings.ToLower(e)
+		if e == mediaType || strings.HasSuffix(e, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(e, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestCompressMiddleware(t *testing.T) {
+	html := "<html><body>" + strings.Repeat("compress me ", 200) + "</body></html>"
+	tests := []struct {
+		name           string
+		cfg            tobab.Config
+		contentType    string
+		encoding       string
+		body           string
+		method         string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{name: "html", contentType: "text/html; charset=utf-8", body: html, wantEncoding: "gzip"},
+		{name: "json", contentType: "application/json", body: `{"a":"` + strings.Repeat("b", 2000) + `"}`, wantEncoding: "gzip"},
+		{name: "css", contentType: "text/css", body: strings.Repeat("a{b:c}", 500), wantEncoding: "gzip"},
+		{name: "js", contentType: "application/javascript", body: strings.Repeat("console.log(1);", 200), wantEncoding: "gzip"},
+		{name: "deflate", contentType: "text/html", body: html, acceptEncoding: "deflate", wantEncoding: "deflate"},
+		{name: "sniffed html", body: html, wantEncoding: "gzip"},
+		{name: "image", contentType: "image/png", body: strings.Repeat("x", 2000)},
+		{name: "video wildcard", contentType: "video/mp4", body: strings.Repeat("x", 2000)},
+		{name: "below min size", contentType: "text/html", body: "<html>small</html>"},
+		{name: "custom min size", cfg: tobab.Config{CompressionMinSize: 10}, contentType: "text/html", body: "<html>small</html>", wantEncoding: "gzip"},
+		{name: "custom exclude list", cfg: tobab.Config{CompressionExcludeTypes: []string{"text/*"}}, contentType: "text/html", body: html},
+		{name: "custom exclude list replaces defaults", cfg: tobab.Config{CompressionExcludeTypes: []string{"text/*"}}, contentType: "image/png", body: strings.Repeat("x", 2000), wantEncoding: "gzip"},
+		{name: "already encoded", contentType: "text/html", encoding: "br", body: html, wantEncoding: "br"},
+		{name: "client without compression", contentType: "text/html", body: html, acceptEncoding: "identity"},
+		{name: "head", contentType: "text/html", body: html, method: http.MethodHead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				//in small writes, the way the proxy copies a backend response
+				for i := 0; i < len(tt.body); i += 100 {
+					end := i + 100
+					if end > len(tt.body) {
+						end = len(tt.body)
+					}
+					_, _ = w.Write([]byte(tt.body[i:end]))
+				}
+			})
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "https://app.example.com/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			} else {
+				req.Header.Set("Accept-Encoding", "gzip, deflate")
+			}
+			w := httptest.NewRecorder()
+			compressMiddleware(tt.cfg)(next).ServeHTTP(w, req)
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if method == http.MethodHead {
+				return
+			}
+			var body io.Reader = w.Body
+			switch tt.wantEncoding {
+			case "gzip":
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			case "deflate":
+				body = flate.NewReader(w.Body)
+			}
+			got, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.body {
+				t.Errorf("body changed, got %d bytes, want %d", len(got), len(tt.body))
+			}
+			if w.Header().Get("Content-Type") == "" {
+				t.Error("Content-Type is missing")
+			}
+		})
+	}
+}
+
+func TestCompressMiddleware_Flush(t *testing.T) {
+	sent := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: hello\n\n"))
+		w.(http.Flusher).Flush()
+		<-sent
+	})
+	front := httptest.NewServer(compressMiddleware(tobab.Config{})(next))
+	defer front.Close()
+	defer close(sent)
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := gz.Read(buf)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	//the handler is still running, so this came from the flush
+	if got := string(buf[:n]); got != "data: hello\n\n" {
+		t.Errorf("flushed event = %q", got)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gnur/tobab"
+)
+
+// concurrencyLimiter limits the number of in flight requests for a host and for every user of that host
+type concurrencyLimiter struct {
+	mu         sync.Mutex
+	max        int
+	maxPerUser int
+	inFlight   int
+	perUser    map[string]int
+}
+
+func (l *concurrencyLimiter) acquire(user string) (ok bool, status int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.inFlight >= l.max {
+		return false, http.StatusServiceUnavailable
+	}
+	if l.maxPerUser > 0 && l.perUser[user] >= l.maxPerUser {
+		return false, http.StatusTooManyRequests
+	}
+	l.inFlight++
+	l.perUser[user]++
+	return true, 0
+}
+
+func (l *concurrencyLimiter) release(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.perUser[user]--
+	if l.perUser[user] <= 0 {
+		delete(l.perUser, user)
+	}
+}
+
+// concurrencyMiddleware enforces MaxConcurrent for the host and MaxConcurrentPerUser for every user, so
+// a single user can't use up all slots. Requests without a user are grouped by client ip.
+func (app *Tobab) concurrencyMiddleware(h tobab.Host, next http.Handler) http.Handler {
+	if h.MaxConcurrent <= 0 && h.MaxConcurrentPerUser <= 0 {
+		return next
+	}
+	l := &concurrencyLimiter{
+		max:        h.MaxConcurrent,
+		maxPerUser: h.MaxConcurrentPerUser,
+		perUser:    map[string]int{},
+	}
+	trusted := app.trustedProxies()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := identity(r, trusted)
+		ok, status := l.acquire(key)
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		defer l.release(key)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identity returns the authenticated user of the request, or the ip of the client if there is none
+func identity(r *http.Request, trusted []*net.IPNet) string {
+	if u, _ := userFromContext(r.Context()); u != "" {
+		return u
+	}
+	return clientIP(r, trusted).String()
+}
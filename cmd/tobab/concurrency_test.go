@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestConcurrencyMiddleware_PerUser(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-unblock
+		}
+	})
+	handler := newTestApp(tobab.Config{}).concurrencyMiddleware(tobab.Host{MaxConcurrent: 10, MaxConcurrentPerUser: 2}, next)
+
+	request := func(user, path string) int {
+		r := httptest.NewRequest("GET", "https://app.example.com"+path, nil)
+		r = r.WithContext(withUser(r.Context(), user))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	//alice uses both of her slots
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- request("alice@example.com", "/slow") }()
+		<-started
+	}
+
+	if got := request("alice@example.com", "/"); got != http.StatusTooManyRequests {
+		t.Errorf("third request of alice: status = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if got := request("bob@example.com", "/"); got != http.StatusOK {
+		t.Errorf("request of bob: status = %d, want %d", got, http.StatusOK)
+	}
+
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if got := <-done; got != http.StatusOK {
+			t.Errorf("slow request of alice: status = %d, want %d", got, http.StatusOK)
+		}
+	}
+	if got := request("alice@example.com", "/"); got != http.StatusOK {
+		t.Errorf("request of alice after her slots were released: status = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestConcurrencyMiddleware_Host(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	})
+	handler := newTestApp(tobab.Config{}).concurrencyMiddleware(tobab.Host{MaxConcurrent: 1}, next)
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-started
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	close(unblock)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestConcurrencyMiddleware_BehindProxy(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	})
+	app := newTestApp(tobab.Config{TrustedProxies: []string{"10.0.0.1"}})
+	handler := app.concurrencyMiddleware(tobab.Host{MaxConcurrentPerUser: 1}, next)
+	request := func(forwardedFor string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		return r
+	}
+
+	go handler.ServeHTTP(httptest.NewRecorder(), request("192.0.2.1"))
+	<-started
+	//another client behind the same load balancer has its own slot
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request("192.0.2.2"))
+		done <- w.Code
+	}()
+	select {
+	case <-started:
+	case code := <-done:
+		t.Errorf("second client behind the proxy: status = %d, want its own slot", code)
+	}
+	w := httptest.NewRecorder()
+	go func() {
+		handler.ServeHTTP(w, request("192.0.2.1"))
+		done <- w.Code
+	}()
+	if code := <-done; code != http.StatusTooManyRequests {
+		t.Errorf("second request of the first client: status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	close(unblock)
+}
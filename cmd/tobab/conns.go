@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connTracker keeps the long lived connections of the https server. Shutdown waits for requests but not for
+// connections that were hijacked, like websockets, and a streaming response like server sent events only ends
+// when the shutdown timeout closes it, so these are counted to show what a shutdown cut off.
+type connTracker struct {
+	mu       sync.Mutex
+	hijacked map[*trackedConn]struct{}
+	//streams are the running requests that flushed a response
+	streams int
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{hijacked: map[*trackedConn]struct{}{}}
+}
+
+// middleware has to be the outermost handler of the server, so every hijack goes through it
+func (t *connTracker) middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &trackingWriter{ResponseWriter: w, t: t}
+		next.ServeHTTP(tw, r)
+		if tw.streaming {
+			t.mu.Lock()
+			t.streams--
+			t.mu.Unlock()
+		}
+	})
+}
+
+func (t *connTracker) streaming() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.streams
+}
+
+func (t *connTracker) open() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.hijacked)
+}
+
+// closeHijacked waits up to wait for the hijacked connections to be closed by either side and closes the ones
+// that are left, it returns how many it closed
+func (t *connTracker) closeHijacked(wait time.Duration) int {
+	if t == nil {
+		return 0
+	}
+	deadline := time.Now().Add(wait)
+	for t.open() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.hijacked))
+	for c := range t.hijacked {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+type trackingWriter struct {
+	http.ResponseWriter
+	t         *connTracker
+	streaming bool
+}
+
+func (tw *trackingWriter) Flush() {
+	if !tw.streaming {
+		tw.streaming = true
+		tw.t.mu.Lock()
+		tw.t.streams++
+		tw.t.mu.Unlock()
+	}
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *trackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hijack(tw.ResponseWriter)
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := &trackedConn{Conn: conn, t: tw.t}
+	tw.t.mu.Lock()
+	tw.t.hijacked[tc] = struct{}{}
+	tw.t.mu.Unlock()
+	return tc, rw, nil
+}
+
+// trackedConn removes itself from the tracker when it is closed
+type trackedConn struct {
+	net.Conn
+	t    *connTracker
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.t.mu.Lock()
+		delete(c.t.hijacked, c)
+		c.t.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
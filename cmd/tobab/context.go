@@ -0,0 +1,42 @@
+package main
+
+import "context"
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	ruleKey
+	backendKey
+	bodyLimitKey
+)
+
+func withUser(ctx context.Context, u string) context.Context {
+	return context.WithValue(ctx, userKey, u)
+}
+
+// userFromContext returns the user that was extracted by the rbac middleware
+func userFromContext(ctx context.Context) (string, bool) {
+	u, ok := ctx.Value(userKey).(string)
+	return u, ok
+}
+
+func withRule(ctx context.Context, rule string) context.Context {
+	return context.WithValue(ctx, ruleKey, rule)
+}
+
+// ruleFromContext returns the name of the rbac rule that decided on the request
+func ruleFromContext(ctx context.Context) (string, bool) {
+	rule, ok := ctx.Value(ruleKey).(string)
+	return rule, ok
+}
+
+func withBackend(ctx context.Context, b *backend) context.Context {
+	return context.WithValue(ctx, backendKey, b)
+}
+
+// backendFromContext returns the backend that was chosen for the request before it reached the proxy
+func backendFromContext(ctx context.Context) (*backend, bool) {
+	b, ok := ctx.Value(backendKey).(*backend)
+	return b, ok
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gnur/tobab"
+)
+
+// cookieModifier rewrites the cookies a backend sets so they can't collide with tobab or other backends
+// on the same cookie scope. Cookies that look like tobab cookies are always dropped.
+func cookieModifier(h tobab.Host) func(*http.Response) error {
+	drop := map[string]bool{}
+	for _, name := range h.DropCookies {
+		drop[name] = true
+	}
+	return func(resp *http.Response) error {
+		cookies := resp.Cookies()
+		if len(cookies) == 0 {
+			return nil
+		}
+		resp.Header.Del("Set-Cookie")
+		for _, c := range cookies {
+			if drop[c.Name] || strings.HasPrefix(c.Name, "X-Tobab") {
+				continue
+			}
+			c.Name = h.CookiePrefix + c.Name
+			if h.CookiePath != "" {
+				c.Path = h.CookiePath
+			}
+			if v := c.String(); v != "" {
+				resp.Header.Add("Set-Cookie", v)
+			}
+		}
+		return nil
+	}
+}
+
+// unprefixCookies removes the cookie prefix of a host before the request is sent to the backend,
+// cookies without the prefix belong to another backend and are not forwarded
+func unprefixCookies(req *http.Request, prefix string) {
+	if prefix == "" {
+		return
+	}
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if strings.HasPrefix(c.Name, prefix) {
+			c.Name = strings.TrimPrefix(c.Name, prefix)
+			req.AddCookie(c)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestCookieModifier(t *testing.T) {
+	tests := []struct {
+		name string
+		host tobab.Host
+		want []string
+	}{
+		{
+			name: "tobab session cookie is never forwarded",
+			host: tobab.Host{},
+			want: []string{"other=1", "session=abc; Path=/app"},
+		},
+		{
+			name: "prefix and path",
+			host: tobab.Host{CookiePrefix: "app_", CookiePath: "/"},
+			want: []string{"app_other=1; Path=/", "app_session=abc; Path=/"},
+		},
+		{
+			name: "drop by name",
+			host: tobab.Host{DropCookies: []string{"other"}},
+			want: []string{"session=abc; Path=/app"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header.Get("Cookie")
+				http.SetCookie(w, &http.Cookie{Name: "X-Tobab-Token", Value: "evil", Path: "/"})
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/app"})
+				http.SetCookie(w, &http.Cookie{Name: "other", Value: "1"})
+			}))
+			defer backend.Close()
+
+			tt.host.Hostname = "app.example.com"
+			tt.host.Backend = backend.URL
+			proxy, err := newTestApp(tobab.Config{}).generateProxy(tt.host)
+			if err != nil {
+				t.Fatalf("unable to create proxy: %v", err)
+			}
+			r := httptest.NewRequest("GET", "https://app.example.com/", nil)
+			r.AddCookie(&http.Cookie{Name: "app_session", Value: "abc"})
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+
+			got := w.Header()["Set-Cookie"]
+			sort.Strings(got)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("Set-Cookie = %v, want %v", got, tt.want)
+			}
+			if tt.host.CookiePrefix != "" && received != "session=abc" {
+				t.Errorf("backend received cookies %q, want the prefix to be removed", received)
+			}
+		})
+	}
+}
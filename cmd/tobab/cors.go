@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gnur/tobab"
+	"github.com/gorilla/mux"
+)
+
+// defaultCORSMethods are allowed for hosts without CORSAllowedMethods
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// corsMaxAge is how many seconds browsers can reuse the answer to a preflight request
+const corsMaxAge = "600"
+
+// corsMiddleware adds the CORS headers of a host to responses for origins it allows and answers preflight
+// requests without sending them to the backend. Browsers send preflight requests without cookies, so this runs
+// before the rbac middleware, which would redirect them to the login.
+func (app *Tobab) corsMiddleware(hosts map[string]tobab.Host) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h, ok := hosts[requestHostname(r)]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Origin")
+			origin := corsAllowOrigin(h, r.Header.Get("Origin"))
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				if origin == "" {
+					app.errorPage(w, r, "origin not allowed", http.StatusForbidden)
+					return
+				}
+				setCORSOrigin(w, h, origin)
+				methods := h.CORSAllowedMethods
+				if len(methods) == 0 {
+					methods = defaultCORSMethods
+				}
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+				if len(h.CORSAllowedHeaders) > 0 {
+					w.Header().Set("Access-Control-Allow-Headers", strings.Join(h.CORSAllowedHeaders, ", "))
+				}
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if origin != "" {
+				setCORSOrigin(w, h, origin)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin for a request from origin, empty when the origin is
+// not allowed
+func corsAllowOrigin(h tobab.Host, origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, o := range h.CORSAllowedOrigins {
+		if o == "*" && !h.CORSAllowCredentials {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			//browsers reject * for requests with cookies, those need the origin itself
+			return origin
+		}
+	}
+	return ""
+}
+
+func setCORSOrigin(w http.ResponseWriter, h tobab.Host, origin string) {
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if h.CORSAllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	api := tobab.Host{
+		Hostname:             "api.example.com",
+		Type:                 "http",
+		Globs:                []tobab.Glob{"*@example.com"},
+		CORSAllowedOrigins:   []string{"https://spa.example.com"},
+		CORSAllowedMethods:   []string{http.MethodGet, http.MethodPut},
+		CORSAllowedHeaders:   []string{"Content-Type"},
+		CORSAllowCredentials: true,
+	}
+	open := tobab.Host{Hostname: "open.example.com", Type: "http", Public: true, CORSAllowedOrigins: []string{"*"}}
+	private := tobab.Host{Hostname: "private.example.com", Type: "http", Globs: []tobab.Glob{"*@example.com"}}
+	app := newTestApp(tobab.Config{}, api, open, private)
+	hosts := map[string]tobab.Host{api.Hostname: api, open.Hostname: open}
+
+	tests := []struct {
+		name            string
+		host            string
+		method          string
+		origin          string
+		user            string
+		preflight       bool
+		wantStatus      int
+		wantOrigin      string
+		wantCredentials bool
+		wantBackend     bool
+	}{
+		{name: "preflight is answered without a login", host: "api.example.com", method: http.MethodOptions, origin: "https://spa.example.com", preflight: true, wantStatus: http.StatusNoContent, wantOrigin: "https://spa.example.com", wantCredentials: true},
+		{name: "preflight from another origin", host: "api.example.com", method: http.MethodOptions, origin: "https://evil.com", preflight: true, wantStatus: http.StatusForbidden},
+		{name: "credentialed request echoes the origin", host: "api.example.com", method: http.MethodGet, origin: "https://spa.example.com", user: "alice@example.com", wantStatus: http.StatusOK, wantOrigin: "https://spa.example.com", wantCredentials: true, wantBackend: true},
+		{name: "request from another origin gets no headers", host: "api.example.com", method: http.MethodGet, origin: "https://evil.com", user: "alice@example.com", wantStatus: http.StatusOK, wantBackend: true},
+		{name: "request without origin", host: "api.example.com", method: http.MethodGet, user: "alice@example.com", wantStatus: http.StatusOK, wantBackend: true},
+		{name: "any origin", host: "open.example.com", method: http.MethodGet, origin: "https://other.com", wantStatus: http.StatusOK, wantOrigin: "*", wantBackend: true},
+		{name: "options that is not a preflight is proxied", host: "open.example.com", method: http.MethodOptions, origin: "https://other.com", wantStatus: http.StatusOK, wantOrigin: "*", wantBackend: true},
+		{name: "host without cors sends preflight to the login", host: "private.example.com", method: http.MethodOptions, origin: "https://spa.example.com", preflight: true, wantStatus: http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := false
+			handler := app.corsMiddleware(hosts)(app.getRBACMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				backend = true
+			})))
+			r := testRequest(t, app, tt.host, tt.user)
+			r.Method = tt.method
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = '%s', want '%s'", got, tt.wantOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %t, want %t", got, tt.wantCredentials)
+			}
+			if backend != tt.wantBackend {
+				t.Errorf("request reached the backend = %t, want %t", backend, tt.wantBackend)
+			}
+			if tt.preflight && tt.wantStatus == http.StatusNoContent {
+				if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, PUT" {
+					t.Errorf("Access-Control-Allow-Methods = '%s'", got)
+				}
+				if got := w.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type" {
+					t.Errorf("Access-Control-Allow-Headers = '%s'", got)
+				}
+			}
+		})
+	}
+}
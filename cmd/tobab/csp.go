@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultCSPNonceMaxBytes = 1 << 20
+
+var scriptTag = regexp.MustCompile(`(?i)<script(\s[^>]*)?>`)
+var nonceAttr = regexp.MustCompile(`(?i)\snonce\s*=`)
+
+// cspNonceModifier adds a fresh nonce to the Content-Security-Policy header and to every script tag
+// in html responses. Bodies larger than maxBytes or encoded bodies are passed through untouched.
+func cspNonceModifier(maxBytes int64) func(*http.Response) error {
+	if maxBytes <= 0 {
+		maxBytes = defaultCSPNonceMaxBytes
+	}
+	return func(resp *http.Response) error {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if mediaType != "text/html" {
+			return nil
+		}
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+			return nil
+		}
+		if resp.ContentLength > maxBytes || bodylessResponse(resp) {
+			//there are no script tags to match a nonce to
+			return nil
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(body)) > maxBytes {
+			//too large to rewrite, send what was read followed by the rest of the body
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return nil
+		}
+		resp.Body.Close()
+
+		nonce, err := newNonce()
+		if err != nil {
+			return err
+		}
+
+		body = scriptTag.ReplaceAllFunc(body, func(tag []byte) []byte {
+			if nonceAttr.Match(tag) {
+				return tag
+			}
+			return append([]byte(`<script nonce="`+nonce+`"`), tag[len("<script"):]...)
+		})
+		resp.Header.Set("Content-Security-Policy", addNonce(resp.Header.Get("Content-Security-Policy"), nonce))
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+}
+
+// addNonce adds the nonce as a source to the script-src directive of policy, creating it if needed
+func addNonce(policy, nonce string) string {
+	source := "'nonce-" + nonce + "'"
+	if strings.TrimSpace(policy) == "" {
+		return "script-src " + source
+	}
+
+	directives := strings.Split(policy, ";")
+	for i, d := range directives {
+		fields := strings.Fields(d)
+		if len(fields) > 0 && strings.EqualFold(fields[0], "script-src") {
+			directives[i] = strings.TrimRight(d, " ") + " " + source
+			return strings.Join(directives, ";")
+		}
+	}
+	return strings.TrimRight(policy, "; ") + "; script-src " + source
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestCSPNonce(t *testing.T) {
+	page := `<html><head><script src="/app.js"></script><SCRIPT>alert(1)</SCRIPT><script nonce="keep">x()</script></head></html>`
+	tests := []struct {
+		name        string
+		contentType string
+		policy      string
+		body        string
+		maxBytes    int64
+		wantNonce   bool
+		wantPolicy  string
+	}{
+		{name: "html without policy", contentType: "text/html; charset=utf-8", body: page, wantNonce: true, wantPolicy: "script-src 'nonce-%s'"},
+		{name: "existing script-src", contentType: "text/html", policy: "default-src 'self'; script-src 'self'", body: page, wantNonce: true, wantPolicy: "default-src 'self'; script-src 'self' 'nonce-%s'"},
+		{name: "no script-src", contentType: "text/html", policy: "default-src 'self';", body: page, wantNonce: true, wantPolicy: "default-src 'self'; script-src 'nonce-%s'"},
+		{name: "json is untouched", contentType: "application/json", body: `{"a":"<script>"}`},
+		{name: "too large is untouched", contentType: "text/html", body: page, maxBytes: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.policy != "" {
+					w.Header().Set("Content-Security-Policy", tt.policy)
+				}
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer backend.Close()
+
+			proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL, CSPNonce: true, CSPNonceMaxBytes: tt.maxBytes})
+			if err != nil {
+				t.Fatalf("unable to create proxy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, httptest.NewRequest("GET", "https://app.example.com/", nil))
+			body, _ := ioutil.ReadAll(w.Body)
+
+			if !tt.wantNonce {
+				if string(body) != tt.body {
+					t.Errorf("body was modified: %s", body)
+				}
+				if w.Header().Get("Content-Security-Policy") != tt.policy {
+					t.Errorf("policy was modified: %s", w.Header().Get("Content-Security-Policy"))
+				}
+				return
+			}
+
+			nonces := regexp.MustCompile(`(?i)<script nonce="([^"]+)"`).FindAllStringSubmatch(string(body), -1)
+			if len(nonces) != 3 {
+				t.Fatalf("expected 3 script tags with a nonce, got %d: %s", len(nonces), body)
+			}
+			nonce := nonces[0][1]
+			if nonces[1][1] != nonce || nonces[2][1] != "keep" {
+				t.Errorf("unexpected nonces: %v", nonces)
+			}
+			wantPolicy := strings.Replace(tt.wantPolicy, "%s", nonce, 1)
+			if got := w.Header().Get("Content-Security-Policy"); got != wantPolicy {
+				t.Errorf("policy = %s, want %s", got, wantPolicy)
+			}
+			if w.Header().Get("Content-Length") != "" && w.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+				t.Errorf("content-length %s does not match body length %d", w.Header().Get("Content-Length"), len(body))
+			}
+		})
+	}
+}
+
+func TestCSPNonce_Bodyless(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", "1234")
+	}))
+	defer backend.Close()
+	proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL, CSPNonce: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "https://app.example.com/", nil))
+	if w.Header().Get("Content-Length") != "1234" || w.Header().Get("Content-Security-Policy") != "" {
+		t.Errorf("HEAD response has Content-Length '%s' and policy '%s', want the length of the backend and no nonce", w.Header().Get("Content-Length"), w.Header().Get("Content-Security-Policy"))
+	}
+
+	//a go backend drops the Content-Type of a bodyless response itself, other backends may still send it
+	resp := &http.Response{
+		StatusCode: http.StatusNoContent,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       http.NoBody,
+		Request:    httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil),
+	}
+	if err := cspNonceModifier(0)(resp); err != nil || resp.Header.Get("Content-Security-Policy") != "" {
+		t.Errorf("204 response has policy '%s', %v, want no nonce", resp.Header.Get("Content-Security-Policy"), err)
+	}
+}
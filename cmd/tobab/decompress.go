@@ -0,0 +1,58 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// decompressModifier unpacks gzipped backend responses when the client didn't say it accepts gzip, the
+// same way the transport does for requests it compressed itself. The body is streamed, so the
+// Content-Length of the compressed body is dropped.
+func decompressModifier(resp *http.Response) error {
+	if !strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip") {
+		return nil
+	}
+	if resp.Request != nil && acceptsEncoding(resp.Request.Header.Get("Accept-Encoding"), "gzip") {
+		return nil
+	}
+	if bodylessResponse(resp) || resp.ContentLength == 0 {
+		//there is nothing to unpack, gzip can't even read the header of an empty body
+		return nil
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	resp.Body = readCloser{gz, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows enc, either by name or with a wildcard
+func acceptsEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		name := strings.TrimSpace(params[0])
+		if !strings.EqualFold(name, enc) && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, _ = strconv.ParseFloat(p[2:], 64)
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestDecompress(t *testing.T) {
+	body := strings.Repeat("tobab ", 100)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte(body))
+	gz.Close()
+
+	//a backend that always sends gzip, whatever the client asked for
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(compressed.Bytes())
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		decompress     bool
+		acceptEncoding string
+		wantEncoding   string
+		wantBody       []byte
+	}{
+		{name: "identity client gets plain body", decompress: true, acceptEncoding: "identity", wantBody: []byte(body)},
+		{name: "gzip refused with q=0", decompress: true, acceptEncoding: "gzip;q=0, identity", wantBody: []byte(body)},
+		{name: "gzip client gets gzip", decompress: true, acceptEncoding: "gzip, deflate", wantEncoding: "gzip", wantBody: compressed.Bytes()},
+		{name: "wildcard client gets gzip", decompress: true, acceptEncoding: "*", wantEncoding: "gzip", wantBody: compressed.Bytes()},
+		{name: "disabled passes gzip through", acceptEncoding: "identity", wantEncoding: "gzip", wantBody: compressed.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Decompress: tt.decompress})
+			if err != nil {
+				t.Fatalf("unable to create proxy: %v", err)
+			}
+			req := httptest.NewRequest("GET", "https://app.example.com/", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if !bytes.Equal(w.Body.Bytes(), tt.wantBody) {
+				t.Errorf("unexpected body of %d bytes", w.Body.Len())
+			}
+			if cl := w.Header().Get("Content-Length"); tt.wantEncoding == "" && cl != "" {
+				t.Errorf("Content-Length of the compressed body was kept: %s", cl)
+			}
+		})
+	}
+}
+
+func TestDecompress_EmptyBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/not-modified":
+			w.WriteHeader(http.StatusNotModified)
+		}
+		//an empty 200 gets a Content-Length of 0
+	}))
+	defer backend.Close()
+	proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Decompress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]int{"/no-content": http.StatusNoContent, "/not-modified": http.StatusNotModified, "/empty": http.StatusOK} {
+		w := httptest.NewRecorder()
+		//without Accept-Encoding the proxy would unpack the body for the client
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com"+path, nil))
+		if w.Code != want || w.Body.Len() != 0 {
+			t.Errorf("%s: status = %d with %d bytes, want %d without a body", path, w.Code, w.Body.Len(), want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/muxlogger"
+)
+
+// delayMiddleware holds every request for the InjectDelay of the host before it is proxied. This is a
+// testing feature to see how clients deal with a slow backend, so it only works in DevMode. The delay is
+// added to the request log so it can be told apart from backend latency.
+func (app *Tobab) delayMiddleware(h tobab.Host, next http.Handler) http.Handler {
+	if h.InjectDelay == "" {
+		return next
+	}
+	if !app.config.DevMode {
+		app.logger.WithField("host", h.Hostname).Warning("ignoring InjectDelay because DevMode is off")
+		return next
+	}
+	min, max, err := tobab.ParseDelay(h.InjectDelay)
+	if err != nil {
+		app.logger.WithError(err).WithField("host", h.Hostname).Error("ignoring invalid InjectDelay")
+		return next
+	}
+	app.logger.WithField("host", h.Hostname).WithField("delay", h.InjectDelay).Warning("injecting delay into every request")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := min
+		if max > min {
+			d += time.Duration(rand.Int63n(int64(max - min)))
+		}
+		muxlogger.SetField(r, "injectedDelay", d.String())
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.C:
+		}
+		next.ServeHTTP(w, r)
+	})
+}
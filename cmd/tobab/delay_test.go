@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/muxlogger"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestDelayMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		devMode   bool
+		delay     string
+		wantDelay time.Duration
+		wantField bool
+	}{
+		{name: "no delay configured", devMode: true},
+		{name: "ignored without devmode", delay: "100ms"},
+		{name: "fixed delay", devMode: true, delay: "100ms", wantDelay: 100 * time.Millisecond, wantField: true},
+		{name: "random delay", devMode: true, delay: "50ms-100ms", wantDelay: 50 * time.Millisecond, wantField: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{DevMode: tt.devMode})
+			hook := test.NewLocal(app.logger.Logger)
+			h := tobab.Host{Hostname: "app.example.com", InjectDelay: tt.delay}
+			handler := muxlogger.NewLogger(app.logger).Middleware(app.delayMiddleware(h, okHandler))
+
+			start := time.Now()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "https://app.example.com/", nil))
+			elapsed := time.Since(start)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if elapsed < tt.wantDelay {
+				t.Errorf("request took %s, want at least %s", elapsed, tt.wantDelay)
+			}
+			if tt.wantDelay == 0 && elapsed > 50*time.Millisecond {
+				t.Errorf("request was delayed by %s", elapsed)
+			}
+			entry := hook.LastEntry()
+			_, logged := entry.Data["injectedDelay"]
+			if logged != tt.wantField {
+				t.Errorf("injectedDelay logged = %t, want %t", logged, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestDelayMiddleware_ClientGone(t *testing.T) {
+	app := newTestApp(tobab.Config{DevMode: true})
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+	handler := app.delayMiddleware(tobab.Host{Hostname: "app.example.com", InjectDelay: "10s"}, next)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://app.example.com/", nil).WithContext(ctx))
+	if time.Since(start) > time.Second {
+		t.Errorf("delay was not interrupted when the client went away")
+	}
+	if called {
+		t.Errorf("request was proxied after the client went away")
+	}
+}
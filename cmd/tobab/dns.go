@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+const (
+	defaultDNSCacheTTL = 10 * time.Second
+	//maxDNSCacheTTL keeps backends behind dns based load balancing from being pinned to an old address
+	maxDNSCacheTTL    = 5 * time.Minute
+	defaultDNSRetries = 2
+	//maxDNSStale is how long an expired entry is still used when the resolver keeps failing
+	maxDNSStale = 5 * time.Minute
+	//minDialTimeout is the least time an address gets when the dial deadline is split, the same floor the
+	//standard dialer uses
+	minDialTimeout = 2 * time.Second
+)
+
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dnsCache caches backend lookups and retries transient resolver failures, so a short dns hiccup doesn't
+// fail requests that need a new backend connection
+type dnsCache struct {
+	resolver   ipResolver
+	ttl        time.Duration
+	retries    int
+	retryDelay time.Duration
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+func newDNSCache(cfg tobab.Config) *dnsCache {
+	ttl := defaultDNSCacheTTL
+	if d, err := time.ParseDuration(cfg.DNSCacheTTL); err == nil {
+		ttl = d
+	}
+	if ttl > maxDNSCacheTTL {
+		ttl = maxDNSCacheTTL
+	}
+	retries := defaultDNSRetries
+	if cfg.DNSRetries > 0 {
+		retries = cfg.DNSRetries
+	}
+	return &dnsCache{
+		resolver:   net.DefaultResolver,
+		ttl:        ttl,
+		retries:    retries,
+		retryDelay: 50 * time.Millisecond,
+		now:        time.Now,
+		entries:    map[string]dnsEntry{},
+	}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	c.mu.Lock()
+	entry, cached := c.entries[host]
+	c.mu.Unlock()
+	if cached && c.now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	var addrs []net.IPAddr
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * c.retryDelay):
+			}
+		}
+		addrs, err = c.resolver.LookupIPAddr(ctx, host)
+		if err == nil || !transientDNSError(err) {
+			break
+		}
+	}
+	if err != nil {
+		if cached && c.now().Before(entry.expires.Add(maxDNSStale)) {
+			//an old address is more likely to work than no address at all
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	if c.ttl > 0 {
+		c.mu.Lock()
+		c.entries[host] = dnsEntry{addrs: addrs, expires: c.now().Add(c.ttl)}
+		c.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+func transientDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	return false
+}
+
+// dialContext resolves the host with the cache and dials the addresses in order until one works. Like the
+// standard dialer the time left is split over the remaining addresses, so one address that doesn't answer
+// can't use up the whole timeout.
+func (c *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		deadline := dialDeadline(ctx, dialer, time.Now())
+		var conn net.Conn
+		for i, ip := range addrs {
+			dialCtx, cancel := ctx, func() {}
+			if !deadline.IsZero() {
+				dialCtx, cancel = context.WithDeadline(ctx, partialDeadline(time.Now(), deadline, len(addrs)-i))
+			}
+			conn, err = dialer.DialContext(dialCtx, network, net.JoinHostPort(ip.String(), port))
+			cancel()
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+		}
+		if err == nil {
+			err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+		return nil, err
+	}
+}
+
+// dialDeadline is the earliest of the deadline of ctx and the timeout of dialer, or zero when there is neither
+func dialDeadline(ctx context.Context, dialer *net.Dialer, now time.Time) time.Time {
+	deadline, _ := ctx.Deadline()
+	if dialer.Timeout > 0 {
+		if d := now.Add(dialer.Timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// partialDeadline gives an equal part of the time until deadline to each of the remaining addresses
+func partialDeadline(now, deadline time.Time, remaining int) time.Time {
+	left := deadline.Sub(now)
+	timeout := left / time.Duration(remaining)
+	if timeout < minDialTimeout {
+		timeout = minDialTimeout
+	}
+	if timeout >= left {
+		return deadline
+	}
+	return now.Add(timeout)
+}
+
+// dialContext uses the dns cache of the app when there is one
+func (app *Tobab) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if app.dns == nil {
+		return dialer.DialContext
+	}
+	return app.dns.dialContext(dialer)
+}
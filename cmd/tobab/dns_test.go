@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+// flakyResolver returns the queued errors first and resolves every name to 127.0.0.1 after that
+type flakyResolver struct {
+	mu      sync.Mutex
+	errs    []error
+	lookups int
+}
+
+func (r *flakyResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return nil, err
+	}
+	return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+func testDNSCache(r ipResolver, ttl time.Duration) *dnsCache {
+	c := newDNSCache(tobab.Config{})
+	c.resolver = r
+	c.ttl = ttl
+	c.retryDelay = time.Millisecond
+	return c
+}
+
+var temporaryDNSError = &net.DNSError{Err: "server misbehaving", Name: "backend.internal", IsTemporary: true}
+
+func TestDNSCache_TransientFailure(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+
+	resolver := &flakyResolver{errs: []error{temporaryDNSError}}
+	app := newTestApp(tobab.Config{})
+	app.dns = testDNSCache(resolver, time.Minute)
+	proxy, err := app.generateProxy(tobab.Host{Hostname: "app.example.com", Backend: strings.Replace(backend.URL, "127.0.0.1", "backend.internal", 1)})
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "https://app.example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("lookups = %d, want a failed lookup followed by a retry", resolver.lookups)
+	}
+}
+
+func TestDNSCache_Lookup(t *testing.T) {
+	permanent := &net.DNSError{Err: "no such host", Name: "backend.internal", IsNotFound: true}
+	tests := []struct {
+		name        string
+		errs        []error
+		ttl         time.Duration
+		prime       bool
+		advance     time.Duration
+		wantErr     bool
+		wantLookups int
+	}{
+		{name: "retries transient failures", errs: []error{temporaryDNSError, temporaryDNSError}, wantLookups: 3},
+		{name: "gives up after the retries", errs: []error{temporaryDNSError, temporaryDNSError, temporaryDNSError}, wantErr: true, wantLookups: 3},
+		{name: "does not retry permanent failures", errs: []error{permanent}, wantErr: true, wantLookups: 1},
+		{name: "cached within ttl", ttl: time.Minute, prime: true, advance: 30 * time.Second, wantLookups: 1},
+		{name: "resolves again after ttl", ttl: time.Minute, prime: true, advance: 2 * time.Minute, wantLookups: 2},
+		{name: "stale entry when resolver fails", errs: []error{permanent}, ttl: time.Minute, prime: true, advance: 2 * time.Minute, wantLookups: 2},
+		{name: "no caching with zero ttl", prime: true, wantLookups: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &flakyResolver{}
+			c := testDNSCache(resolver, tt.ttl)
+			now := time.Now()
+			c.now = func() time.Time { return now }
+			if tt.prime {
+				if _, err := c.lookup(context.Background(), "backend.internal"); err != nil {
+					t.Fatal(err)
+				}
+				now = now.Add(tt.advance)
+			}
+			resolver.errs = tt.errs
+
+			addrs, err := c.lookup(context.Background(), "backend.internal")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("127.0.0.1"))) {
+				t.Errorf("unexpected addresses: %v", addrs)
+			}
+			if resolver.lookups != tt.wantLookups {
+				t.Errorf("lookups = %d, want %d", resolver.lookups, tt.wantLookups)
+			}
+		})
+	}
+}
+
+func TestNewDNSCache_CapsTTL(t *testing.T) {
+	if c := newDNSCache(tobab.Config{DNSCacheTTL: "1h"}); c.ttl != maxDNSCacheTTL {
+		t.Errorf("ttl = %s, want %s", c.ttl, maxDNSCacheTTL)
+	}
+	if c := newDNSCache(tobab.Config{DNSCacheTTL: "0s"}); c.ttl != 0 {
+		t.Errorf("ttl = %s, want caching disabled", c.ttl)
+	}
+}
+
+func TestPartialDeadline(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		left      time.Duration
+		remaining int
+		want      time.Duration
+	}{
+		{name: "split over the addresses", left: 30 * time.Second, remaining: 3, want: 10 * time.Second},
+		{name: "last address gets the rest", left: 30 * time.Second, remaining: 1, want: 30 * time.Second},
+		{name: "at least the minimum", left: 3 * time.Second, remaining: 3, want: minDialTimeout},
+		{name: "never past the deadline", left: time.Second, remaining: 2, want: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partialDeadline(now, now.Add(tt.left), tt.remaining).Sub(now); got != tt.want {
+				t.Errorf("timeout = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	//the default dial timeout is long, a shorter context deadline wins
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(time.Minute))
+	defer cancel()
+	if got := dialDeadline(ctx, &net.Dialer{Timeout: 10 * time.Minute}, now); !got.Equal(now.Add(time.Minute)) {
+		t.Errorf("deadline = %s, want the deadline of the context", got.Sub(now))
+	}
+	if got := dialDeadline(context.Background(), &net.Dialer{Timeout: time.Minute}, now); !got.Equal(now.Add(time.Minute)) {
+		t.Errorf("deadline = %s, want the dialer timeout", got.Sub(now))
+	}
+	if got := dialDeadline(context.Background(), &net.Dialer{}, now); !got.IsZero() {
+		t.Errorf("deadline = %s, want none", got)
+	}
+}
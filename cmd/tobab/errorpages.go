@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// errorPageData is passed to the error templates, like 502.html
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	Host       string
+	RequestID  string
+}
+
+// errorPage responds with the template for the status to browsers, other clients and statuses without a
+// template get msg as plain text.
+func (app *Tobab) errorPage(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	app.hostErrorPage(w, r, requestHostname(r), msg, status)
+}
+
+// hostErrorPage is errorPage for requests of which the host was already rewritten, like upstream requests
+func (app *Tobab) hostErrorPage(w http.ResponseWriter, r *http.Request, host, msg string, status int) {
+	app.templatePage(w, r, fmt.Sprintf("%d.html", status), host, msg, status)
+}
+
+// maintenancePage responds with maintenance.html, the page of hosts in maintenance mode
+func (app *Tobab) maintenancePage(w http.ResponseWriter, r *http.Request) {
+	app.templatePage(w, r, "maintenance.html", requestHostname(r), "this host is under maintenance", http.StatusServiceUnavailable)
+}
+
+func requestHostname(r *http.Request) string {
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		return h
+	}
+	return r.Host
+}
+
+// templatePage responds with the template tpl to browsers, other clients and missing templates get msg as plain
+// text
+func (app *Tobab) templatePage(w http.ResponseWriter, r *http.Request, tpl, host, msg string, status int) {
+	if app.templates == nil || app.templates.Lookup(tpl) == nil || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		errorWithRequestID(w, r, msg, status)
+		return
+	}
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    msg,
+		Host:       host,
+	}
+	data.RequestID, _ = requestIDFromContext(r.Context())
+
+	//rendered first so a broken template can still fall back to plain text
+	var buf bytes.Buffer
+	if err := app.templates.ExecuteTemplate(&buf, tpl, data); err != nil {
+		app.logger.WithError(err).WithField("template", tpl).Error("failed executing error template")
+		errorWithRequestID(w, r, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestErrorPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tobab-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "502.html"), []byte(`<p>custom {{.Status}} for {{.Host}} ({{.RequestID}})</p>`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builtin, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := loadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := httptest.NewServer(okHandler)
+	backend.Close()
+
+	tests := []struct {
+		name       string
+		app        *Tobab
+		accept     string
+		wantType   string
+		wantInBody []string
+	}{
+		{name: "browser", app: &Tobab{templates: builtin}, accept: "text/html,application/xhtml+xml", wantType: "text/html; charset=utf-8", wantInBody: []string{"<h1>Bad Gateway</h1>", "app.example.com", "request id abc-123"}},
+		{name: "api client", app: &Tobab{templates: builtin}, accept: "application/json", wantType: "text/plain; charset=utf-8", wantInBody: []string{"backend unavailable (request id abc-123)"}},
+		{name: "override", app: &Tobab{templates: custom}, accept: "text/html", wantType: "text/html; charset=utf-8", wantInBody: []string{"<p>custom 502 for app.example.com (abc-123)</p>"}},
+		{name: "no templates", app: &Tobab{}, accept: "text/html", wantType: "text/plain; charset=utf-8", wantInBody: []string{"backend unavailable"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{})
+			app.templates = tt.app.templates
+			proxy, err := app.generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			r.Header.Set("Accept", tt.accept)
+			r.Header.Set(defaultRequestIDHeader, "abc-123")
+			w := httptest.NewRecorder()
+			requestIDMiddleware(defaultRequestIDHeader)(proxy).ServeHTTP(w, r)
+
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %s, want %s", got, tt.wantType)
+			}
+			for _, want := range tt.wantInBody {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("body doesn't contain %s:\n%s", want, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestErrorPage_AuthFailures(t *testing.T) {
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "private.example.com", Backend: "http://localhost:1234", Type: "http", Globs: []tobab.Glob{"*@example.com"}})
+	app.templates, _ = loadTemplates("")
+
+	r := testRequest(t, app, "private.example.com", "mallory@evil.com")
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	app.getRBACMiddleware()(okHandler).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "<h1>Unauthorized</h1>") {
+		t.Errorf("status = %d, body:\n%s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/markbates/goth"
+)
+
+// groupsClaim is the claim with the groups of the user at the identity provider
+const groupsClaim = "groups"
+
+// groupClient looks up the groups of a user at the identity provider they logged in with, using the access
+// token of the login. Groups are prefixed with the provider, like github:acme/devs, so a group of one provider
+// can't grant access that was meant for a group with the same name at another provider.
+type groupClient struct {
+	client *http.Client
+	github string
+	gitlab string
+	google string
+}
+
+func newGroupClient() *groupClient {
+	return &groupClient{
+		client: &http.Client{Timeout: 10 * time.Second},
+		github: "https://api.github.com",
+		gitlab: "https://gitlab.com",
+		google: "https://cloudidentity.googleapis.com",
+	}
+}
+
+// groups returns the groups of user, providers without groups return an empty list
+func (c *groupClient) groups(ctx context.Context, user goth.User) ([]string, error) {
+	switch user.Provider {
+	case tobab.ProviderGitHub:
+		return c.githubGroups(ctx, user.AccessToken)
+	case tobab.ProviderGitLab:
+		return c.gitlabGroups(ctx, user.AccessToken)
+	case tobab.ProviderGoogle:
+		return c.googleGroups(ctx, user.AccessToken, user.Email)
+	}
+	return []string{}, nil
+}
+
+// githubGroups returns the organizations of the user and the teams in them as org/team
+func (c *groupClient) githubGroups(ctx context.Context, token string) ([]string, error) {
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	if err := c.get(ctx, c.github+"/user/orgs?per_page=100", token, &orgs); err != nil {
+		return nil, err
+	}
+	var teams []struct {
+		Slug         string `json:"slug"`
+		Organization struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+	}
+	if err := c.get(ctx, c.github+"/user/teams?per_page=100", token, &teams); err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, o := range orgs {
+		groups = append(groups, tobab.ProviderGitHub+":"+o.Login)
+	}
+	for _, t := range teams {
+		groups = append(groups, tobab.ProviderGitHub+":"+t.Organization.Login+"/"+t.Slug)
+	}
+	return groups, nil
+}
+
+// gitlabGroups returns the full paths of the groups the user is a member of, including subgroups
+func (c *groupClient) gitlabGroups(ctx context.Context, token string) ([]string, error) {
+	var list []struct {
+		FullPath string `json:"full_path"`
+	}
+	if err := c.get(ctx, c.gitlab+"/api/v4/groups?min_access_level=10&per_page=100", token, &list); err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, g := range list {
+		groups = append(groups, tobab.ProviderGitLab+":"+g.FullPath)
+	}
+	return groups, nil
+}
+
+// googleGroups returns the email addresses of the google workspace groups the user is a member of, directly
+// or through another group
+func (c *groupClient) googleGroups(ctx context.Context, token, email string) ([]string, error) {
+	query := fmt.Sprintf("member_key_id == '%s' && 'cloudidentity.googleapis.com/groups.discussion_forum' in labels", email)
+	var resp struct {
+		Memberships []struct {
+			GroupKey struct {
+				ID string `json:"id"`
+			} `json:"groupKey"`
+		} `json:"memberships"`
+	}
+	u := c.google + "/v1/groups/-/memberships:searchTransitiveGroups?query=" + url.QueryEscape(query)
+	if err := c.get(ctx, u, token, &resp); err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, m := range resp.Memberships {
+		groups = append(groups, tobab.ProviderGoogle+":"+m.GroupKey.ID)
+	}
+	return groups, nil
+}
+
+func (c *groupClient) get(ctx context.Context, u, token string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// userGroups returns the groups of a user that just logged in, when the provider is configured to look them
+// up. A failed lookup doesn't stop the login, the user just gets no groups.
+func (app *Tobab) userGroups(ctx context.Context, user goth.User) []string {
+	if !app.config.ProviderGroups(user.Provider) {
+		return []string{}
+	}
+	groups, err := app.groups.groups(ctx, user)
+	if err != nil {
+		app.logger.WithError(err).WithField("provider", user.Provider).WithField("user", user.Email).Warning("unable to look up the groups of the user, continuing without groups")
+		return []string{}
+	}
+	return groups
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/markbates/goth"
+)
+
+func TestGroupClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var v interface{}
+		switch r.URL.Path {
+		case "/user/orgs":
+			v = []map[string]string{{"login": "acme"}}
+		case "/user/teams":
+			v = []map[string]interface{}{{"slug": "devs", "organization": map[string]string{"login": "acme"}}}
+		case "/api/v4/groups":
+			v = []map[string]string{{"full_path": "acme/platform"}}
+		case "/v1/groups/-/memberships:searchTransitiveGroups":
+			if r.URL.Query().Get("query") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			v = map[string]interface{}{"memberships": []map[string]interface{}{{"groupKey": map[string]string{"id": "admins@example.com"}}}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	defer srv.Close()
+	c := &groupClient{client: srv.Client(), github: srv.URL, gitlab: srv.URL, google: srv.URL}
+
+	tests := []struct {
+		provider string
+		want     []string
+	}{
+		{provider: tobab.ProviderGitHub, want: []string{"github:acme", "github:acme/devs"}},
+		{provider: tobab.ProviderGitLab, want: []string{"gitlab:acme/platform"}},
+		{provider: tobab.ProviderGoogle, want: []string{"google:admins@example.com"}},
+		{provider: "faux", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			got, err := c.groups(context.Background(), goth.User{Provider: tt.provider, Email: "alice@example.com", AccessToken: "access-token"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groups() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := c.groups(context.Background(), goth.User{Provider: tobab.ProviderGitHub, AccessToken: "expired"}); err == nil {
+		t.Error("expected an error when the api refuses the token")
+	}
+}
+
+func TestUserGroups_LookupFailureKeepsLogin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	app := newTestApp(tobab.Config{Providers: []tobab.Provider{{Name: tobab.ProviderGitHub, Key: "id", Secret: "secret", Groups: true}}})
+	app.groups = &groupClient{client: srv.Client(), github: srv.URL}
+	groups := app.userGroups(context.Background(), goth.User{Provider: tobab.ProviderGitHub, AccessToken: "access-token"})
+	if groups == nil || len(groups) != 0 {
+		t.Errorf("expected an empty set of groups, got %#v", groups)
+	}
+	//google comes from the googlekey and doesn't look up groups
+	if groups := app.userGroups(context.Background(), goth.User{Provider: tobab.ProviderGoogle}); len(groups) != 0 {
+		t.Errorf("groups were looked up for a provider without Groups: %v", groups)
+	}
+}
+
+func TestRBACMiddleware_TokenGroups(t *testing.T) {
+	app := newTestApp(tobab.Config{}, tobab.Host{
+		Hostname:      "app.example.com",
+		Backend:       "http://localhost:1234",
+		Type:          "http",
+		Globs:         []tobab.Glob{"*@example.com"},
+		AllowedGroups: []tobab.PathGroups{{Path: "/admin", Groups: []string{"github:acme/admins"}}},
+	})
+	tests := []struct {
+		name       string
+		provider   string
+		groups     []string
+		wantStatus int
+	}{
+		{name: "member", provider: tobab.ProviderGitHub, groups: []string{"github:acme", "github:acme/admins"}, wantStatus: http.StatusOK},
+		{name: "not a member", provider: tobab.ProviderGitHub, groups: []string{"github:acme"}, wantStatus: http.StatusForbidden},
+		{name: "no groups", provider: tobab.ProviderGoogle, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := app.issueToken("alice@example.com", "test", tt.provider, tt.groups, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "https://app.example.com/admin", nil)
+			r.AddCookie(&http.Cookie{Name: "X-Tobab-Token", Value: token})
+			w := httptest.NewRecorder()
+			app.getRBACMiddleware()(okHandler).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gnur/tobab"
+)
+
+// preserveHeaderCasing moves the values of the canonicalized headers in names to a key with the exact
+// casing of names. The server canonicalizes every incoming header name, but the transport writes map
+// keys as they are, so this restores the casing some backends insist on.
+func preserveHeaderCasing(header http.Header, names []string) {
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(name)
+		if canonical == name {
+			continue
+		}
+		values, ok := header[canonical]
+		if !ok {
+			continue
+		}
+		delete(header, canonical)
+		header[name] = values
+	}
+}
+
+// userPlaceholder in a header value is replaced with the email address of the user of the request
+const userPlaceholder = "${user}"
+
+// headerValue returns v with the user of the request in place of userPlaceholder, requests without a login
+// get an empty user
+func headerValue(r *http.Request, v string) string {
+	if !strings.Contains(v, userPlaceholder) {
+		return v
+	}
+	u, _ := userFromContext(r.Context())
+	return strings.ReplaceAll(v, userPlaceholder, u)
+}
+
+// setRequestHeaders adds the SetRequestHeaders of a host to a request to its backend, replacing the values the
+// client sent. Validate refuses the X-Forwarded headers, the reverse proxy appends to X-Forwarded-For.
+func setRequestHeaders(req *http.Request, headers map[string]string) {
+	for name, v := range headers {
+		req.Header.Set(name, headerValue(req, v))
+	}
+}
+
+// responseHeaderModifier sets the SetResponseHeaders of a host on the responses of its backend and removes the
+// RemoveResponseHeaders, like a Server header that gives away what runs behind tobab
+func responseHeaderModifier(h tobab.Host) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for name, v := range h.SetResponseHeaders {
+			resp.Header.Set(name, headerValue(resp.Request, v))
+		}
+		for _, name := range h.RemoveResponseHeaders {
+			resp.Header.Del(name)
+		}
+		return nil
+	}
+}
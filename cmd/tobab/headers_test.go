@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestHeaderCasing(t *testing.T) {
+	//a plain tcp backend, a net/http server would canonicalize the header names before we could see them
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var names []string
+			br := bufio.NewReader(conn)
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+				if i := strings.Index(line, ":"); i > 0 {
+					names = append(names, line[:i])
+				}
+			}
+			_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			conn.Close()
+			received <- names
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		casing   []string
+		wantName string
+	}{
+		{name: "canonical by default", wantName: "X-Apikey"},
+		{name: "configured casing is kept", casing: []string{"X-ApiKey"}, wantName: "X-ApiKey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{Hostname: "app.example.com", Backend: "http://" + l.Addr().String(), HeaderCasing: tt.casing})
+			if err != nil {
+				t.Fatalf("unable to create proxy: %v", err)
+			}
+			req := httptest.NewRequest("GET", "https://app.example.com/", nil)
+			req.Header.Set("X-ApiKey", "secret")
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			names := <-received
+			found := false
+			for _, n := range names {
+				if strings.EqualFold(n, "x-apikey") {
+					found = true
+					if n != tt.wantName {
+						t.Errorf("header was sent as %s, want %s", n, tt.wantName)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("header was not forwarded, got %v", names)
+			}
+		})
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Got-User", r.Header.Get("X-Remote-User"))
+		w.Header().Set("X-Got-Proto", r.Header.Get("X-Forwarded-Proto"))
+		w.Header().Set("Server", "nginx/1.2.3")
+		w.Header().Set("Cache-Control", "public")
+	}))
+	defer backend.Close()
+
+	proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{
+		Hostname:              "app.example.com",
+		Backend:               backend.URL,
+		SetRequestHeaders:     map[string]string{"Authorization": "Basic abc", "X-Remote-User": "${user}"},
+		SetResponseHeaders:    map[string]string{"Cache-Control": "no-store", "X-Served-For": "${user}"},
+		RemoveResponseHeaders: []string{"server"},
+	})
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+	req.Header.Set("Authorization", "Bearer from-the-client")
+	req = req.WithContext(withUser(req.Context(), "erwin@example.com"))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	want := map[string]string{
+		"X-Got-Authorization": "Basic abc",
+		"X-Got-User":          "erwin@example.com",
+		"X-Got-Proto":         "https",
+		"Cache-Control":       "no-store",
+		"X-Served-For":        "erwin@example.com",
+		"Server":              "",
+	}
+	for name, v := range want {
+		if got := w.Header().Get(name); got != v {
+			t.Errorf("%s = %q, want %q", name, got, v)
+		}
+	}
+}
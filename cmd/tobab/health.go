@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	maxHealthCheckTimeout      = 5 * time.Second
+)
+
+// balancerRegistry keeps the balancers of the running proxies so the health of their backends can be queried
+type balancerRegistry struct {
+	mu        sync.Mutex
+	balancers map[string]*balancer
+}
+
+func newBalancerRegistry() *balancerRegistry {
+	return &balancerRegistry{balancers: map[string]*balancer{}}
+}
+
+func (br *balancerRegistry) set(hostname string, b *balancer) {
+	if br == nil {
+		return
+	}
+	br.mu.Lock()
+	br.balancers[hostname] = b
+	br.mu.Unlock()
+}
+
+func (br *balancerRegistry) get(hostname string) (*balancer, bool) {
+	if br == nil {
+		return nil, false
+	}
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	b, ok := br.balancers[hostname]
+	return b, ok
+}
+
+// unavailableMiddleware responds right away when no backend is healthy, instead of waiting for a dial timeout
+func (app *Tobab) unavailableMiddleware(bal *balancer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bal.available() {
+			w.Header().Set("Retry-After", "10")
+			app.errorPage(w, r, "backend is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkHealth polls the HealthCheckPath of every backend of h until stop is closed, backends that don't
+// respond with a 2xx are taken out of routing until they pass a check again
+func (app *Tobab) checkHealth(h tobab.Host, bal *balancer, stop <-chan struct{}) {
+	interval := defaultHealthCheckInterval
+	if d := duration(h.HealthCheckInterval); d > 0 {
+		interval = d
+	}
+	timeout := interval
+	if timeout > maxHealthCheckTimeout {
+		timeout = maxHealthCheckTimeout
+	}
+	tlsConfig, err := app.backendTLSConfig(h)
+	if err != nil {
+		app.logger.WithError(err).WithField("host", h.Hostname).Error("Failed starting health check")
+		return
+	}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			DialContext:     app.dialContext(&net.Dialer{Timeout: timeout}),
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, be := range bal.backends {
+			app.checkBackend(h, be, client)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *Tobab) checkBackend(h tobab.Host, be *backend, client *http.Client) {
+	u := *be.url
+	u.Path = h.HealthCheckPath
+	u.RawQuery = ""
+
+	checkErr := probe(client, u.String())
+
+	be.mu.Lock()
+	wasFailed := be.checkFailed
+	be.checkFailed = checkErr != nil
+	be.lastCheck = time.Now()
+	be.lastError = ""
+	if checkErr != nil {
+		be.lastError = checkErr.Error()
+	}
+	be.mu.Unlock()
+
+	logger := app.logger.WithField("host", h.Hostname).WithField("backend", be.url.String())
+	if checkErr != nil && !wasFailed {
+		logger.WithError(checkErr).Warn("backend is unhealthy")
+	} else if checkErr == nil && wasFailed {
+		logger.Info("backend recovered")
+	}
+}
+
+func probe(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// health returns the current state of every backend
+func (b *balancer) health() []clirpc.BackendHealth {
+	now := b.now()
+	var out []clirpc.BackendHealth
+	for _, be := range b.backends {
+		healthy := be.healthy(now)
+		be.mu.Lock()
+		out = append(out, clirpc.BackendHealth{
+			URL:       be.url.String(),
+			Healthy:   healthy,
+			LastCheck: be.lastCheck,
+			Error:     be.lastError,
+		})
+		be.mu.Unlock()
+	}
+	return out
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+)
+
+// eventually retries check until it returns true or a second has passed
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var healthy int32 = 1
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	h := tobab.Host{
+		Hostname:            "app.example.com",
+		Backend:             backend.URL,
+		Type:                "http",
+		Public:              true,
+		HealthCheckPath:     "/health",
+		HealthCheckInterval: "10ms",
+	}
+	app := newTestApp(tobab.Config{}, h)
+	app.balancers = newBalancerRegistry()
+
+	proxy, err := app.generateProxy(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, ok := app.balancers.get(h.Hostname)
+	if !ok {
+		t.Fatal("generateProxy did not register the balancer")
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go app.checkHealth(h, bal, stop)
+
+	status := func() int {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+		return w.Code
+	}
+	health := func() clirpc.BackendHealth {
+		var out clirpc.GetHealthOut
+		if err := app.GetHealth(&clirpc.GetHealthIn{Auth: testAuth, Hostname: h.Hostname}, &out); err != nil {
+			t.Fatal(err)
+		}
+		if len(out.Backends) != 1 {
+			t.Fatalf("expected a single backend, got %v", out.Backends)
+		}
+		return out.Backends[0]
+	}
+
+	eventually(t, "the first check ran", func() bool { return !health().LastCheck.IsZero() })
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("status = %d with a healthy backend", got)
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	eventually(t, "the backend is unhealthy", func() bool { return status() == http.StatusServiceUnavailable })
+	if hs := health(); hs.Healthy || hs.Error == "" {
+		t.Errorf("expected rpc to report the failed check, got %+v", hs)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	eventually(t, "the backend recovered", func() bool { return status() == http.StatusOK })
+	if hs := health(); !hs.Healthy || hs.Error != "" {
+		t.Errorf("expected rpc to report a healthy backend, got %+v", hs)
+	}
+}
+
+func TestHealthCheck_OnlyFailingBackendIsSkipped(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "up")
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	h := tobab.Host{
+		Hostname:            "app.example.com",
+		Backends:            []tobab.Backend{{URL: up.URL}, {URL: down.URL}},
+		HealthCheckPath:     "/health",
+		HealthCheckInterval: "10ms",
+	}
+	app := newTestApp(tobab.Config{})
+	app.balancers = newBalancerRegistry()
+	proxy, err := app.generateProxy(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bal, _ := app.balancers.get(h.Hostname)
+	stop := make(chan struct{})
+	defer close(stop)
+	go app.checkHealth(h, bal, stop)
+
+	eventually(t, "the failing backend is taken out", func() bool { return !bal.backends[1].healthy(time.Now()) })
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+		if w.Code != http.StatusOK || w.Header().Get("X-Backend") != "up" {
+			t.Errorf("request %d went to the failing backend, status %d", i, w.Code)
+		}
+	}
+}
+
+func TestGetHealth_UnknownHost(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	app.balancers = newBalancerRegistry()
+	var out clirpc.GetHealthOut
+	if err := app.GetHealth(&clirpc.GetHealthIn{Auth: testAuth, Hostname: "missing.example.com"}, &out); err == nil {
+		t.Error("expected an error for an unknown host")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultHSTSMaxAge is the max-age of the Strict-Transport-Security header when none is configured
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// redirectToHTTPS sends plain http requests to the same url over https. ACME http challenges never reach it,
+// acmeChallengeMiddleware answers those first.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		http.Error(w, "missing host", http.StatusBadRequest)
+		return
+	}
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		//a 301 turns a POST into a GET in most clients
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+}
+
+// hstsMiddleware tells browsers to only use https for the host for maxAge. Like the served by header it is set
+// right before the response is written, so a backend can't send a shorter max-age.
+func hstsMiddleware(enabled bool, maxAge time.Duration) func(http.Handler) http.Handler {
+	if !enabled {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	return servedByMiddleware("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int64(maxAge/time.Second)))
+}
+
+// hstsMaxAge returns the configured max-age, "0s" is valid and makes browsers forget the host
+func hstsMaxAge(s string) time.Duration {
+	if s == "" {
+		return defaultHSTSMaxAge
+	}
+	return duration(s)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	magic := certmagic.NewDefault()
+	magic.Storage = challengeStorage{"app.example.com": "pending-token"}
+	am := certmagic.NewACMEManager(magic, certmagic.ACMEManager{})
+	h := acmeChallengeMiddleware(am)(http.HandlerFunc(redirectToHTTPS))
+
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "path and query are kept", method: "GET", url: "http://app.example.com/some/path?a=1&b=2", wantStatus: http.StatusMovedPermanently, wantLocation: "https://app.example.com/some/path?a=1&b=2"},
+		{name: "port is dropped", method: "GET", url: "http://app.example.com:80/", wantStatus: http.StatusMovedPermanently, wantLocation: "https://app.example.com/"},
+		{name: "post keeps its method", method: "POST", url: "http://app.example.com/form", wantStatus: http.StatusPermanentRedirect, wantLocation: "https://app.example.com/form"},
+		{name: "pending challenge is answered", method: "GET", url: "http://app.example.com/.well-known/acme-challenge/pending-token", wantStatus: http.StatusOK},
+		{name: "unknown challenge is not redirected", method: "GET", url: "http://app.example.com/.well-known/acme-challenge/other-token", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.url, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %s, want %s", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestHSTSMiddleware(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	tests := []struct {
+		name    string
+		enabled bool
+		maxAge  string
+		want    string
+	}{
+		{name: "off", want: "max-age=60"},
+		{name: "default max-age", enabled: true, want: "max-age=31536000"},
+		{name: "configured max-age", enabled: true, maxAge: "24h", want: "max-age=86400"},
+		{name: "zero clears it", enabled: true, maxAge: "0s", want: "max-age=0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			hstsMiddleware(tt.enabled, hstsMaxAge(tt.maxAge))(backend).ServeHTTP(w, httptest.NewRequest("GET", "https://app.example.com/", nil))
+			if got := w.Header().Values("Strict-Transport-Security"); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("Strict-Transport-Security = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
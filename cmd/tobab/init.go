@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+)
+
+type InitCmd struct {
+	Output   string `help:"location of the config file to write" default:"tobab.toml" short:"o"`
+	Hostname string `help:"hostname where the login occurs, prompted for if empty"`
+	Email    string `help:"email address used for letsencrypt, prompted for if empty"`
+	Force    bool   `help:"overwrite an existing config file"`
+}
+
+func (r *InitCmd) Run(ctx *Globals) error {
+	if _, err := os.Stat(r.Output); err == nil && !r.Force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", r.Output)
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	var err error
+	if r.Hostname == "" {
+		r.Hostname, err = prompt(in, "hostname where the login occurs (e.g. login.example.com): ")
+		if err != nil {
+			return err
+		}
+	}
+	if r.Email == "" {
+		r.Email, err = prompt(in, "email address for letsencrypt: ")
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(r.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = writeStarterConfig(f, r.Hostname, r.Email)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("config written to %s, add your google key and secret before starting tobab\n", r.Output)
+	return nil
+}
+
+func prompt(in *bufio.Reader, question string) (string, error) {
+	fmt.Print(question)
+	answer, err := in.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return "", errors.New("no answer provided")
+	}
+	return answer, nil
+}
+
+// randomString returns n random bytes from crypto/rand, base64 encoded
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+var starterConfig = template.Must(template.New("config").Parse(`# tobab config, see https://github.com/gnur/tobab for all options
+
+# hostname where the login occurs
+hostname = "{{.Hostname}}"
+# domain the login cookie is valid for, all hosts that aren't public should be in this domain
+cookiescope = "{{.CookieScope}}"
+# used to sign tokens, changing it logs out every user
+secret = "{{.Secret}}"
+salt = "{{.Salt}}"
+# directory with write access where certificates are stored
+certdir = "./certs"
+# letsencrypt account email
+email = "{{.Email}}"
+# staging = true # use the letsencrypt staging environment while testing
+# create an oauth application at https://developers.google.com/identity/protocols/oauth2/web-server
+googlekey = "google id"
+googlesecret = "google secret"
+loglevel = "info" # or debug, warning, error
+databasepath = "./tobab.db"
+# users that can use the api
+adminglobs = [ "{{.Email}}" ]
+# required by the cli to manage tobab, pass the config with -c or set $TOBAB_RPC_SECRET
+rpcsecret = "{{.RPCSecret}}"
+`))
+
+func writeStarterConfig(w io.Writer, hostname, email string) error {
+	secret, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	salt, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	rpcSecret, err := randomString(32)
+	if err != nil {
+		return err
+	}
+
+	cookieScope := hostname
+	if i := strings.Index(hostname, "."); i > 0 && strings.Count(hostname, ".") > 1 {
+		cookieScope = hostname[i+1:]
+	}
+
+	return starterConfig.Execute(w, map[string]string{
+		"Hostname":    hostname,
+		"CookieScope": cookieScope,
+		"Secret":      secret,
+		"Salt":        salt,
+		"Email":       email,
+		"RPCSecret":   rpcSecret,
+	})
+}
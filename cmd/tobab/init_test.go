@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gnur/tobab"
+)
+
+func TestWriteStarterConfig(t *testing.T) {
+	var configs []tobab.Config
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		if err := writeStarterConfig(&buf, "login.example.com", "admin@example.com"); err != nil {
+			t.Fatalf("writeStarterConfig() error = %v", err)
+		}
+		var cfg tobab.Config
+		if _, err := toml.Decode(buf.String(), &cfg); err != nil {
+			t.Fatalf("generated config does not parse: %v\n%s", err, buf.String())
+		}
+		if ok, err := cfg.Validate(); !ok {
+			t.Fatalf("generated config is invalid: %v", err)
+		}
+		configs = append(configs, cfg)
+	}
+
+	if configs[0].CookieScope != "example.com" {
+		t.Errorf("cookiescope = %s, want example.com", configs[0].CookieScope)
+	}
+	if len(configs[0].Secret) < 32 || len(configs[0].Salt) < 16 {
+		t.Errorf("secret or salt is too short: %q %q", configs[0].Secret, configs[0].Salt)
+	}
+	if configs[0].Secret == configs[1].Secret || configs[0].Salt == configs[1].Salt {
+		t.Errorf("secret and salt should be random")
+	}
+	if len(configs[0].RPCSecret) < 32 || configs[0].RPCSecret == configs[1].RPCSecret {
+		t.Errorf("rpc secret should be long and random: %q %q", configs[0].RPCSecret, configs[1].RPCSecret)
+	}
+}
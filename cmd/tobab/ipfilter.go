@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gnur/tobab"
+	"github.com/gorilla/mux"
+)
+
+// ipFilter limits a host to clients in AllowCIDRs that are not in DenyCIDRs
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPFilter returns nil for a host that doesn't limit clients by ip
+func newIPFilter(h tobab.Host) (*ipFilter, error) {
+	if len(h.AllowCIDRs) == 0 && len(h.DenyCIDRs) == 0 {
+		return nil, nil
+	}
+	allow, err := tobab.ParseIPNets(h.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := tobab.ParseIPNets(h.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+func (f *ipFilter) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	//a denied range wins, even when it is inside an allowed range
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the ip of the client. X-Forwarded-For is only used when the connection comes from one of
+// the trusted proxies, the address before the last trusted proxy in the header is the client, everything
+// before that could be made up by the client.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trusted, ip) {
+		return ip
+	}
+	var forwarded []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(v, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardHeaders prepares the X-Forwarded headers of a request to a backend. The reverse proxy appends the
+// address of the peer to X-Forwarded-For, a value that came from a peer that isn't a trusted proxy is dropped
+// first so a client can't make up its own ip.
+func forwardHeaders(req *http.Request, trusted []*net.IPNet) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !containsIP(trusted, ip) {
+		req.Header.Del("X-Forwarded-For")
+	}
+	//clients always talk https to tobab
+	req.Header.Set("X-Forwarded-Proto", "https")
+}
+
+// trustedProxies are validated with the config, so they always parse
+func (app *Tobab) trustedProxies() []*net.IPNet {
+	nets, _ := tobab.ParseIPNets(app.config.TrustedProxies)
+	return nets
+}
+
+// ipFilterMiddleware rejects clients that the ip filter of the host doesn't allow with a 403, before they are
+// asked to log in
+func (app *Tobab) ipFilterMiddleware(filters map[string]*ipFilter) mux.MiddlewareFunc {
+	trusted := app.trustedProxies()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hostname := r.Host
+			if h, _, err := net.SplitHostPort(hostname); err == nil {
+				hostname = h
+			}
+			f, ok := filters[hostname]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ip := clientIP(r, trusted); !f.allowed(ip) {
+				app.logger.WithField("host", hostname).WithField("ip", ip.String()).Warning("request from an ip that is not allowed")
+				app.errorPage(w, r, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := tobab.ParseIPNets([]string{"10.0.0.0/8", "fd00::/8"})
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.7:4321", want: "203.0.113.7"},
+		{name: "direct ipv6", remoteAddr: "[2001:db8::1]:4321", want: "2001:db8::1"},
+		{name: "forwarded by untrusted peer is ignored", remoteAddr: "203.0.113.7:4321", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "forwarded by trusted proxy", remoteAddr: "10.0.0.2:4321", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "forwarded over ipv6", remoteAddr: "[fd00::2]:4321", forwarded: []string{"2001:db8::5"}, want: "2001:db8::5"},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.2:4321", forwarded: []string{"198.51.100.1, 10.0.0.3"}, want: "198.51.100.1"},
+		{name: "spoofed entries before the client", remoteAddr: "10.0.0.2:4321", forwarded: []string{"192.0.2.66", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "trusted proxy without header", remoteAddr: "10.0.0.2:4321", want: "10.0.0.2"},
+		{name: "garbage in the header", remoteAddr: "10.0.0.2:4321", forwarded: []string{"not-an-ip"}, want: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://app.example.com/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r, trusted); got.String() != tt.want {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{TrustedProxies: []string{"10.0.0.1"}},
+		tobab.Host{
+			Hostname:   "admin.example.com",
+			Backend:    backend.URL,
+			Type:       "http",
+			Globs:      []tobab.Glob{"*@example.com"},
+			AllowCIDRs: []string{"192.168.0.0/16", "2001:db8::/32"},
+			DenyCIDRs:  []string{"192.168.66.0/24", "2001:db8:66::/48"},
+		},
+		tobab.Host{Hostname: "open.example.com", Backend: backend.URL, Type: "http", Public: true, DenyCIDRs: []string{"203.0.113.0/24"}},
+	)
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+
+	tests := []struct {
+		name       string
+		host       string
+		remoteAddr string
+		forwarded  string
+		user       string
+		wantStatus int
+	}{
+		{name: "allowed range", host: "admin.example.com", remoteAddr: "192.168.1.10:1234", user: "alice@example.com", wantStatus: http.StatusOK},
+		{name: "allowed range ipv6", host: "admin.example.com", remoteAddr: "[2001:db8:1::10]:1234", user: "alice@example.com", wantStatus: http.StatusOK},
+		{name: "allowed range still needs a login", host: "admin.example.com", remoteAddr: "192.168.1.10:1234", wantStatus: http.StatusFound},
+		{name: "outside the allowed range", host: "admin.example.com", remoteAddr: "203.0.113.7:1234", user: "alice@example.com", wantStatus: http.StatusForbidden},
+		{name: "blocked before the login", host: "admin.example.com", remoteAddr: "203.0.113.7:1234", wantStatus: http.StatusForbidden},
+		{name: "deny wins from allow", host: "admin.example.com", remoteAddr: "192.168.66.10:1234", user: "alice@example.com", wantStatus: http.StatusForbidden},
+		{name: "deny wins from allow ipv6", host: "admin.example.com", remoteAddr: "[2001:db8:66::10]:1234", user: "alice@example.com", wantStatus: http.StatusForbidden},
+		{name: "forwarded by a trusted proxy", host: "admin.example.com", remoteAddr: "10.0.0.1:1234", forwarded: "192.168.1.10", user: "alice@example.com", wantStatus: http.StatusOK},
+		{name: "spoofed by an untrusted client", host: "admin.example.com", remoteAddr: "203.0.113.7:1234", forwarded: "192.168.1.10", user: "alice@example.com", wantStatus: http.StatusForbidden},
+		{name: "only denied ranges", host: "open.example.com", remoteAddr: "198.51.100.1:1234", wantStatus: http.StatusOK},
+		{name: "denied on a public host", host: "open.example.com", remoteAddr: "203.0.113.7:1234", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRequest(t, app, tt.host, tt.user)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			app.router.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestProxy_ForwardedHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Forwarded-For", strings.Join(r.Header.Values("X-Forwarded-For"), ", "))
+		w.Header().Set("X-Got-Forwarded-Proto", r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backend.Close()
+	proxy, err := newTestApp(tobab.Config{TrustedProxies: []string{"10.0.0.0/8"}}).generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:1234", want: "203.0.113.7"},
+		{name: "spoofed by a client", remoteAddr: "203.0.113.7:1234", forwarded: "192.168.1.10", want: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1234", forwarded: "198.51.100.1", want: "198.51.100.1, 10.0.0.1"},
+		{name: "ipv6 client", remoteAddr: "[2001:db8::1]:1234", forwarded: "192.168.1.10", want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			r.Header.Set("X-Forwarded-Proto", "http")
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			if got := w.Header().Get("X-Got-Forwarded-For"); got != tt.want {
+				t.Errorf("backend got X-Forwarded-For %s, want %s", got, tt.want)
+			}
+			if got := w.Header().Get("X-Got-Forwarded-Proto"); got != "https" {
+				t.Errorf("backend got X-Forwarded-Proto %s, want https", got)
+			}
+		})
+	}
+}
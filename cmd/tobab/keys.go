@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// keyRing holds the keys that were added by rotating the key. New tokens are signed with the active key, or the
+// key derived from the secret until the key is rotated for the first time, and tokens of retired keys are
+// accepted until the last token they signed has expired. A previous secret is one of the retired keys.
+type keyRing struct {
+	mu      sync.RWMutex
+	active  []byte
+	retired []retiredKey
+}
+
+type retiredKey struct {
+	key        []byte
+	validUntil time.Time
+}
+
+// signingKey returns the key new tokens are signed with
+func (app *Tobab) signingKey() []byte {
+	if app.keys == nil {
+		return app.key
+	}
+	app.keys.mu.RLock()
+	defer app.keys.mu.RUnlock()
+	if app.keys.active == nil {
+		return app.key
+	}
+	return app.keys.active
+}
+
+// verificationKeys returns the keys a token can be signed with, the signing key first
+func (app *Tobab) verificationKeys(now time.Time) [][]byte {
+	keys := [][]byte{app.signingKey()}
+	if app.keys != nil {
+		app.keys.mu.RLock()
+		//newest first, most tokens are signed with the key that was retired last
+		for i := len(app.keys.retired) - 1; i >= 0; i-- {
+			if k := app.keys.retired[i]; now.Before(k.validUntil) {
+				keys = append(keys, k.key)
+			}
+		}
+		app.keys.mu.RUnlock()
+	}
+	return keys
+}
+
+// loadSigningKeys loads the keys from the database and deletes the retired keys that can't have valid tokens
+// anymore
+func (app *Tobab) loadSigningKeys() error {
+	stored, err := app.db.GetSigningKeys()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var active []byte
+	var retired []retiredKey
+	for _, k := range stored {
+		key, err := openKey(app.key, k.Key)
+		if err != nil {
+			app.logger.WithError(err).WithField("key", k.ID).Error("unable to decrypt signing key, it was added with another secret")
+			continue
+		}
+		if k.RetiredAt.IsZero() {
+			active = key
+			continue
+		}
+		if !now.Before(k.ValidUntil) {
+			if err := app.db.DeleteSigningKey(k.ID); err != nil {
+				return err
+			}
+			app.logger.WithField("key", k.ID).WithField("retiredAt", k.RetiredAt).Info("deleted signing key, every token it signed has expired")
+			continue
+		}
+		retired = append(retired, retiredKey{key: key, validUntil: k.ValidUntil})
+	}
+	if app.keys == nil {
+		app.keys = &keyRing{}
+	}
+	app.keys.mu.Lock()
+	app.keys.active = active
+	app.keys.retired = retired
+	app.keys.mu.Unlock()
+	return nil
+}
+
+// retirePreviousSecret moves the keys in the database over to the current secret after the secret was changed.
+// Keys that were encrypted with previousKey are encrypted again with the key of the current secret, and when
+// previousKey itself was signing tokens it is added as a retired key that is accepted until validUntil. It runs
+// before loadSigningKeys and does nothing when it already ran for previousKey.
+func (app *Tobab) retirePreviousSecret(previousKey []byte, rotatedAt, validUntil time.Time) error {
+	app.rotateMu.Lock()
+	defer app.rotateMu.Unlock()
+
+	stored, err := app.db.GetSigningKeys()
+	if err != nil {
+		return err
+	}
+	hasActive, hasPrevious := false, false
+	for _, k := range stored {
+		key, err := openKey(app.key, k.Key)
+		if err != nil {
+			if key, err = openKey(previousKey, k.Key); err != nil {
+				//loadSigningKeys logs it
+				continue
+			}
+			if k.Key, err = sealKey(app.key, key); err != nil {
+				return err
+			}
+			if err := app.db.SaveSigningKey(k); err != nil {
+				return err
+			}
+		}
+		hasActive = hasActive || k.RetiredAt.IsZero()
+		hasPrevious = hasPrevious || bytes.Equal(key, previousKey)
+	}
+	//with an active key in the database the previous secret was only signing tokens before that key was added,
+	//it is in the database already or none of its tokens are valid anymore
+	if hasActive || hasPrevious || !time.Now().Before(validUntil) {
+		return nil
+	}
+	return app.saveSigningKey(tobab.SigningKey{CreatedAt: rotatedAt, RetiredAt: rotatedAt, ValidUntil: validUntil}, previousKey)
+}
+
+// saveSigningKey stores key in k encrypted with the key of the secret, k gets a random id when it has none
+func (app *Tobab) saveSigningKey(k tobab.SigningKey, key []byte) error {
+	var err error
+	if k.Key, err = sealKey(app.key, key); err != nil {
+		return err
+	}
+	if k.ID == "" {
+		if k.ID, err = randomString(16); err != nil {
+			return err
+		}
+	}
+	return app.db.SaveSigningKey(k)
+}
+
+// rotateSigningKey adds a new active key and retires the current one, it returns the id of the new key and
+// until when tokens of the retired key are accepted
+func (app *Tobab) rotateSigningKey() (string, time.Time, error) {
+	app.rotateMu.Lock()
+	defer app.rotateMu.Unlock()
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", time.Time{}, err
+	}
+	id, err := randomString(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	validUntil := now.Add(app.maxAge)
+	stored, err := app.db.GetSigningKeys()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	retired := false
+	for _, k := range stored {
+		if k.RetiredAt.IsZero() {
+			k.RetiredAt = now
+			k.ValidUntil = validUntil
+			if err := app.db.SaveSigningKey(k); err != nil {
+				return "", time.Time{}, err
+			}
+			retired = true
+		}
+	}
+	if !retired {
+		//the key derived from the secret was signing tokens, it is kept like any other retired key
+		if err := app.saveSigningKey(tobab.SigningKey{CreatedAt: now, RetiredAt: now, ValidUntil: validUntil}, app.key); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	if err := app.saveSigningKey(tobab.SigningKey{ID: id, CreatedAt: now}, key); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := app.loadSigningKeys(); err != nil {
+		return "", time.Time{}, err
+	}
+	app.logger.WithField("key", id).Info("rotated signing key")
+	return id, validUntil, nil
+}
+
+// sealKey encrypts key with the key derived from the secret, the nonce is prepended
+func sealKey(secretKey, key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(key)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func openKey(secretKey, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed key is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
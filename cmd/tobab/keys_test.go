@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+)
+
+func TestRotateKey(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	secretToken, err := app.newToken("alice@example.com", "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out clirpc.RotateKeyOut
+	if err := app.RotateKey(&clirpc.RotateKeyIn{Auth: testAuth}, &out); err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+	if out.KeyID == "" || out.RetiredValidUntil.Before(time.Now().Add(app.maxAge-time.Minute)) {
+		t.Errorf("RotateKey() = %+v, want a key id and the previous key valid for maxAge", out)
+	}
+	if bytes.Equal(app.signingKey(), app.key) {
+		t.Fatal("tokens are still signed with the key of the secret after rotating")
+	}
+	stored := app.db.(memDB).signingKeys[out.KeyID]
+	if len(stored.Key) == 0 || bytes.Contains(stored.Key, app.signingKey()) {
+		t.Errorf("stored key = %x, want the key encrypted", stored.Key)
+	}
+	var secretKey tobab.SigningKey
+	for id, k := range app.db.(memDB).signingKeys {
+		if id != out.KeyID {
+			secretKey = k
+		}
+	}
+	if key, err := openKey(app.key, secretKey.Key); err != nil || !bytes.Equal(key, app.key) {
+		t.Errorf("the key of the secret was not stored as a retired key: %v", err)
+	}
+	if !secretKey.ValidUntil.Equal(out.RetiredValidUntil) {
+		t.Errorf("retired key is valid until %s, want %s", secretKey.ValidUntil, out.RetiredValidUntil)
+	}
+	rotatedToken, err := app.newToken("bob@example.com", "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.RotateKey(&clirpc.RotateKeyIn{Auth: testAuth}, &out); err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+	if n := len(app.db.(memDB).signingKeys); n != 3 {
+		t.Errorf("database has %d signing keys, want the secret key and 2 rotated keys", n)
+	}
+
+	//a restart loads the keys from the database
+	restarted := newTestApp(tobab.Config{})
+	restarted.db = app.db
+	if err := restarted.loadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restarted.signingKey(), app.signingKey()) {
+		t.Error("a restart signs tokens with another key than the active key")
+	}
+	for name, token := range map[string]string{"secret": secretToken, "rotated": rotatedToken} {
+		if _, err := restarted.decryptToken(token); err != nil {
+			t.Errorf("token of the %s key is rejected after rotating: %v", name, err)
+		}
+	}
+
+	//once maxAge has passed since the first rotation no token of the secret key can be valid
+	secretKey.ValidUntil = time.Now()
+	_ = app.db.SaveSigningKey(secretKey)
+	if err := app.loadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := app.db.(memDB).signingKeys[secretKey.ID]; ok {
+		t.Error("the secret key was not deleted after maxAge")
+	}
+	if _, err := app.decryptToken(secretToken); err != ErrInvalidToken {
+		t.Errorf("token of a key that aged out = %v, want %v", err, ErrInvalidToken)
+	}
+	if _, err := app.decryptToken(rotatedToken); err != nil {
+		t.Errorf("token of the retired key is rejected: %v", err)
+	}
+}
+
+func TestLoadSigningKeys_OtherSecret(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	secretToken, err := app.newToken("alice@example.com", "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := app.rotateSigningKey(); err != nil {
+		t.Fatal(err)
+	}
+	rotatedToken, err := app.newToken("bob@example.com", "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestApp(tobab.Config{})
+	other.key = []byte("fedcba9876543210fedcba9876543210")
+	other.db = app.db
+	if err := other.loadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(other.signingKey(), other.key) {
+		t.Error("a key added with another secret should be skipped")
+	}
+
+	//after changing the secret the keys are encrypted with the new secret, the old one isn't needed anymore
+	if err := other.retirePreviousSecret(app.key, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.loadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(other.signingKey(), app.signingKey()) {
+		t.Error("the active key was not moved to the new secret")
+	}
+	stored := other.db.(memDB).signingKeys
+	if len(stored) != 2 {
+		t.Errorf("database has %d signing keys, the previous secret was retired already and shouldn't be added", len(stored))
+	}
+	for id, k := range stored {
+		if _, err := openKey(app.key, k.Key); err == nil {
+			t.Errorf("key %s is still encrypted with the previous secret", id)
+		}
+	}
+	for name, token := range map[string]string{"secret": secretToken, "rotated": rotatedToken} {
+		if _, err := other.decryptToken(token); err != nil {
+			t.Errorf("token of the %s key is rejected after changing the secret: %v", name, err)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/rpc"
+	"os"
+	"text/tabwriter"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -13,8 +16,47 @@ import (
 )
 
 type Globals struct {
-	Debug  bool
-	Config string `help:"config location" type:"existingfile" short:"c"`
+	Debug     bool
+	Config    string `help:"config location" type:"existingfile" short:"c"`
+	RPC       string `help:"address of the tobab rpc, like unix:///var/run/tobab.sock, defaults to the RPCListen of the config"`
+	RPCSecret string `help:"secret for the tobab rpc, defaults to the RPCSecret of the config" env:"TOBAB_RPC_SECRET"`
+}
+
+// rpcClient provides the rpc secret with every call
+type rpcClient struct {
+	*rpc.Client
+	secret string
+}
+
+func (c *rpcClient) Call(method string, in interface{ SetSecret(string) }, out interface{}) error {
+	in.SetSecret(c.secret)
+	return c.Client.Call(method, in, out)
+}
+
+// dialRPC connects to the rpc of a running tobab, with the address and secret from the flags or the config
+func dialRPC(ctx *Globals) (*rpcClient, error) {
+	addr, secret := ctx.RPC, ctx.RPCSecret
+	if (addr == "" || secret == "") && ctx.Config != "" {
+		cfg, err := tobab.LoadConf(ctx.Config)
+		if err != nil {
+			return nil, err
+		}
+		if addr == "" {
+			addr = cfg.RPCListen
+		}
+		if secret == "" {
+			secret = cfg.RPCSecret
+		}
+	}
+	network, address, err := tobab.ParseRPCListen(addr)
+	if err != nil {
+		return nil, err
+	}
+	client, err := rpc.DialHTTP(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcClient{Client: client, secret: secret}, nil
 }
 
 type RunCmd struct {
@@ -25,22 +67,234 @@ func (r *RunCmd) Run(ctx *Globals) error {
 	return errors.New("Server exited")
 }
 
-type ValidateCmd struct {
+type HostCmd struct {
+	List        HostListCmd        `cmd:"" help:"list all hosts"`
+	Show        ShowHostCmd        `cmd:"" help:"show the effective configuration of a host as json"`
+	Add         AddHostCmd         `cmd:"" help:"add a new proxy host"`
+	Delete      DeleteHostCmd      `cmd:"" help:"delete a host"`
+	Disable     DisableHostCmd     `cmd:"" help:"temporarily stop proxying a host"`
+	Enable      EnableHostCmd      `cmd:"" help:"resume proxying a disabled host"`
+	Maintenance MaintenanceHostCmd `cmd:"" help:"serve a maintenance page instead of proxying a host, for example during a deploy"`
+	Capture     CaptureCmd         `cmd:"" help:"capture full request/response pairs of a host for debugging"`
+	Renew       RenewCertCmd       `cmd:"" help:"obtain a new certificate for a host right away"`
+	Health      HostHealthCmd      `cmd:"" help:"show the health of the backends of a host as json"`
+	Purge       PurgeCacheCmd      `cmd:"" help:"drop the cached responses of a host"`
+}
+
+type ShowHostCmd struct {
+	Hostname string `arg:"" help:"hostname to show"`
 }
 
-func (r *ValidateCmd) Run(ctx *Globals) error {
-	_, err := tobab.LoadConf(ctx.Config)
-	if err == nil {
-		fmt.Println("Config ok")
+func (r *ShowHostCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
 	}
+	in := &clirpc.ShowHostIn{
+		Hostname: r.Hostname,
+	}
+	var out clirpc.ShowHostOut
+	err = client.Call("Tobab.ShowHost", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
 
-	return err
+type HostHealthCmd struct {
+	Hostname string `arg:"" help:"hostname to show the backend health of"`
 }
 
-type HostCmd struct {
-	List   HostListCmd   `cmd:"" help:"list all hosts"`
-	Add    AddHostCmd    `cmd:"" help:"add a new proxy host"`
-	Delete DeleteHostCmd `cmd:"" help:"delete a host"`
+func (r *HostHealthCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.GetHealthIn{
+		Hostname: r.Hostname,
+	}
+	var out clirpc.GetHealthOut
+	err = client.Call("Tobab.GetHealth", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+type RenewCertCmd struct {
+	Hostname string `help:"hostname to renew the certificate of" kong:"required" short:"h"`
+}
+
+func (r *RenewCertCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.RenewCertIn{
+		Hostname: r.Hostname,
+	}
+	var out clirpc.RenewCertOut
+	err = client.Call("Tobab.RenewCert", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	fmt.Println("certificate renewed, it expires at", out.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+type PurgeCacheCmd struct {
+	Hostname string `help:"hostname to drop the cached responses of" kong:"required" short:"h"`
+}
+
+func (r *PurgeCacheCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.PurgeCacheIn{
+		Hostname: r.Hostname,
+	}
+	var out clirpc.PurgeCacheOut
+	err = client.Call("Tobab.PurgeCache", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	fmt.Printf("purged %d cached responses\n", out.Purged)
+	return nil
+}
+
+type CaptureCmd struct {
+	Arm  ArmCaptureCmd  `cmd:"" help:"capture the next requests of a host"`
+	List ListCaptureCmd `cmd:"" help:"print the captured requests of a host as json"`
+}
+
+type ArmCaptureCmd struct {
+	Hostname string        `help:"hostname to capture requests of" kong:"required" short:"h"`
+	Count    int           `help:"number of requests to capture" default:"10" short:"n"`
+	Timeout  time.Duration `help:"stop capturing after this time" default:"10m"`
+}
+
+func (r *ArmCaptureCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.ArmCaptureIn{
+		Hostname: r.Hostname,
+		Count:    r.Count,
+		Timeout:  r.Timeout,
+	}
+	var out clirpc.Empty
+	err = client.Call("Tobab.ArmCapture", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	fmt.Println("capture armed")
+	return nil
+}
+
+type ListCaptureCmd struct {
+	Hostname string `help:"hostname to show captured requests of" kong:"required" short:"h"`
+}
+
+func (r *ListCaptureCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.GetCapturesIn{
+		Hostname: r.Hostname,
+	}
+	var out clirpc.GetCapturesOut
+	err = client.Call("Tobab.GetCaptures", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	b, err := json.MarshalIndent(out.Captures, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+type DisableHostCmd struct {
+	Hostname string `help:"hostname to disable" kong:"required" short:"h"`
+}
+
+func (r *DisableHostCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.DisableHostIn{
+		Hostname: r.Hostname,
+	}
+	var out clirpc.Empty
+	err = client.Call("Tobab.DisableHost", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	fmt.Println("host disabled")
+	return nil
+}
+
+type EnableHostCmd struct {
+	Hostname string `help:"hostname to enable" kong:"required" short:"h"`
+}
+
+func (r *EnableHostCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.EnableHostIn{
+		Hostname: r.Hostname,
+	}
+	var out clirpc.Empty
+	err = client.Call("Tobab.EnableHost", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	fmt.Println("host enabled")
+	return nil
+}
+
+type MaintenanceHostCmd struct {
+	Hostname string `help:"hostname to serve the maintenance page for" kong:"required" short:"h"`
+	Off      bool   `help:"end the maintenance and proxy the host again"`
+}
+
+func (r *MaintenanceHostCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.SetMaintenanceIn{
+		Hostname:    r.Hostname,
+		Maintenance: !r.Off,
+	}
+	var out clirpc.Empty
+	err = client.Call("Tobab.SetMaintenance", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	if r.Off {
+		fmt.Println("maintenance ended")
+	} else {
+		fmt.Println("host in maintenance")
+	}
+	return nil
 }
 
 type DeleteHostCmd struct {
@@ -48,7 +302,7 @@ type DeleteHostCmd struct {
 }
 
 func (r *DeleteHostCmd) Run(ctx *Globals) error {
-	client, err := rpc.DialHTTP("tcp", "localhost:1234")
+	client, err := dialRPC(ctx)
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
@@ -66,26 +320,176 @@ func (r *DeleteHostCmd) Run(ctx *Globals) error {
 
 type AddHostCmd struct {
 	Hostname string       `help:"hostname to listen on" kong:"required"`
-	Backend  string       `help:"Backend to connect to" kong:"required"`
+	Backend  []string     `help:"Backend to connect to, repeat it to spread requests over multiple backends, or the directory to serve for a static host" kong:"required"`
+	Strategy string       `help:"how requests are spread over multiple backends: round-robin (default), weighted, least-connections, consistent-hash or variant"`
 	Public   bool         `help:"allows all connections"`
-	Type     string       `help:"type of proxy" kong:"required"`
+	Type     string       `help:"type of proxy, http, static or tcp" kong:"required"`
 	Globs    []tobab.Glob `help:"if host is not public, globs of email addresses to allow access"`
+	RBACMode string       `help:"enforce (default) denies access, audit only logs requests that would be denied"`
+
+	PublicPaths []string `help:"paths that are reachable without authentication, like /health or /api/*/public"`
+
+	CleanPath          bool `help:"collapse double slashes and resolve . and .. in the path before proxying"`
+	RejectEncodedSlash bool `help:"reject requests with encoded slashes in the path"`
+	CSPNonce           bool `help:"inject a Content-Security-Policy nonce into html responses"`
+	BufferResponse     bool `help:"read the complete backend response before sending it to the client"`
+	Decompress         bool `help:"decompress gzipped backend responses for clients that don't accept gzip"`
+
+	InjectDelay string `help:"delay every request by a fixed (200ms) or random (100ms-500ms) time, only for testing and requires devmode"`
+
+	CookiePrefix string   `help:"prefix added to the names of cookies set by the backend"`
+	CookiePath   string   `help:"path set on all cookies set by the backend"`
+	DropCookies  []string `help:"names of cookies set by the backend that are never forwarded"`
+
+	HeaderCasing []string `help:"request header names that are sent to the backend with exactly this casing, like X-ApiKey"`
+
+	SetRequestHeader     map[string]string `help:"header set on requests to the backend, like X-Api-Key=secret, ${user} is replaced with the email of the user" mapsep:"none"`
+	SetResponseHeader    map[string]string `help:"header set on responses to the client, like Cache-Control=no-store" mapsep:"none"`
+	RemoveResponseHeader []string          `help:"header removed from responses of the backend, like Server"`
+
+	CORSAllowedOrigin    []string `name:"cors-allowed-origin" help:"origin that can call this host from a browser, like https://app.example.com, or * for any origin"`
+	CORSAllowedMethod    []string `name:"cors-allowed-method" help:"method a cross origin request can use, defaults to GET, HEAD and POST"`
+	CORSAllowedHeader    []string `name:"cors-allowed-header" help:"request header a cross origin request can send, like Authorization"`
+	CORSAllowCredentials bool     `name:"cors-allow-credentials" help:"let cross origin requests send the cookies of the user, the origins have to be listed"`
+
+	MaxConcurrent        int `help:"maximum number of in flight requests for this host"`
+	MaxConcurrentPerUser int `help:"maximum number of in flight requests for a single user of this host"`
+
+	RateLimitRPS   float64 `help:"requests per second for every user, or client ip without a login"`
+	RateLimitBurst int     `help:"requests a user can do at once, defaults to rate-limit-rps"`
+
+	ClientCAFile string `help:"pem file with the CAs that client certificates must be signed by"`
+	ClientAuth   string `help:"require (default) or verify-if-given"`
+
+	ClientCertIdentity string `help:"log clients with a verified certificate in as its cn or email, without a login"`
+
+	BasicAuth bool `help:"accept basic auth credentials created with tobab credential create from clients without a session"`
+
+	DisableSessionTickets bool `help:"disable TLS session resumption for this host"`
+
+	BackendCAFile       string `help:"pem file with the CAs to verify an https backend with, defaults to the system roots"`
+	BackendCertGrace    string `help:"keep accepting an expired backend certificate for this long after it expired"`
+	BackendCertWarnDays int    `help:"warn when the backend certificate expires within this many days, defaults to 14"`
+
+	Listen     string   `help:"address a tcp host listens on, like :5432"`
+	AllowedIPs []string `help:"ips or CIDR ranges that may connect to a tcp host"`
+
+	AllowCIDRs []string `help:"ips or CIDR ranges that may use an http host, checked before the login"`
+	DenyCIDRs  []string `help:"ips or CIDR ranges that may not use an http host, wins from allow-cidrs"`
+
+	SPAFallback      bool `help:"serve index.html of a static host for paths that don't exist, for client side routing"`
+	DirectoryListing bool `help:"list the files of directories without an index.html on a static host"`
+
+	RetryAttempts int `help:"how often a GET, HEAD or OPTIONS request is retried on another backend when connecting to its backend fails"`
+
+	TokenAge string `help:"how long tokens of users that log in to this host are valid, replaces the default token age"`
+
+	MaxBodyBytes int64 `help:"reject requests with a larger body with a 413, 0 allows any size"`
+
+	CacheSizeMB int `name:"cache-size-mb" help:"cache responses the backend marks cacheable, up to this many megabytes in memory"`
+
+	HealthCheckPath     string `help:"path on the backend that is polled and should return a 2xx, like /health"`
+	HealthCheckInterval string `help:"how often the health check runs, defaults to 10s"`
+
+	DialTimeout     string `help:"timeout for connecting to the backend, defaults to the global default"`
+	ResponseTimeout string `help:"timeout for waiting on the response headers of the backend"`
+	IdleTimeout     string `help:"how long idle backend connections are kept open"`
+	RequestTimeout  string `help:"timeout for the complete request"`
 }
 
 func (r *AddHostCmd) Run(ctx *Globals) error {
-	client, err := rpc.DialHTTP("tcp", "localhost:1234")
+	client, err := dialRPC(ctx)
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
 	in := &clirpc.AddHostIn{
 		Host: tobab.Host{
 			Hostname: r.Hostname,
-			Backend:  r.Backend,
+			Strategy: r.Strategy,
 			Public:   r.Public,
 			Type:     r.Type,
 			Globs:    r.Globs,
+			RBACMode: r.RBACMode,
+
+			PublicPaths: r.PublicPaths,
+
+			CleanPath:          r.CleanPath,
+			RejectEncodedSlash: r.RejectEncodedSlash,
+			CSPNonce:           r.CSPNonce,
+			BufferResponse:     r.BufferResponse,
+			Decompress:         r.Decompress,
+
+			InjectDelay: r.InjectDelay,
+
+			CookiePrefix: r.CookiePrefix,
+			CookiePath:   r.CookiePath,
+			DropCookies:  r.DropCookies,
+
+			HeaderCasing: r.HeaderCasing,
+
+			SetRequestHeaders:     r.SetRequestHeader,
+			SetResponseHeaders:    r.SetResponseHeader,
+			RemoveResponseHeaders: r.RemoveResponseHeader,
+
+			CORSAllowedOrigins:   r.CORSAllowedOrigin,
+			CORSAllowedMethods:   r.CORSAllowedMethod,
+			CORSAllowedHeaders:   r.CORSAllowedHeader,
+			CORSAllowCredentials: r.CORSAllowCredentials,
+
+			MaxConcurrent:        r.MaxConcurrent,
+			MaxConcurrentPerUser: r.MaxConcurrentPerUser,
+
+			RateLimitRPS:   r.RateLimitRPS,
+			RateLimitBurst: r.RateLimitBurst,
+
+			ClientCAFile: r.ClientCAFile,
+			ClientAuth:   r.ClientAuth,
+
+			ClientCertIdentity: r.ClientCertIdentity,
+
+			BasicAuth: r.BasicAuth,
+
+			DisableSessionTickets: r.DisableSessionTickets,
+
+			BackendCAFile:       r.BackendCAFile,
+			BackendCertGrace:    r.BackendCertGrace,
+			BackendCertWarnDays: r.BackendCertWarnDays,
+
+			Listen:     r.Listen,
+			AllowedIPs: r.AllowedIPs,
+
+			AllowCIDRs: r.AllowCIDRs,
+			DenyCIDRs:  r.DenyCIDRs,
+
+			SPAFallback:      r.SPAFallback,
+			DirectoryListing: r.DirectoryListing,
+
+			RetryAttempts: r.RetryAttempts,
+
+			TokenAge: r.TokenAge,
+
+			MaxBodyBytes: r.MaxBodyBytes,
+
+			CacheSizeMB: r.CacheSizeMB,
+
+			HealthCheckPath:     r.HealthCheckPath,
+			HealthCheckInterval: r.HealthCheckInterval,
+
+			Timeouts: tobab.Timeouts{
+				DialTimeout:     r.DialTimeout,
+				ResponseTimeout: r.ResponseTimeout,
+				IdleTimeout:     r.IdleTimeout,
+				RequestTimeout:  r.RequestTimeout,
+			},
 		},
 	}
+	if len(r.Backend) == 1 {
+		in.Host.Backend = r.Backend[0]
+	} else {
+		for _, b := range r.Backend {
+			in.Host.Backends = append(in.Host.Backends, tobab.Backend{URL: b})
+		}
+	}
 	var out clirpc.Empty
 	err = client.Call("Tobab.AddHost", in, &out)
 	if err != nil {
@@ -99,11 +503,11 @@ type HostListCmd struct {
 }
 
 func (r *HostListCmd) Run(ctx *Globals) error {
-	client, err := rpc.DialHTTP("tcp", "localhost:1234")
+	client, err := dialRPC(ctx)
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
-	in := &clirpc.Empty{}
+	in := &clirpc.GetHostsIn{}
 	var out clirpc.GetHostsOut
 	err = client.Call("Tobab.GetHosts", in, &out)
 	if err != nil {
@@ -126,6 +530,8 @@ func (r *VersionCmd) Run(ctx *Globals) error {
 type TokenCmd struct {
 	Create   CreateTokenCmd   `cmd:"" help:"generate a new token"`
 	Validate ValidateTokenCmd `cmd:"" help:"Get fields from a token"`
+	Revoke   RevokeTokenCmd   `cmd:"" help:"revoke a token, or all tokens of a user"`
+	List     ListTokensCmd    `cmd:"" help:"list the active sessions, tokens issued by logging in that are not expired or revoked"`
 }
 
 type CreateTokenCmd struct {
@@ -138,7 +544,7 @@ func (r *CreateTokenCmd) Run(ctx *Globals) error {
 	if err != nil {
 		return fmt.Errorf("Invalid duration provided: %w", err)
 	}
-	client, err := rpc.DialHTTP("tcp", "localhost:1234")
+	client, err := dialRPC(ctx)
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
@@ -161,7 +567,7 @@ type ValidateTokenCmd struct {
 }
 
 func (r *ValidateTokenCmd) Run(ctx *Globals) error {
-	client, err := rpc.DialHTTP("tcp", "localhost:1234")
+	client, err := dialRPC(ctx)
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
@@ -175,11 +581,129 @@ func (r *ValidateTokenCmd) Run(ctx *Globals) error {
 	}
 	t := out.Token
 	fmt.Printf(`
+Token ID:      %s
 Issuer:	       %s
 Subject:       %s
 Issued at:     %s
 Expires at:    %s
-`, t.Issuer, t.Subject, t.IssuedAt, t.Expiration)
+`, t.Jti, t.Issuer, t.Subject, t.IssuedAt, t.Expiration)
+	return nil
+}
+
+type RevokeTokenCmd struct {
+	ID    string `help:"id of the token to revoke, as shown by token validate" xor:"target"`
+	Email string `help:"revoke all tokens issued to this email address so far" short:"e" xor:"target"`
+}
+
+func (r *RevokeTokenCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.RevokeTokenIn{
+		TokenID: r.ID,
+		Email:   r.Email,
+	}
+	var out clirpc.Empty
+	err = client.Call("Tobab.RevokeToken", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	fmt.Println("token revoked")
+	return nil
+}
+
+type ListTokensCmd struct {
+}
+
+func (r *ListTokensCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	var out clirpc.ListTokensOut
+	err = client.Call("Tobab.ListTokens", &clirpc.ListTokensIn{}, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tHOST\tIP\tISSUED AT\tEXPIRES AT")
+	for _, t := range out.Tokens {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Email, t.Host, t.IP, t.IssuedAt.Format(time.RFC3339), t.ExpiresAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+type KeyCmd struct {
+	Rotate RotateKeyCmd `cmd:"" help:"sign new tokens with a new key, tokens signed with the current key stay valid until they expire"`
+}
+
+type RotateKeyCmd struct {
+}
+
+func (r *RotateKeyCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	var out clirpc.RotateKeyOut
+	err = client.Call("Tobab.RotateKey", &clirpc.RotateKeyIn{}, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	fmt.Printf("new tokens are signed with key %s, tokens of the previous key are accepted until %s\n", out.KeyID, out.RetiredValidUntil.Format(time.RFC3339))
+	return nil
+}
+
+type CredentialCmd struct {
+	Create CreateCredentialCmd `cmd:"" help:"create a basic auth credential for a service, the password is shown once"`
+	Delete DeleteCredentialCmd `cmd:"" help:"delete a basic auth credential"`
+}
+
+type CreateCredentialCmd struct {
+	Hostname string `help:"host the credential is for, it needs basic auth enabled" kong:"required"`
+	Username string `help:"username of the service, it is the user that Globs and groups are matched against" kong:"required" short:"u"`
+}
+
+func (r *CreateCredentialCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.CreateCredentialIn{
+		Hostname: r.Hostname,
+		Username: r.Username,
+	}
+	var out clirpc.CreateCredentialOut
+	err = client.Call("Tobab.CreateCredential", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	fmt.Println("credential created, the password can't be shown again")
+	fmt.Println(out.Password)
+	return nil
+}
+
+type DeleteCredentialCmd struct {
+	Hostname string `help:"host the credential is for" kong:"required"`
+	Username string `help:"username of the service" kong:"required" short:"u"`
+}
+
+func (r *DeleteCredentialCmd) Run(ctx *Globals) error {
+	client, err := dialRPC(ctx)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	in := &clirpc.DeleteCredentialIn{
+		Hostname: r.Hostname,
+		Username: r.Username,
+	}
+	var out clirpc.Empty
+	err = client.Call("Tobab.DeleteCredential", in, &out)
+	if err != nil {
+		log.Fatal("tobab error:", err)
+	}
+	fmt.Println("credential deleted")
 	return nil
 }
 
@@ -187,14 +711,19 @@ var cli struct {
 	Globals
 
 	Run      RunCmd      `cmd:"" help:"start tobab server"`
-	Validate ValidateCmd `cmd:"" help:"validate tobab config"`
+	Init     InitCmd     `cmd:"" help:"write a starter config with a random secret and salt"`
+	Validate ValidateCmd `cmd:"" help:"validate tobab config and the stored hosts without starting the server"`
 	Host     HostCmd     `cmd:"" help:"various host related commands"`
 	Version  VersionCmd  `cmd:"" help:"print tobab version"`
 	Token    TokenCmd    `cmd:"" help:"various token related commands"`
+
+	Credential CredentialCmd `cmd:"" help:"basic auth credentials for services that can't log in with a browser"`
+	Key        KeyCmd        `cmd:"" help:"rotate the key tokens are signed with"`
 }
 
 func main() {
-	ctx := kong.Parse(&cli, kong.UsageOnError())
+	//help texts are interpolated, this keeps the placeholder of header values readable
+	ctx := kong.Parse(&cli, kong.UsageOnError(), kong.Vars{"user": userPlaceholder})
 	err := ctx.Run(&Globals{
 		Debug:  cli.Debug,
 		Config: cli.Config,
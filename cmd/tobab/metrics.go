@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type appMetrics struct {
+	registry        *prometheus.Registry
+	requestDuration *prometheus.HistogramVec
+	proxyErrors     *prometheus.CounterVec
+	clientCanceled  *prometheus.CounterVec
+	authFailures    *prometheus.CounterVec
+	backendTLS      *prometheus.CounterVec
+}
+
+func newMetrics() *appMetrics {
+	m := &appMetrics{
+		registry: prometheus.NewRegistry(),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "tobab_request_duration_seconds",
+			Help: "Time spent handling a request.",
+		}, []string{"host", "code"}),
+		proxyErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tobab_proxy_errors_total",
+			Help: "Requests that failed because the backend could not be reached or failed.",
+		}, []string{"host"}),
+		clientCanceled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tobab_client_canceled_requests_total",
+			Help: "Requests of which the client disconnected before the response was complete.",
+		}, []string{"host"}),
+		backendTLS: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tobab_backend_tls_errors_total",
+			Help: "Failed TLS handshakes with a backend, by reason. Expired certificates accepted during the grace period have reason expired_allowed.",
+		}, []string{"host", "reason"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tobab_auth_failures_total",
+			Help: "Requests with an invalid token or a user that was denied access, requests without a token are not counted.",
+		}, []string{"host", "reason"}),
+	}
+	m.registry.MustRegister(m.requestDuration, m.proxyErrors, m.clientCanceled, m.backendTLS, m.authFailures)
+	return m
+}
+
+// handler serves the metrics, the OpenMetrics format with the exemplars is used when the client accepts it
+func (m *appMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+func (app *Tobab) startMetricsServer() {
+	if app.config.MetricsListen == "" {
+		return
+	}
+	app.logger.WithField("address", app.config.MetricsListen).Info("starting metrics listener")
+	err := http.ListenAndServe(app.config.MetricsListen, app.metrics.handler())
+	if err != nil {
+		app.logger.WithError(err).Error("Failed to start metrics listener")
+	}
+}
+
+// metricsMiddleware records the duration of every request, the trace id of the request is attached as an exemplar
+func (app *Tobab) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		observer, err := app.metrics.requestDuration.GetMetricWithLabelValues(metricsHost(r), strconv.Itoa(sw.status))
+		if err != nil {
+			app.logger.WithError(err).Error("unable to record request duration")
+			return
+		}
+		took := time.Since(start).Seconds()
+		if traceID := traceIDFromRequest(r); traceID != "" {
+			observer.(prometheus.ExemplarObserver).ObserveWithExemplar(took, prometheus.Labels{"trace_id": traceID})
+			return
+		}
+		observer.Observe(took)
+	})
+}
+
+// metricsHost is the configured hostname of the route that matched r. mux matches a host with any port, so the
+// Host header itself would let every client add series.
+func metricsHost(r *http.Request) string {
+	host := r.Host
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetHostTemplate(); err == nil {
+			host = tmpl
+		}
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// traceIDFromRequest returns the trace id from a w3c traceparent header, or an empty string if there is none
+func traceIDFromRequest(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+		return ""
+	}
+	for _, c := range parts[1] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+	return parts[1]
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	sw.status = http.StatusSwitchingProtocols
+	return hijack(sw.ResponseWriter)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestMetricsMiddleware_Exemplar(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	r := httptest.NewRequest("GET", "https://app.example.com/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	app.metricsMiddleware(okHandler).ServeHTTP(httptest.NewRecorder(), r)
+	//requests without a valid trace id are counted but don't get an exemplar
+	r = httptest.NewRequest("GET", "https://app.example.com/", nil)
+	r.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	app.metricsMiddleware(okHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+	out := scrapeMetrics(app, "application/openmetrics-text")
+	if !strings.Contains(out, `tobab_request_duration_seconds_count{code="200",host="app.example.com"} 2`) {
+		t.Errorf("request count missing:\n%s", out)
+	}
+	if strings.Count(out, `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`) != 1 {
+		t.Errorf("expected exactly one exemplar with the trace id:\n%s", out)
+	}
+}
+
+func TestMetricsMiddleware_HostLabel(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http", Public: true})
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+
+	for _, host := range []string{"app.example.com", "app.example.com:1", "app.example.com:2", "APP.example.com", "login.example.com:3"} {
+		app.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil))
+	}
+
+	families, err := app.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := map[string]bool{}
+	for _, f := range families {
+		if f.GetName() != "tobab_request_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "host" {
+					hosts[l.GetValue()] = true
+				}
+			}
+		}
+	}
+	want := map[string]bool{"app.example.com": true, "login.example.com": true}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("host labels = %v, want only the configured hostnames %v", hosts, want)
+	}
+}
+
+func TestMetricsHandler_Format(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	app.metrics.proxyErrors.WithLabelValues("app.example.com").Inc()
+
+	text := scrapeMetrics(app, "")
+	if !strings.Contains(text, `tobab_proxy_errors_total{host="app.example.com"} 1`) || strings.Contains(text, "# EOF") {
+		t.Errorf("unexpected prometheus text format:\n%s", text)
+	}
+	if om := scrapeMetrics(app, "application/openmetrics-text"); !strings.HasSuffix(om, "# EOF\n") {
+		t.Errorf("unexpected OpenMetrics format:\n%s", om)
+	}
+}
+
+func scrapeMetrics(app *Tobab, accept string) string {
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	app.metrics.handler().ServeHTTP(w, r)
+	return w.Body.String()
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"net/url"
 	"strings"
 
-	"github.com/asdine/storm"
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/muxlogger"
 	"github.com/sirupsen/logrus"
 )
 
@@ -14,41 +16,143 @@ func (app *Tobab) getRBACMiddleware() func(http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 			hostname := r.Host
-			u, extractUserErr := app.extractUser(r)
+			if hostname == app.config.Hostname && isProbe(r) {
+				//a probe has no token, and a stale cookie shouldn't make tobab look unhealthy
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			//configured hostname is always accessible
+			var h *tobab.Host
+			var groups []string
+			if hostname != app.config.Hostname {
+				var err error
+				h, err = app.db.GetHost(hostname)
+				if errors.Is(err, tobab.ErrHostNotFound) {
+					http.Error(w, "not found", 404)
+					return
+				}
+				if err != nil {
+					app.logger.WithError(err).WithField("host", hostname).Error("unable to load host")
+					http.Error(w, "internal server error", http.StatusInternalServerError)
+					return
+				}
+
+				var public bool
+				public, groups = h.PathAccess(r.URL.Path)
+				if public || h.Public && len(groups) == 0 {
+					//public hosts and paths never need the token so don't bother parsing it
+					r.Header.Del("X-Tobab-User")
+					stripTobabCookies(r)
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			var u, provider string
+			var userGroups []string
+			t, extractUserErr := app.extractToken(r)
+			if extractUserErr == nil {
+				u = t.Subject
+				provider = tokenProvider(t)
+				userGroups = tokenGroups(t)
+			}
+			if extractUserErr == ErrUnauthenticatedRequest && h != nil {
+				//services can't log in interactively, a client certificate takes the place of the token
+				if id := clientCertIdentity(*h, r); id != "" {
+					u = id
+					provider = tobab.ProviderClientCert
+					extractUserErr = nil
+				}
+			}
+			if extractUserErr == ErrUnauthenticatedRequest && h != nil && h.BasicAuth {
+				if user, password, ok := r.BasicAuth(); ok {
+					if !app.checkServiceCredential(h.Hostname, user, password) {
+						app.logger.WithField("host", hostname).WithField("user", user).Warning("invalid basic auth credentials")
+						app.authFailure(hostname, "basic_auth_invalid")
+						app.audit(r, tobab.AuditDenied, user, hostname, tobab.AuditFailure, "basic_auth_invalid")
+						app.basicAuthChallenge(w, r, h, "invalid credentials")
+						return
+					}
+					u = user
+					provider = tobab.ProviderBasicAuth
+					extractUserErr = nil
+					//the credential is for tobab, not for the backend
+					r.Header.Del("Authorization")
+				}
+			}
 			if extractUserErr != nil && extractUserErr != ErrUnauthenticatedRequest {
-				//this shouldn't happen unless someone tampered with a cookie manually
+				//this shouldn't happen unless someone tampered with a cookie manually or the token was revoked
 				app.logger.WithError(extractUserErr).Error("Unable to extract user")
+				app.authFailure(hostname, authFailureReason(extractUserErr))
+				app.audit(r, tobab.AuditDenied, "", hostname, tobab.AuditFailure, authFailureReason(extractUserErr))
 				//invalid cookie is present, delete it and force re-auth
-				c := http.Cookie{
-					Name:     "X-Tobab-Token",
-					Domain:   app.config.CookieScope,
-					SameSite: http.SameSiteLaxMode,
-					Secure:   true,
-					HttpOnly: true,
-					MaxAge:   -1,
-					Path:     "/",
+				app.expireTokenCookies(w, r)
+				if extractUserErr == ErrRevokedToken {
+					app.errorPage(w, r, "token is revoked", http.StatusUnauthorized)
+					return
 				}
-				http.SetCookie(w, &c)
 				http.Error(w, "bad request", http.StatusBadRequest)
 				return
 			}
-			app.logger.WithFields(logrus.Fields{
-				"host": hostname,
-				"user": u,
-				"uri":  r.RequestURI,
-			}).Debug("checking auth")
+			if app.logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+				app.logger.WithFields(logrus.Fields{
+					"host":     hostname,
+					"user":     u,
+					"provider": provider,
+					"uri":      r.RequestURI,
+				}).Debug("checking auth")
+			}
 
-			r.Header.Add("X-Tobab-User", u)
+			//set instead of add so clients can't provide their own user
+			r.Header.Set("X-Tobab-User", u)
+			r = r.WithContext(withUser(r.Context(), u))
 
-			//configured hostname is always accessible
-			if hostname != app.config.Hostname {
-				h, err := app.db.GetHost(hostname)
-				if err == storm.ErrNotFound {
-					http.Error(w, "not found", 404)
-					return
+			if h != nil {
+				rule, allowed := h.MatchProviderRule(u, provider)
+				if !allowed {
+					rule = "default-deny"
+				}
+				//access to the host isn't enough for a path that is restricted to groups
+				groupDenied := allowed && len(groups) > 0 && !app.config.InGroups(u, groups) && !inAnyGroup(userGroups, groups)
+				if groupDenied {
+					allowed = false
+					rule = "group-deny"
+				}
+				r = r.WithContext(withRule(r.Context(), rule))
+				muxlogger.SetField(r, "rule", rule)
+
+				if !allowed && h.EffectiveRBACMode(app.config.RBACMode) == tobab.RBACModeAudit {
+					//audit mode only reports what enforce mode would have done
+					app.logger.WithFields(logrus.Fields{
+						"host":  hostname,
+						"user":  u,
+						"uri":   r.RequestURI,
+						"rule":  rule,
+						"globs": h.Globs,
+					}).Warning("audit: request would have been denied")
+					allowed = true
 				}
 
-				if !h.HasAccess(u) {
+				if !allowed {
+					if extractUserErr == ErrUnauthenticatedRequest && h.BasicAuth && (!wantsHTML(r) || !app.config.HasIdentityProvider()) {
+						//clients that aren't browsers can't follow the login redirect
+						app.basicAuthChallenge(w, r, h, "authentication required")
+						return
+					}
+					if extractUserErr == ErrUnauthenticatedRequest && h.ClientCertIdentity != "" && !app.config.HasIdentityProvider() {
+						//services are expected to present a certificate, there is no login to send them to
+						app.authFailure(hostname, "client_cert_missing")
+						app.audit(r, tobab.AuditDenied, "", hostname, tobab.AuditFailure, "client_cert_missing")
+						app.errorPage(w, r, "client certificate required", http.StatusUnauthorized)
+						return
+					}
+					if extractUserErr == ErrUnauthenticatedRequest && !app.config.HasIdentityProvider() {
+						//a redirect would end on a login page without any way to log in
+						app.logger.WithField("host", hostname).Error("host requires a login but no identity provider is configured")
+						app.errorPage(w, r, "this host requires a login but no identity provider is configured", http.StatusServiceUnavailable)
+						return
+					}
 					if extractUserErr == ErrUnauthenticatedRequest {
 						redirectURL := url.URL{
 							Host:   hostname,
@@ -65,21 +169,20 @@ func (app *Tobab) getRBACMiddleware() func(http.Handler) http.Handler {
 						}
 						http.SetCookie(w, &c)
 						http.Redirect(w, r, app.fqdn, 302)
+					} else if groupDenied {
+						app.authFailure(hostname, "group_denied")
+						app.audit(r, tobab.AuditDenied, u, hostname, tobab.AuditFailure, "group_denied")
+						app.errorPage(w, r, "access denied", http.StatusForbidden)
 					} else {
-						http.Error(w, "access denied", http.StatusUnauthorized)
+						app.authFailure(hostname, "rbac_denied")
+						app.audit(r, tobab.AuditDenied, u, hostname, tobab.AuditFailure, "rbac_denied")
+						app.errorPage(w, r, "access denied", http.StatusUnauthorized)
 					}
 
 					return
 				}
 
-				//get all cookies, clear them, and then re-add the ones that are not tobab specific
-				cookies := r.Cookies()
-				r.Header.Del("Cookie")
-				for _, c := range cookies {
-					if !strings.HasPrefix(c.Name, "X-Tobab") {
-						r.AddCookie(c)
-					}
-				}
+				stripTobabCookies(r)
 			}
 
 			next.ServeHTTP(w, r)
@@ -87,11 +190,23 @@ func (app *Tobab) getRBACMiddleware() func(http.Handler) http.Handler {
 	}
 }
 
+// inAnyGroup reports whether one of the groups the user got from their identity provider is in groups
+func inAnyGroup(userGroups, groups []string) bool {
+	for _, ug := range userGroups {
+		for _, g := range groups {
+			if ug == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (app *Tobab) adminMiddleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-			u := r.Header.Get("X-Tobab-User")
+			u, _ := userFromContext(r.Context())
 			if u == "" || !allowAdmin(u, app.config.AdminGlobs) {
 				app.logger.WithFields(logrus.Fields{
 					"user":  u,
@@ -105,3 +220,33 @@ func (app *Tobab) adminMiddleware() func(http.Handler) http.Handler {
 		})
 	}
 }
+
+const defaultMaxURILength = 8192
+
+// uriLengthMiddleware rejects requests with a request uri longer than max bytes
+func uriLengthMiddleware(max int) func(http.Handler) http.Handler {
+	if max <= 0 {
+		max = defaultMaxURILength
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.RequestURI) > max {
+				http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// stripTobabCookies removes all tobab specific cookies so they are never sent to a backend
+func stripTobabCookies(r *http.Request) {
+	//get all cookies, clear them, and then re-add the ones that are not tobab specific
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if !strings.HasPrefix(c.Name, "X-Tobab") {
+			r.AddCookie(c)
+		}
+	}
+}
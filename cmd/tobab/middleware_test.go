@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+	"github.com/gnur/tobab/muxlogger"
+	"github.com/sirupsen/logrus"
+)
+
+type memDB struct {
+	hosts         map[string]tobab.Host
+	revoked       map[string]bool
+	revokedBefore map[string]time.Time
+	keyParams     map[string]tobab.KeyParams
+	tokens        map[string]tobab.IssuedToken
+	credentials   map[string]tobab.ServiceCredential
+	audit         *[]tobab.AuditEvent
+	signingKeys   map[string]tobab.SigningKey
+}
+
+func newMemDB() memDB {
+	return memDB{
+		hosts:         map[string]tobab.Host{},
+		revoked:       map[string]bool{},
+		revokedBefore: map[string]time.Time{},
+		keyParams:     map[string]tobab.KeyParams{},
+		tokens:        map[string]tobab.IssuedToken{},
+		credentials:   map[string]tobab.ServiceCredential{},
+		audit:         &[]tobab.AuditEvent{},
+		signingKeys:   map[string]tobab.SigningKey{},
+	}
+}
+
+func (db memDB) AddHost(h tobab.Host) error {
+	db.hosts[h.Hostname] = h
+	return nil
+}
+
+func (db memDB) GetHost(hostname string) (*tobab.Host, error) {
+	h, ok := db.hosts[hostname]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", tobab.ErrHostNotFound, hostname)
+	}
+	return &h, nil
+}
+
+func (db memDB) GetHosts() ([]tobab.Host, error) {
+	var hosts []tobab.Host
+	for _, h := range db.hosts {
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+func (db memDB) DeleteHost(hostname string) error {
+	if _, ok := db.hosts[hostname]; !ok {
+		return fmt.Errorf("%w: %s", tobab.ErrHostNotFound, hostname)
+	}
+	delete(db.hosts, hostname)
+	return nil
+}
+
+func (db memDB) RevokeToken(tokenID string) error {
+	db.revoked[tokenID] = true
+	return nil
+}
+
+func (db memDB) IsRevoked(tokenID string) (bool, error) {
+	return db.revoked[tokenID], nil
+}
+
+func (db memDB) RevokeUserTokens(email string, before time.Time) error {
+	db.revokedBefore[email] = before
+	return nil
+}
+
+func (db memDB) UserTokensRevokedBefore(email string) (time.Time, error) {
+	return db.revokedBefore[email], nil
+}
+
+func (db memDB) SaveToken(t tobab.IssuedToken) error {
+	db.tokens[t.ID] = t
+	return nil
+}
+
+func (db memDB) ListTokens(expiresAfter time.Time) ([]tobab.IssuedToken, error) {
+	var tokens []tobab.IssuedToken
+	for _, t := range db.tokens {
+		if t.ExpiresAt.After(expiresAfter) {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].IssuedAt.Before(tokens[j].IssuedAt)
+	})
+	return tokens, nil
+}
+
+func (db memDB) GetKeyParams() (*tobab.KeyParams, error) {
+	p, ok := db.keyParams[""]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (db memDB) SaveKeyParams(p tobab.KeyParams) error {
+	db.keyParams[""] = p
+	return nil
+}
+
+func (db memDB) SaveCredential(c tobab.ServiceCredential) error {
+	c.ID = tobab.ServiceCredentialID(c.Host, c.Username)
+	db.credentials[c.ID] = c
+	return nil
+}
+
+func (db memDB) GetCredential(host, username string) (*tobab.ServiceCredential, error) {
+	c, ok := db.credentials[tobab.ServiceCredentialID(host, username)]
+	if !ok {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+func (db memDB) DeleteCredential(host, username string) error {
+	id := tobab.ServiceCredentialID(host, username)
+	if _, ok := db.credentials[id]; !ok {
+		return fmt.Errorf("%w: %s on %s", tobab.ErrCredentialNotFound, username, host)
+	}
+	delete(db.credentials, id)
+	return nil
+}
+
+func (db memDB) SaveAuditEvent(e tobab.AuditEvent) error {
+	*db.audit = append(*db.audit, e)
+	return nil
+}
+
+func (db memDB) SaveSigningKey(k tobab.SigningKey) error {
+	db.signingKeys[k.ID] = k
+	return nil
+}
+
+func (db memDB) GetSigningKeys() ([]tobab.SigningKey, error) {
+	var keys []tobab.SigningKey
+	for _, k := range db.signingKeys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (db memDB) DeleteSigningKey(id string) error {
+	if _, ok := db.signingKeys[id]; !ok {
+		return fmt.Errorf("%w: %s", tobab.ErrSigningKeyNotFound, id)
+	}
+	delete(db.signingKeys, id)
+	return nil
+}
+
+func (db memDB) Ping() error {
+	return nil
+}
+
+func (db memDB) Close() {}
+
+// testAuth is the rpc secret of newTestApp
+var testAuth = clirpc.Auth{Secret: "rpc-secret"}
+
+func newTestApp(cfg tobab.Config, hosts ...tobab.Host) *Tobab {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	db := newMemDB()
+	for _, h := range hosts {
+		_ = db.AddHost(h)
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname = "login.example.com"
+	}
+	if cfg.CookieScope == "" {
+		cfg.CookieScope = "example.com"
+	}
+	if cfg.RPCSecret == "" {
+		cfg.RPCSecret = testAuth.Secret
+	}
+	if cfg.GoogleKey == "" {
+		cfg.GoogleKey = "google-key"
+		cfg.GoogleSecret = "google-secret"
+	}
+
+	return &Tobab{
+		key:        []byte("0123456789abcdef0123456789abcdef"),
+		config:     cfg,
+		logger:     logger.WithField("test", true),
+		maxAge:     24 * time.Hour,
+		defaultAge: time.Hour,
+		fqdn:       "https://" + cfg.Hostname,
+		db:         db,
+		metrics:    newMetrics(),
+		captures:   newCaptureManager(),
+	}
+}
+
+func testRequest(t *testing.T, app *Tobab, host, user string) *http.Request {
+	r := httptest.NewRequest("GET", "https://"+host+"/some/path", nil)
+	if user != "" {
+		token, err := app.newToken(user, "test", time.Hour)
+		if err != nil {
+			t.Fatalf("unable to create token: %v", err)
+		}
+		r.AddCookie(&http.Cookie{Name: "X-Tobab-Token", Value: token})
+	}
+	return r
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func TestRBACMiddleware_Mode(t *testing.T) {
+	tests := []struct {
+		name       string
+		globalMode string
+		hostMode   string
+		user       string
+		wantStatus int
+	}{
+		{name: "enforce denies unknown user", user: "eve@evil.com", wantStatus: http.StatusUnauthorized},
+		{name: "enforce redirects anonymous", wantStatus: http.StatusFound},
+		{name: "enforce allows matching user", user: "alice@example.com", wantStatus: http.StatusOK},
+		{name: "global audit allows unknown user", globalMode: tobab.RBACModeAudit, user: "eve@evil.com", wantStatus: http.StatusOK},
+		{name: "global audit allows anonymous", globalMode: tobab.RBACModeAudit, wantStatus: http.StatusOK},
+		{name: "host audit allows unknown user", hostMode: tobab.RBACModeAudit, user: "eve@evil.com", wantStatus: http.StatusOK},
+		{name: "host enforce overrides global audit", globalMode: tobab.RBACModeAudit, hostMode: tobab.RBACModeEnforce, user: "eve@evil.com", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{RBACMode: tt.globalMode}, tobab.Host{
+				Hostname: "app.example.com",
+				Backend:  "http://localhost:1234",
+				Type:     "http",
+				Globs:    []tobab.Glob{"*@example.com"},
+				RBACMode: tt.hostMode,
+			})
+
+			w := httptest.NewRecorder()
+			app.getRBACMiddleware()(okHandler).ServeHTTP(w, testRequest(t, app, "app.example.com", tt.user))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRBACMiddleware_UserHeader(t *testing.T) {
+	app := newTestApp(tobab.Config{},
+		tobab.Host{Hostname: "public.example.com", Backend: "http://localhost:1234", Type: "http", Public: true},
+		tobab.Host{Hostname: "private.example.com", Backend: "http://localhost:1234", Type: "http", Globs: []tobab.Glob{"*"}},
+	)
+	tests := []struct {
+		host string
+		user string
+		want string
+	}{
+		{host: "public.example.com", user: "alice@example.com", want: ""},
+		{host: "private.example.com", user: "alice@example.com", want: "alice@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			var got string
+			var cookies []*http.Cookie
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("X-Tobab-User")
+				cookies = r.Cookies()
+			})
+			r := testRequest(t, app, tt.host, tt.user)
+			r.Header.Set("X-Tobab-User", "spoofed@example.com")
+			app.getRBACMiddleware()(next).ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("X-Tobab-User = %q, want %q", got, tt.want)
+			}
+			if len(cookies) != 0 {
+				t.Errorf("tobab cookies were forwarded: %v", cookies)
+			}
+		})
+	}
+}
+
+func TestRBACMiddleware_PublicPaths(t *testing.T) {
+	app := newTestApp(tobab.Config{}, tobab.Host{
+		Hostname:    "app.example.com",
+		Backend:     "http://localhost:1234",
+		Type:        "http",
+		Globs:       []tobab.Glob{"*@example.com"},
+		PublicPaths: []string{"/health", "/webhooks/"},
+	})
+	tests := []struct {
+		name       string
+		path       string
+		user       string
+		wantStatus int
+	}{
+		{name: "public path without login", path: "/health", wantStatus: http.StatusOK},
+		{name: "below public path without login", path: "/webhooks/github", wantStatus: http.StatusOK},
+		{name: "public path for denied user", path: "/health", user: "eve@evil.com", wantStatus: http.StatusOK},
+		{name: "sibling path requires login", path: "/healthz", wantStatus: http.StatusFound},
+		{name: "private path requires login", path: "/admin", wantStatus: http.StatusFound},
+		{name: "private path denies unknown user", path: "/admin", user: "eve@evil.com", wantStatus: http.StatusUnauthorized},
+		{name: "private path allows user", path: "/admin", user: "alice@example.com", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRequest(t, app, "app.example.com", tt.user)
+			r.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			app.getRBACMiddleware()(okHandler).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRBACMiddleware_AllowedGroups(t *testing.T) {
+	app := newTestApp(tobab.Config{
+		Groups: map[string][]tobab.Glob{
+			"admins":  {"alice@example.com"},
+			"billing": {"bob@example.com"},
+		},
+	}, tobab.Host{
+		Hostname:    "app.example.com",
+		Backend:     "http://localhost:1234",
+		Type:        "http",
+		Globs:       []tobab.Glob{"*@example.com"},
+		PublicPaths: []string{"/api/*/public", "/admin/status"},
+		AllowedGroups: []tobab.PathGroups{
+			{Path: "/api/*", Groups: []string{"admins", "billing"}},
+			{Path: "/api/invoices/*", Groups: []string{"billing"}},
+			{Path: "/admin", Groups: []string{"admins"}},
+		},
+	})
+	tests := []struct {
+		name       string
+		path       string
+		user       string
+		wantStatus int
+	}{
+		{name: "unrestricted path", path: "/home", user: "carol@example.com", wantStatus: http.StatusOK},
+		{name: "restricted path for group member", path: "/api/users", user: "alice@example.com", wantStatus: http.StatusOK},
+		{name: "restricted path for other user", path: "/api/users", user: "carol@example.com", wantStatus: http.StatusForbidden},
+		{name: "restricted path without login", path: "/api/users", wantStatus: http.StatusFound},
+		{name: "restricted path for user without host access", path: "/api/users", user: "eve@evil.com", wantStatus: http.StatusUnauthorized},
+		{name: "more specific glob wins", path: "/api/invoices/1", user: "alice@example.com", wantStatus: http.StatusForbidden},
+		{name: "more specific glob allows its group", path: "/api/invoices/1", user: "bob@example.com", wantStatus: http.StatusOK},
+		{name: "public glob inside restricted glob", path: "/api/docs/public", wantStatus: http.StatusOK},
+		{name: "public path below restricted prefix", path: "/admin/status", wantStatus: http.StatusOK},
+		{name: "restricted prefix", path: "/admin/users", user: "bob@example.com", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRequest(t, app, "app.example.com", tt.user)
+			r.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			app.getRBACMiddleware()(okHandler).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRBACMiddleware_AllowedGroupsOnPublicHost(t *testing.T) {
+	app := newTestApp(tobab.Config{Groups: map[string][]tobab.Glob{"admins": {"alice@example.com"}}}, tobab.Host{
+		Hostname:      "www.example.com",
+		Backend:       "http://localhost:1234",
+		Type:          "http",
+		Public:        true,
+		AllowedGroups: []tobab.PathGroups{{Path: "/admin", Groups: []string{"admins"}}},
+	})
+	for _, tt := range []struct {
+		path       string
+		user       string
+		wantStatus int
+	}{
+		{path: "/", wantStatus: http.StatusOK},
+		{path: "/admin", wantStatus: http.StatusFound},
+		{path: "/admin", user: "alice@example.com", wantStatus: http.StatusOK},
+	} {
+		r := testRequest(t, app, "www.example.com", tt.user)
+		r.URL.Path = tt.path
+		w := httptest.NewRecorder()
+		app.getRBACMiddleware()(okHandler).ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s as '%s': status = %d, want %d", tt.path, tt.user, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestRBACMiddleware_NoIdentityProvider(t *testing.T) {
+	app := newTestApp(tobab.Config{},
+		tobab.Host{Hostname: "public.example.com", Backend: "http://localhost:1234", Type: "http", Public: true},
+		tobab.Host{Hostname: "private.example.com", Backend: "http://localhost:1234", Type: "http", Globs: []tobab.Glob{"*@example.com"}},
+	)
+	app.config.GoogleKey = ""
+	app.config.GoogleSecret = ""
+
+	tests := []struct {
+		name       string
+		host       string
+		user       string
+		wantStatus int
+	}{
+		{name: "public host", host: "public.example.com", wantStatus: http.StatusOK},
+		{name: "private host without login", host: "private.example.com", wantStatus: http.StatusServiceUnavailable},
+		{name: "private host with cli token", host: "private.example.com", user: "alice@example.com", wantStatus: http.StatusOK},
+		{name: "private host with denied token", host: "private.example.com", user: "eve@evil.com", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			app.getRBACMiddleware()(okHandler).ServeHTTP(w, testRequest(t, app, tt.host, tt.user))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code == http.StatusServiceUnavailable && !strings.Contains(w.Body.String(), "no identity provider") {
+				t.Errorf("body does not explain the misconfiguration: %s", w.Body.String())
+			}
+		})
+	}
+
+	err := app.AddHost(&clirpc.AddHostIn{Auth: testAuth, Host: tobab.Host{Hostname: "new.example.com", Backend: "http://localhost:1234", Type: "http", Globs: []tobab.Glob{"*"}}}, &clirpc.Empty{})
+	if err == nil {
+		t.Errorf("expected an error when adding a host that requires a login without identity provider")
+	}
+}
+
+// brokenDB fails every host lookup like a database that can't be read
+type brokenDB struct {
+	memDB
+}
+
+func (db brokenDB) GetHost(hostname string) (*tobab.Host, error) {
+	return nil, errors.New("database is corrupt")
+}
+
+func (db brokenDB) Ping() error {
+	return errors.New("database is corrupt")
+}
+
+func TestRBACMiddleware_HostLookup(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	w := httptest.NewRecorder()
+	app.getRBACMiddleware()(okHandler).ServeHTTP(w, testRequest(t, app, "missing.example.com", ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown host: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	//a failing database is not the same as a host that doesn't exist
+	app.db = brokenDB{newMemDB()}
+	w = httptest.NewRecorder()
+	app.getRBACMiddleware()(okHandler).ServeHTTP(w, testRequest(t, app, "app.example.com", ""))
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "corrupt") {
+		t.Errorf("failing database: status = %d '%s', want %d without the error", w.Code, w.Body.String(), http.StatusInternalServerError)
+	}
+}
+
+func TestURILengthMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        int
+		pathLength int
+		wantStatus int
+	}{
+		{name: "default allows normal urls", pathLength: 100, wantStatus: http.StatusOK},
+		{name: "default rejects huge urls", pathLength: defaultMaxURILength + 1, wantStatus: http.StatusRequestURITooLong},
+		{name: "configured limit", max: 64, pathLength: 100, wantStatus: http.StatusRequestURITooLong},
+		{name: "exactly at the limit", max: 64, pathLength: 63, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/"+strings.Repeat("a", tt.pathLength), nil)
+			w := httptest.NewRecorder()
+			uriLengthMiddleware(tt.max)(okHandler).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRBACMiddleware_RuleLogging(t *testing.T) {
+	host := tobab.Host{
+		Hostname: "app.example.com",
+		Backend:  "http://localhost:1234",
+		Type:     "http",
+		Rules: []tobab.Rule{
+			{Name: "admins", Globs: []tobab.Glob{"admin@example.com"}},
+			{Name: "employees", Globs: []tobab.Glob{"*@example.com"}},
+			{Globs: []tobab.Glob{"*@partner.com"}},
+		},
+	}
+	tests := []struct {
+		user     string
+		mode     string
+		wantRule string
+	}{
+		{user: "admin@example.com", wantRule: "admins"},
+		{user: "bob@example.com", wantRule: "employees"},
+		{user: "carol@partner.com", wantRule: "rules[2]"},
+		{user: "eve@evil.com", wantRule: "default-deny"},
+		{user: "eve@evil.com", mode: tobab.RBACModeAudit, wantRule: "default-deny"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+tt.mode, func(t *testing.T) {
+			h := host
+			h.RBACMode = tt.mode
+			app := newTestApp(tobab.Config{}, h)
+			var buf bytes.Buffer
+			app.logger.Logger.SetOutput(&buf)
+			app.logger.Logger.SetFormatter(&logrus.JSONFormatter{})
+
+			var ctxRule string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxRule, _ = ruleFromContext(r.Context())
+			})
+			handler := muxlogger.NewLogger(app.logger).Middleware(app.getRBACMiddleware()(next))
+			handler.ServeHTTP(httptest.NewRecorder(), testRequest(t, app, "app.example.com", tt.user))
+
+			var line map[string]interface{}
+			for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				_ = json.Unmarshal([]byte(l), &line)
+			}
+			if line["rule"] != tt.wantRule {
+				t.Errorf("logged rule = %v, want %s", line["rule"], tt.wantRule)
+			}
+			if h.HasAccess(tt.user) || tt.mode == tobab.RBACModeAudit {
+				if ctxRule != tt.wantRule {
+					t.Errorf("rule in context = %s, want %s", ctxRule, tt.wantRule)
+				}
+			}
+		})
+	}
+}
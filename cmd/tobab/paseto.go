@@ -1,70 +1,220 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"net/http"
 	"time"
 
+	"github.com/gnur/tobab"
 	"github.com/o1egl/paseto/v2"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
 )
 
 var ErrUnauthenticatedRequest = errors.New("No user information in request")
 var ErrInvalidToken = errors.New("Unable to parse token")
+var ErrExpiredToken = errors.New("Token is expired or not valid yet")
+var ErrUnknownUser = errors.New("Token has no user")
+var ErrRevokedToken = errors.New("Token is revoked")
 
 var v2 = paseto.NewV2()
 var footer = "tobab"
 
-func (app *Tobab) extractUser(r *http.Request) (string, error) {
+// providerClaim is the claim with the name of the identity provider that authenticated the user
+const providerClaim = "provider"
+
+// deriveKey transforms the provided salt and secret into a key that can be used by paseto
+func deriveKey(secret, salt []byte, p tobab.KeyDerivation) []byte {
+	p = p.WithDefaults()
+	return argon2.IDKey(secret, salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+}
+
+// keyDerivation returns the parameters to derive the key with. The parameters are stored together with a hash
+// of the salt the first time, when the configured parameters change later the stored ones keep being used
+// because a different key would invalidate every token. A new salt starts over with the configured parameters.
+func keyDerivation(db tobab.Database, salt []byte, configured tobab.KeyDerivation, logger *logrus.Entry) (tobab.KeyDerivation, error) {
+	configured = configured.WithDefaults()
+	sum := sha256.Sum256(salt)
+	saltHash := hex.EncodeToString(sum[:])
 
-	c, err := r.Cookie("X-Tobab-Token")
+	stored, err := db.GetKeyParams()
 	if err != nil {
-		return "", ErrUnauthenticatedRequest
+		return configured, err
 	}
+	if stored != nil && stored.SaltHash == saltHash {
+		if stored.KeyDerivation != configured {
+			logger.WithFields(logrus.Fields{
+				"configured": configured,
+				"stored":     stored.KeyDerivation,
+			}).Error("KeyDerivation differs from the parameters existing tokens were created with, keeping the stored parameters. Change the salt as well to use the new parameters, which logs out every user")
+		}
+		return stored.KeyDerivation, nil
+	}
+	err = db.SaveKeyParams(tobab.KeyParams{SaltHash: saltHash, KeyDerivation: configured})
+	return configured, err
+}
 
-	t, err := app.decryptToken(c.Value)
+// requestUser returns the user of the request without parsing the token again if the rbac middleware already did
+func (app *Tobab) requestUser(r *http.Request) (string, error) {
+	if u, ok := userFromContext(r.Context()); ok {
+		if u == "" {
+			return "", ErrUnauthenticatedRequest
+		}
+		return u, nil
+	}
+	return app.extractUser(r)
+}
+
+func (app *Tobab) extractUser(r *http.Request) (string, error) {
+	t, err := app.extractToken(r)
 	if err != nil {
 		return "", err
 	}
-
 	return t.Subject, nil
 }
 
+// extractToken returns the valid token of the request, which always has a user
+func (app *Tobab) extractToken(r *http.Request) (*paseto.JSONToken, error) {
+
+	token, err := tokenFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := app.decryptToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if t.Subject == "" {
+		return nil, ErrUnknownUser
+	}
+	if err := app.checkRevoked(t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// tokenProvider returns the identity provider the user of the token logged in with, empty for tokens created
+// with the cli or before tobab supported multiple providers
+func tokenProvider(t *paseto.JSONToken) string {
+	var provider string
+	if err := t.Get(providerClaim, &provider); err != nil {
+		return ""
+	}
+	return provider
+}
+
+// tokenGroups returns the groups of the user of the token at their identity provider
+func tokenGroups(t *paseto.JSONToken) []string {
+	var groups []string
+	if err := t.Get(groupsClaim, &groups); err != nil {
+		return nil
+	}
+	return groups
+}
+
+// checkRevoked returns ErrRevokedToken when the token itself or all tokens of its user were revoked
+func (app *Tobab) checkRevoked(t *paseto.JSONToken) error {
+	if t.Jti != "" {
+		revoked, err := app.db.IsRevoked(t.Jti)
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return ErrRevokedToken
+		}
+	}
+	before, err := app.db.UserTokensRevokedBefore(t.Subject)
+	if err != nil {
+		return err
+	}
+	//issued at only has a precision of seconds, a token from the same second as the revocation is revoked too
+	if !before.IsZero() && !t.IssuedAt.After(before.Truncate(time.Second)) {
+		return ErrRevokedToken
+	}
+	return nil
+}
+
 func (app *Tobab) decryptToken(t string) (*paseto.JSONToken, error) {
 	// Decrypt data
 	var token paseto.JSONToken
 	var footer string
-	err := v2.Decrypt(t, app.key, &token, &footer)
+	var err error
+	for _, key := range app.verificationKeys(time.Now()) {
+		if err = v2.Decrypt(t, key, &token, &footer); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, ErrInvalidToken
 	}
 	err = token.Validate()
 	if err != nil {
-		return nil, err
+		return nil, ErrExpiredToken
 	}
 
 	return &token, nil
 }
 
 func (app *Tobab) newToken(u, issuer string, TTL time.Duration) (string, error) {
+	token, _, err := app.issueToken(u, issuer, "", nil, TTL)
+	return token, err
+}
+
+// loginTokenAge returns how long the token of a login to hostname is valid, the TokenAge of the host when it has
+// one and the default age otherwise, never longer than maxAge. A TokenAge longer than maxAge can only come from
+// lowering MaxTokenAge after the host was added, it is ignored instead of cut short so it gets noticed.
+func (app *Tobab) loginTokenAge(hostname string) time.Duration {
+	age := app.defaultAge
+	if h, err := app.db.GetHost(hostname); err == nil && h.TokenAge != "" {
+		if d := duration(h.TokenAge); d > app.maxAge {
+			app.logger.WithField("host", hostname).WithField("tokenAge", h.TokenAge).WithField("maxAge", app.maxAge.String()).Warning("TokenAge of host is longer than the max token age, using the default token age")
+		} else if d > 0 {
+			age = d
+		}
+	}
+	if age > app.maxAge {
+		age = app.maxAge
+	}
+	return age
+}
+
+// issueToken returns a new token together with its claims, provider is the identity provider the user logged
+// in with and groups their groups there, both are empty for tokens that were created otherwise
+func (app *Tobab) issueToken(u, issuer, provider string, groups []string, TTL time.Duration) (string, paseto.JSONToken, error) {
 	now := time.Now()
 	if TTL > app.maxAge {
-		return "", errors.New("Provided ttl is too long")
+		return "", paseto.JSONToken{}, errors.New("Provided ttl is too long")
 	}
 	exp := now.Add(TTL)
 	nbt := now
+	jti, err := randomString(16)
+	if err != nil {
+		return "", paseto.JSONToken{}, err
+	}
 
 	jsonToken := paseto.JSONToken{
+		Jti:        jti,
 		Issuer:     issuer,
 		Subject:    u,
 		IssuedAt:   now,
 		Expiration: exp,
 		NotBefore:  nbt,
 	}
+	if provider != "" {
+		jsonToken.Set(providerClaim, provider)
+	}
+	if len(groups) > 0 {
+		jsonToken.Set(groupsClaim, groups)
+	}
 
-	token, err := v2.Encrypt(app.key, jsonToken, footer)
+	token, err := v2.Encrypt(app.signingKey(), jsonToken, footer)
 	if err != nil {
-		return "", err
+		return "", paseto.JSONToken{}, err
 	}
 
-	return token, nil
+	return token, jsonToken, nil
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+	"github.com/o1egl/paseto/v2"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestDecryptToken_PreviousKey(t *testing.T) {
+	oldKey := deriveKey([]byte("old-secret"), []byte("salt"), tobab.KeyDerivation{})
+	newKey := deriveKey([]byte("new-secret"), []byte("salt"), tobab.KeyDerivation{})
+
+	old := newTestApp(tobab.Config{})
+	old.key = oldKey
+	token, err := old.newToken("alice@example.com", "test", time.Hour)
+	if err != nil {
+		t.Fatalf("unable to create token: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		previousKey []byte
+		validUntil  time.Time
+		wantErr     bool
+	}{
+		{name: "no previous key", wantErr: true},
+		{name: "within grace period", previousKey: oldKey, validUntil: time.Now().Add(time.Hour)},
+		{name: "after grace period", previousKey: oldKey, validUntil: time.Now().Add(-time.Second), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{})
+			app.key = newKey
+			if tt.previousKey != nil {
+				//a restart with the previous secret still configured doesn't add it again
+				for i := 0; i < 2; i++ {
+					if err := app.retirePreviousSecret(tt.previousKey, time.Now().Add(-time.Minute), tt.validUntil); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := app.loadSigningKeys(); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(app.db.(memDB).signingKeys); n > 1 {
+				t.Errorf("database has %d signing keys, want at most the previous secret", n)
+			}
+
+			got, err := app.decryptToken(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decryptToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Subject != "alice@example.com" {
+				t.Errorf("subject = %s, want alice@example.com", got.Subject)
+			}
+		})
+	}
+}
+
+func TestLoginTokenAge(t *testing.T) {
+	tests := []struct {
+		name       string
+		defaultAge time.Duration
+		tokenAge   string
+		want       time.Duration
+	}{
+		{name: "default age", defaultAge: time.Hour, want: time.Hour},
+		{name: "host token age", defaultAge: time.Hour, tokenAge: "5m", want: 5 * time.Minute},
+		{name: "host token age longer than default", defaultAge: time.Hour, tokenAge: "12h", want: 12 * time.Hour},
+		{name: "host token age of max age", defaultAge: time.Hour, tokenAge: "24h", want: 24 * time.Hour},
+		{name: "host token age over max age", defaultAge: time.Hour, tokenAge: "24h1s", want: time.Hour},
+		{name: "default age of max age", defaultAge: 24 * time.Hour, want: 24 * time.Hour},
+		{name: "default age over max age is clamped", defaultAge: 48 * time.Hour, want: 24 * time.Hour},
+		{name: "host token age over max age with default over max age", defaultAge: 48 * time.Hour, tokenAge: "36h", want: 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "admin.example.com", TokenAge: tt.tokenAge})
+			app.defaultAge = tt.defaultAge
+			if got := app.loginTokenAge("admin.example.com"); got != tt.want {
+				t.Errorf("loginTokenAge() = %s, want %s", got, tt.want)
+			}
+			//logins to tobab itself or a host that is gone use the default age
+			want := tt.defaultAge
+			if want > app.maxAge {
+				want = app.maxAge
+			}
+			if got := app.loginTokenAge("gone.example.com"); got != want {
+				t.Errorf("loginTokenAge() of a missing host = %s, want %s", got, want)
+			}
+			//issueToken refuses ages over maxAge, the clamped age has to be accepted
+			if _, _, err := app.issueToken("alice@example.com", app.fqdn, "", nil, app.loginTokenAge("admin.example.com")); err != nil {
+				t.Errorf("issueToken() with the login token age error = %v", err)
+			}
+		})
+	}
+}
+
+func TestRBACMiddleware_RevokedToken(t *testing.T) {
+	host := tobab.Host{
+		Hostname: "app.example.com",
+		Backend:  "http://localhost:1234",
+		Type:     "http",
+		Globs:    []tobab.Glob{"*@example.com"},
+	}
+
+	tests := []struct {
+		name   string
+		revoke func(app *Tobab, tokenID string) error
+	}{
+		{name: "by token id", revoke: func(app *Tobab, tokenID string) error {
+			return app.RevokeToken(&clirpc.RevokeTokenIn{Auth: testAuth, TokenID: tokenID}, &clirpc.Empty{})
+		}},
+		{name: "by email", revoke: func(app *Tobab, tokenID string) error {
+			return app.RevokeToken(&clirpc.RevokeTokenIn{Auth: testAuth, Email: "alice@example.com"}, &clirpc.Empty{})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{}, host)
+			r := testRequest(t, app, "app.example.com", "alice@example.com")
+			token, err := tokenFromRequest(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := app.decryptToken(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Jti == "" {
+				t.Fatal("token has no id")
+			}
+
+			w := httptest.NewRecorder()
+			app.getRBACMiddleware()(okHandler).ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status before revoking = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			if err := tt.revoke(app, parsed.Jti); err != nil {
+				t.Fatal(err)
+			}
+			//the middleware strips the tobab cookies from the first request
+			r = httptest.NewRequest(http.MethodGet, "https://app.example.com/some/path", nil)
+			r.AddCookie(&http.Cookie{Name: tokenCookie, Value: token})
+			w = httptest.NewRecorder()
+			app.getRBACMiddleware()(okHandler).ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status after revoking = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+
+			//other users are not affected
+			w = httptest.NewRecorder()
+			app.getRBACMiddleware()(okHandler).ServeHTTP(w, testRequest(t, app, "app.example.com", "bob@example.com"))
+			if w.Code != http.StatusOK {
+				t.Errorf("status for another user = %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestCheckRevoked_TokensAfterRevocation(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	app.db.RevokeUserTokens("alice@example.com", time.Now().Add(-time.Minute))
+
+	if err := app.checkRevoked(&paseto.JSONToken{Subject: "alice@example.com", IssuedAt: time.Now().Add(-2 * time.Minute)}); err != ErrRevokedToken {
+		t.Errorf("token issued before the revocation: got %v, want %v", err, ErrRevokedToken)
+	}
+	if err := app.checkRevoked(&paseto.JSONToken{Subject: "alice@example.com", IssuedAt: time.Now()}); err != nil {
+		t.Errorf("token issued after the revocation should be valid, got %v", err)
+	}
+}
+
+func TestRevokeToken_RequiresOneTarget(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	for _, in := range []clirpc.RevokeTokenIn{{}, {TokenID: "id", Email: "alice@example.com"}} {
+		if err := app.RevokeToken(&in, &clirpc.Empty{}); err == nil {
+			t.Errorf("expected an error for %+v", in)
+		}
+	}
+}
+
+func TestKeyDerivation_KeepsStoredParameters(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	stronger := tobab.KeyDerivation{Time: 8, Memory: 64 * 1024, Threads: 4}
+
+	p, err := keyDerivation(app.db, []byte("salt"), tobab.KeyDerivation{}, app.logger)
+	if err != nil || p != tobab.DefaultKeyDerivation {
+		t.Fatalf("first start: keyDerivation() = %+v, %v, want the defaults", p, err)
+	}
+	key := deriveKey([]byte("secret"), []byte("salt"), p)
+
+	p, err = keyDerivation(app.db, []byte("salt"), stronger, app.logger)
+	if err != nil || p != tobab.DefaultKeyDerivation {
+		t.Errorf("changed parameters: keyDerivation() = %+v, %v, want the stored parameters", p, err)
+	}
+	if string(deriveKey([]byte("secret"), []byte("salt"), p)) != string(key) {
+		t.Error("changing the parameters changed the key")
+	}
+
+	stronger.KeyLen = 32
+	p, err = keyDerivation(app.db, []byte("new-salt"), stronger, app.logger)
+	if err != nil || p != stronger {
+		t.Errorf("new salt: keyDerivation() = %+v, %v, want the configured parameters", p, err)
+	}
+	p, _ = keyDerivation(app.db, []byte("new-salt"), tobab.KeyDerivation{}, app.logger)
+	if p != stronger {
+		t.Errorf("parameters of the new salt were not stored, got %+v", p)
+	}
+}
+
+func TestDeriveKey_Defaults(t *testing.T) {
+	//tokens created before the parameters were configurable have to stay valid
+	if string(deriveKey([]byte("secret"), []byte("salt"), tobab.KeyDerivation{})) != string(argon2.IDKey([]byte("secret"), []byte("salt"), 4, 4*1024, 2, 32)) {
+		t.Error("the default parameters changed")
+	}
+}
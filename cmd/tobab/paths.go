@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gnur/tobab"
+)
+
+// pathMiddleware normalizes the request path before it is proxied to the backend of h
+func pathMiddleware(h tobab.Host, next http.Handler) http.Handler {
+	if !h.CleanPath && !h.RejectEncodedSlash {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.RejectEncodedSlash && hasEncodedSlash(r.URL.EscapedPath()) {
+			http.Error(w, "encoded slashes are not allowed", http.StatusBadRequest)
+			return
+		}
+		if h.CleanPath {
+			r.URL.Path = cleanPath(r.URL.Path)
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasEncodedSlash(p string) bool {
+	p = strings.ToLower(p)
+	return strings.Contains(p, "%2f") || strings.Contains(p, "%5c")
+}
+
+// cleanPath collapses double slashes and resolves . and .. elements while keeping a trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
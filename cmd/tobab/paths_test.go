@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestPathMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       tobab.Host
+		rawURL     string
+		wantStatus int
+		wantPath   string
+	}{
+		{name: "disabled keeps traversal", host: tobab.Host{}, rawURL: "/a/../../etc/passwd", wantStatus: 200, wantPath: "/a/../../etc/passwd"},
+		{name: "traversal is resolved", host: tobab.Host{CleanPath: true}, rawURL: "/a/../../etc/passwd", wantStatus: 200, wantPath: "/etc/passwd"},
+		{name: "encoded traversal is resolved", host: tobab.Host{CleanPath: true}, rawURL: "/a/%2e%2e/%2e%2e/etc/passwd", wantStatus: 200, wantPath: "/etc/passwd"},
+		{name: "double slashes collapse", host: tobab.Host{CleanPath: true}, rawURL: "//a//b/./c/", wantStatus: 200, wantPath: "/a/b/c/"},
+		{name: "encoded slash allowed by default", host: tobab.Host{CleanPath: true}, rawURL: "/a%2Fb", wantStatus: 200, wantPath: "/a/b"},
+		{name: "encoded slash rejected", host: tobab.Host{RejectEncodedSlash: true}, rawURL: "/a%2Fb", wantStatus: 400},
+		{name: "encoded backslash rejected", host: tobab.Host{RejectEncodedSlash: true}, rawURL: "/a%5c..%5cb", wantStatus: 400},
+		{name: "lowercase encoded slash rejected", host: tobab.Host{RejectEncodedSlash: true, CleanPath: true}, rawURL: "/a/..%2fb", wantStatus: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.EscapedPath()
+			})
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "http://app.example.com"+tt.rawURL, nil)
+			pathMiddleware(tt.host, next).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == 200 && gotPath != tt.wantPath {
+				t.Errorf("path = %s, want %s", gotPath, tt.wantPath)
+			}
+		})
+	}
+}
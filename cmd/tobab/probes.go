@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// the probes are served on the hostname of tobab, for orchestrators like kubernetes
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+// probeResponse is the body of both probes, Checks has the outcome of every readiness check so a failing one
+// stands out
+type probeResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func isProbe(r *http.Request) bool {
+	return r.URL.Path == livenessPath || r.URL.Path == readinessPath
+}
+
+// setServing marks whether the https server accepts requests, startServer sets it once the listener is bound
+// and shutdown clears it before draining
+func (app *Tobab) setServing(serving bool) {
+	var v int32
+	if serving {
+		v = 1
+	}
+	atomic.StoreInt32(&app.serving, v)
+}
+
+// livenessHandler only shows that the process can still answer requests, a failing dependency is up to the
+// readiness probe so a restart isn't triggered for it
+func (app *Tobab) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeProbe(w, http.StatusOK, probeResponse{Status: "ok"})
+}
+
+func (app *Tobab) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	resp := probeResponse{Status: "ok", Checks: map[string]string{}}
+	status := http.StatusOK
+	for name, err := range app.readinessChecks() {
+		if err == nil {
+			resp.Checks[name] = "ok"
+			continue
+		}
+		resp.Checks[name] = err.Error()
+		resp.Status = "failing"
+		status = http.StatusServiceUnavailable
+	}
+	app.writeProbe(w, status, resp)
+}
+
+// readinessChecks returns nil for every check that passes. The probes don't require a login, so the errors
+// only name the problem and the details are logged.
+func (app *Tobab) readinessChecks() map[string]error {
+	checks := map[string]error{}
+
+	if app.config.Hostname == "" {
+		checks["config"] = errors.New("not loaded")
+	} else {
+		checks["config"] = nil
+	}
+
+	if app.db == nil {
+		checks["database"] = errors.New("not open")
+	} else if err := app.db.Ping(); err != nil {
+		app.logger.WithError(err).Error("readiness check failed to reach the database")
+		checks["database"] = errors.New("unreachable")
+	} else {
+		checks["database"] = nil
+	}
+
+	if atomic.LoadInt32(&app.serving) == 0 {
+		checks["server"] = errors.New("not serving")
+	} else {
+		checks["server"] = nil
+	}
+	return checks
+}
+
+func (app *Tobab) writeProbe(w http.ResponseWriter, status int, resp probeResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	//a cached answer is no answer at all
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		app.logger.WithError(err).Error("failed writing JSON response")
+	}
+}
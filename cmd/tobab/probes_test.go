@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/gorilla/mux"
+)
+
+func getProbe(t *testing.T, app *Tobab, path string) (int, probeResponse) {
+	r := mux.NewRouter()
+	app.setTobabRoutes(r.Host(app.config.Hostname).Subrouter())
+	r.Use(app.getRBACMiddleware())
+
+	req := httptest.NewRequest(http.MethodGet, "https://"+app.config.Hostname+path, nil)
+	//a cookie that can't be decrypted gets a 400 on every other path
+	req.AddCookie(&http.Cookie{Name: "X-Tobab-Token", Value: "stale"})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp probeResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("%s returned %d without a JSON body: %v", path, w.Code, err)
+	}
+	return w.Code, resp
+}
+
+func TestLivenessProbe(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	app.db = brokenDB{newMemDB()}
+	if code, resp := getProbe(t, app, livenessPath); code != http.StatusOK || resp.Status != "ok" {
+		t.Errorf("liveness = %d %+v, want ok even with a failing database", code, resp)
+	}
+}
+
+func TestReadinessProbe(t *testing.T) {
+	tests := []struct {
+		name       string
+		db         tobab.Database
+		serving    bool
+		wantStatus int
+		wantChecks map[string]string
+	}{
+		{name: "ready", db: newMemDB(), serving: true, wantStatus: http.StatusOK, wantChecks: map[string]string{"config": "ok", "database": "ok", "server": "ok"}},
+		{name: "not serving", db: newMemDB(), wantStatus: http.StatusServiceUnavailable, wantChecks: map[string]string{"config": "ok", "database": "ok", "server": "not serving"}},
+		{name: "database unreachable", db: brokenDB{newMemDB()}, serving: true, wantStatus: http.StatusServiceUnavailable, wantChecks: map[string]string{"config": "ok", "database": "unreachable", "server": "ok"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{})
+			app.db = tt.db
+			app.setServing(tt.serving)
+
+			code, resp := getProbe(t, app, readinessPath)
+			if code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", code, tt.wantStatus)
+			}
+			if !reflect.DeepEqual(resp.Checks, tt.wantChecks) {
+				t.Errorf("checks = %v, want %v", resp.Checks, tt.wantChecks)
+			}
+			if (resp.Status == "ok") != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("status in the body = %s with a %d", resp.Status, code)
+			}
+			for _, c := range resp.Checks {
+				if strings.Contains(c, "corrupt") {
+					t.Errorf("check '%s' shows the database error to anyone", c)
+				}
+			}
+		})
+	}
+}
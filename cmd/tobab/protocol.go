@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gnur/tobab"
+)
+
+// protocolMiddleware rejects requests that don't use the protocol version required by h
+func protocolMiddleware(h tobab.Host, next http.Handler) http.Handler {
+	if h.RequireProtocol == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok := r.ProtoMajor >= 2
+		if h.RequireProtocol == tobab.ProtocolHTTP1 {
+			ok = r.ProtoMajor == 1
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("%s requires %s, this request used %s", h.Hostname, h.RequireProtocol, r.Proto), http.StatusHTTPVersionNotSupported)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
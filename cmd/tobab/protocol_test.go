@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestProtocolMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		require   string
+		wantHTTP1 int
+		wantHTTP2 int
+	}{
+		{name: "no requirement", require: "", wantHTTP1: http.StatusOK, wantHTTP2: http.StatusOK},
+		{name: "http2 required", require: tobab.ProtocolHTTP2, wantHTTP1: http.StatusHTTPVersionNotSupported, wantHTTP2: http.StatusOK},
+		{name: "http1 required", require: tobab.ProtocolHTTP1, wantHTTP1: http.StatusOK, wantHTTP2: http.StatusHTTPVersionNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tobab.Host{Hostname: "app.example.com", RequireProtocol: tt.require}
+			srv := httptest.NewUnstartedServer(protocolMiddleware(h, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			srv.EnableHTTP2 = true
+			srv.StartTLS()
+			defer srv.Close()
+
+			http2 := srv.Client()
+			http1 := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: http2.Transport.(*http.Transport).TLSClientConfig.Clone(),
+				//an empty map turns off http2
+				TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+			}}
+
+			for _, c := range []struct {
+				client *http.Client
+				major  int
+				want   int
+			}{{http1, 1, tt.wantHTTP1}, {http2, 2, tt.wantHTTP2}} {
+				resp, err := c.client.Get(srv.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.ProtoMajor != c.major {
+					t.Fatalf("request was sent with %s, expected HTTP/%d", resp.Proto, c.major)
+				}
+				if resp.StatusCode != c.want {
+					t.Errorf("%s: status = %d, want %d", resp.Proto, resp.StatusCode, c.want)
+				}
+			}
+		})
+	}
+}
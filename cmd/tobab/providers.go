@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/gnur/tobab"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/github"
+	"github.com/markbates/goth/providers/gitlab"
+	"github.com/markbates/goth/providers/google"
+)
+
+// gothProviders returns the identity providers of the config for goth, each with a callback url on the
+// tobab host that includes its name
+func gothProviders(cfg tobab.Config, fqdn string) []goth.Provider {
+	var providers []goth.Provider
+	for _, p := range cfg.IdentityProviders() {
+		callback := fqdn + "/auth/" + p.Name + "/callback"
+		switch p.Name {
+		case tobab.ProviderGoogle:
+			scopes := []string{"email"}
+			if p.Groups {
+				scopes = append(scopes, "https://www.googleapis.com/auth/cloud-identity.groups.readonly")
+			}
+			providers = append(providers, google.New(p.Key, p.Secret, callback, scopes...))
+		case tobab.ProviderGitHub:
+			//the email address is private for a lot of github users, it is only returned with this scope
+			scopes := []string{"user:email"}
+			if p.Groups {
+				scopes = append(scopes, "read:org")
+			}
+			providers = append(providers, github.New(p.Key, p.Secret, callback, scopes...))
+		case tobab.ProviderGitLab:
+			var scopes []string
+			if p.Groups {
+				scopes = []string{"read_user", "read_api"}
+			}
+			providers = append(providers, gitlab.New(p.Key, p.Secret, callback, scopes...))
+		}
+	}
+	return providers
+}
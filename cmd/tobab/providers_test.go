@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+func TestGothProviders(t *testing.T) {
+	cfg := tobab.Config{
+		GoogleKey:    "google-key",
+		GoogleSecret: "google-secret",
+		Providers: []tobab.Provider{
+			{Name: tobab.ProviderGitHub, Key: "github-key", Secret: "github-secret"},
+			{Name: tobab.ProviderGitLab, Key: "gitlab-key", Secret: "gitlab-secret"},
+		},
+	}
+	providers := gothProviders(cfg, "https://login.example.com")
+	if len(providers) != 3 {
+		t.Fatalf("expected 3 providers, got %d", len(providers))
+	}
+	for i, name := range []string{tobab.ProviderGoogle, tobab.ProviderGitHub, tobab.ProviderGitLab} {
+		p := providers[i]
+		if p.Name() != name {
+			t.Errorf("provider %d is %s, want %s", i, p.Name(), name)
+		}
+		sess, err := p.BeginAuth("state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := sess.GetAuthURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "redirect_uri=https%3A%2F%2Flogin.example.com%2Fauth%2F" + name + "%2Fcallback"
+		if !strings.Contains(u, want) {
+			t.Errorf("auth url %s of %s doesn't have the callback %s", u, name, want)
+		}
+	}
+}
+
+func TestRBACMiddleware_ProviderRules(t *testing.T) {
+	app := newTestApp(tobab.Config{}, tobab.Host{
+		Hostname: "app.example.com",
+		Backend:  "http://localhost:1234",
+		Type:     "http",
+		Rules:    []tobab.Rule{{Name: "github-users", Globs: []tobab.Glob{"*@example.com"}, Providers: []string{tobab.ProviderGitHub}}},
+	})
+	tests := []struct {
+		name       string
+		provider   string
+		wantStatus int
+	}{
+		{name: "matching provider", provider: tobab.ProviderGitHub, wantStatus: http.StatusOK},
+		{name: "other provider", provider: tobab.ProviderGoogle, wantStatus: http.StatusUnauthorized},
+		{name: "cli token", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := app.issueToken("alice@example.com", "test", tt.provider, nil, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			r.AddCookie(&http.Cookie{Name: "X-Tobab-Token", Value: token})
+			w := httptest.NewRecorder()
+			app.getRBACMiddleware()(okHandler).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
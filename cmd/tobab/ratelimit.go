@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+// rateLimitCleanupInterval is how often buckets of clients that stopped sending requests are removed
+const rateLimitCleanupInterval = time.Minute
+
+// rateLimiter is a token bucket per user or client ip, a bucket holds up to burst tokens and gets rps tokens
+// every second
+type rateLimiter struct {
+	mu      sync.Mutex
+	rps     float64
+	burst   float64
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		//without a burst a client can still do rps requests every second
+		burst = int(math.Max(1, math.Ceil(rps)))
+	}
+	return &rateLimiter{
+		rps:     rps,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from the bucket of key, when there is none it returns how long until there is one
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rps)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rps * float64(time.Second))
+	return false, wait
+}
+
+// cleanup removes the buckets that are full again, a new bucket for the same key starts out full as well
+func (l *rateLimiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rps >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitMiddleware limits every user of the host to RateLimitRPS requests per second with bursts of
+// RateLimitBurst, requests without a user are limited by client ip. The limits start over when the hosts are
+// reloaded.
+func (app *Tobab) rateLimitMiddleware(h tobab.Host, stop <-chan struct{}, next http.Handler) http.Handler {
+	if h.RateLimitRPS <= 0 {
+		return next
+	}
+	l := newRateLimiter(h.RateLimitRPS, h.RateLimitBurst)
+	go func() {
+		t := time.NewTicker(rateLimitCleanupInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				l.cleanup()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	trusted := app.trustedProxies()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _ := userFromContext(r.Context())
+		if key == "" {
+			key = clientIP(r, trusted).String()
+		}
+		if ok, wait := l.allow(key); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("alice"); !ok {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	ok, wait := l.allow("alice")
+	if ok {
+		t.Fatal("request after the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %s, want 500ms at 2 requests per second", wait)
+	}
+	if ok, _ := l.allow("bob"); !ok {
+		t.Error("another key shares the bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("alice"); !ok {
+		t.Error("no token after waiting for one")
+	}
+	if ok, _ := l.allow("alice"); ok {
+		t.Error("got more tokens than were added")
+	}
+}
+
+func TestRateLimiter_Cleanup(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(1, 5)
+	l.now = func() time.Time { return now }
+	l.allow("one-off")
+	for i := 0; i < 5; i++ {
+		l.allow("busy")
+	}
+
+	now = now.Add(2 * time.Second)
+	l.cleanup()
+	if _, ok := l.buckets["one-off"]; ok {
+		t.Error("full bucket was not removed")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("bucket that is still refilling was removed")
+	}
+	if ok, _ := l.allow("busy"); !ok {
+		t.Error("refilled tokens were lost")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	stop := make(chan struct{})
+	defer close(stop)
+	h := app.rateLimitMiddleware(tobab.Host{Hostname: "app.example.com", RateLimitRPS: 0.5, RateLimitBurst: 2}, stop, okHandler)
+
+	request := func(user, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+		r.RemoteAddr = ip + ":1234"
+		if user != "" {
+			r = r.WithContext(withUser(r.Context(), user))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("alice@example.com", "192.0.2.1"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d", i+1, w.Code)
+		}
+	}
+	w := request("alice@example.com", "192.0.2.2")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d for a user over the limit from another ip", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %s, want 2", got)
+	}
+	if w := request("bob@example.com", "192.0.2.1"); w.Code != http.StatusOK {
+		t.Errorf("another user from the same ip was limited: %d", w.Code)
+	}
+
+	for i := 0; i < 2; i++ {
+		request("", "198.51.100.1")
+	}
+	if w := request("", "198.51.100.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("anonymous client over the limit: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w := request("", "198.51.100.2"); w.Code != http.StatusOK {
+		t.Errorf("another anonymous client was limited: %d", w.Code)
+	}
+}
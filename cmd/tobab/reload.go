@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/muxlogger"
+	"github.com/gorilla/mux"
+)
+
+// routerSwitch serves requests with the router of the current hosts. Requests that already started keep using
+// the router they started with, so replacing it doesn't affect them.
+type routerSwitch struct {
+	router atomic.Value
+}
+
+func newRouterSwitch(h http.Handler) *routerSwitch {
+	rs := &routerSwitch{}
+	rs.set(h)
+	return rs
+}
+
+func (rs *routerSwitch) set(h http.Handler) {
+	//atomic.Value needs the same concrete type for every store
+	rs.router.Store(&h)
+}
+
+func (rs *routerSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*rs.router.Load().(*http.Handler)).ServeHTTP(w, r)
+}
+
+// reloadHosts builds a router for the hosts in the database and swaps it in without stopping the listener.
+// Certificates are only obtained for hostnames that aren't managed yet and tcp hosts that didn't change keep
+// their listener and connections. A host that can't be served is logged and skipped, the only error is a
+// database that can't be read, which keeps the current router.
+func (app *Tobab) reloadHosts() error {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	app.logger.Debug("loading hosts")
+	hosts, err := app.db.GetHosts()
+	if err != nil {
+		app.logger.WithError(err).Error("unable to load hosts")
+		return err
+	}
+
+	//stops the health checks of these hosts when they are replaced or the server shuts down
+	stop := make(chan struct{})
+
+	r := mux.NewRouter()
+	filters := map[string]*ipFilter{}
+	cors := map[string]tobab.Host{}
+	cached := map[string]bool{}
+	certHosts := []string{app.config.CertificateName(app.config.Hostname)}
+	var tcpHosts []tobab.Host
+	skipped := 0
+	for _, conf := range hosts {
+		if conf.Type == "tcp" {
+			if conf.IsEnabled() {
+				tcpHosts = append(tcpHosts, conf)
+			}
+			continue
+		}
+		if conf.Type != "http" && conf.Type != "static" {
+			app.logger.WithField("type", conf.Type).WithField("host", conf.Hostname).Error("Unsupported type, only http, static and tcp are supported")
+			skipped++
+			continue
+		}
+
+		if err := app.requireIdentityProvider(conf); err != nil {
+			app.logger.WithField("host", conf.Hostname).Error(err.Error())
+		}
+
+		filter, err := newIPFilter(conf)
+		if err != nil {
+			app.logger.WithError(err).WithField("host", conf.Hostname).Error("Invalid ip filter")
+			skipped++
+			continue
+		}
+		if filter != nil {
+			filters[conf.Hostname] = filter
+		}
+		if len(conf.CORSAllowedOrigins) > 0 {
+			cors[conf.Hostname] = conf
+		}
+		if conf.CacheSizeMB > 0 {
+			cached[conf.Hostname] = true
+		}
+
+		var proxy http.Handler
+		if conf.Type == "static" {
+			proxy = staticHandler(conf)
+		} else {
+			proxy, err = app.generateProxy(conf)
+			if err != nil {
+				app.logger.WithError(err).WithField("host", conf.Hostname).Error("Failed creating proxy")
+				skipped++
+				continue
+			}
+			if bal, ok := app.balancers.get(conf.Hostname); ok && conf.HealthCheckPath != "" && conf.IsEnabled() {
+				go app.checkHealth(conf, bal, stop)
+			}
+		}
+
+		handler := clientCertMiddleware(conf, protocolMiddleware(conf, app.bodyLimitMiddleware(conf, pathMiddleware(conf, app.rateLimitMiddleware(conf, stop, app.concurrencyMiddleware(conf, app.delayMiddleware(conf, app.captureMiddleware(conf, app.cacheMiddleware(conf, proxy)))))))))
+		if !conf.IsEnabled() {
+			//disabled hosts keep their certificate but are not proxied
+			handler = http.HandlerFunc(app.disabledHostHandler)
+		} else if conf.Maintenance {
+			handler = http.HandlerFunc(app.maintenanceHandler)
+		}
+
+		app.logger.WithField("host", conf.Hostname).Debug("adding proxy route")
+		r.Host(conf.Hostname).PathPrefix("/").Handler(handler)
+		//hosts under a wildcard share its certificate
+		certHosts = append(certHosts, app.config.CertificateName(conf.Hostname))
+	}
+
+	tobabRoutes := r.Host(app.config.Hostname).Subrouter()
+	app.setTobabRoutes(tobabRoutes)
+
+	r.Use(muxlogger.NewLogger(app.logger).Middleware)
+	r.Use(requestIDLogMiddleware)
+	r.Use(app.metricsMiddleware)
+	r.Use(compressMiddleware(app.config))
+	r.Use(app.ipFilterMiddleware(filters))
+	r.Use(app.corsMiddleware(cors))
+	r.Use(app.getRBACMiddleware())
+
+	app.manageCertificates(certHosts)
+	app.setTLSHosts(hosts)
+	app.caches.retain(cached)
+	skipped += app.updateTCPProxies(tcpHosts)
+	app.router.set(r)
+
+	if app.hostsStop != nil {
+		close(app.hostsStop)
+	}
+	app.hostsStop = stop
+	logger := app.logger.WithField("hosts", len(hosts)-skipped).WithField("skipped", skipped)
+	if skipped > 0 {
+		logger.Warning("hosts loaded, some hosts were skipped because of errors")
+	} else {
+		logger.Info("hosts loaded")
+	}
+	return nil
+}
+
+// manageCertificates obtains or loads the certificates of hostnames that aren't managed yet. Certificates of
+// removed hosts stay in the cache, certmagic has no way to stop managing them.
+func (app *Tobab) manageCertificates(hostnames []string) {
+	if app.magic == nil {
+		return
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, h := range hostnames {
+		if !app.managed[h] && !seen[h] {
+			names = append(names, h)
+			seen[h] = true
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	if err := app.magic.ManageSync(names); err != nil {
+		app.logger.WithError(err).WithField("hosts", names).Error("Failed managing certificates")
+		return
+	}
+	for _, h := range names {
+		app.managed[h] = true
+	}
+}
+
+// stopHosts stops the health checks of the current hosts
+func (app *Tobab) stopHosts() {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+	if app.hostsStop != nil {
+		close(app.hostsStop)
+		app.hostsStop = nil
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+)
+
+func TestReloadHosts_KeepsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(okHandler)
+	defer fast.Close()
+
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "slow.example.com", Backend: slow.URL, Type: "http", Public: true})
+	app.balancers = newBalancerRegistry()
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+
+	inFlight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		app.router.ServeHTTP(inFlight, httptest.NewRequest(http.MethodGet, "https://slow.example.com/", nil))
+		close(done)
+	}()
+	<-started
+
+	app.db.AddHost(tobab.Host{Hostname: "new.example.com", Backend: fast.URL, Type: "http", Public: true})
+	app.reloadHosts()
+
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://new.example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("added host: status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	close(release)
+	<-done
+	if inFlight.Code != http.StatusOK {
+		t.Errorf("request that started before the reload: status = %d, want %d", inFlight.Code, http.StatusOK)
+	}
+
+	app.db.DeleteHost("new.example.com")
+	app.reloadHosts()
+	w = httptest.NewRecorder()
+	app.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://new.example.com/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("deleted host: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestRouterSwitch_ConcurrentSwaps(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http", Public: true})
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				app.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+				if w.Code != http.StatusOK {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		app.reloadHosts()
+	}
+	close(stop)
+	wg.Wait()
+	if failed > 0 {
+		t.Errorf("%d requests failed while the router was swapped", failed)
+	}
+}
+
+func TestReloadHosts_SkipsBadHosts(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http", Public: true})
+	app.db.AddHost(tobab.Host{Hostname: "udp.example.com", Backend: backend.URL, Type: "udp", Public: true})
+	app.db.AddHost(tobab.Host{Hostname: "filter.example.com", Backend: backend.URL, Type: "http", Public: true, AllowCIDRs: []string{"not-a-range"}})
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	if err := app.reloadHosts(); err != nil {
+		t.Fatalf("reloadHosts() error = %v", err)
+	}
+	defer app.stopHosts()
+
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("working host: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	for _, h := range []string{"udp.example.com", "filter.example.com"} {
+		w := httptest.NewRecorder()
+		app.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://"+h+"/", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want %d", h, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+type unreachableDB struct {
+	memDB
+}
+
+func (db unreachableDB) GetHosts() ([]tobab.Host, error) {
+	return nil, errors.New("database is unreachable")
+}
+
+func TestReloadHosts_UnreachableDatabase(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http", Public: true})
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+
+	app.db = unreachableDB{app.db.(memDB)}
+	if err := app.reloadHosts(); err == nil {
+		t.Fatal("reloadHosts() without a database returned no error")
+	}
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status after a failed reload = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestReloadHosts_Maintenance(t *testing.T) {
+	probed := make(chan struct{}, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			probed <- struct{}{}
+			return
+		}
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	templates, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http", Public: true, HealthCheckPath: "/health", Maintenance: true})
+	app.templates = templates
+	app.balancers = newBalancerRegistry()
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+
+	r := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("host in maintenance: status = %d with Retry-After '%s', want %d with a Retry-After", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Under maintenance") || strings.Contains(body, "backend") {
+		t.Errorf("host in maintenance served '%s', want the maintenance page", body)
+	}
+	select {
+	case <-probed:
+	case <-time.After(5 * time.Second):
+		t.Error("the backend of a host in maintenance was not health checked")
+	}
+
+	if err := app.SetMaintenance(&clirpc.SetMaintenanceIn{Auth: testAuth, Hostname: "app.example.com"}, &clirpc.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	//the rpc reloads the hosts in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w = httptest.NewRecorder()
+		app.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+		if w.Code == http.StatusOK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "backend" {
+		t.Errorf("after maintenance: status = %d body '%s', want the backend", w.Code, w.Body.String())
+	}
+}
+
+func TestReloadHosts_Cache(t *testing.T) {
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http", Public: true, CacheSizeMB: 1})
+	app.balancers = newBalancerRegistry()
+	app.caches = newCacheRegistry()
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		app.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+		return w.Body.String()
+	}
+	get()
+	//a reload that doesn't change the host keeps its responses
+	app.reloadHosts()
+	if body := get(); body != "backend" || requests != 1 {
+		t.Errorf("second request = '%s' after %d backend requests, want it served from the cache", body, requests)
+	}
+}
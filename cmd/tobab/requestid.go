@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gnur/tobab/muxlogger"
+)
+
+const defaultRequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength limits incoming ids, they end up in every log line of the request
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the id that requestIDMiddleware gave the request
+func requestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+func requestIDHeader(configured string) string {
+	if configured == "" {
+		return defaultRequestIDHeader
+	}
+	return configured
+}
+
+// requestIDMiddleware gives every request an id, an id in the header of the request is reused so the request can
+// be followed through multiple proxies. The id is sent back in the same header on every response, like the
+// served by header it replaces whatever the backend set.
+func requestIDMiddleware(header string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if !validRequestID(id) {
+				id, _ = randomString(12)
+			}
+			r.Header.Set(header, id)
+			r = r.WithContext(withRequestID(r.Context(), id))
+			servedByMiddleware(header, id)(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// validRequestID only accepts ids that can't mess up a log line or a header
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDLogMiddleware adds the request id to the log line of the request
+func requestIDLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := requestIDFromContext(r.Context()); ok {
+			muxlogger.SetField(r, "requestID", id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorWithRequestID is http.Error with the id of the request in the message, so a user can report it
+func errorWithRequestID(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if id, ok := requestIDFromContext(r.Context()); ok {
+		msg = fmt.Sprintf("%s (request id %s)", msg, id)
+	}
+	http.Error(w, msg, code)
+}
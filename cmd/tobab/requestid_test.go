@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Id", r.Header.Get("X-Trace"))
+		w.Header().Set("X-Trace", "set-by-backend")
+	}))
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{RequestIDHeader: "X-Trace"}, tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http", Public: true})
+	hook := test.NewLocal(app.logger.Logger)
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+	h := requestIDMiddleware("X-Trace")(app.router)
+
+	tests := []struct {
+		name     string
+		incoming string
+		reused   bool
+	}{
+		{name: "generated", reused: false},
+		{name: "incoming id is reused", incoming: "abc-123", reused: true},
+		{name: "invalid id is replaced", incoming: "bad id\twith spaces", reused: false},
+		{name: "long id is replaced", incoming: strings.Repeat("a", 200), reused: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			r := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			if tt.incoming != "" {
+				r.Header.Set("X-Trace", tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			id := w.Header().Get("X-Trace")
+			if id == "" || tt.reused && id != tt.incoming || !tt.reused && id == tt.incoming {
+				t.Fatalf("response id = %s, incoming %s", id, tt.incoming)
+			}
+			if got := w.Header().Values("X-Trace"); len(got) != 1 {
+				t.Errorf("response has ids %v, the one of the backend should be replaced", got)
+			}
+			if got := w.Header().Get("X-Got-Id"); got != id {
+				t.Errorf("backend got id %s, want %s", got, id)
+			}
+			var logged bool
+			for _, e := range hook.AllEntries() {
+				if e.Message == "handled request" && e.Data["requestID"] == id {
+					logged = true
+				}
+			}
+			if !logged {
+				t.Error("request log has no request id")
+			}
+		})
+	}
+}
+
+func TestRequestID_InProxyErrors(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	backend.Close()
+
+	proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+	r.Header.Set(defaultRequestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	requestIDMiddleware(defaultRequestIDHeader)(proxy).ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if !strings.Contains(w.Body.String(), "abc-123") || w.Header().Get(defaultRequestIDHeader) != "abc-123" {
+		t.Errorf("error response doesn't have the request id, body: %s", w.Body.String())
+	}
+}
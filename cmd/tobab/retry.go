@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/gnur/tobab"
+)
+
+// retryTransport sends a request that failed before the backend could respond to another healthy backend, at
+// most RetryAttempts times. Only requests without a body and with a method that is safe to repeat are retried,
+// so nothing has to be buffered and a backend never handles a write twice.
+type retryTransport struct {
+	app      *Tobab
+	host     tobab.Host
+	bal      *balancer
+	attempts int
+	next     http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if !retryable(req) {
+		return resp, err
+	}
+	tried := []string{req.URL.Host}
+	for i := 0; i < t.attempts && err != nil && retryableError(err) && req.Context().Err() == nil; i++ {
+		t.bal.markUnhealthy(req.URL.Host)
+		be := t.bal.retryBackend(tried)
+		if be == nil {
+			break
+		}
+		logger := t.app.logger.WithError(err).WithField("host", t.host.Hostname).WithField("failed", req.URL.Host).WithField("backend", be.url.Host).WithField("attempt", i+1)
+		if id, ok := requestIDFromContext(req.Context()); ok {
+			logger = logger.WithField("requestID", id)
+		}
+		logger.Warning("retrying request on another backend")
+
+		req = retryRequest(req, be)
+		tried = append(tried, be.url.Host)
+		resp, err = t.next.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// retryable reports whether req can be sent again, a body may already be partly read by the failed attempt
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// retryableError reports whether err means the backend never got to the request, a timeout or an error after
+// the response started could be a request that is still running on the backend
+func retryableError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryRequest is req pointed at be, the way the director of the proxy points the first attempt at a backend
+func retryRequest(req *http.Request, be *backend) *http.Request {
+	r := req.Clone(req.Context())
+	r.Host = be.url.Host
+	r.URL.Host = be.url.Host
+	r.URL.Scheme = be.url.Scheme
+	if fh := r.Header["X-Forwarded-Host"]; len(fh) > 0 {
+		//the director added the failed backend last
+		fh[len(fh)-1] = be.url.Hostname()
+	}
+	return r
+}
+
+// retryBackend returns the first healthy backend that isn't in tried, or nil when every backend was tried or
+// is unhealthy
+func (b *balancer) retryBackend(tried []string) *backend {
+	now := b.now()
+next:
+	for _, be := range b.backends {
+		for _, host := range tried {
+			if be.url.Host == host {
+				continue next
+			}
+		}
+		if be.healthy(now) {
+			return be
+		}
+	}
+	return nil
+}
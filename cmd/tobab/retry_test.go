@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+// closedAddr is an address nothing listens on, connecting to it is refused
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestRetryTransport(t *testing.T) {
+	live := httptest.NewServer(okHandler)
+	defer live.Close()
+	dead := "http://" + closedAddr(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		attempts   int
+		wantStatus int
+	}{
+		{name: "get is retried", method: http.MethodGet, attempts: 1, wantStatus: http.StatusOK},
+		{name: "head is retried", method: http.MethodHead, attempts: 1, wantStatus: http.StatusOK},
+		{name: "no retries by default", method: http.MethodGet, wantStatus: http.StatusBadGateway},
+		{name: "post is never retried", method: http.MethodPost, body: "a=1", attempts: 3, wantStatus: http.StatusBadGateway},
+		{name: "delete is never retried", method: http.MethodDelete, attempts: 3, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//round robin starts at the first backend, so the first attempt always fails
+			h := tobab.Host{Hostname: "app.example.com", Type: "http", RetryAttempts: tt.attempts, Backends: []tobab.Backend{{URL: dead}, {URL: live.URL}}}
+			proxy, err := newTestApp(tobab.Config{}).generateProxy(h)
+			if err != nil {
+				t.Fatalf("unable to create proxy: %v", err)
+			}
+			var req *http.Request
+			if tt.body != "" {
+				req = httptest.NewRequest(tt.method, "https://app.example.com/", strings.NewReader(tt.body))
+			} else {
+				req = httptest.NewRequest(tt.method, "https://app.example.com/", nil)
+			}
+			req = req.WithContext(withRequestID(req.Context(), "retry-test"))
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRetryTransport_AllBackendsDown(t *testing.T) {
+	h := tobab.Host{Hostname: "app.example.com", Type: "http", RetryAttempts: 5, Backends: []tobab.Backend{{URL: "http://" + closedAddr(t)}, {URL: "http://" + closedAddr(t)}}}
+	proxy, err := newTestApp(tobab.Config{}).generateProxy(h)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+)
+
+// instanceID returns the configured instance id, falling back to $TOBAB_INSTANCE_ID and the hostname of the machine
+func instanceID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	if id := os.Getenv("TOBAB_INSTANCE_ID"); id != "" {
+		return id
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "unknown"
+}
+
+// servedByMiddleware adds a header with the id of this instance to every response. The header is set
+// right before the response is written so a backend can't add its own value.
+func servedByMiddleware(header, id string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if header == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&servedByWriter{ResponseWriter: w, header: header, id: id}, r)
+		})
+	}
+}
+
+type servedByWriter struct {
+	http.ResponseWriter
+	header string
+	id     string
+	wrote  bool
+}
+
+func (sw *servedByWriter) WriteHeader(code int) {
+	if !sw.wrote {
+		sw.wrote = true
+		sw.Header().Set(sw.header, sw.id)
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *servedByWriter) Write(b []byte) (int, error) {
+	if !sw.wrote {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Hijack sets the header first, the reverse proxy writes the 101 response with these headers itself
+func (sw *servedByWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !sw.wrote {
+		sw.wrote = true
+		sw.Header().Set(sw.header, sw.id)
+	}
+	return hijack(sw.ResponseWriter)
+}
+
+func (sw *servedByWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestServedByMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "backend-1")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	proxy, err := newTestApp(tobab.Config{}).generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL})
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   []string
+	}{
+		{name: "off by default", want: []string{"backend-1"}},
+		{name: "replaces the backend value", header: "X-Served-By", want: []string{"tobab-eu-1"}},
+		{name: "custom header name", header: "X-Tobab-Instance", want: []string{"tobab-eu-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			servedByMiddleware(tt.header, "tobab-eu-1")(proxy).ServeHTTP(w, httptest.NewRequest("GET", "https://app.example.com/", nil))
+			name := tt.header
+			if name == "" {
+				name = "X-Served-By"
+			}
+			got := w.Header()[http.CanonicalHeaderKey(name)]
+			if len(got) != len(tt.want) || got[0] != tt.want[0] {
+				t.Errorf("%s = %v, want %v", name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	if got := instanceID("configured"); got != "configured" {
+		t.Errorf("instanceID() = %s, want the configured id", got)
+	}
+	os.Setenv("TOBAB_INSTANCE_ID", "from-env")
+	defer os.Unsetenv("TOBAB_INSTANCE_ID")
+	if got := instanceID(""); got != "from-env" {
+		t.Errorf("instanceID() = %s, want the id from the environment", got)
+	}
+}
@@ -2,28 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"html/template"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/rpc"
-	"net/url"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/gnur/tobab"
 	"github.com/gnur/tobab/muxlogger"
+	"github.com/gnur/tobab/sqlite"
 	"github.com/gnur/tobab/storm"
-	"github.com/gorilla/handlers"
-	"github.com/gorilla/mux"
+	"github.com/markbates/goth"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/argon2"
 )
 
 var version = "manual build"
 
+const defaultServerTimeout = 15 * time.Second
+
 type Tobab struct {
 	fqdn       string
 	key        []byte
@@ -35,19 +39,46 @@ type Tobab struct {
 	confLoc    string
 	db         tobab.Database
 	server     *http.Server
+	//serving is 1 while server accepts requests, it is read by the readiness probe
+	serving    int32
+	httpServer *http.Server
+	rpcServer  *http.Server
+	metrics    *appMetrics
+	authAlerts *authFailureAlerter
+	auditLog   *auditLogger
+	captures   *captureManager
+	dns        *dnsCache
+	balancers  *balancerRegistry
+	caches     *cacheRegistry
+	conns      *connTracker
+	groups     *groupClient
+
+	//tcpProxies are started and stopped together with server
+	tcpMu      sync.Mutex
+	tcpProxies []*tcpProxy
+
+	//router serves the current hosts, reloadHosts replaces it and the tls configs of the hosts
+	router    *routerSwitch
+	tlsHosts  *tlsHostConfigs
+	magic     *certmagic.Config
+	managed   map[string]bool
+	reloadMu  sync.Mutex
+	hostsStop chan struct{}
+
+	//keys are the rotated keys and the previous secret, rotateMu makes sure only one rotation runs at a time
+	keys     *keyRing
+	rotateMu sync.Mutex
 }
 
 func run(confLoc string) {
 	logger := logrus.New()
-	logger.SetFormatter(&logrus.TextFormatter{
-		ForceColors:   true,
-		FullTimestamp: true,
-	})
+	logger.SetFormatter(logFormatter(tobab.LogFormatText))
 
 	cfg, err := tobab.LoadConf(confLoc)
 	if err != nil {
 		logger.WithError(err).Fatal("Failed loading config")
 	}
+	logger.SetFormatter(logFormatter(cfg.LogFormat))
 
 	if lvl, err := logrus.ParseLevel(cfg.Loglevel); err == nil {
 		logger.SetLevel(lvl)
@@ -55,6 +86,20 @@ func run(confLoc string) {
 
 	certmagic.DefaultACME.Agreed = true
 	certmagic.DefaultACME.Email = cfg.Email
+	//startServer enables the http challenge once it has port 80, until then only the TLS-ALPN challenge is
+	//possible, or the DNS-01 challenge when a dns provider is set
+	certmagic.DefaultACME.DisableHTTPChallenge = true
+	//renewed certificates are served right away, even when the old one is still valid
+	certmagic.Default.CertSelection = newestCertificateSelector{}
+
+	dnsProvider, err := newDNSProvider(cfg)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed configuring the DNS-01 challenge")
+	}
+	if dnsProvider != nil {
+		//with a dns provider certmagic only uses the DNS-01 challenge
+		certmagic.DefaultACME.DNSProvider = dnsProvider
+	}
 
 	if cfg.Staging {
 		certmagic.DefaultACME.CA = certmagic.LetsEncryptStagingCA
@@ -68,136 +113,230 @@ func run(confLoc string) {
 	//set secret that goth uses
 	os.Setenv("SESSION_SECRET", string(secret))
 
-	//transform provided salt and secret into a 32 byte key that can be used by paseto
-	key := argon2.IDKey(secret, salt, 4, 4*1024, 2, 32)
-
 	if version == "" {
 		version = "unknown"
 	}
 
-	db, err := storm.New(cfg.DatabasePath)
+	db, err := openDatabase(cfg)
 	if err != nil {
 		logger.WithError(err).WithField("location", cfg.DatabasePath).Fatal("Unable to initialize database")
 	}
-	defer db.Close()
+
+	params, err := keyDerivation(db, salt, cfg.KeyDerivation, logger.WithField("version", version))
+	if err != nil {
+		logger.WithError(err).Fatal("Unable to load the key derivation parameters")
+	}
+	key := deriveKey(secret, salt, params)
 
 	app := Tobab{
 		key:     key,
 		config:  cfg,
 		logger:  logger.WithField("version", version),
-		maxAge:  720 * time.Hour,
 		fqdn:    "https://" + cfg.Hostname,
 		confLoc: confLoc,
 		db:      db,
+		metrics: newMetrics(),
 	}
 
-	if age, err := time.ParseDuration(cfg.DefaultTokenAge); err != nil {
-		app.defaultAge = 720 * time.Hour
-	} else {
-		app.defaultAge = age
+	app.defaultAge, app.maxAge = tokenAges(cfg)
+
+	if cfg.PreviousSecret != "" {
+		grace := app.defaultAge
+		if age, err := time.ParseDuration(cfg.SecretGracePeriod); err == nil {
+			grace = age
+		}
+		validUntil := cfg.SecretRotatedAt.Add(grace)
+		if err := app.retirePreviousSecret(deriveKey([]byte(cfg.PreviousSecret), salt, params), cfg.SecretRotatedAt, validUntil); err != nil {
+			logger.WithError(err).Fatal("Unable to move the signing keys to the new secret")
+		}
+		app.logger.WithField("validUntil", validUntil).Info("accepting tokens signed with the previous secret")
 	}
 
-	if age, err := time.ParseDuration(cfg.MaxTokenAge); err != nil {
-		app.maxAge = 24 * 365 * time.Hour
-	} else {
-		app.maxAge = age
+	if err := app.loadSigningKeys(); err != nil {
+		logger.WithError(err).Fatal("Unable to load the signing keys")
+	}
+
+	app.authAlerts = newAuthFailureAlerter(cfg, app.logger)
+	app.auditLog, err = newAuditLogger(cfg, db, app.logger)
+	if err != nil {
+		logger.WithError(err).WithField("location", cfg.AuditLog).Fatal("Unable to open the audit log")
 	}
+	app.captures = newCaptureManager()
+	app.dns = newDNSCache(cfg)
+	app.balancers = newBalancerRegistry()
+	app.caches = newCacheRegistry()
+	app.conns = newConnTracker()
+	app.groups = newGroupClient()
 
-	app.templates, err = loadTemplates()
+	goth.UseProviders(gothProviders(cfg, app.fqdn)...)
+
+	app.templates, err = loadTemplates(cfg.TemplatesDir)
 	if err != nil {
 		logger.WithError(err).Fatal("unable to load templates")
 	}
 	go app.startServer()
+	//created here so a shutdown that comes before the listener is up still stops it
+	app.rpcServer = &http.Server{}
 	go app.startRPCServer()
+	go app.startMetricsServer()
 
 	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C) or SIGTERM, which is what systemd and
+	// kubernetes send. SIGKILL and SIGQUIT will not be caught.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	// Block until we receive our signal.
-	<-c
-	app.logger.Info("shutting down")
+	sig := <-c
+	app.logger.WithField("signal", sig.String()).Info("shutting down")
+
+	timeout := defaultShutdownTimeout
+	if d, err := time.ParseDuration(cfg.ShutdownTimeout); err == nil {
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		//a second signal doesn't wait for the requests that are left
+		<-c
+		app.logger.Warning("received a second signal, closing connections")
+		cancel()
+	}()
+	app.shutdown(ctx, db.Close)
+}
+
+// tokenAges returns the DefaultTokenAge and MaxTokenAge of cfg, or their defaults when they are not set
+func tokenAges(cfg tobab.Config) (defaultAge, maxAge time.Duration) {
+	defaultAge = 720 * time.Hour
+	if age, err := time.ParseDuration(cfg.DefaultTokenAge); err == nil {
+		defaultAge = age
+	}
+	maxAge = 24 * 365 * time.Hour
+	if age, err := time.ParseDuration(cfg.MaxTokenAge); err == nil {
+		maxAge = age
+	}
+	return defaultAge, maxAge
+}
+
+// logFormatter returns the formatter for a validated log format, colors are only used for text
+func logFormatter(format string) logrus.Formatter {
+	if format == tobab.LogFormatJSON {
+		return &logrus.JSONFormatter{}
+	}
+	return &logrus.TextFormatter{
+		ForceColors:   true,
+		FullTimestamp: true,
+	}
+}
+
+func openDatabase(cfg tobab.Config) (tobab.Database, error) {
+	if cfg.DatabaseType == tobab.DatabaseTypeSQLite {
+		return sqlite.New(cfg.DatabasePath)
+	}
+	return storm.New(cfg.DatabasePath)
+}
+
+func openDatabaseReadOnly(cfg tobab.Config) (tobab.Database, error) {
+	if cfg.DatabaseType == tobab.DatabaseTypeSQLite {
+		return sqlite.NewReadOnly(cfg.DatabasePath)
+	}
+	return storm.NewReadOnly(cfg.DatabasePath)
 }
 
 func (app *Tobab) startRPCServer() {
+	if app.config.RPCSecret == "" {
+		app.logger.Error("no RPCSecret is configured, the rpc is not started")
+		return
+	}
 	err := rpc.Register(app)
 	if err != nil {
 		app.logger.WithError(err).Error("Failed to register rpc")
 		return
 	}
 	rpc.HandleHTTP()
-	l, err := net.Listen("tcp", ":1234")
+	network, address, err := tobab.ParseRPCListen(app.config.RPCListen)
 	if err != nil {
-		app.logger.WithError(err).Error("Failed to start rpc listener")
+		app.logger.WithError(err).Error("Invalid rpc listen address")
 		return
 	}
-	err = http.Serve(l, nil)
+	if network == "unix" {
+		//a socket left behind by a previous run that didn't shut down cleanly blocks the listener
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	l, err := net.Listen(network, address)
 	if err != nil {
+		app.logger.WithError(err).Error("Failed to start rpc listener")
+		return
+	}
+	if network == "unix" {
+		//on top of the RPCSecret only the user tobab runs as may use the socket, so a leaked secret alone isn't enough
+		if err := os.Chmod(address, 0600); err != nil {
+			app.logger.WithError(err).Error("Failed to restrict rpc socket permissions")
+		}
+	}
+	app.logger.WithFields(logrus.Fields{
+		"network": network,
+		"address": l.Addr().String(),
+	}).Info("rpc listening")
+	err = app.rpcServer.Serve(l)
+	if err != nil && err != http.ErrServerClosed {
 		app.logger.WithError(err).Error("Failed to start rpc http")
 		return
 	}
 
 }
 
-func (app *Tobab) restartServer() {
-
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancel()
-	app.logger.Info("shutting down server")
-	err := app.server.Shutdown(ctx)
-	app.logger.WithError(err).Info("server was shut down")
-
-	go app.startServer()
-}
-
+// startServer starts the https listener. Changes to hosts after that are applied by reloadHosts, which swaps the
+// router without touching the listener or its connections.
 func (app *Tobab) startServer() {
 	app.logger.Info("starting server")
-	r := mux.NewRouter()
-	certHosts := []string{app.config.Hostname}
-	var err error
 
-	app.logger.Debug("loading hosts")
-	hosts, err := app.db.GetHosts()
+	httpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", certmagic.HTTPPort))
 	if err != nil {
-		app.logger.WithError(err).Fatal("unable to load hosts")
+		app.logger.WithError(err).Warning("Failed listening for http, plain http requests are not redirected to https")
+	} else {
+		certmagic.DefaultACME.DisableHTTPChallenge = false
 	}
 
-	for _, conf := range hosts {
-		if conf.Type != "http" {
-			app.logger.WithField("type", conf.Type).Fatal("Unsupported type, currently only http is supported")
-		}
-
-		proxy, err := generateProxy(conf.Hostname, conf.Backend)
-		if err != nil {
-			app.logger.WithError(err).WithField("host", conf.Hostname).Error("Failed creating proxy")
-			continue
-		}
-
-		app.logger.WithField("host", conf.Hostname).Debug("starting proxy listener")
-		r.Host(conf.Hostname).PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			proxy.ServeHTTP(w, r)
-		})
-		certHosts = append(certHosts, conf.Hostname)
+	magic := certmagic.NewDefault()
+	//clients without SNI, like probes that connect to an ip, get the certificate of tobab itself
+	magic.DefaultServerName = app.config.Hostname
+	app.magic = magic
+	app.managed = map[string]bool{}
+	tlsConfig := app.tlsConfig(magic.TLSConfig(), nil)
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	//a single host that can't be served is skipped, without a database there is nothing to serve
+	if err := app.reloadHosts(); err != nil {
+		app.logger.WithError(err).Fatal("Unable to load hosts from the database")
 	}
 
-	tobabRoutes := r.Host(app.config.Hostname).Subrouter()
-	app.setTobabRoutes(tobabRoutes)
-
-	r.Use(muxlogger.NewLogger(app.logger).Middleware)
-	r.Use(handlers.CompressHandler)
-	r.Use(app.getRBACMiddleware())
-
-	magicListener, err := certmagic.Listen(certHosts)
+	magicListener, err := tls.Listen("tcp", fmt.Sprintf(":%d", certmagic.HTTPSPort), tlsConfig)
 	if err != nil {
 		app.logger.WithError(err).Fatal("Failed getting certmagic listener")
 	}
 
+	//stopped when the server shuts down
+	stop := make(chan struct{})
 	srv := &http.Server{
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
+		WriteTimeout: serverTimeout(app.config.WriteTimeout),
+		ReadTimeout:  serverTimeout(app.config.ReadTimeout),
 		IdleTimeout:  time.Second * 60,
-		Handler:      r,
+		//acme challenges and the uri length are checked before routing so the router never sees them
+		Handler: app.conns.middleware(requestIDMiddleware(requestIDHeader(app.config.RequestIDHeader))(
+			hstsMiddleware(app.config.StrictTransportSecurity, hstsMaxAge(app.config.StrictTransportSecurityMaxAge))(
+				servedByMiddleware(app.config.ServedByHeader, instanceID(app.config.InstanceID))(
+					acmeChallengeMiddleware(acmeManager(magic))(uriLengthMiddleware(app.config.MaxURILength)(app.router)),
+				),
+			),
+		)),
+	}
+	srv.RegisterOnShutdown(func() {
+		close(stop)
+		app.stopHosts()
+	})
+	if interval := duration(app.config.SessionTicketKeyRotation); interval > 0 && !app.config.DisableSessionTickets {
+		go rotateSessionTicketKeys(tlsConfig, interval, stop)
 	}
 	go func() {
 		err = srv.Serve(magicListener)
@@ -208,30 +347,208 @@ func (app *Tobab) startServer() {
 		}
 	}()
 	app.server = srv
+	app.setServing(true)
+
+	if httpListener != nil {
+		app.httpServer = &http.Server{
+			WriteTimeout: defaultServerTimeout,
+			ReadTimeout:  defaultServerTimeout,
+			IdleTimeout:  time.Second * 60,
+			Handler:      acmeChallengeMiddleware(acmeManager(magic))(http.HandlerFunc(redirectToHTTPS)),
+		}
+		go func() {
+			err := app.httpServer.Serve(httpListener)
+			if err != nil && err != http.ErrServerClosed {
+				app.logger.WithError(err).Error("Failed serving http")
+			}
+		}()
+	}
+}
+
+func (app *Tobab) disabledHostHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "300")
+	app.errorPage(w, r, "this host is temporarily unavailable", http.StatusServiceUnavailable)
 }
 
-func generateProxy(host, backend string) (http.Handler, error) {
-	url, err := url.Parse(backend)
+// maintenanceHandler is served instead of the proxy of a host in maintenance. Its health checks keep running so
+// the health of the backend shows when it is safe to end the maintenance.
+func (app *Tobab) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "300")
+	app.maintenancePage(w, r)
+}
+
+func (app *Tobab) generateProxy(h tobab.Host) (http.Handler, error) {
+	bal, err := newBalancer(h)
+	if err != nil {
+		return nil, err
+	}
+	timeouts := h.EffectiveTimeouts(app.config.Defaults)
+	tlsConfig, err := app.backendTLSConfig(h)
 	if err != nil {
 		return nil, err
 	}
+
+	trusted := app.trustedProxies()
+	bal.trusted = trusted
+	idHeader := requestIDHeader(app.config.RequestIDHeader)
+
 	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
+			url := bal.pick(req).url
+			//before the headers of tobab itself, so these win
+			setRequestHeaders(req, h.SetRequestHeaders)
+			forwardHeaders(req, trusted)
+			if id, ok := requestIDFromContext(req.Context()); ok {
+				req.Header.Set(idHeader, id)
+			}
 			req.Header.Add("X-Forwarded-Host", url.Hostname())
-			req.Header.Add("X-Origin-Host", host)
+			req.Header.Add("X-Origin-Host", h.Hostname)
 			req.Host = url.Host
 			req.URL.Host = url.Host
 			req.URL.Scheme = url.Scheme
+			unprefixCookies(req, h.CookiePrefix)
+			preserveHeaderCasing(req.Header, h.HeaderCasing)
+		},
+	}
+	var transport http.RoundTripper = &http.Transport{
+		TLSHandshakeTimeout:   10 * time.Second,
+		TLSClientConfig:       tlsConfig,
+		IdleConnTimeout:       duration(timeouts.IdleTimeout),
+		ResponseHeaderTimeout: duration(timeouts.ResponseTimeout),
+		MaxIdleConns:          100,
+		DialContext: app.dialContext(&net.Dialer{
+			Timeout:   duration(timeouts.DialTimeout),
+			KeepAlive: 300 * time.Second,
+		}),
+	}
+	if h.RetryAttempts > 0 {
+		transport = &retryTransport{app: app, host: h, bal: bal, attempts: h.RetryAttempts, next: transport}
+	}
+	proxy.Transport = upstreamTimer{next: transport}
+
+	modifiers := []func(*http.Response) error{cookieModifier(h)}
+	if len(h.SetResponseHeaders) > 0 || len(h.RemoveResponseHeaders) > 0 {
+		modifiers = append(modifiers, responseHeaderModifier(h))
+	}
+	if h.Decompress {
+		modifiers = append(modifiers, decompressModifier)
+	}
+	if h.BufferResponse {
+		modifiers = append(modifiers, bufferModifier(h.BufferMaxBytes))
+	}
+	if h.CSPNonce {
+		modifiers = append(modifiers, cspNonceModifier(h.CSPNonceMaxBytes))
+	}
+	proxy.ModifyResponse = chainModifiers(modifiers)
+	proxy.ErrorHandler = app.proxyErrorHandler(h, bal)
+
+	app.balancers.set(h.Hostname, bal)
+	return app.trackCanceled(h, requestTimeout(duration(timeouts.RequestTimeout), app.unavailableMiddleware(bal, variantMiddleware(h, bal, countConnections(bal, proxy))))), nil
+}
 
-		}, Transport: &http.Transport{
-			TLSHandshakeTimeout: 10 * time.Second,
-			IdleConnTimeout:     90 * time.Second,
-			MaxIdleConns:        100,
-			Dial: (&net.Dialer{
-				Timeout:   600 * time.Second,
-				KeepAlive: 300 * time.Second,
-			}).Dial,
-		}}
-
-	return proxy, nil
+// upstreamTimer logs how long the backend took to respond with headers as upstream_ms, including retries, so
+// it can be told apart from the time tobab itself took for the request
+type upstreamTimer struct {
+	next http.RoundTripper
+}
+
+func (t upstreamTimer) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	//the upstream request has the context of the client request, so this ends up in its log line
+	muxlogger.SetField(req, "upstream_ms", float64(time.Since(start))/float64(time.Millisecond))
+	return resp, err
+}
+
+// requestTimeout cancels the request, including the upstream request, once d has passed
+func requestTimeout(d time.Duration, next http.Handler) http.Handler {
+	if d <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// serverTimeout is a read or write timeout of the https server, unset means the default of 15s
+func serverTimeout(s string) time.Duration {
+	if s == "" {
+		return defaultServerTimeout
+	}
+	return duration(s)
+}
+
+// duration parses a validated duration, an empty value means no timeout
+func duration(s string) time.Duration {
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+func (app *Tobab) proxyErrorHandler(h tobab.Host, bal *balancer) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() == context.Canceled {
+			//the client is gone, there is nobody to send an error to
+			return
+		}
+		if bodyTooLarge(r) {
+			//the backend is fine, the client sent too much
+			app.hostErrorPage(w, r, h.Hostname, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if retryableError(err) || backendTLSErrorReason(err) != "" {
+			//r is the upstream request, so its url has the backend that failed. A timeout or a response that
+			//couldn't be read is one request, the backend can still serve the others
+			bal.markUnhealthy(r.URL.Host)
+		}
+		app.metrics.proxyErrors.WithLabelValues(h.Hostname).Inc()
+		logger := app.logger.WithError(err).WithField("host", h.Hostname)
+		if id, ok := requestIDFromContext(r.Context()); ok {
+			logger = logger.WithField("requestID", id)
+		}
+		logger.Error("proxy error")
+		if reason := backendTLSErrorReason(err); reason != "" {
+			app.metrics.backendTLS.WithLabelValues(h.Hostname, reason).Inc()
+			if reason == "expired" {
+				app.hostErrorPage(w, r, h.Hostname, "backend certificate expired", http.StatusBadGateway)
+				return
+			}
+		}
+		if netErr, ok := err.(net.Error); r.Context().Err() == context.DeadlineExceeded || ok && netErr.Timeout() {
+			app.hostErrorPage(w, r, h.Hostname, "backend did not respond in time", http.StatusGatewayTimeout)
+			return
+		}
+		app.hostErrorPage(w, r, h.Hostname, "backend unavailable", http.StatusBadGateway)
+	}
+}
+
+// trackCanceled counts requests of which the client disconnected before the response was sent. The upstream
+// request uses the context of the client request so those are canceled as well.
+func (app *Tobab) trackCanceled(h tobab.Host, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//deferred so it also runs when the proxy aborts the handler halfway through the body
+		defer func() {
+			if r.Context().Err() == context.Canceled {
+				app.metrics.clientCanceled.WithLabelValues(h.Hostname).Inc()
+				app.logger.WithFields(logrus.Fields{
+					"host": h.Hostname,
+					"path": r.URL.Path,
+				}).Info("client canceled request")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// chainModifiers runs all response modifiers in order and stops at the first error
+func chainModifiers(modifiers []func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, m := range modifiers {
+			if err := m(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/muxlogger"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestProxy_ClientDisconnectCancelsUpstream(t *testing.T) {
+	backendCanceled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first chunk"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(backendCanceled)
+	}))
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{})
+	proxy, err := app.generateProxy(tobab.Host{Hostname: "app.example.com", Backend: backend.URL})
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	done := make(chan struct{})
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		proxy.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", front.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	_, _ = resp.Body.Read(buf)
+	//client goes away mid stream
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-backendCanceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend request was not canceled after the client disconnected")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy handler did not return")
+	}
+
+	if got := testutil.ToFloat64(app.metrics.clientCanceled.WithLabelValues("app.example.com")); got != 1 {
+		t.Errorf("client canceled requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(app.metrics.proxyErrors.WithLabelValues("app.example.com")); got != 0 {
+		t.Errorf("proxy errors = %v, want 0", got)
+	}
+}
+
+func TestProxy_ResponseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			//headers right away, the body takes longer than the response timeout
+			w.Write([]byte("first chunk,"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte("second chunk"))
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{})
+	proxy, err := app.generateProxy(tobab.Host{
+		Hostname: "app.example.com",
+		Backend:  backend.URL,
+		Timeouts: tobab.Timeouts{ResponseTimeout: "50ms"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/slow", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("slow backend: status = %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("slow backend was cut off after %s instead of the response timeout", took)
+	}
+
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.com/stream", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "first chunk,second chunk" {
+		t.Errorf("streaming response was cut off: %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestLogFormatter_JSONRequestLogs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(logFormatter(tobab.LogFormatJSON))
+
+	h := muxlogger.NewLogger(logger.WithField("version", "test")).Middleware(okHandler)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://app.example.com/some/path", nil))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("request log is not json: %v\n%s", err, buf.String())
+	}
+	for key, want := range map[string]interface{}{
+		"msg":     "handled request",
+		"method":  "GET",
+		"host":    "app.example.com",
+		"path":    "/some/path",
+		"status":  float64(http.StatusOK),
+		"version": "test",
+	} {
+		if line[key] != want {
+			t.Errorf("%s = %v, want %v", key, line[key], want)
+		}
+	}
+	if _, ok := line["took_ms"].(float64); !ok {
+		t.Errorf("took_ms is not a number: %v", line["took_ms"])
+	}
+	if strings.Contains(buf.String(), "\x1b[") {
+		t.Error("json logs contain colors")
+	}
+}
+
+func TestProxy_LogsUpstreamTime(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte(strings.Repeat("compressible ", 100)))
+	}))
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "app.example.com", Backend: backend.URL, Type: "http", Public: true})
+	hook := test.NewLocal(app.logger.Logger)
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+
+	//through the complete chain, so with compression and rbac
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("response was not compressed")
+	}
+
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "handled request" {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatal("request was not logged")
+	}
+	upstream, ok := entry.Data["upstream_ms"].(float64)
+	if !ok {
+		t.Fatalf("upstream_ms not logged: %v", entry.Data)
+	}
+	if upstream < 50 {
+		t.Errorf("upstream_ms = %f, want at least 50", upstream)
+	}
+	if took := entry.Data["took_ms"].(float64); took < upstream {
+		t.Errorf("took_ms = %f is less than upstream_ms = %f", took, upstream)
+	}
+}
+
+func TestProxyErrorHandler_MarksUnhealthy(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantUnhealthy bool
+	}{
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, wantUnhealthy: true},
+		{name: "connection reset", err: fmt.Errorf("read: %w", syscall.ECONNRESET), wantUnhealthy: true},
+		{name: "tls handshake", err: x509.UnknownAuthorityError{}, wantUnhealthy: true},
+		{name: "response timeout", err: context.DeadlineExceeded},
+		{name: "invalid response", err: fmt.Errorf("unable to decompress response: %w", gzip.ErrHeader)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := hashHost("http://a:80", "http://b:80")
+			bal, _ := newBalancer(h)
+			app := newTestApp(tobab.Config{})
+
+			r := httptest.NewRequest(http.MethodGet, "http://a:80/", nil)
+			app.proxyErrorHandler(h, bal)(httptest.NewRecorder(), r, tt.err)
+			if unhealthy := !bal.backends[0].healthy(time.Now()); unhealthy != tt.wantUnhealthy {
+				t.Errorf("backend unhealthy = %t, want %t", unhealthy, tt.wantUnhealthy)
+			}
+		})
+	}
+}
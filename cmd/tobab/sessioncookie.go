@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tokenCookie = "X-Tobab-Token"
+	//maxCookieValueBytes stays below the 4096 bytes browsers allow for a cookie including its attributes
+	maxCookieValueBytes = 3800
+	//maxTokenChunks bounds how many chunk cookies are read, together they stay well below the header limits
+	//of common servers
+	maxTokenChunks = 8
+)
+
+var ErrTokenTooLarge = errors.New("Token is too large for the session cookies")
+
+// setTokenCookie stores the token in the session cookie. Tokens that are too large for a single cookie are
+// split over X-Tobab-Token-0, X-Tobab-Token-1 and so on, cookies of a previous session in the other format are
+// removed so they can't be picked up instead. A token that needs more than maxTokenChunks cookies would not be
+// read back, ErrTokenTooLarge is returned for it and no cookie is set.
+func (app *Tobab) setTokenCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) error {
+	var chunks []string
+	for len(token) > maxCookieValueBytes {
+		chunks = append(chunks, token[:maxCookieValueBytes])
+		token = token[maxCookieValueBytes:]
+	}
+	if len(chunks) == 0 {
+		app.clearTokenCookies(w, r, 0)
+		http.SetCookie(w, app.tokenCookie(tokenCookie, token, expires))
+		return nil
+	}
+	chunks = append(chunks, token)
+	if len(chunks) > maxTokenChunks {
+		return ErrTokenTooLarge
+	}
+
+	app.clearTokenCookies(w, r, len(chunks))
+	for i, chunk := range chunks {
+		http.SetCookie(w, app.tokenCookie(chunkName(i), chunk, expires))
+	}
+	return nil
+}
+
+// clearTokenCookies expires the session cookies in r, except for the first keep chunks. With keep 0 the
+// unchunked cookie is kept as well.
+func (app *Tobab) clearTokenCookies(w http.ResponseWriter, r *http.Request, keep int) {
+	for _, c := range r.Cookies() {
+		if c.Name == tokenCookie && keep == 0 {
+			continue
+		}
+		if c.Name != tokenCookie && !isTokenChunk(c.Name, keep) {
+			continue
+		}
+		expired := app.tokenCookie(c.Name, "", time.Time{})
+		expired.MaxAge = -1
+		http.SetCookie(w, expired)
+	}
+}
+
+// expireTokenCookies removes the whole session, the unchunked cookie as well as all of its chunks
+func (app *Tobab) expireTokenCookies(w http.ResponseWriter, r *http.Request) {
+	app.clearTokenCookies(w, r, 0)
+	expired := app.tokenCookie(tokenCookie, "", time.Time{})
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+}
+
+func (app *Tobab) tokenCookie(name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Domain:   app.config.CookieScope,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   true,
+		HttpOnly: true,
+		Expires:  expires,
+		Value:    value,
+		Path:     "/",
+	}
+}
+
+// tokenFromRequest returns the session token, joining the chunks when it was split
+func tokenFromRequest(r *http.Request) (string, error) {
+	if c, err := r.Cookie(tokenCookie); err == nil {
+		return c.Value, nil
+	}
+	var token strings.Builder
+	for i := 0; i < maxTokenChunks; i++ {
+		c, err := r.Cookie(chunkName(i))
+		if err != nil {
+			break
+		}
+		token.WriteString(c.Value)
+	}
+	if token.Len() == 0 {
+		return "", ErrUnauthenticatedRequest
+	}
+	return token.String(), nil
+}
+
+func chunkName(i int) string {
+	return tokenCookie + "-" + strconv.Itoa(i)
+}
+
+// isTokenChunk reports whether name is a chunk cookie with an index of at least from
+func isTokenChunk(name string, from int) bool {
+	if !strings.HasPrefix(name, tokenCookie+"-") {
+		return false
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(name, tokenCookie+"-"))
+	return err == nil && i >= from
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gorilla/mux"
+	"github.com/o1egl/paseto/v2"
+)
+
+func TestTokenCookie_LargeClaims(t *testing.T) {
+	var gotUser string
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser = r.Header.Get("X-Tobab-User")
+	}))
+	//small enough that forwarding the session would result in a 431
+	backend.Config.MaxHeaderBytes = 4096
+	backend.Start()
+	defer backend.Close()
+
+	host := tobab.Host{
+		Hostname: "app.example.com",
+		Backend:  backend.URL,
+		Type:     "http",
+		Globs:    []tobab.Glob{"*@example.com"},
+	}
+	app := newTestApp(tobab.Config{}, host)
+
+	claims := paseto.JSONToken{
+		Subject:    "alice@example.com",
+		IssuedAt:   time.Now(),
+		NotBefore:  time.Now(),
+		Expiration: time.Now().Add(time.Hour),
+	}
+	claims.Set("groups", strings.Repeat("engineering-platform-team,", 400))
+	token, err := v2.Encrypt(app.key, claims, footer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := app.setTokenCookie(w, httptest.NewRequest(http.MethodGet, "/", nil), token, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range w.Header()["Set-Cookie"] {
+		if len(c) >= 4096 {
+			t.Errorf("cookie of %d bytes is too large for a browser", len(c))
+		}
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) < 2 {
+		t.Fatalf("expected the token of %d bytes to be split, got %d cookies", len(token), len(cookies))
+	}
+
+	proxy, err := app.generateProxy(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	app.getRBACMiddleware()(proxy).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if gotUser != "alice@example.com" {
+		t.Errorf("backend got user '%s'", gotUser)
+	}
+}
+
+func TestTokenCookie_RemovesStaleChunks(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 3; i++ {
+		r.AddCookie(&http.Cookie{Name: chunkName(i), Value: "old"})
+	}
+
+	w := httptest.NewRecorder()
+	if err := app.setTokenCookie(w, r, "small", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	set := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		set[c.Name] = c
+	}
+	if c := set[tokenCookie]; c == nil || c.Value != "small" {
+		t.Errorf("expected an unchunked token cookie, got %v", set)
+	}
+	for i := 0; i < 3; i++ {
+		if c := set[chunkName(i)]; c == nil || c.MaxAge != -1 {
+			t.Errorf("chunk %d of the previous session was not removed", i)
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: tokenCookie, Value: "small"})
+	w = httptest.NewRecorder()
+	if err := app.setTokenCookie(w, r, strings.Repeat("x", maxCookieValueBytes+1), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	set = map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		set[c.Name] = c
+	}
+	if c := set[tokenCookie]; c == nil || c.MaxAge != -1 {
+		t.Error("the unchunked cookie should be removed when the token is split")
+	}
+	if set[chunkName(0)] == nil || set[chunkName(1)] == nil {
+		t.Errorf("expected two chunks, got %v", set)
+	}
+}
+
+func TestTokenCookie_TooLarge(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+
+	w := httptest.NewRecorder()
+	token := strings.Repeat("x", maxTokenChunks*maxCookieValueBytes)
+	if err := app.setTokenCookie(w, httptest.NewRequest(http.MethodGet, "/", nil), token, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("a token of %d chunks should fit: %v", maxTokenChunks, err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if got, err := tokenFromRequest(r); err != nil || got != token {
+		t.Errorf("the largest token is not read back: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	if err := app.setTokenCookie(w, httptest.NewRequest(http.MethodGet, "/", nil), token+"x", time.Now().Add(time.Hour)); err != ErrTokenTooLarge {
+		t.Errorf("expected ErrTokenTooLarge, got %v", err)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("no cookies should be set for a token that is too large, got %d", len(cookies))
+	}
+}
+
+func TestLogout_ExpiresSession(t *testing.T) {
+	app := newTestApp(tobab.Config{CookieScope: "example.com"})
+	router := mux.NewRouter()
+	app.setTobabRoutes(router)
+
+	r := httptest.NewRequest(http.MethodGet, "https://tobab.example.com/logout", nil)
+	token, err := app.newToken("alice@example.com", "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//split the token in two chunks
+	r.AddCookie(&http.Cookie{Name: chunkName(0), Value: token[:10]})
+	r.AddCookie(&http.Cookie{Name: chunkName(1), Value: token[10:]})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Errorf("expected a redirect to the login page, got %d to '%s'", w.Code, w.Header().Get("Location"))
+	}
+	set := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		set[c.Name] = c
+	}
+	for _, name := range []string{tokenCookie, chunkName(0), chunkName(1), "X-Tobab-Source"} {
+		c := set[name]
+		if c == nil || c.MaxAge != -1 {
+			t.Errorf("cookie %s was not expired", name)
+			continue
+		}
+		if c.Domain != "example.com" {
+			t.Errorf("cookie %s was expired for domain '%s' instead of the cookie scope", name, c.Domain)
+		}
+	}
+
+	//a copy of the token is no longer accepted either
+	r = httptest.NewRequest(http.MethodGet, "https://tobab.example.com/", nil)
+	r.AddCookie(&http.Cookie{Name: tokenCookie, Value: token})
+	if _, err := app.extractUser(r); err != ErrRevokedToken {
+		t.Errorf("expected the token to be revoked after logout, got %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdown stops tobab in an order where nothing uses a resource after it is gone. The http redirects go first,
+// then the https server stops accepting connections and drains in flight requests and upgraded connections,
+// together with the tcp listeners, then the rpc server, which can still change hosts until then, and the
+// database is closed last.
+func (app *Tobab) shutdown(ctx context.Context, closeDB func()) {
+	//load balancers stop sending new requests while the old ones drain
+	app.setServing(false)
+	servers := []struct {
+		name string
+		srv  *http.Server
+	}{
+		{"http", app.httpServer},
+		{"server", app.server},
+		{"rpc", app.rpcServer},
+	}
+	for _, s := range servers {
+		if s.srv == nil {
+			continue
+		}
+		logger := app.logger.WithField("step", s.name)
+		start := time.Now()
+		logger.Info("draining requests")
+		if err := s.srv.Shutdown(ctx); err != nil {
+			//the timeout passed, close whatever is left so the database isn't used after it is closed
+			l := logger.WithError(err)
+			if s.name == "server" {
+				l = l.WithField("streaming", app.conns.streaming())
+			}
+			l.Warn("requests did not finish in time, closing connections")
+			s.srv.Close()
+		}
+		if s.name == "server" {
+			//Shutdown and Close leave hijacked connections open
+			if n := app.conns.closeHijacked(duration(app.config.UpgradedShutdownTimeout)); n > 0 {
+				logger.WithField("connections", n).Warn("closed upgraded connections that were still open, like websockets")
+			}
+		}
+		logger.WithField("took", time.Since(start)).Info("stopped")
+		if s.name == "server" {
+			app.logger.WithField("step", "tcp").Info("closing tcp listeners")
+			app.closeTCPProxies()
+		}
+	}
+
+	app.logger.WithField("step", "database").Info("closing database")
+	//a database audit log needs the database, so it goes first
+	app.auditLog.close()
+	closeDB()
+	app.logger.Info("shutdown complete")
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestShutdown_ClosesDatabaseAfterDraining(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	hook := test.NewLocal(app.logger.Logger)
+
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		record("request finished")
+	})}
+	app.rpcServer = &http.Server{}
+
+	for _, srv := range []*http.Server{app.server, app.rpcServer} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(l)
+		if srv == app.server {
+			go http.Get("http://" + l.Addr().String())
+		}
+	}
+	<-started
+	app.setServing(true)
+
+	done := make(chan struct{})
+	go func() {
+		app.shutdown(context.Background(), func() { record("database closed") })
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("shutdown finished while a request was in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if app.readinessChecks()["server"] == nil {
+		t.Error("tobab is still ready while it drains requests")
+	}
+	close(release)
+	<-done
+
+	if len(events) != 2 || events[0] != "request finished" || events[1] != "database closed" {
+		t.Errorf("expected the database to be closed after the request finished, got %v", events)
+	}
+
+	var steps []string
+	for _, e := range hook.AllEntries() {
+		if step, ok := e.Data["step"].(string); ok && e.Message != "draining requests" {
+			steps = append(steps, step)
+		}
+	}
+	want := []string{"server", "tcp", "rpc", "database"}
+	if strings.Join(steps, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v to be stopped in that order, got %v", want, steps)
+	}
+}
+
+func TestShutdown_TimeoutStillClosesDatabase(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	app.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.server.Serve(l)
+	go http.Get("http://" + l.Addr().String())
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	closed := false
+	app.shutdown(ctx, func() { closed = true })
+	if !closed {
+		t.Error("database was not closed after the shutdown timeout")
+	}
+}
+
+func TestShutdown_UpgradedConnections(t *testing.T) {
+	tests := []struct {
+		name        string
+		wait        string
+		clientClose time.Duration
+		wantClosed  int
+	}{
+		{name: "closed right away", wantClosed: 1},
+		{name: "closed after waiting", wait: "100ms", wantClosed: 1},
+		{name: "client closes while waiting", wait: "5s", clientClose: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{UpgradedShutdownTimeout: tt.wait})
+			hook := test.NewLocal(app.logger.Logger)
+			app.conns = newConnTracker()
+
+			hijacked := make(chan struct{})
+			app.server = &http.Server{Handler: app.conns.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, _, err := hijack(w)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				close(hijacked)
+				//like the reverse proxy, which closes it when either side is done
+				ioutil.ReadAll(conn)
+				conn.Close()
+			}))}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go app.server.Serve(l)
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte("GET / HTTP/1.1\r\nHost: app.example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+			<-hijacked
+			if tt.clientClose > 0 {
+				time.AfterFunc(tt.clientClose, func() { client.Close() })
+			}
+
+			start := time.Now()
+			app.shutdown(context.Background(), func() {})
+			if tt.clientClose > 0 && time.Since(start) > time.Second {
+				t.Errorf("shutdown took %s, it should stop waiting once the connection is closed", time.Since(start))
+			}
+			if tt.wantClosed > 0 {
+				client.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+					t.Errorf("client connection is still open after the shutdown: %v", err)
+				}
+			}
+
+			closed := 0
+			for _, e := range hook.AllEntries() {
+				if n, ok := e.Data["connections"].(int); ok {
+					closed = n
+				}
+			}
+			if closed != tt.wantClosed {
+				t.Errorf("shutdown logged %d closed connections, want %d", closed, tt.wantClosed)
+			}
+		})
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestConnTracker_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("data: 2\n\n"))
+	}))
+	defer backend.Close()
+	var once sync.Once
+	releaseBackend := func() { once.Do(func() { close(release) }) }
+	//a failing test still has to let the backend finish, or closing it blocks
+	defer releaseBackend()
+
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "events.example.com", Backend: backend.URL, Type: "http", Public: true})
+	app.conns = newConnTracker()
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+	srv := httptest.NewServer(app.conns.middleware(app.router))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	req.Host = "events.example.com"
+	//asked for explicitly, so the client doesn't ask for gzip
+	req.Header.Set("Accept-Encoding", "identity")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	//the first event has to get through every middleware while the backend is still busy with the second
+	first := make([]byte, len("data: 1\n\n"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "data: 1\n\n" {
+		t.Fatalf("first event = '%s', %v", first, err)
+	}
+	if n := app.conns.streaming(); n != 1 {
+		t.Errorf("streaming() = %d while a response is streaming, want 1", n)
+	}
+	releaseBackend()
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(rest) != "data: 2\n\n" {
+		t.Errorf("second event = '%s', %v", rest, err)
+	}
+	//the handler returns after the client has the last bytes
+	deadline := time.Now().Add(time.Second)
+	for app.conns.streaming() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := app.conns.streaming(); n != 0 {
+		t.Errorf("streaming() = %d after the response ended, want 0", n)
+	}
+}
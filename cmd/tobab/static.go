@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/gnur/tobab"
+)
+
+// staticFS hides directories without an index.html unless listing is enabled, http.FileServer would list them
+type staticFS struct {
+	fs      http.FileSystem
+	listing bool
+}
+
+func (s staticFS) Open(name string) (http.File, error) {
+	f, err := s.fs.Open(name)
+	if err != nil || s.listing {
+		return f, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.IsDir() {
+		index, err := s.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// staticHandler serves the files in the Backend directory of a static host. With SPAFallback paths that
+// don't exist get the index.html of the root, so the client side router of a single page app can handle them.
+func staticHandler(h tobab.Host) http.Handler {
+	fs := staticFS{fs: http.Dir(h.Backend), listing: h.DirectoryListing}
+	files := http.FileServer(fs)
+	if !h.SPAFallback {
+		return files
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := fs.Open(path.Clean("/" + r.URL.Path))
+		if err == nil {
+			f.Close()
+		}
+		if !os.IsNotExist(err) {
+			files.ServeHTTP(w, r)
+			return
+		}
+		index, err := fs.Open("/index.html")
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer index.Close()
+		st, err := index.Stat()
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "index.html", st.ModTime(), index)
+	})
+}
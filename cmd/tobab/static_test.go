@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+// staticDir creates a site with an index, an asset, a directory with an index and one without
+func staticDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tobab-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"index.html":      "app index",
+		"app.js":          "console.log(1)",
+		"docs/index.html": "docs index",
+		"files/a.txt":     "a",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestStaticHandler(t *testing.T) {
+	dir := staticDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name       string
+		host       tobab.Host
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "index", path: "/", wantStatus: http.StatusOK, wantBody: "app index"},
+		{name: "file", path: "/app.js", wantStatus: http.StatusOK, wantBody: "console.log(1)"},
+		{name: "directory index", path: "/docs/", wantStatus: http.StatusOK, wantBody: "docs index"},
+		{name: "unknown path", path: "/users/42", wantStatus: http.StatusNotFound},
+		{name: "no listing by default", path: "/files/", wantStatus: http.StatusNotFound},
+		{name: "listing", host: tobab.Host{DirectoryListing: true}, path: "/files/", wantStatus: http.StatusOK, wantBody: "a.txt"},
+		{name: "traversal", path: "/../../etc/passwd", wantStatus: http.StatusNotFound},
+		{name: "spa fallback", host: tobab.Host{SPAFallback: true}, path: "/users/42", wantStatus: http.StatusOK, wantBody: "app index"},
+		{name: "spa fallback keeps files", host: tobab.Host{SPAFallback: true}, path: "/app.js", wantStatus: http.StatusOK, wantBody: "console.log(1)"},
+		{name: "spa fallback for directory without index", host: tobab.Host{SPAFallback: true}, path: "/files/", wantStatus: http.StatusOK, wantBody: "app index"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.host.Backend = dir
+			w := httptest.NewRecorder()
+			staticHandler(tt.host).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://static.example.com"+tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestReloadHosts_StaticHostRequiresLogin(t *testing.T) {
+	dir := staticDir(t)
+	defer os.RemoveAll(dir)
+
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "static.example.com", Backend: dir, Type: "static", Globs: []tobab.Glob{"*@example.com"}})
+	app.router = newRouterSwitch(http.NotFoundHandler())
+	app.reloadHosts()
+	defer app.stopHosts()
+
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://static.example.com/", nil))
+	if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "app index") {
+		t.Errorf("static host was served without a login, status %d", w.Code)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/sirupsen/logrus"
+)
+
+// tcpProxy copies raw connections between its listener and the backend of a tcp host. There is nothing to
+// authenticate on a raw stream so connections are only accepted from the allowed ip ranges.
+type tcpProxy struct {
+	host     tobab.Host
+	logger   *logrus.Entry
+	listener net.Listener
+	backend  string
+	allowed  []*net.IPNet
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// startTCPProxy listens on the address of a tcp host. Tcp hosts don't go through the router or the https
+// listener, every host has a listener of its own next to it.
+func (app *Tobab) startTCPProxy(h tobab.Host) (*tcpProxy, error) {
+	allowed, err := tobab.ParseIPNets(h.AllowedIPs)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", h.Listen)
+	if err != nil {
+		return nil, err
+	}
+	timeouts := h.EffectiveTimeouts(app.config.Defaults)
+	p := &tcpProxy{
+		host:     h,
+		logger:   app.logger.WithField("host", h.Hostname),
+		listener: l,
+		backend:  h.Backend,
+		allowed:  allowed,
+		dial: app.dialContext(&net.Dialer{
+			Timeout:   duration(timeouts.DialTimeout),
+			KeepAlive: 300 * time.Second,
+		}),
+		conns: map[net.Conn]struct{}{},
+	}
+	p.logger.WithField("address", l.Addr().String()).Info("starting tcp listener")
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+func (p *tcpProxy) serve() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if !closed {
+				p.logger.WithError(err).Error("tcp listener failed")
+			}
+			return
+		}
+		if !p.allow(conn.RemoteAddr()) {
+			p.logger.WithField("remoteAddr", conn.RemoteAddr().String()).Warning("tcp connection from an ip that is not allowed")
+			conn.Close()
+			continue
+		}
+		if !p.track(conn) {
+			conn.Close()
+			return
+		}
+		p.wg.Add(1)
+		go p.handle(conn)
+	}
+}
+
+func (p *tcpProxy) allow(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range p.allowed {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// track registers conn so Close can close it, it returns false when the proxy is already closed
+func (p *tcpProxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *tcpProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	delete(p.conns, conn)
+	p.mu.Unlock()
+}
+
+func (p *tcpProxy) handle(client net.Conn) {
+	defer p.wg.Done()
+	defer p.untrack(client)
+	defer client.Close()
+
+	backend, err := p.dial(context.Background(), "tcp", p.backend)
+	if err != nil {
+		p.logger.WithError(err).Error("unable to connect to tcp backend")
+		return
+	}
+	if !p.track(backend) {
+		backend.Close()
+		return
+	}
+	defer p.untrack(backend)
+	defer backend.Close()
+
+	done := make(chan struct{})
+	go func() {
+		copyAndCloseWrite(backend, client)
+		close(done)
+	}()
+	copyAndCloseWrite(client, backend)
+	<-done
+}
+
+// copyAndCloseWrite copies until src is done and then tells dst nothing more is coming, so both directions
+// of a connection can end independently
+func copyAndCloseWrite(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// updateTCPProxies makes the running tcp proxies match hosts. Proxies of hosts that didn't change keep
+// running, the others are closed before the new ones start so they can listen on the same address.
+func (app *Tobab) updateTCPProxies(hosts []tobab.Host) (failed int) {
+	app.tcpMu.Lock()
+	defer app.tcpMu.Unlock()
+
+	current := map[string]*tcpProxy{}
+	for _, p := range app.tcpProxies {
+		current[p.host.Hostname] = p
+	}
+	var proxies []*tcpProxy
+	var start []tobab.Host
+	for _, h := range hosts {
+		if p, ok := current[h.Hostname]; ok && reflect.DeepEqual(p.host, h) {
+			proxies = append(proxies, p)
+			delete(current, h.Hostname)
+			continue
+		}
+		start = append(start, h)
+	}
+	for _, p := range current {
+		p.Close()
+	}
+	for _, h := range start {
+		p, err := app.startTCPProxy(h)
+		if err != nil {
+			app.logger.WithError(err).WithField("host", h.Hostname).Error("Failed starting tcp listener")
+			failed++
+			continue
+		}
+		proxies = append(proxies, p)
+	}
+	app.tcpProxies = proxies
+	return failed
+}
+
+// closeTCPProxies closes the listeners and connections of all tcp hosts, it returns when they are all done
+func (app *Tobab) closeTCPProxies() {
+	app.tcpMu.Lock()
+	proxies := app.tcpProxies
+	app.tcpProxies = nil
+	app.tcpMu.Unlock()
+	for _, p := range proxies {
+		p.Close()
+	}
+}
+
+// Close stops accepting connections, closes the open ones and waits until all of them are done
+func (p *tcpProxy) Close() {
+	p.mu.Lock()
+	p.closed = true
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.listener.Close()
+	p.wg.Wait()
+}
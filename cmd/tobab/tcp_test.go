@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+// echoServer accepts connections and echoes every line back
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTCPProxy(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		allowed []string
+		wantOK  bool
+	}{
+		{name: "allowed ip", allowed: []string{"127.0.0.1"}, wantOK: true},
+		{name: "allowed range", allowed: []string{"10.0.0.0/8", "127.0.0.0/8"}, wantOK: true},
+		{name: "not allowed", allowed: []string{"10.0.0.0/8"}, wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{})
+			p, err := app.startTCPProxy(tobab.Host{
+				Hostname:   "db.example.com",
+				Type:       "tcp",
+				Listen:     "127.0.0.1:0",
+				Backend:    backend.Addr().String(),
+				AllowedIPs: tt.allowed,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			conn, err := net.Dial("tcp", p.listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+
+			_, err = conn.Write([]byte("ping\n"))
+			var line string
+			if err == nil {
+				line, err = bufio.NewReader(conn).ReadString('\n')
+			}
+			if tt.wantOK && (err != nil || line != "ping\n") {
+				t.Errorf("expected ping to be echoed, got '%s' and error %v", line, err)
+			}
+			if !tt.wantOK && err == nil {
+				t.Errorf("connection from a disallowed ip was proxied, got '%s'", line)
+			}
+		})
+	}
+}
+
+func TestTCPProxy_CloseEndsConnections(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{})
+	app.updateTCPProxies([]tobab.Host{{
+		Hostname:   "db.example.com",
+		Type:       "tcp",
+		Listen:     "127.0.0.1:0",
+		Backend:    backend.Addr().String(),
+		AllowedIPs: []string{"127.0.0.1"},
+	}})
+	if len(app.tcpProxies) != 1 {
+		t.Fatal("tcp proxy did not start")
+	}
+	addr := app.tcpProxies[0].listener.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("ping\n"))
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		app.closeTCPProxies()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("closing the tcp proxy did not finish with an open connection")
+	}
+
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("open connection was not closed")
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("listener still accepts connections after closing")
+	}
+}
+
+func TestUpdateTCPProxies_KeepsUnchangedHosts(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	app := newTestApp(tobab.Config{})
+	host := tobab.Host{
+		Hostname:   "db.example.com",
+		Type:       "tcp",
+		Listen:     "127.0.0.1:0",
+		Backend:    backend.Addr().String(),
+		AllowedIPs: []string{"127.0.0.1"},
+	}
+	app.updateTCPProxies([]tobab.Host{host})
+	defer app.closeTCPProxies()
+
+	conn, err := net.Dial("tcp", app.tcpProxies[0].listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	echo := func() error {
+		if _, err := conn.Write([]byte("ping\n")); err != nil {
+			return err
+		}
+		_, err := r.ReadString('\n')
+		return err
+	}
+	if err := echo(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := host
+	other.Hostname = "cache.example.com"
+	app.updateTCPProxies([]tobab.Host{host, other})
+	if len(app.tcpProxies) != 2 {
+		t.Fatalf("expected 2 tcp proxies, got %d", len(app.tcpProxies))
+	}
+	if err := echo(); err != nil {
+		t.Errorf("connection of an unchanged host was closed when another host was added: %v", err)
+	}
+
+	host.AllowedIPs = []string{"127.0.0.0/8"}
+	app.updateTCPProxies([]tobab.Host{host, other})
+	if err := echo(); err == nil {
+		t.Error("connection of a changed host is still open")
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/markbates/pkger"
 )
 
-func loadTemplates() (*template.Template, error) {
+// loadTemplates parses the built in templates, the html files in dir replace the templates with the same name,
+// like 502.html, or can define their own with {{define}}
+func loadTemplates(dir string) (*template.Template, error) {
 	tpl := template.New("")
 	tpl.Funcs(templateFunctions)
 
@@ -30,6 +34,22 @@ func loadTemplates() (*template.Template, error) {
 		}
 		return nil
 	})
+	if err != nil || dir == "" {
+		return tpl, err
+	}
 
-	return tpl, err
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return tpl, err
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return tpl, err
+		}
+		if _, err := tpl.New(filepath.Base(f)).Parse(string(b)); err != nil {
+			return tpl, fmt.Errorf("%s: %w", f, err)
+		}
+	}
+	return tpl, nil
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+)
+
+// acmeTLSProtocol is the alpn protocol used by the TLS-ALPN challenge, those handshakes never ask for a client cert
+const acmeTLSProtocol = "acme-tls/1"
+
+// tlsConfig returns base extended with per host client certificate verification and session ticket settings.
+// A listener only has one tls.Config, so the config for a handshake is picked in GetConfigForClient based on
+// the SNI server name. The per host configs are replaced by setTLSHosts when hosts change.
+func (app *Tobab) tlsConfig(base *tls.Config, hosts []tobab.Host) *tls.Config {
+	base = base.Clone()
+	base.SessionTicketsDisabled = app.config.DisableSessionTickets
+	hostConfigs := &tlsHostConfigs{base: base}
+	app.tlsHosts = hostConfigs
+	app.setTLSHosts(hosts)
+
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acmeTLSProtocol {
+				return nil, nil
+			}
+		}
+		perHost, _ := hostConfigs.perHost.Load().(map[string]*tls.Config)
+		if c, ok := perHost[strings.ToLower(hello.ServerName)]; ok {
+			return c, nil
+		}
+		return nil, nil
+	}
+	return cfg
+}
+
+// tlsHostConfigs are the tls configs of hosts with settings of their own, keyed by lowercase hostname
+type tlsHostConfigs struct {
+	base    *tls.Config
+	perHost atomic.Value
+}
+
+func (app *Tobab) setTLSHosts(hosts []tobab.Host) {
+	if app.tlsHosts == nil {
+		return
+	}
+	base := app.tlsHosts.base
+	perHost := map[string]*tls.Config{}
+	for _, h := range hosts {
+		if h.ClientCAFile == "" && !h.DisableSessionTickets {
+			continue
+		}
+		cfg := base.Clone()
+		if h.DisableSessionTickets {
+			cfg.SessionTicketsDisabled = true
+		}
+		if h.ClientCAFile != "" {
+			pool, err := loadCertPool(h.ClientCAFile)
+			if err != nil {
+				app.logger.WithError(err).WithField("host", h.Hostname).Error("Failed loading client CAs, client certificates will not be accepted")
+				pool = x509.NewCertPool()
+			}
+			cfg.ClientCAs = pool
+			cfg.ClientAuth = clientAuthType(h.ClientAuth)
+		}
+		perHost[strings.ToLower(h.Hostname)] = cfg
+	}
+	app.tlsHosts.perHost.Store(perHost)
+}
+
+// rotateSessionTicketKeys replaces the session ticket key of cfg every interval until stop is closed. The
+// previous key is kept for one more interval so sessions don't all fail to resume at every rotation. Configs
+// returned by GetConfigForClient without keys of their own use the keys of cfg.
+func rotateSessionTicketKeys(cfg *tls.Config, interval time.Duration, stop <-chan struct{}) {
+	var keys [][32]byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var key [32]byte
+		//when reading fails the current keys are kept rather than a predictable one, the next tick tries again
+		if _, err := rand.Read(key[:]); err == nil {
+			keys = append([][32]byte{key}, keys...)
+			if len(keys) > 2 {
+				keys = keys[:2]
+			}
+			cfg.SetSessionTicketKeys(keys)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func clientAuthType(mode string) tls.ClientAuthType {
+	if mode == tobab.ClientAuthVerifyIfGiven {
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.RequireAndVerifyClientCert
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s does not contain any pem encoded certificates", path)
+	}
+	return pool, nil
+}
+
+// clientCertMiddleware makes sure the client certificate was verified for this host. Because verification
+// happens during the handshake based on SNI, a request for this host over a connection made for another
+// server name has not been verified against the CAs of this host.
+func clientCertMiddleware(h tobab.Host, next http.Handler) http.Handler {
+	if h.ClientCAFile == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || !strings.EqualFold(r.TLS.ServerName, h.Hostname) {
+			http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			return
+		}
+		if clientAuthType(h.ClientAuth) == tls.RequireAndVerifyClientCert && len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientCertIdentity returns the identity of the verified client certificate of r, or an empty string when the
+// host doesn't use ClientCertIdentity or there is no certificate that was verified for this host
+func clientCertIdentity(h tobab.Host, r *http.Request) string {
+	if h.ClientCertIdentity == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	//the rbac middleware runs before clientCertMiddleware, so check that the CAs of this host verified it
+	if !strings.EqualFold(r.TLS.ServerName, h.Hostname) {
+		return ""
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	if h.ClientCertIdentity == tobab.ClientCertIdentityEmail {
+		if len(leaf.EmailAddresses) == 0 {
+			return ""
+		}
+		return leaf.EmailAddresses[0]
+	}
+	return leaf.Subject.CommonName
+}
+
+// certificateStatus describes the certificate stored for hostname, it only reads from storage so it never
+// triggers issuance or renewal
+func certificateStatus(magic *certmagic.Config, hostname string) clirpc.CertificateStatus {
+	var status clirpc.CertificateStatus
+	if magic.Issuer == nil {
+		status.Error = "no certificate issuer configured"
+		return status
+	}
+	b, err := magic.Storage.Load(certmagic.StorageKeys.SiteCert(magic.Issuer.IssuerKey(), hostname))
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		status.Error = "stored certificate is not valid pem"
+		return status
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Managed = true
+	status.Issuer = cert.Issuer.String()
+	status.NotBefore = cert.NotBefore
+	status.NotAfter = cert.NotAfter
+	return status
+}
+
+// renewCertificate obtains a new certificate for hostname right away, even when the current one is not due
+// for renewal. A failed renewal leaves the current certificate in place.
+func renewCertificate(ctx context.Context, magic *certmagic.Config, hostname string) (time.Time, error) {
+	//a ratio of 1 puts every certificate in its renewal window
+	magic.RenewalWindowRatio = 1
+	err := magic.RenewCert(ctx, hostname, true)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("renewing certificate for %s failed, the current certificate is still used: %w", hostname, err)
+	}
+	cert, err := magic.CacheManagedCertificate(hostname)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("certificate for %s was renewed but could not be loaded: %w", hostname, err)
+	}
+	return cert.Leaf.NotAfter, nil
+}
+
+// newestCertificateSelector picks the most recently issued valid certificate. The cache keeps the old
+// certificate next to a renewed one, and the default selector would keep serving the old one.
+type newestCertificateSelector struct{}
+
+func (newestCertificateSelector) SelectCertificate(hello *tls.ClientHelloInfo, choices []certmagic.Certificate) (certmagic.Certificate, error) {
+	var best certmagic.Certificate
+	found := false
+	now := time.Now()
+	for _, c := range choices {
+		if hello.SupportsCertificate(&c.Certificate) != nil {
+			continue
+		}
+		if now.Before(c.Leaf.NotBefore) || now.After(c.Leaf.NotAfter) {
+			continue
+		}
+		if !found || c.Leaf.NotBefore.After(best.Leaf.NotBefore) {
+			best, found = c, true
+		}
+	}
+	if !found {
+		return certmagic.DefaultCertificateSelector(hello, choices)
+	}
+	return best, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/gnur/tobab"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-30 * 24 * time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create ca: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a leaf certificate signed by the ca, usable for clients and servers
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	return ca.issueValid(t, name, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+func (ca *testCA) issueValid(t *testing.T, name string, notBefore, notAfter time.Time) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("unable to issue certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSConfig_ClientCAs(t *testing.T) {
+	internal := newTestCA(t, "internal")
+	partner := newTestCA(t, "partner")
+	dir, err := ioutil.TempDir("", "tobab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "internal.pem")
+	if err := ioutil.WriteFile(caFile, internal.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := []tobab.Host{
+		{Hostname: "required.example.com", ClientCAFile: caFile},
+		{Hostname: "optional.example.com", ClientCAFile: caFile, ClientAuth: tobab.ClientAuthVerifyIfGiven},
+		{Hostname: "open.example.com"},
+	}
+	app := newTestApp(tobab.Config{})
+	mux := http.NewServeMux()
+	for _, h := range hosts {
+		mux.Handle(h.Hostname+"/", clientCertMiddleware(h, okHandler))
+	}
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.TLS = app.tlsConfig(&tls.Config{Certificates: []tls.Certificate{internal.issue(t, "example.com")}}, hosts)
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		serverName string
+		host       string
+		clientCert *tls.Certificate
+		wantErr    bool
+		wantStatus int
+	}{
+		{name: "required with trusted issuer", serverName: "required.example.com", clientCert: ptrCert(internal.issue(t, "svc")), wantStatus: 200},
+		{name: "required with untrusted issuer", serverName: "required.example.com", clientCert: ptrCert(partner.issue(t, "svc")), wantErr: true},
+		{name: "required without certificate", serverName: "required.example.com", wantErr: true},
+		{name: "optional without certificate", serverName: "optional.example.com", wantStatus: 200},
+		{name: "optional with untrusted issuer", serverName: "optional.example.com", clientCert: ptrCert(partner.issue(t, "svc")), wantErr: true},
+		{name: "host without client cas", serverName: "open.example.com", clientCert: ptrCert(partner.issue(t, "svc")), wantStatus: 200},
+		{name: "sni of another host", serverName: "open.example.com", host: "required.example.com", wantStatus: http.StatusMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientTLS := &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}
+			if tt.clientCert != nil {
+				//always send the certificate, even if the server doesn't list its issuer
+				clientTLS.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return tt.clientCert, nil
+				}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			host := tt.host
+			if host == "" {
+				host = tt.serverName
+			}
+			req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+			req.Host = host
+			resp, err := client.Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("request error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRBACMiddleware_ClientCertIdentity(t *testing.T) {
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "billing-service"}, EmailAddresses: []string{"billing@svc.example.com"}}
+	hosts := map[string]tobab.Host{
+		"cn":       {Hostname: "api.example.com", ClientCAFile: "ca.pem", ClientCertIdentity: tobab.ClientCertIdentityCN, Globs: []tobab.Glob{"billing-service"}},
+		"email":    {Hostname: "api.example.com", ClientCAFile: "ca.pem", ClientCertIdentity: tobab.ClientCertIdentityEmail, Globs: []tobab.Glob{"*@svc.example.com"}},
+		"disabled": {Hostname: "api.example.com", ClientCAFile: "ca.pem", Globs: []tobab.Glob{"billing-service"}},
+		"other":    {Hostname: "api.example.com", ClientCAFile: "ca.pem", ClientCertIdentity: tobab.ClientCertIdentityCN, Globs: []tobab.Glob{"reporting-service"}},
+		"provider": {Hostname: "api.example.com", ClientCAFile: "ca.pem", ClientCertIdentity: tobab.ClientCertIdentityCN, Rules: []tobab.Rule{{Name: "services", Globs: []tobab.Glob{"*"}, Providers: []string{tobab.ProviderClientCert}}}},
+	}
+	tests := []struct {
+		name       string
+		host       string
+		serverName string
+		noCert     bool
+		wantStatus int
+		wantUser   string
+	}{
+		{name: "common name", host: "cn", serverName: "api.example.com", wantStatus: http.StatusOK, wantUser: "billing-service"},
+		{name: "email", host: "email", serverName: "api.example.com", wantStatus: http.StatusOK, wantUser: "billing@svc.example.com"},
+		{name: "rule for client certificates", host: "provider", serverName: "api.example.com", wantStatus: http.StatusOK, wantUser: "billing-service"},
+		{name: "identity not allowed", host: "other", serverName: "api.example.com", wantStatus: http.StatusUnauthorized},
+		{name: "not enabled for the host", host: "disabled", serverName: "api.example.com", wantStatus: http.StatusFound},
+		{name: "without certificate browsers log in", host: "cn", serverName: "api.example.com", noCert: true, wantStatus: http.StatusFound},
+		{name: "verified for another host", host: "cn", serverName: "other.example.com", wantStatus: http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{}, hosts[tt.host])
+			var gotUser string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUser = r.Header.Get("X-Tobab-User")
+			})
+			r := httptest.NewRequest(http.MethodGet, "https://api.example.com/invoices", nil)
+			r.TLS = &tls.ConnectionState{ServerName: tt.serverName}
+			if !tt.noCert {
+				r.TLS.VerifiedChains = [][]*x509.Certificate{{leaf}}
+			}
+			w := httptest.NewRecorder()
+			app.getRBACMiddleware()(next).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if gotUser != tt.wantUser {
+				t.Errorf("X-Tobab-User = %q, want %q", gotUser, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestRBACMiddleware_ClientCertRequired(t *testing.T) {
+	app := newTestApp(tobab.Config{}, tobab.Host{Hostname: "api.example.com", ClientCAFile: "ca.pem", ClientCertIdentity: tobab.ClientCertIdentityCN, Globs: []tobab.Glob{"billing-service"}})
+	//without an identity provider there is no login to redirect to
+	app.config.GoogleKey = ""
+	w := httptest.NewRecorder()
+	app.getRBACMiddleware()(okHandler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://api.example.com/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func ptrCert(c tls.Certificate) *tls.Certificate {
+	return &c
+}
+
+func TestCertificateStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tobab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	magic := certmagic.NewDefault()
+	magic.Storage = &certmagic.FileStorage{Path: dir}
+
+	ca := newTestCA(t, "test ca")
+	cert := ca.issue(t, "app.example.com")
+	key := certmagic.StorageKeys.SiteCert(magic.Issuer.IssuerKey(), "app.example.com")
+	if err := magic.Storage.Store(key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})); err != nil {
+		t.Fatal(err)
+	}
+
+	status := certificateStatus(magic, "app.example.com")
+	if !status.Managed || status.Error != "" {
+		t.Fatalf("expected a managed certificate, got %+v", status)
+	}
+	if status.Issuer != "CN=test ca" {
+		t.Errorf("Issuer = %s, want CN=test ca", status.Issuer)
+	}
+	if status.NotAfter.Before(time.Now()) {
+		t.Errorf("NotAfter = %s, expected it in the future", status.NotAfter)
+	}
+
+	status = certificateStatus(magic, "other.example.com")
+	if status.Managed || status.Error == "" {
+		t.Errorf("expected an error for a host without certificate, got %+v", status)
+	}
+}
+
+func TestTLSConfig_SessionTickets(t *testing.T) {
+	ca := newTestCA(t, "internal")
+	hosts := []tobab.Host{
+		{Hostname: "resume.example.com"},
+		{Hostname: "noresume.example.com", DisableSessionTickets: true},
+	}
+
+	tests := []struct {
+		name       string
+		config     tobab.Config
+		serverName string
+		rotate     time.Duration
+		wait       time.Duration
+		wantResume bool
+	}{
+		{name: "resumption allowed", serverName: "resume.example.com", wantResume: true},
+		{name: "disabled for host", serverName: "noresume.example.com"},
+		{name: "disabled globally", config: tobab.Config{DisableSessionTickets: true}, serverName: "resume.example.com"},
+		{name: "rotated keys no longer resume", serverName: "resume.example.com", rotate: 20 * time.Millisecond, wait: 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tt.config)
+			srv := httptest.NewUnstartedServer(okHandler)
+			srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+			srv.TLS = app.tlsConfig(&tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com")}}, hosts)
+			srv.StartTLS()
+			defer srv.Close()
+			if tt.rotate > 0 {
+				//StartTLS uses a copy of the config, so rotate the keys of the copy
+				stop := make(chan struct{})
+				defer close(stop)
+				go rotateSessionTicketKeys(srv.TLS, tt.rotate, stop)
+			}
+
+			client := &http.Client{Transport: &http.Transport{
+				DisableKeepAlives: true,
+				TLSClientConfig: &tls.Config{
+					ServerName:         tt.serverName,
+					InsecureSkipVerify: true,
+					ClientSessionCache: tls.NewLRUClientSessionCache(10),
+				},
+			}}
+			var resumed bool
+			for i := 0; i < 2; i++ {
+				if i == 1 {
+					time.Sleep(tt.wait)
+				}
+				resp, err := client.Get(srv.URL)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				_, _ = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				resumed = resp.TLS.DidResume
+			}
+			if resumed != tt.wantResume {
+				t.Errorf("DidResume = %t, want %t", resumed, tt.wantResume)
+			}
+		})
+	}
+}
+
+func TestNewestCertificateSelector(t *testing.T) {
+	ca := newTestCA(t, "internal")
+	now := time.Now()
+	cert := func(name string, notBefore, notAfter time.Time) certmagic.Certificate {
+		c := ca.issueValid(t, name, notBefore, notAfter)
+		c.Leaf, _ = x509.ParseCertificate(c.Certificate[0])
+		return certmagic.Certificate{Certificate: c, Names: []string{name}}
+	}
+	old := cert("app.example.com", now.Add(-48*time.Hour), now.Add(48*time.Hour))
+	renewed := cert("app.example.com", now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	expired := cert("app.example.com", now.Add(-time.Minute), now.Add(-time.Second))
+	other := cert("other.example.com", now.Add(-time.Minute), now.Add(time.Hour))
+
+	hello := &tls.ClientHelloInfo{
+		ServerName:        "app.example.com",
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	tests := []struct {
+		name    string
+		choices []certmagic.Certificate
+		want    certmagic.Certificate
+	}{
+		{name: "renewed certificate wins", choices: []certmagic.Certificate{old, renewed}, want: renewed},
+		{name: "order does not matter", choices: []certmagic.Certificate{renewed, old}, want: renewed},
+		{name: "expired certificate is skipped", choices: []certmagic.Certificate{old, expired}, want: old},
+		{name: "certificate for another name is skipped", choices: []certmagic.Certificate{other, old}, want: old},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newestCertificateSelector{}.SelectCertificate(hello, tt.choices)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Leaf.SerialNumber.Cmp(tt.want.Leaf.SerialNumber) != 0 {
+				t.Errorf("selected certificate valid from %s, want the one valid from %s", got.Leaf.NotBefore, tt.want.Leaf.NotBefore)
+			}
+		})
+	}
+}
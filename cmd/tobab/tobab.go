@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/caddyserver/certmagic"
 	"github.com/gnur/tobab"
 	"github.com/gnur/tobab/clirpc"
 	"github.com/gorilla/mux"
-	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
-	"github.com/markbates/goth/providers/google"
+	"github.com/o1egl/paseto/v2"
 )
 
 func (app *Tobab) setTobabRoutes(r *mux.Router) {
@@ -50,8 +56,8 @@ func (app *Tobab) setTobabRoutes(r *mux.Router) {
 			return
 		}
 
-		if ok, err := h.Validate(app.config.CookieScope); !ok {
-			http.Error(w, fmt.Sprintf("invalid backend: %e", err), http.StatusBadRequest)
+		if err := app.validateNewHost(h); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		err = app.db.AddHost(h)
@@ -61,7 +67,7 @@ func (app *Tobab) setTobabRoutes(r *mux.Router) {
 			return
 		}
 		http.Error(w, "ok", 202)
-		go app.restartServer()
+		go app.reloadHosts()
 
 	}).Methods("POST")
 
@@ -74,20 +80,87 @@ func (app *Tobab) setTobabRoutes(r *mux.Router) {
 			return
 		}
 		err := app.db.DeleteHost(h)
+		if errors.Is(err, tobab.ErrHostNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			app.logger.WithError(err).Error("Failed to delete host from database")
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
 		http.Error(w, "ok", 202)
-		go app.restartServer()
+		go app.reloadHosts()
 
 	}).Methods("DELETE")
 
-	//setup user facing auth
-	goth.UseProviders(
-		google.New(app.config.GoogleKey, app.config.GoogleSecret, app.fqdn+"/auth/google/callback"),
-	)
+	//RENEW the certificate of a host
+	api.HandleFunc("/host/{hostname}/renew", func(w http.ResponseWriter, r *http.Request) {
+		var out clirpc.RenewCertOut
+		err := app.renewCert(&clirpc.RenewCertIn{Hostname: mux.Vars(r)["hostname"]}, &out)
+		if errors.Is(err, tobab.ErrHostNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(out)
+		if err != nil {
+			app.logger.WithError(err).Error("failed writing JSON response")
+		}
+	}).Methods("POST")
+
+	//ARM capture of the next requests of a host
+	api.HandleFunc("/capture/{hostname}", func(w http.ResponseWriter, r *http.Request) {
+		in := clirpc.ArmCaptureIn{Hostname: mux.Vars(r)["hostname"], Count: 10}
+		if c := r.URL.Query().Get("count"); c != "" {
+			n, err := strconv.Atoi(c)
+			if err != nil {
+				http.Error(w, "count should be a number", http.StatusBadRequest)
+				return
+			}
+			in.Count = n
+		}
+		if t := r.URL.Query().Get("timeout"); t != "" {
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				http.Error(w, "timeout should be a duration", http.StatusBadRequest)
+				return
+			}
+			in.Timeout = d
+		}
+		err := app.armCapture(&in, &clirpc.Empty{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "ok", 202)
+	}).Methods("POST")
+
+	//GET captures of a host
+	api.HandleFunc("/capture/{hostname}", func(w http.ResponseWriter, r *http.Request) {
+		var out clirpc.GetCapturesOut
+		err := app.getCaptures(&clirpc.GetCapturesIn{Hostname: mux.Vars(r)["hostname"]}, &out)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(out.Captures)
+		if err != nil {
+			app.logger.WithError(err).Error("failed writing JSON response")
+		}
+	}).Methods("GET")
+
+	//static assets for the login page, these never require authentication
+	r.PathPrefix("/static/").Handler(app.assetHandler())
+
+	//probes for orchestrators, the rbac middleware lets them through without looking at cookies
+	r.HandleFunc(livenessPath, app.livenessHandler).Methods("GET", "HEAD")
+	r.HandleFunc(readinessPath, app.readinessHandler).Methods("GET", "HEAD")
 
 	r.HandleFunc("/auth/{provider}", func(w http.ResponseWriter, r *http.Request) {
 		gothic.BeginAuthHandler(w, r)
@@ -96,28 +169,28 @@ func (app *Tobab) setTobabRoutes(r *mux.Router) {
 	r.HandleFunc("/auth/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
 		user, err := gothic.CompleteUserAuth(w, r)
 		if err != nil {
+			app.audit(r, tobab.AuditLogin, "", app.loginHost(r), tobab.AuditFailure, err.Error())
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		token, err := app.newToken(user.Email, app.fqdn, app.defaultAge)
+		token, claims, err := app.issueToken(user.Email, app.fqdn, user.Provider, app.userGroups(r.Context(), user), app.loginTokenAge(app.loginHost(r)))
 		if err != nil {
+			app.audit(r, tobab.AuditLogin, user.Email, app.loginHost(r), tobab.AuditFailure, err.Error())
 			http.Error(w, http.StatusText(500), http.StatusInternalServerError)
 			return
 		}
-
-		c := http.Cookie{
-			Name:     "X-Tobab-Token",
-			Domain:   app.config.CookieScope,
-			SameSite: http.SameSiteLaxMode,
-			Secure:   true,
-			HttpOnly: true,
-			Expires:  time.Now().Add(app.maxAge),
-			Value:    token,
-			Path:     "/",
+		if err := app.setTokenCookie(w, r, token, time.Now().Add(app.maxAge)); err != nil {
+			//most likely the user is in so many groups that the claims don't fit
+			app.logger.WithError(err).WithField("user", user.Email).WithField("bytes", len(token)).Error("unable to store token in the session cookies")
+			app.audit(r, tobab.AuditLogin, user.Email, app.loginHost(r), tobab.AuditFailure, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		app.audit(r, tobab.AuditLogin, user.Email, app.loginHost(r), tobab.AuditSuccess, user.Provider)
+		app.audit(r, tobab.AuditTokenIssued, user.Email, app.loginHost(r), tobab.AuditSuccess, claims.Jti)
 
-		http.SetCookie(w, &c)
+		app.saveIssuedToken(r, claims)
 
 		cr, err := r.Cookie("X-Tobab-Source")
 		if err != nil {
@@ -128,9 +201,41 @@ func (app *Tobab) setTobabRoutes(r *mux.Router) {
 
 	})
 
+	r.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		//a copy of the token could still be used after the cookies are gone, revoke it as well
+		var user string
+		if token, err := tokenFromRequest(r); err == nil {
+			if t, err := app.decryptToken(token); err == nil {
+				user = t.Subject
+				if t.Jti != "" {
+					if err := app.db.RevokeToken(t.Jti); err != nil {
+						app.logger.WithError(err).Error("unable to revoke token on logout")
+					}
+				}
+			}
+		}
+		app.audit(r, tobab.AuditLogout, user, app.config.Hostname, tobab.AuditSuccess, "")
+		//the session cookies are scoped to the cookie domain, expiring them here logs the user out of every host
+		app.expireTokenCookies(w, r)
+		http.SetCookie(w, &http.Cookie{
+			Name:   "X-Tobab-Source",
+			Domain: app.config.CookieScope,
+			MaxAge: -1,
+			Path:   "/",
+		})
+		if err := gothic.Logout(w, r); err != nil {
+			app.logger.WithError(err).Error("unable to clear provider session")
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		user, err := app.extractUser(r)
-		providerIndex := &ProviderIndex{Providers: []string{"google"}, ProvidersMap: map[string]string{"google": "Google"}}
+		user, err := app.requestUser(r)
+		providerIndex := &ProviderIndex{ProvidersMap: map[string]string{}}
+		for _, p := range app.config.IdentityProviders() {
+			providerIndex.Providers = append(providerIndex.Providers, p.Name)
+			providerIndex.ProvidersMap[p.Name] = p.DisplayName()
+		}
 		if err == nil {
 			providerIndex.User = user
 		} else {
@@ -143,45 +248,381 @@ func (app *Tobab) setTobabRoutes(r *mux.Router) {
 	})
 }
 
+// saveIssuedToken stores a token issued with the login flow so it shows up in the sessions, together with the
+// host the user was sent to log in from. Failing to store it is only logged, it doesn't stop the login.
+func (app *Tobab) saveIssuedToken(r *http.Request, claims paseto.JSONToken) {
+	host := app.loginHost(r)
+	//the token itself only has a precision of seconds, revocations are compared with that
+	t := tobab.IssuedToken{
+		ID:        claims.Jti,
+		Email:     claims.Subject,
+		Host:      host,
+		IssuedAt:  claims.IssuedAt.Truncate(time.Second),
+		ExpiresAt: claims.Expiration.Truncate(time.Second),
+	}
+	if ip := clientIP(r, app.trustedProxies()); ip != nil {
+		t.IP = ip.String()
+	}
+	err := app.db.SaveToken(t)
+	if err != nil {
+		app.logger.WithError(err).Error("unable to store issued token")
+	}
+}
+
+// loginHost returns the host the user was sent to log in from, or the hostname of tobab when they came to the
+// login page themselves
+func (app *Tobab) loginHost(r *http.Request) string {
+	if cr, err := r.Cookie("X-Tobab-Source"); err == nil {
+		if u, err := url.Parse(cr.Value); err == nil && u.Hostname() != "" {
+			return u.Hostname()
+		}
+	}
+	return app.config.Hostname
+}
+
+// requireIdentityProvider returns an error for hosts that need a login when nobody is able to log in
+func (app *Tobab) requireIdentityProvider(h tobab.Host) error {
+	if h.Public || h.Type == "tcp" || h.ClientCertIdentity != "" || h.BasicAuth || app.config.HasIdentityProvider() {
+		return nil
+	}
+	return fmt.Errorf("%s requires a login but no identity provider is configured, make the host public or configure an identity provider", h.Hostname)
+}
+
 type ProviderIndex struct {
 	Providers    []string
 	ProvidersMap map[string]string
 	User         string
 }
 
-func (app *Tobab) GetHosts(in *clirpc.Empty, out *clirpc.GetHostsOut) error {
+var ErrUnauthorizedRPC = errors.New("rpc secret is missing or wrong")
+
+// authorizeRPC returns ErrUnauthorizedRPC when a call doesn't provide the RPCSecret, without a configured secret
+// every call is refused. The http api calls the unexported versions of the methods it shares with the rpc, it
+// has its own authentication.
+func (app *Tobab) authorizeRPC(a clirpc.Auth) error {
+	if app.config.RPCSecret == "" {
+		return ErrUnauthorizedRPC
+	}
+	if subtle.ConstantTimeCompare([]byte(a.Secret), []byte(app.config.RPCSecret)) != 1 {
+		return ErrUnauthorizedRPC
+	}
+	return nil
+}
+
+func (app *Tobab) GetHosts(in *clirpc.GetHostsIn, out *clirpc.GetHostsOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
 	h, err := app.db.GetHosts()
 	out.Hosts = h
 	return err
 }
 
+func (app *Tobab) ShowHost(in *clirpc.ShowHostIn, out *clirpc.ShowHostOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	h, err := app.db.GetHost(in.Hostname)
+	if err != nil {
+		return err
+	}
+	out.Host = *h
+	out.Enabled = h.IsEnabled()
+	out.RBACMode = h.EffectiveRBACMode(app.config.RBACMode)
+	out.Timeouts = h.EffectiveTimeouts(app.config.Defaults)
+	out.Certificate = certificateStatus(certmagic.NewDefault(), app.config.CertificateName(h.Hostname))
+	return nil
+}
+
 func (app *Tobab) AddHost(in *clirpc.AddHostIn, out *clirpc.Empty) error {
-	ok, err := in.Host.Validate(app.config.CookieScope)
-	if !ok {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	if err := app.validateNewHost(in.Host); err != nil {
 		return err
 	}
-	err = app.db.AddHost(in.Host)
+	err := app.db.AddHost(in.Host)
 	if err == nil {
-		go app.restartServer()
+		go app.reloadHosts()
 	}
 	return err
 }
 
+// validateNewHost returns why h can't be added, the database would replace an existing host with the same name
+// so that is refused as well
+func (app *Tobab) validateNewHost(h tobab.Host) error {
+	if ok, err := h.Validate(app.config.CookieScope); !ok {
+		return fmt.Errorf("invalid host %s: %w", h.Hostname, err)
+	}
+	if err := app.requireIdentityProvider(h); err != nil {
+		return err
+	}
+	if strings.EqualFold(h.Hostname, app.config.Hostname) {
+		return fmt.Errorf("%s is the hostname of tobab itself", h.Hostname)
+	}
+	if d := duration(h.TokenAge); d > app.maxAge {
+		return fmt.Errorf("TokenAge %s of %s is longer than the max token age of %s", h.TokenAge, h.Hostname, app.maxAge)
+	}
+	hosts, err := app.db.GetHosts()
+	if err != nil {
+		return err
+	}
+	for _, existing := range hosts {
+		if strings.EqualFold(existing.Hostname, h.Hostname) {
+			return fmt.Errorf("a host named %s already exists, delete it first to replace it", existing.Hostname)
+		}
+	}
+	return nil
+}
+
 func (app *Tobab) DeleteHost(in *clirpc.DeleteHostIn, out *clirpc.Empty) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
 	err := app.db.DeleteHost(in.Hostname)
 	if err == nil {
-		go app.restartServer()
+		go app.reloadHosts()
 	}
 	return err
 }
 
+func (app *Tobab) DisableHost(in *clirpc.DisableHostIn, out *clirpc.Empty) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	return app.setHostEnabled(in.Hostname, false)
+}
+
+func (app *Tobab) EnableHost(in *clirpc.EnableHostIn, out *clirpc.Empty) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	return app.setHostEnabled(in.Hostname, true)
+}
+
+func (app *Tobab) setHostEnabled(hostname string, enabled bool) error {
+	h, err := app.db.GetHost(hostname)
+	if err != nil {
+		return err
+	}
+	h.Enabled = &enabled
+	err = app.db.AddHost(*h)
+	if err == nil {
+		go app.reloadHosts()
+	}
+	return err
+}
+
+// SetMaintenance serves the maintenance page of a host instead of proxying it, or proxies it again
+func (app *Tobab) SetMaintenance(in *clirpc.SetMaintenanceIn, out *clirpc.Empty) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	h, err := app.db.GetHost(in.Hostname)
+	if err != nil {
+		return err
+	}
+	h.Maintenance = in.Maintenance
+	err = app.db.AddHost(*h)
+	if err == nil {
+		go app.reloadHosts()
+	}
+	return err
+}
+
+// PurgeCache drops the cached responses of a host, the next requests go to the backend
+func (app *Tobab) PurgeCache(in *clirpc.PurgeCacheIn, out *clirpc.PurgeCacheOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	h, err := app.db.GetHost(in.Hostname)
+	if err != nil {
+		return err
+	}
+	if h.CacheSizeMB <= 0 {
+		return fmt.Errorf("%s doesn't cache responses, set CacheSizeMB to enable the cache", h.Hostname)
+	}
+	//nothing is cached yet when the host was added after the last reload
+	out.Purged = app.caches.purge(h.Hostname)
+	return nil
+}
+
+func (app *Tobab) RenewCert(in *clirpc.RenewCertIn, out *clirpc.RenewCertOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	return app.renewCert(in, out)
+}
+
+func (app *Tobab) renewCert(in *clirpc.RenewCertIn, out *clirpc.RenewCertOut) error {
+	if in.Hostname != app.config.Hostname {
+		if _, err := app.db.GetHost(in.Hostname); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	notAfter, err := renewCertificate(ctx, certmagic.NewDefault(), app.config.CertificateName(in.Hostname))
+	if err != nil {
+		app.logger.WithError(err).WithField("host", in.Hostname).Error("Failed renewing certificate")
+		return err
+	}
+	app.logger.WithField("host", in.Hostname).WithField("notAfter", notAfter).Info("renewed certificate")
+	out.NotAfter = notAfter
+	return nil
+}
+
+func (app *Tobab) ArmCapture(in *clirpc.ArmCaptureIn, out *clirpc.Empty) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	return app.armCapture(in, out)
+}
+
+func (app *Tobab) armCapture(in *clirpc.ArmCaptureIn, out *clirpc.Empty) error {
+	if _, err := app.db.GetHost(in.Hostname); err != nil {
+		return err
+	}
+	return app.captures.arm(in.Hostname, in.Count, in.Timeout)
+}
+
+func (app *Tobab) GetCaptures(in *clirpc.GetCapturesIn, out *clirpc.GetCapturesOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	return app.getCaptures(in, out)
+}
+
+func (app *Tobab) getCaptures(in *clirpc.GetCapturesIn, out *clirpc.GetCapturesOut) error {
+	if _, err := app.db.GetHost(in.Hostname); err != nil {
+		return err
+	}
+	out.Captures = app.captures.get(in.Hostname)
+	return nil
+}
+
+func (app *Tobab) GetHealth(in *clirpc.GetHealthIn, out *clirpc.GetHealthOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	if _, err := app.db.GetHost(in.Hostname); err != nil {
+		return err
+	}
+	bal, ok := app.balancers.get(in.Hostname)
+	if !ok {
+		return fmt.Errorf("%s is not being proxied", in.Hostname)
+	}
+	out.Backends = bal.health()
+	return nil
+}
+
 func (app *Tobab) CreateToken(in *clirpc.CreateTokenIn, out *clirpc.CreateTokenOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
 	token, err := app.newToken(in.Email, "tobab:cli", in.TTL)
+	if err != nil {
+		app.audit(nil, tobab.AuditTokenIssued, in.Email, app.config.Hostname, tobab.AuditFailure, err.Error())
+	} else {
+		app.audit(nil, tobab.AuditTokenIssued, in.Email, app.config.Hostname, tobab.AuditSuccess, "cli")
+	}
 	out.Token = token
 	return err
 }
 
+func (app *Tobab) RevokeToken(in *clirpc.RevokeTokenIn, out *clirpc.Empty) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	if (in.TokenID == "") == (in.Email == "") {
+		return errors.New("provide either a token id or an email")
+	}
+	if in.TokenID != "" {
+		return app.db.RevokeToken(in.TokenID)
+	}
+	return app.db.RevokeUserTokens(in.Email, time.Now())
+}
+
+// ListTokens returns the tokens issued with the login flow that are not expired or revoked
+func (app *Tobab) ListTokens(in *clirpc.ListTokensIn, out *clirpc.ListTokensOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	tokens, err := app.db.ListTokens(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		err := app.checkRevoked(&paseto.JSONToken{Jti: t.ID, Subject: t.Email, IssuedAt: t.IssuedAt})
+		if err == ErrRevokedToken {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		out.Tokens = append(out.Tokens, t)
+	}
+	return nil
+}
+
+// CreateCredential creates a basic auth credential for a host, the generated password is only returned here
+func (app *Tobab) CreateCredential(in *clirpc.CreateCredentialIn, out *clirpc.CreateCredentialOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	if err := validServiceUsername(in.Username); err != nil {
+		return err
+	}
+	h, err := app.db.GetHost(in.Hostname)
+	if err != nil {
+		return fmt.Errorf("unable to find host %s: %w", in.Hostname, err)
+	}
+	if !h.BasicAuth {
+		return fmt.Errorf("%s does not accept basic auth, add the host with BasicAuth enabled first", in.Hostname)
+	}
+	password, err := newServicePassword()
+	if err != nil {
+		return err
+	}
+	err = app.db.SaveCredential(tobab.ServiceCredential{
+		Host:      h.Hostname,
+		Username:  in.Username,
+		Hash:      hashServicePassword(password),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	out.Password = password
+	return nil
+}
+
+// DeleteCredential removes a basic auth credential, requests that use it are rejected right away
+func (app *Tobab) DeleteCredential(in *clirpc.DeleteCredentialIn, out *clirpc.Empty) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	return app.db.DeleteCredential(in.Hostname, in.Username)
+}
+
+// RotateKey signs new tokens with a new key, tokens of the previous key stay valid until they expire
+func (app *Tobab) RotateKey(in *clirpc.RotateKeyIn, out *clirpc.RotateKeyOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
+	id, validUntil, err := app.rotateSigningKey()
+	if err != nil {
+		return err
+	}
+	out.KeyID = id
+	out.RetiredValidUntil = validUntil
+	return nil
+}
+
 func (app *Tobab) ValidateToken(in *clirpc.ValidateTokenIn, out *clirpc.ValidateTokenOut) error {
+	if err := app.authorizeRPC(in.Auth); err != nil {
+		return err
+	}
 	token, err := app.decryptToken(in.Token)
 	out.Token = *token
 	return err
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/clirpc"
+	"github.com/o1egl/paseto/v2"
+)
+
+func TestShowHost(t *testing.T) {
+	app := newTestApp(tobab.Config{
+		RBACMode: tobab.RBACModeAudit,
+		Defaults: tobab.Timeouts{ResponseTimeout: "30s", IdleTimeout: "10s"},
+	}, tobab.Host{
+		Hostname: "app.example.com",
+		Backend:  "http://localhost:1234",
+		Type:     "http",
+		Globs:    []tobab.Glob{"*@example.com"},
+		Timeouts: tobab.Timeouts{IdleTimeout: "5s"},
+	})
+
+	var out clirpc.ShowHostOut
+	if err := app.ShowHost(&clirpc.ShowHostIn{Auth: testAuth, Hostname: "app.example.com"}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.Enabled {
+		t.Errorf("expected host to be enabled")
+	}
+	if out.RBACMode != tobab.RBACModeAudit {
+		t.Errorf("RBACMode = %s, want the global %s", out.RBACMode, tobab.RBACModeAudit)
+	}
+	want := tobab.Timeouts{DialTimeout: "600s", ResponseTimeout: "30s", IdleTimeout: "5s"}
+	if out.Timeouts != want {
+		t.Errorf("Timeouts = %+v, want %+v", out.Timeouts, want)
+	}
+	if out.Host.Timeouts.ResponseTimeout != "" {
+		t.Errorf("stored host should not be modified, got %+v", out.Host.Timeouts)
+	}
+
+	if err := app.ShowHost(&clirpc.ShowHostIn{Auth: testAuth, Hostname: "missing.example.com"}, &out); err == nil {
+		t.Errorf("expected an error for an unknown host")
+	}
+}
+
+func TestRenewCert_UnknownHost(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	var out clirpc.RenewCertOut
+	if err := app.RenewCert(&clirpc.RenewCertIn{Auth: testAuth, Hostname: "missing.example.com"}, &out); !errors.Is(err, tobab.ErrHostNotFound) {
+		t.Errorf("RenewCert() of an unknown host error = %v, want ErrHostNotFound", err)
+	}
+}
+
+func TestRPC_RequiresSecret(t *testing.T) {
+	app := newTestApp(tobab.Config{RPCSecret: "s3cret"}, tobab.Host{
+		Hostname: "app.example.com",
+		Backend:  "http://localhost:1234",
+		Type:     "http",
+		Public:   true,
+	})
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Tobab", app); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr bool
+	}{
+		{name: "no secret", wantErr: true},
+		{name: "wrong secret", secret: "guess", wantErr: true},
+		{name: "correct secret", secret: "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := rpc.DialHTTPPath("tcp", ts.Listener.Addr().String(), rpc.DefaultRPCPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &rpcClient{Client: c, secret: tt.secret}
+			defer client.Close()
+
+			var out clirpc.GetHostsOut
+			err = client.Call("Tobab.GetHosts", &clirpc.GetHostsIn{}, &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && err.Error() != ErrUnauthorizedRPC.Error() {
+				t.Errorf("expected %v, got %v", ErrUnauthorizedRPC, err)
+			}
+			if !tt.wantErr && len(out.Hosts) != 1 {
+				t.Errorf("expected 1 host, got %d", len(out.Hosts))
+			}
+
+			//a rejected call doesn't do any work
+			if tt.wantErr {
+				client.Call("Tobab.DisableHost", &clirpc.DisableHostIn{Hostname: "app.example.com"}, &clirpc.Empty{})
+				if h, _ := app.db.GetHost("app.example.com"); !h.IsEnabled() {
+					t.Error("host was disabled by an unauthorized call")
+				}
+			}
+		})
+	}
+}
+
+func TestRPC_WithoutSecret(t *testing.T) {
+	app := newTestApp(tobab.Config{}, tobab.Host{
+		Hostname: "app.example.com",
+		Backend:  "http://localhost:1234",
+		Type:     "http",
+		Public:   true,
+	})
+	app.config.RPCSecret = ""
+
+	//an empty secret doesn't match an empty secret
+	if err := app.DisableHost(&clirpc.DisableHostIn{Hostname: "app.example.com"}, &clirpc.Empty{}); err != ErrUnauthorizedRPC {
+		t.Errorf("DisableHost() error = %v, want %v", err, ErrUnauthorizedRPC)
+	}
+	if h, _ := app.db.GetHost("app.example.com"); !h.IsEnabled() {
+		t.Error("host was disabled without an rpc secret")
+	}
+
+	dir, err := ioutil.TempDir("", "tobab-rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "tobab.sock")
+	app.config.RPCListen = "unix://" + socket
+	app.startRPCServer()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("the rpc should not listen without a secret, stat error = %v", err)
+	}
+}
+
+func TestListTokens(t *testing.T) {
+	app := newTestApp(tobab.Config{TrustedProxies: []string{"10.0.0.1"}})
+
+	login := func(source string) paseto.JSONToken {
+		_, claims, err := app.issueToken("alice@example.com", app.fqdn, tobab.ProviderGoogle, nil, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "https://login.example.com/auth/google/callback", nil)
+		r.RemoteAddr = "10.0.0.1:4321"
+		r.Header.Set("X-Forwarded-For", "192.0.2.7")
+		if source != "" {
+			r.AddCookie(&http.Cookie{Name: "X-Tobab-Source", Value: source})
+		}
+		app.saveIssuedToken(r, claims)
+		return claims
+	}
+	first := login("https://app.example.com/dashboard?tab=1")
+	second := login("")
+	revoked := login("https://docs.example.com/")
+	app.db.RevokeToken(revoked.Jti)
+	app.db.SaveToken(tobab.IssuedToken{ID: "expired", Email: "bob@example.com", IssuedAt: time.Now().Add(-2 * time.Hour), ExpiresAt: time.Now().Add(-time.Hour)})
+
+	var out clirpc.ListTokensOut
+	if err := app.ListTokens(&clirpc.ListTokensIn{Auth: testAuth}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Tokens) != 2 {
+		t.Fatalf("expected the 2 active tokens, got %+v", out.Tokens)
+	}
+	hosts := map[string]string{first.Jti: "app.example.com", second.Jti: "login.example.com"}
+	for _, tok := range out.Tokens {
+		want, ok := hosts[tok.ID]
+		if !ok {
+			t.Errorf("token %s should not be listed", tok.ID)
+			continue
+		}
+		if tok.Host != want || tok.Email != "alice@example.com" || tok.IP != "192.0.2.7" {
+			t.Errorf("token %s = %+v, want host %s and the ip of the client", tok.ID, tok, want)
+		}
+	}
+
+	app.db.RevokeUserTokens("alice@example.com", time.Now())
+	out = clirpc.ListTokensOut{}
+	if err := app.ListTokens(&clirpc.ListTokensIn{Auth: testAuth}, &out); err != nil || len(out.Tokens) != 0 {
+		t.Errorf("tokens of a revoked user are still listed: %+v, %v", out.Tokens, err)
+	}
+}
+
+func TestAddHost_Validation(t *testing.T) {
+	existing := tobab.Host{Hostname: "app.example.com", Backend: "http://10.0.0.1:8080", Type: "http", Public: true}
+	valid := tobab.Host{Hostname: "new.example.com", Backend: "http://10.0.0.2:8080", Type: "http", Public: true}
+	tests := []struct {
+		name    string
+		change  func(h *tobab.Host)
+		wantErr string
+	}{
+		{name: "valid", change: func(h *tobab.Host) {}},
+		{name: "unsupported type", change: func(h *tobab.Host) { h.Type = "udp" }, wantErr: "host type must be"},
+		{name: "missing type", change: func(h *tobab.Host) { h.Type = "" }, wantErr: "Type"},
+		{name: "unparseable backend", change: func(h *tobab.Host) { h.Backend = "http://[::1" }, wantErr: "failed to parse as a url"},
+		{name: "backend without scheme", change: func(h *tobab.Host) { h.Backend = "10.0.0.2:8080" }, wantErr: "failed to parse as a url"},
+		{name: "backend with other scheme", change: func(h *tobab.Host) { h.Backend = "ftp://10.0.0.2" }, wantErr: "invalid or missing scheme"},
+		{name: "invalid hostname", change: func(h *tobab.Host) { h.Hostname = "new_host!.example.com" }, wantErr: "Hostname"},
+		{name: "missing hostname", change: func(h *tobab.Host) { h.Hostname = "" }, wantErr: "Hostname"},
+		{name: "duplicate hostname", change: func(h *tobab.Host) { h.Hostname = "app.example.com" }, wantErr: "already exists"},
+		{name: "duplicate hostname in other case", change: func(h *tobab.Host) { h.Hostname = "App.Example.com" }, wantErr: "already exists"},
+		{name: "hostname of tobab", change: func(h *tobab.Host) { h.Hostname = "login.example.com" }, wantErr: "hostname of tobab"},
+		{name: "token age of max age", change: func(h *tobab.Host) { h.TokenAge = "24h" }},
+		{name: "token age over max age", change: func(h *tobab.Host) { h.TokenAge = "25h" }, wantErr: "max token age"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(tobab.Config{}, existing)
+			app.router = newRouterSwitch(http.NotFoundHandler())
+			h := valid
+			tt.change(&h)
+			err := app.AddHost(&clirpc.AddHostIn{Auth: testAuth, Host: h}, &clirpc.Empty{})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if _, err := app.db.GetHost(h.Hostname); err != nil {
+					t.Errorf("valid host was not stored: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("AddHost() error = %v, want an error about %s", err, tt.wantErr)
+			}
+			if stored, _ := app.db.GetHost("app.example.com"); stored.Backend != existing.Backend {
+				t.Errorf("existing host was replaced by %+v", stored)
+			}
+			if hosts, _ := app.db.GetHosts(); len(hosts) != 1 {
+				t.Errorf("invalid host was stored, the database has %d hosts", len(hosts))
+			}
+		})
+	}
+}
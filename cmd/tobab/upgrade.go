@@ -0,0 +1,18 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// hijack takes over the connection below w. The response writer wrappers use it so the reverse proxy can
+// switch protocols, a websocket upgrade fails with a 502 when any writer in the chain can't be hijacked.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/muxlogger"
+	"golang.org/x/net/websocket"
+)
+
+func TestProxy_Websocket(t *testing.T) {
+	ca := newTestCA(t, "backend ca")
+	dir, err := ioutil.TempDir("", "tobab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "backend.pem")
+	if err := ioutil.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	})
+
+	tests := []struct {
+		name   string
+		tls    bool
+		scheme string
+	}{
+		{name: "ws backend", scheme: "ws"},
+		{name: "http backend", scheme: "http"},
+		{name: "wss backend", tls: true, scheme: "wss"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewUnstartedServer(echo)
+			if tt.tls {
+				backend.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "localhost")}}
+				backend.StartTLS()
+			} else {
+				backend.Start()
+			}
+			defer backend.Close()
+
+			app := newTestApp(tobab.Config{ServedByHeader: "X-Served-By"})
+			h := tobab.Host{
+				Hostname:      "app.example.com",
+				Backend:       tt.scheme + "://" + strings.SplitN(strings.Replace(backend.URL, "127.0.0.1", "localhost", 1), "://", 2)[1],
+				BackendCAFile: caFile,
+			}
+			proxy, err := app.generateProxy(h)
+			if err != nil {
+				t.Fatalf("unable to create proxy: %v", err)
+			}
+
+			//the same writer wrappers as the real server
+			var handler http.Handler = app.captureMiddleware(h, proxy)
+			handler = compressMiddleware(app.config)(handler)
+			handler = app.metricsMiddleware(handler)
+			handler = muxlogger.NewLogger(app.logger).Middleware(handler)
+			handler = servedByMiddleware(app.config.ServedByHeader, "test")(handler)
+			handler = newConnTracker().middleware(handler)
+			front := httptest.NewServer(handler)
+			defer front.Close()
+
+			ws, err := websocket.Dial(strings.Replace(front.URL, "http", "ws", 1), "", "http://app.example.com/")
+			if err != nil {
+				t.Fatalf("websocket handshake through the proxy failed: %v", err)
+			}
+			defer ws.Close()
+
+			for _, msg := range []string{"hello", "world"} {
+				if err := websocket.Message.Send(ws, msg); err != nil {
+					t.Fatal(err)
+				}
+				var got string
+				if err := websocket.Message.Receive(ws, &got); err != nil {
+					t.Fatal(err)
+				}
+				if got != msg {
+					t.Errorf("got '%s' back, want '%s'", got, msg)
+				}
+			}
+		})
+	}
+}
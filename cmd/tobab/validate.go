@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/gnur/tobab"
+	"github.com/sirupsen/logrus"
+)
+
+type ValidateCmd struct {
+	Database string `help:"validate the hosts of this database instead of the one in the config, like a copy of a database that a running tobab has locked"`
+}
+
+// Run checks the config and the stored hosts the way run does, without obtaining certificates or opening
+// listeners, so it can run next to a server that is in use
+func (r *ValidateCmd) Run(ctx *Globals) error {
+	cfg, err := tobab.LoadConf(ctx.Config)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Config ok")
+	if r.Database != "" {
+		cfg.DatabasePath = r.Database
+	}
+
+	if _, err := loadTemplates(cfg.TemplatesDir); err != nil {
+		return fmt.Errorf("unable to load templates: %w", err)
+	}
+
+	db, err := openDatabaseReadOnly(cfg)
+	if err != nil {
+		return fmt.Errorf("unable to open database %s: %w", cfg.DatabasePath, err)
+	}
+	defer db.Close()
+	hosts, err := db.GetHosts()
+	if err != nil {
+		return fmt.Errorf("unable to load hosts: %w", err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	app := Tobab{
+		config: cfg,
+		logger: logger.WithField("version", version),
+		db:     db,
+	}
+	app.defaultAge, app.maxAge = tokenAges(cfg)
+	if invalid := app.validateHosts(os.Stdout, hosts); invalid > 0 {
+		return fmt.Errorf("%d of %d hosts are invalid", invalid, len(hosts))
+	}
+	return nil
+}
+
+// validateHosts writes the problems of every host to w and returns the number of hosts that have any
+func (app *Tobab) validateHosts(w io.Writer, hosts []tobab.Host) int {
+	invalid := 0
+	seen := map[string]string{}
+	for _, h := range hosts {
+		problems := app.hostProblems(h)
+		//hostnames are matched without case, only one of these gets the requests
+		if other, ok := seen[strings.ToLower(h.Hostname)]; ok {
+			problems = append(problems, fmt.Errorf("%s is the same hostname as %s", h.Hostname, other))
+		}
+		seen[strings.ToLower(h.Hostname)] = h.Hostname
+
+		if len(problems) == 0 {
+			fmt.Fprintf(w, "%s: ok\n", h.Hostname)
+			continue
+		}
+		invalid++
+		for _, p := range problems {
+			fmt.Fprintf(w, "%s: %s\n", h.Hostname, p)
+		}
+	}
+	return invalid
+}
+
+// hostProblems returns why AddHost would refuse h or reloadHosts would skip it, building its proxy doesn't
+// connect to the backends
+func (app *Tobab) hostProblems(h tobab.Host) []error {
+	var problems []error
+	if ok, err := h.Validate(app.config.CookieScope); !ok {
+		problems = append(problems, err)
+	}
+	if err := app.requireIdentityProvider(h); err != nil {
+		problems = append(problems, err)
+	}
+	if strings.EqualFold(h.Hostname, app.config.Hostname) {
+		problems = append(problems, fmt.Errorf("%s is the hostname of tobab itself", h.Hostname))
+	}
+	if d := duration(h.TokenAge); d > app.maxAge {
+		problems = append(problems, fmt.Errorf("TokenAge %s is longer than the max token age of %s", h.TokenAge, app.maxAge))
+	}
+	if h.Type != "http" && h.Type != "static" {
+		return problems
+	}
+	if _, err := newIPFilter(h); err != nil {
+		problems = append(problems, fmt.Errorf("invalid ip filter: %w", err))
+	}
+	if h.Type == "http" {
+		if _, err := app.generateProxy(h); err != nil {
+			problems = append(problems, fmt.Errorf("unable to create proxy: %w", err))
+		}
+	}
+	return problems
+}
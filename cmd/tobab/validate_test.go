@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/storm"
+)
+
+func TestValidateHosts(t *testing.T) {
+	app := newTestApp(tobab.Config{})
+	hosts := []tobab.Host{
+		{Hostname: "app.example.com", Backend: "http://10.0.0.1:8080", Type: "http", Globs: []tobab.Glob{"*@example.com"}},
+		{Hostname: "static.example.com", Backend: "/srv/app", Type: "static", Public: true},
+		{Hostname: "db.example.com", Backend: "db.internal:5432", Type: "tcp", Listen: ":5432", AllowedIPs: []string{"10.0.0.0/8"}},
+		{Hostname: "other.com", Backend: "http://10.0.0.1:8080", Type: "http", Globs: []tobab.Glob{"*@example.com"}},
+		{Hostname: "ca.example.com", Backend: "https://10.0.0.1:8443", Type: "http", Public: true, BackendCAFile: "/does/not/exist.pem"},
+		{Hostname: "login.example.com", Backend: "http://10.0.0.1:8080", Type: "http", Public: true},
+		{Hostname: "App.example.com", Backend: "http://10.0.0.2:8080", Type: "http", Public: true},
+	}
+	var buf bytes.Buffer
+	if invalid := app.validateHosts(&buf, hosts); invalid != 4 {
+		t.Errorf("validateHosts() = %d invalid hosts, want 4\n%s", invalid, buf.String())
+	}
+
+	lines := map[string][]string{}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		parts := strings.SplitN(l, ": ", 2)
+		lines[parts[0]] = append(lines[parts[0]], parts[1])
+	}
+	want := map[string]string{
+		"app.example.com":    "ok",
+		"static.example.com": "ok",
+		"db.example.com":     "ok",
+		"other.com":          "cookiescope",
+		"ca.example.com":     "unable to create proxy",
+		"login.example.com":  "hostname of tobab itself",
+		"App.example.com":    "same hostname as app.example.com",
+	}
+	for host, problem := range want {
+		if len(lines[host]) != 1 || !strings.Contains(lines[host][0], problem) {
+			t.Errorf("output for %s = %q, want a line with '%s'", host, lines[host], problem)
+		}
+	}
+}
+
+func TestValidateCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tobab-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	confPath := filepath.Join(dir, "tobab.toml")
+	f, err := os.Create(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStarterConfig(f, "login.example.com", "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dbPath := filepath.Join(dir, "tobab.db")
+	cmd := ValidateCmd{Database: dbPath}
+	if err := cmd.Run(&Globals{Config: confPath}); err == nil {
+		t.Fatal("expected an error for a database that doesn't exist")
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Fatalf("validate created the database: %v", err)
+	}
+
+	db, err := storm.New(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.AddHost(tobab.Host{Hostname: "app.example.com", Backend: "http://10.0.0.1:8080", Type: "http", Public: true})
+	db.Close()
+	if err := cmd.Run(&Globals{Config: confPath}); err != nil {
+		t.Fatalf("Run() with valid hosts error = %v", err)
+	}
+
+	db, _ = storm.New(dbPath)
+	_ = db.AddHost(tobab.Host{Hostname: "other.com", Backend: "http://10.0.0.1:8080", Type: "http", Globs: []tobab.Glob{"*@example.com"}})
+	//while the database is open for writing, like in a running tobab, it can't be read
+	if err := cmd.Run(&Globals{Config: confPath}); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("Run() on a locked database error = %v, want it reported as locked", err)
+	}
+	db.Close()
+	if err := cmd.Run(&Globals{Config: confPath}); err == nil || !strings.Contains(err.Error(), "1 of 2 hosts") {
+		t.Errorf("Run() with an invalid host error = %v, want 1 of 2 hosts invalid", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+const (
+	defaultVariantHeader = "X-Variant"
+	defaultVariantCookie = "tobab_variant"
+	variantCookieAge     = 30 * 24 * time.Hour
+)
+
+// variantMiddleware chooses the backend for hosts with the variant strategy. The variant header overrides the
+// assignment for a single request, otherwise the variant cookie is used. Clients without either get a weighted
+// random variant and a cookie so they stay in it.
+func variantMiddleware(h tobab.Host, bal *balancer, next http.Handler) http.Handler {
+	if h.Strategy != tobab.StrategyVariant {
+		return next
+	}
+	header := h.VariantHeader
+	if header == "" {
+		header = defaultVariantHeader
+	}
+	cookie := h.VariantCookie
+	if cookie == "" {
+		cookie = defaultVariantCookie
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		be := bal.variant(r.Header.Get(header))
+		if be == nil {
+			if c, err := r.Cookie(cookie); err == nil {
+				be = bal.variant(c.Value)
+			}
+		}
+		if be == nil {
+			be = bal.randomVariant()
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookie,
+				Value:    be.name,
+				Path:     "/",
+				MaxAge:   int(variantCookieAge.Seconds()),
+				Secure:   true,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		next.ServeHTTP(w, r.WithContext(withBackend(r.Context(), be)))
+	})
+}
+
+// variant returns the backend with this name, or nil when there is none
+func (b *balancer) variant(name string) *backend {
+	if name == "" {
+		return nil
+	}
+	for _, be := range b.backends {
+		if be.name == name {
+			return be
+		}
+	}
+	return nil
+}
+
+// randomVariant picks a healthy backend with a chance proportional to its weight
+func (b *balancer) randomVariant() *backend {
+	now := b.now()
+	var healthy []*backend
+	total := 0
+	for _, be := range b.backends {
+		if be.healthy(now) {
+			healthy = append(healthy, be)
+			total += be.weight
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = b.backends
+		total = 0
+		for _, be := range healthy {
+			total += be.weight
+		}
+	}
+	n := b.rand(total)
+	for _, be := range healthy {
+		if n < be.weight {
+			return be
+		}
+		n -= be.weight
+	}
+	return healthy[len(healthy)-1]
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func variantHost() tobab.Host {
+	return tobab.Host{
+		Strategy: tobab.StrategyVariant,
+		Backends: []tobab.Backend{
+			{URL: "http://a:80", Name: "a", Weight: 9},
+			{URL: "http://b:80", Name: "b", Weight: 1},
+		},
+	}
+}
+
+// serveVariant returns the name of the backend that was chosen and the response
+func serveVariant(t *testing.T, h tobab.Host, bal *balancer, r *http.Request) (string, *httptest.ResponseRecorder) {
+	t.Helper()
+	var chosen string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chosen = bal.pick(r).name
+	})
+	w := httptest.NewRecorder()
+	variantMiddleware(h, bal, next).ServeHTTP(w, r)
+	return chosen, w
+}
+
+func TestVariantMiddleware_InitialAssignment(t *testing.T) {
+	h := variantHost()
+	bal, _ := newBalancer(h)
+
+	counts := map[string]int{}
+	for n := 0; n < 10; n++ {
+		n := n
+		bal.rand = func(int) int { return n }
+		chosen, w := serveVariant(t, h, bal, httptest.NewRequest(http.MethodGet, "/", nil))
+		counts[chosen]++
+
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != defaultVariantCookie || cookies[0].Value != chosen {
+			t.Fatalf("expected a %s cookie with %s, got %v", defaultVariantCookie, chosen, cookies)
+		}
+	}
+	if counts["a"] != 9 || counts["b"] != 1 {
+		t.Errorf("expected variants to be assigned 9:1 by weight, got %v", counts)
+	}
+}
+
+func TestVariantMiddleware_Sticky(t *testing.T) {
+	h := variantHost()
+	h.VariantCookie = "ab"
+	bal, _ := newBalancer(h)
+	//a fresh assignment would always be a
+	bal.rand = func(int) int { return 0 }
+
+	for i := 0; i < 5; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: "ab", Value: "b"})
+		chosen, w := serveVariant(t, h, bal, r)
+		if chosen != "b" {
+			t.Errorf("client with variant b was sent to %s", chosen)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Error("an assigned client should not get a new cookie")
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "ab", Value: "removed"})
+	if chosen, w := serveVariant(t, h, bal, r); chosen != "a" || len(w.Result().Cookies()) != 1 {
+		t.Errorf("a cookie for an unknown variant should be replaced, got %s", chosen)
+	}
+}
+
+func TestVariantMiddleware_HeaderOverride(t *testing.T) {
+	h := variantHost()
+	bal, _ := newBalancer(h)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultVariantCookie, Value: "a"})
+	r.Header.Set("X-Variant", "b")
+	chosen, w := serveVariant(t, h, bal, r)
+	if chosen != "b" {
+		t.Errorf("header override for b was sent to %s", chosen)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("a header override should not change the assigned variant")
+	}
+}
@@ -1,9 +1,56 @@
 package tobab
 
+import (
+	"errors"
+	"time"
+)
+
+// The implementations of Database wrap these errors for things that are not stored, so callers can tell them
+// apart from a database that can't be read with errors.Is
+var (
+	ErrHostNotFound       = errors.New("host not found")
+	ErrCredentialNotFound = errors.New("service credential not found")
+	ErrSigningKeyNotFound = errors.New("signing key not found")
+)
+
 type Database interface {
-	//hosts
+	//hosts, GetHost and DeleteHost return ErrHostNotFound for a hostname that isn't stored
 	AddHost(Host) error
 	GetHost(string) (*Host, error)
 	GetHosts() ([]Host, error)
 	DeleteHost(string) error
+
+	//tokens
+	RevokeToken(tokenID string) error
+	IsRevoked(tokenID string) (bool, error)
+	//RevokeUserTokens revokes all tokens of a user that were issued before the given time
+	RevokeUserTokens(email string, before time.Time) error
+	UserTokensRevokedBefore(email string) (time.Time, error)
+	//SaveToken stores a token issued with the login flow, ListTokens returns the ones that expire after the
+	//given time, oldest first
+	SaveToken(IssuedToken) error
+	ListTokens(expiresAfter time.Time) ([]IssuedToken, error)
+
+	//service credentials, GetCredential returns nil when the host has no credential for the username and
+	//DeleteCredential returns ErrCredentialNotFound
+	SaveCredential(ServiceCredential) error
+	GetCredential(host, username string) (*ServiceCredential, error)
+	DeleteCredential(host, username string) error
+
+	//SaveAuditEvent appends an event to the audit log, when the audit log is stored in the database
+	SaveAuditEvent(AuditEvent) error
+
+	//signing keys, GetSigningKeys returns them oldest first and DeleteSigningKey returns ErrSigningKeyNotFound
+	//for a key that isn't stored
+	SaveSigningKey(SigningKey) error
+	GetSigningKeys() ([]SigningKey, error)
+	DeleteSigningKey(id string) error
+
+	//key derivation, GetKeyParams returns nil when nothing is stored yet
+	GetKeyParams() (*KeyParams, error)
+	SaveKeyParams(KeyParams) error
+
+	//Ping returns an error when the database can't be used, for the readiness check
+	Ping() error
+	Close()
 }
@@ -0,0 +1,402 @@
+// Package dbtest is a test suite that every implementation of tobab.Database has to pass
+package dbtest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+// Opener opens or creates the database at path
+type Opener func(path string) (tobab.Database, error)
+
+// Run runs the suite against the databases returned by open, every test gets a new database
+func Run(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		test func(*testing.T, tobab.Database)
+	}{
+		{"hosts", testHosts},
+		{"replace host", testReplaceHost},
+		{"delete host", testDeleteHost},
+		{"revoke token", testRevokeToken},
+		{"revoke user tokens", testRevokeUserTokens},
+		{"key params", testKeyParams},
+		{"issued tokens", testIssuedTokens},
+		{"service credentials", testServiceCredentials},
+		{"audit events", testAuditEvents},
+		{"signing keys", testSigningKeys},
+		{"ping", testPing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tobab-dbtest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			db, err := open(filepath.Join(dir, "tobab.db"))
+			if err != nil {
+				t.Fatalf("unable to open database: %v", err)
+			}
+			defer db.Close()
+			tt.test(t, db)
+		})
+	}
+	t.Run("reopen", func(t *testing.T) {
+		testReopen(t, open)
+	})
+}
+
+var testHost = tobab.Host{
+	Hostname: "app.example.com",
+	Type:     "http",
+	Backends: []tobab.Backend{{URL: "http://10.0.0.1:8080", Weight: 2}, {URL: "http://10.0.0.2:8080"}},
+	Globs:    []tobab.Glob{"*@example.com"},
+	Strategy: "weighted",
+	Public:   true,
+}
+
+func testHosts(t *testing.T, db tobab.Database) {
+	if h, err := db.GetHost(testHost.Hostname); !errors.Is(err, tobab.ErrHostNotFound) || h != nil {
+		t.Errorf("GetHost() of a host that doesn't exist = %v, %v, want ErrHostNotFound", h, err)
+	}
+	hosts, err := db.GetHosts()
+	if err != nil || len(hosts) != 0 {
+		t.Errorf("GetHosts() of an empty database = %v, %v", hosts, err)
+	}
+
+	other := tobab.Host{Hostname: "other.example.com", Type: "http", Backend: "http://10.0.0.3:8080"}
+	for _, h := range []tobab.Host{testHost, other} {
+		if err := db.AddHost(h); err != nil {
+			t.Fatalf("AddHost() error = %v", err)
+		}
+	}
+	h, err := db.GetHost(testHost.Hostname)
+	if err != nil {
+		t.Fatalf("GetHost() error = %v", err)
+	}
+	if !reflect.DeepEqual(*h, testHost) {
+		t.Errorf("GetHost() = %+v, want %+v", *h, testHost)
+	}
+	hosts, err = db.GetHosts()
+	if err != nil {
+		t.Fatalf("GetHosts() error = %v", err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("GetHosts() returned %d hosts, want 2", len(hosts))
+	}
+	for _, h := range hosts {
+		if h.Hostname == other.Hostname && !reflect.DeepEqual(h, other) {
+			t.Errorf("GetHosts() returned %+v, want %+v", h, other)
+		}
+	}
+}
+
+func testReplaceHost(t *testing.T, db tobab.Database) {
+	if err := db.AddHost(testHost); err != nil {
+		t.Fatal(err)
+	}
+	changed := testHost
+	changed.Backends = nil
+	changed.Backend = "http://10.0.0.9:8080"
+	if err := db.AddHost(changed); err != nil {
+		t.Fatalf("AddHost() of an existing host error = %v", err)
+	}
+	hosts, err := db.GetHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || !reflect.DeepEqual(hosts[0], changed) {
+		t.Errorf("GetHosts() = %+v, want only %+v", hosts, changed)
+	}
+}
+
+func testDeleteHost(t *testing.T, db tobab.Database) {
+	if err := db.AddHost(testHost); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteHost(testHost.Hostname); err != nil {
+		t.Fatalf("DeleteHost() error = %v", err)
+	}
+	if _, err := db.GetHost(testHost.Hostname); !errors.Is(err, tobab.ErrHostNotFound) {
+		t.Errorf("GetHost() after deleting the host error = %v, want ErrHostNotFound", err)
+	}
+	if err := db.DeleteHost(testHost.Hostname); !errors.Is(err, tobab.ErrHostNotFound) {
+		t.Errorf("DeleteHost() of a host that doesn't exist error = %v, want ErrHostNotFound", err)
+	}
+}
+
+func testRevokeToken(t *testing.T, db tobab.Database) {
+	revoked, err := db.IsRevoked("token-1")
+	if err != nil || revoked {
+		t.Fatalf("IsRevoked() of an unknown token = %v, %v", revoked, err)
+	}
+	if err := db.RevokeToken("token-1"); err != nil {
+		t.Fatalf("RevokeToken() error = %v", err)
+	}
+	for id, want := range map[string]bool{"token-1": true, "token-2": false} {
+		revoked, err := db.IsRevoked(id)
+		if err != nil || revoked != want {
+			t.Errorf("IsRevoked(%s) = %v, %v, want %v", id, revoked, err, want)
+		}
+	}
+}
+
+func testRevokeUserTokens(t *testing.T, db tobab.Database) {
+	before, err := db.UserTokensRevokedBefore("alice@example.com")
+	if err != nil || !before.IsZero() {
+		t.Fatalf("UserTokensRevokedBefore() of an unknown user = %v, %v", before, err)
+	}
+	cutoff := time.Now()
+	for _, c := range []time.Time{cutoff.Add(-time.Hour), cutoff} {
+		if err := db.RevokeUserTokens("alice@example.com", c); err != nil {
+			t.Fatalf("RevokeUserTokens() error = %v", err)
+		}
+	}
+	before, err = db.UserTokensRevokedBefore("alice@example.com")
+	if err != nil || !before.Equal(cutoff) {
+		t.Errorf("UserTokensRevokedBefore() = %v, %v, want the latest cutoff %v", before, err, cutoff)
+	}
+	before, err = db.UserTokensRevokedBefore("bob@example.com")
+	if err != nil || !before.IsZero() {
+		t.Errorf("UserTokensRevokedBefore() of another user = %v, %v", before, err)
+	}
+}
+
+func testKeyParams(t *testing.T, db tobab.Database) {
+	p, err := db.GetKeyParams()
+	if err != nil || p != nil {
+		t.Fatalf("GetKeyParams() of an empty database = %v, %v", p, err)
+	}
+	for _, want := range []tobab.KeyParams{
+		{SaltHash: "hash", KeyDerivation: tobab.DefaultKeyDerivation},
+		{SaltHash: "other", KeyDerivation: tobab.KeyDerivation{Time: 8, Memory: 64 * 1024, Threads: 4, KeyLen: 32}},
+	} {
+		if err := db.SaveKeyParams(want); err != nil {
+			t.Fatalf("SaveKeyParams() error = %v", err)
+		}
+		p, err = db.GetKeyParams()
+		if err != nil || p == nil || *p != want {
+			t.Errorf("GetKeyParams() = %v, %v, want %v", p, err, want)
+		}
+	}
+}
+
+func testIssuedTokens(t *testing.T, db tobab.Database) {
+	now := time.Unix(1600000000, 0)
+	tokens := []tobab.IssuedToken{
+		{ID: "new", Email: "alice@example.com", Host: "app.example.com", IP: "10.0.0.1", IssuedAt: now, ExpiresAt: now.Add(time.Hour)},
+		{ID: "old", Email: "bob@example.com", Host: "docs.example.com", IP: "2001:db8::1", IssuedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Minute)},
+		{ID: "expired", Email: "alice@example.com", IssuedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+	}
+	for _, tok := range tokens {
+		if err := db.SaveToken(tok); err != nil {
+			t.Fatalf("SaveToken() error = %v", err)
+		}
+	}
+	got, err := db.ListTokens(now)
+	if err != nil {
+		t.Fatalf("ListTokens() error = %v", err)
+	}
+	want := []tobab.IssuedToken{tokens[1], tokens[0]}
+	if len(got) != len(want) {
+		t.Fatalf("ListTokens() returned %d tokens, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.ID != w.ID || g.Email != w.Email || g.Host != w.Host || g.IP != w.IP || !g.IssuedAt.Equal(w.IssuedAt) || !g.ExpiresAt.Equal(w.ExpiresAt) {
+			t.Errorf("ListTokens()[%d] = %+v, want %+v", i, g, w)
+		}
+	}
+	if got, err := db.ListTokens(now.Add(2 * time.Hour)); err != nil || len(got) != 0 {
+		t.Errorf("ListTokens() after every token expired = %v, %v", got, err)
+	}
+}
+
+func testServiceCredentials(t *testing.T, db tobab.Database) {
+	if c, err := db.GetCredential("app.example.com", "monitoring"); c != nil || err != nil {
+		t.Errorf("GetCredential() of an empty database = %v, %v", c, err)
+	}
+	created := time.Unix(1600000000, 0)
+	cred := tobab.ServiceCredential{Host: "app.example.com", Username: "monitoring", Hash: "abc", CreatedAt: created}
+	if err := db.SaveCredential(cred); err != nil {
+		t.Fatalf("SaveCredential() error = %v", err)
+	}
+	if err := db.SaveCredential(tobab.ServiceCredential{Host: "other.example.com", Username: "monitoring", Hash: "def", CreatedAt: created}); err != nil {
+		t.Fatalf("SaveCredential() error = %v", err)
+	}
+	c, err := db.GetCredential("App.Example.com", "monitoring")
+	if err != nil || c == nil {
+		t.Fatalf("GetCredential() = %v, %v", c, err)
+	}
+	if c.Host != cred.Host || c.Username != cred.Username || c.Hash != cred.Hash || !c.CreatedAt.Equal(created) {
+		t.Errorf("GetCredential() = %+v, want %+v", c, cred)
+	}
+	if c, _ := db.GetCredential("app.example.com", "Monitoring"); c != nil {
+		t.Error("usernames should be case sensitive")
+	}
+
+	if err := db.DeleteCredential("app.example.com", "monitoring"); err != nil {
+		t.Fatalf("DeleteCredential() error = %v", err)
+	}
+	if c, err := db.GetCredential("app.example.com", "monitoring"); c != nil || err != nil {
+		t.Errorf("GetCredential() after delete = %v, %v", c, err)
+	}
+	if c, _ := db.GetCredential("other.example.com", "monitoring"); c == nil {
+		t.Error("deleting a credential removed the credential of another host")
+	}
+	if err := db.DeleteCredential("app.example.com", "monitoring"); !errors.Is(err, tobab.ErrCredentialNotFound) {
+		t.Errorf("DeleteCredential() of a credential that doesn't exist error = %v, want ErrCredentialNotFound", err)
+	}
+}
+
+func testAuditEvents(t *testing.T, db tobab.Database) {
+	e := tobab.AuditEvent{
+		Time:     time.Unix(1600000000, 0),
+		Type:     tobab.AuditLogin,
+		User:     "user@example.com",
+		Host:     "app.example.com",
+		ClientIP: "192.0.2.1",
+		Outcome:  tobab.AuditSuccess,
+	}
+	//the same event twice is two logins, the second one shouldn't replace the first
+	for i := 0; i < 2; i++ {
+		if err := db.SaveAuditEvent(e); err != nil {
+			t.Fatalf("SaveAuditEvent() error = %v", err)
+		}
+	}
+}
+
+func testSigningKeys(t *testing.T, db tobab.Database) {
+	if keys, err := db.GetSigningKeys(); len(keys) != 0 || err != nil {
+		t.Errorf("GetSigningKeys() of an empty database = %v, %v", keys, err)
+	}
+	retired := tobab.SigningKey{ID: "a", Key: []byte("sealed-a"), CreatedAt: time.Unix(1600000000, 0), RetiredAt: time.Unix(1600000100, 0), ValidUntil: time.Unix(1600086500, 0)}
+	active := tobab.SigningKey{ID: "b", Key: []byte("sealed"), CreatedAt: time.Unix(1600000100, 0)}
+	for _, k := range []tobab.SigningKey{active, retired} {
+		if err := db.SaveSigningKey(k); err != nil {
+			t.Fatalf("SaveSigningKey() error = %v", err)
+		}
+	}
+	keys, err := db.GetSigningKeys()
+	if err != nil {
+		t.Fatalf("GetSigningKeys() error = %v", err)
+	}
+	if len(keys) != 2 || keys[0].ID != retired.ID || keys[1].ID != active.ID {
+		t.Fatalf("GetSigningKeys() = %+v, want the retired key and then the active key", keys)
+	}
+	if string(keys[0].Key) != "sealed-a" || !keys[0].RetiredAt.Equal(retired.RetiredAt) || !keys[0].ValidUntil.Equal(retired.ValidUntil) {
+		t.Errorf("retired key = %+v, want %+v", keys[0], retired)
+	}
+	if string(keys[1].Key) != "sealed" || !keys[1].CreatedAt.Equal(active.CreatedAt) || !keys[1].RetiredAt.IsZero() || !keys[1].ValidUntil.IsZero() {
+		t.Errorf("active key = %+v, want %+v", keys[1], active)
+	}
+
+	//retiring a key replaces it
+	active.RetiredAt = time.Unix(1600000200, 0)
+	active.ValidUntil = time.Unix(1600086600, 0)
+	if err := db.SaveSigningKey(active); err != nil {
+		t.Fatalf("SaveSigningKey() error = %v", err)
+	}
+	if keys, _ := db.GetSigningKeys(); len(keys) != 2 || !keys[1].RetiredAt.Equal(active.RetiredAt) || !keys[1].ValidUntil.Equal(active.ValidUntil) {
+		t.Errorf("GetSigningKeys() after retiring = %+v", keys)
+	}
+
+	if err := db.DeleteSigningKey(retired.ID); err != nil {
+		t.Fatalf("DeleteSigningKey() error = %v", err)
+	}
+	if keys, _ := db.GetSigningKeys(); len(keys) != 1 || keys[0].ID != active.ID {
+		t.Errorf("GetSigningKeys() after delete = %+v", keys)
+	}
+	if err := db.DeleteSigningKey(retired.ID); !errors.Is(err, tobab.ErrSigningKeyNotFound) {
+		t.Errorf("DeleteSigningKey() of a key that doesn't exist error = %v, want ErrSigningKeyNotFound", err)
+	}
+}
+
+func testPing(t *testing.T, db tobab.Database) {
+	if err := db.Ping(); err != nil {
+		t.Errorf("Ping() of an open database error = %v", err)
+	}
+}
+
+func testReopen(t *testing.T, open Opener) {
+	dir, err := ioutil.TempDir("", "tobab-dbtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tobab.db")
+
+	db, err := open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddHost(testHost); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RevokeToken("token-1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := db.Ping(); err == nil {
+		t.Error("expected Ping() of a closed database to fail")
+	}
+
+	db, err = open(path)
+	if err != nil {
+		t.Fatalf("unable to open an existing database: %v", err)
+	}
+	defer db.Close()
+	if h, err := db.GetHost(testHost.Hostname); err != nil || !reflect.DeepEqual(*h, testHost) {
+		t.Errorf("GetHost() after reopening = %+v, %v", h, err)
+	}
+	if revoked, err := db.IsRevoked("token-1"); err != nil || !revoked {
+		t.Errorf("IsRevoked() after reopening = %v, %v", revoked, err)
+	}
+}
+
+// RunReadOnly checks that openReadOnly reads a database created with open and refuses to change it
+func RunReadOnly(t *testing.T, open, openReadOnly Opener) {
+	dir, err := ioutil.TempDir("", "tobab-dbtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tobab.db")
+
+	if _, err := openReadOnly(path); err == nil {
+		t.Error("expected an error opening a database that doesn't exist read-only")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("opening read-only created the database: %v", err)
+	}
+
+	db, err := open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddHost(testHost); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = openReadOnly(path)
+	if err != nil {
+		t.Fatalf("unable to open an existing database read-only: %v", err)
+	}
+	defer db.Close()
+	hosts, err := db.GetHosts()
+	if err != nil || len(hosts) != 1 || !reflect.DeepEqual(hosts[0], testHost) {
+		t.Errorf("GetHosts() read-only = %+v, %v", hosts, err)
+	}
+	if err := db.AddHost(tobab.Host{Hostname: "other.example.com"}); err == nil {
+		t.Error("expected an error adding a host to a read-only database")
+	}
+}
@@ -9,21 +9,25 @@ require (
 	github.com/alecthomas/kong v0.2.11
 	github.com/asaskevich/govalidator v0.0.0-20200907205600-7a23bdc65eef
 	github.com/asdine/storm v2.1.2+incompatible
+	github.com/aws/aws-sdk-go v1.30.20
 	github.com/caddyserver/certmagic v0.11.2
-	github.com/gorilla/handlers v1.5.1
+	github.com/go-acme/lego/v3 v3.7.0
 	github.com/gorilla/mux v1.8.0
 	github.com/kr/text v0.2.0 // indirect
 	github.com/logrusorgru/aurora v2.0.3+incompatible
 	github.com/markbates/goth v1.64.2
 	github.com/markbates/pkger v0.17.1
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/o1egl/paseto/v2 v2.1.1
+	github.com/prometheus/client_golang v1.11.1
 	github.com/ryanuber/go-glob v1.0.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.6.1 // indirect
 	github.com/vmihailenco/msgpack v4.0.4+incompatible // indirect
-	go.etcd.io/bbolt v1.3.5 // indirect
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
 	gopkg.in/check.v1 v1.0.0-20200902074654-038fdea0a05b // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776 // indirect
 )
@@ -3,9 +3,13 @@ package muxlogger
 //inspired by: https://github.com/pytimer/mux-logrus
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -41,6 +45,24 @@ func NewLogger(l *logrus.Entry) *LoggingMiddleware {
 	}
 }
 
+type fieldsKey struct{}
+
+type requestFields struct {
+	mu     sync.Mutex
+	fields logrus.Fields
+}
+
+// SetField adds a field to the log line of the request, it is a no-op for requests that aren't logged
+func SetField(r *http.Request, key string, value interface{}) {
+	rf, ok := r.Context().Value(fieldsKey{}).(*requestFields)
+	if !ok {
+		return
+	}
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.fields[key] = value
+}
+
 // realIP get the real IP from http request
 func realIP(req *http.Request) string {
 	ra := req.RemoteAddr
@@ -72,13 +94,36 @@ func (lw *loggingResponseWriter) Write(b []byte) (int, error) {
 	return lw.ResponseWriter.Write(b)
 }
 
+// Hijack allows upgrading the connection, like for websockets
+func (lw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := lw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	lw.statusCode = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Flush sends what is buffered to the client, streaming responses like server sent events depend on it
+func (lw *loggingResponseWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the writer underneath
+func (lw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
 // Middleware implement mux middleware interface
 func (m *LoggingMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		entry := m.logger.WithFields(logrus.Fields{
-			"path": r.URL.Path,
-			"host": r.Host,
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"host":   r.Host,
 		})
 		start := m.clock.Now()
 
@@ -86,15 +131,24 @@ func (m *LoggingMiddleware) Middleware(next http.Handler) http.Handler {
 			entry = entry.WithField("remoteAddr", remoteAddr)
 		}
 
+		rf := &requestFields{fields: logrus.Fields{}}
+		r = r.WithContext(context.WithValue(r.Context(), fieldsKey{}, rf))
+
 		lw := newLoggingResponseWriter(w)
 		next.ServeHTTP(lw, r)
 
 		latency := m.clock.Since(start)
 
+		rf.mu.Lock()
+		entry = entry.WithFields(rf.fields)
+		rf.mu.Unlock()
+
 		status := lw.statusCode
 		entry = entry.WithFields(logrus.Fields{
 			"status": status,
-			"took":   latency,
+			"took":   latency.String(),
+			//a number is easier to aggregate than the duration string
+			"took_ms": float64(latency) / float64(time.Millisecond),
 		})
 		if status < 499 {
 			entry.Info("handled request")
@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package sqlite
+
+//the driver needs cgo, so it is only included when tobab is built with -tags sqlite
+import _ "github.com/mattn/go-sqlite3"
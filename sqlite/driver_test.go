@@ -0,0 +1,7 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+//the tests always run against the real driver when cgo is available, tobab itself only includes it with -tags sqlite
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,377 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+// driverName is the database/sql driver this package expects, it is registered by driver.go
+const driverName = "sqlite3"
+
+// migrations are applied in order on New, the user_version of the database is the number that already ran
+var migrations = []string{
+	`CREATE TABLE hosts (
+		hostname TEXT PRIMARY KEY,
+		host TEXT NOT NULL
+	)`,
+	`CREATE TABLE revoked_tokens (
+		id TEXT PRIMARY KEY,
+		revoked_at INTEGER NOT NULL
+	);
+	CREATE TABLE revoked_users (
+		email TEXT PRIMARY KEY,
+		before INTEGER NOT NULL
+	)`,
+	`CREATE TABLE key_params (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		params TEXT NOT NULL
+	)`,
+	`CREATE TABLE issued_tokens (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		host TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		issued_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX issued_tokens_expires_at ON issued_tokens (expires_at)`,
+	`CREATE TABLE service_credentials (
+		id TEXT PRIMARY KEY,
+		host TEXT NOT NULL,
+		username TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		user TEXT NOT NULL,
+		host TEXT NOT NULL,
+		client_ip TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		detail TEXT NOT NULL
+	)`,
+	`CREATE TABLE signing_keys (
+		id TEXT PRIMARY KEY,
+		key_data BLOB,
+		created_at INTEGER NOT NULL,
+		retired_at INTEGER NOT NULL
+	)`,
+	`ALTER TABLE signing_keys ADD COLUMN valid_until INTEGER NOT NULL DEFAULT 0`,
+}
+
+type sqliteDB struct {
+	db *sql.DB
+}
+
+func New(path string) (*sqliteDB, error) {
+	if !registered() {
+		return nil, fmt.Errorf("sqlite support is not compiled in, build tobab with -tags sqlite")
+	}
+	//writers wait for each other instead of failing, and readers don't block the writer
+	db, err := sql.Open(driverName, "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", path, err)
+	}
+	return &sqliteDB{db: db}, nil
+}
+
+// NewReadOnly opens an existing database without the option to change it, it can be opened while tobab is
+// running. Migrations don't run, a database that tobab hasn't migrated yet can still be read.
+func NewReadOnly(path string) (*sqliteDB, error) {
+	if !registered() {
+		return nil, fmt.Errorf("sqlite support is not compiled in, build tobab with -tags sqlite")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driverName, "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	//sql.Open doesn't connect, an unreadable file should fail here
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteDB{db: db}, nil
+}
+
+func registered() bool {
+	for _, d := range sql.Drivers() {
+		if d == driverName {
+			return true
+		}
+	}
+	return false
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		//pragmas don't take parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *sqliteDB) AddHost(h tobab.Host) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("INSERT INTO hosts (hostname, host) VALUES (?, ?) ON CONFLICT (hostname) DO UPDATE SET host = excluded.host", h.Hostname, string(b))
+	return err
+}
+
+func (db *sqliteDB) GetHost(hostname string) (*tobab.Host, error) {
+	var h tobab.Host
+	var b string
+	err := db.db.QueryRow("SELECT host FROM hosts WHERE hostname = ?", hostname).Scan(&b)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", tobab.ErrHostNotFound, hostname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(b), &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (db *sqliteDB) GetHosts() ([]tobab.Host, error) {
+	rows, err := db.db.Query("SELECT host FROM hosts ORDER BY hostname")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hosts []tobab.Host
+	for rows.Next() {
+		var b string
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var h tobab.Host
+		if err := json.Unmarshal([]byte(b), &h); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, rows.Err()
+}
+
+func (db *sqliteDB) DeleteHost(hostname string) error {
+	res, err := db.db.Exec("DELETE FROM hosts WHERE hostname = ?", hostname)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %s", tobab.ErrHostNotFound, hostname)
+	}
+	return nil
+}
+
+func (db *sqliteDB) RevokeToken(tokenID string) error {
+	_, err := db.db.Exec("INSERT OR REPLACE INTO revoked_tokens (id, revoked_at) VALUES (?, ?)", tokenID, time.Now().UnixNano())
+	return err
+}
+
+func (db *sqliteDB) IsRevoked(tokenID string) (bool, error) {
+	var revokedAt int64
+	err := db.db.QueryRow("SELECT revoked_at FROM revoked_tokens WHERE id = ?", tokenID).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *sqliteDB) RevokeUserTokens(email string, before time.Time) error {
+	_, err := db.db.Exec("INSERT OR REPLACE INTO revoked_users (email, before) VALUES (?, ?)", email, before.UnixNano())
+	return err
+}
+
+func (db *sqliteDB) UserTokensRevokedBefore(email string) (time.Time, error) {
+	var before int64
+	err := db.db.QueryRow("SELECT before FROM revoked_users WHERE email = ?", email).Scan(&before)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, before), nil
+}
+
+func (db *sqliteDB) SaveToken(t tobab.IssuedToken) error {
+	_, err := db.db.Exec("INSERT OR REPLACE INTO issued_tokens (id, email, host, ip, issued_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		t.ID, t.Email, t.Host, t.IP, t.IssuedAt.UnixNano(), t.ExpiresAt.UnixNano())
+	return err
+}
+
+func (db *sqliteDB) ListTokens(expiresAfter time.Time) ([]tobab.IssuedToken, error) {
+	rows, err := db.db.Query("SELECT id, email, host, ip, issued_at, expires_at FROM issued_tokens WHERE expires_at > ? ORDER BY issued_at", expiresAfter.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []tobab.IssuedToken
+	for rows.Next() {
+		var t tobab.IssuedToken
+		var issued, expires int64
+		if err := rows.Scan(&t.ID, &t.Email, &t.Host, &t.IP, &issued, &expires); err != nil {
+			return nil, err
+		}
+		t.IssuedAt = time.Unix(0, issued)
+		t.ExpiresAt = time.Unix(0, expires)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (db *sqliteDB) SaveCredential(c tobab.ServiceCredential) error {
+	_, err := db.db.Exec("INSERT OR REPLACE INTO service_credentials (id, host, username, hash, created_at) VALUES (?, ?, ?, ?, ?)",
+		tobab.ServiceCredentialID(c.Host, c.Username), c.Host, c.Username, c.Hash, c.CreatedAt.UnixNano())
+	return err
+}
+
+func (db *sqliteDB) GetCredential(host, username string) (*tobab.ServiceCredential, error) {
+	var c tobab.ServiceCredential
+	var created int64
+	err := db.db.QueryRow("SELECT id, host, username, hash, created_at FROM service_credentials WHERE id = ?", tobab.ServiceCredentialID(host, username)).
+		Scan(&c.ID, &c.Host, &c.Username, &c.Hash, &created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.CreatedAt = time.Unix(0, created)
+	return &c, nil
+}
+
+func (db *sqliteDB) DeleteCredential(host, username string) error {
+	res, err := db.db.Exec("DELETE FROM service_credentials WHERE id = ?", tobab.ServiceCredentialID(host, username))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %s on %s", tobab.ErrCredentialNotFound, username, host)
+	}
+	return nil
+}
+
+func (db *sqliteDB) SaveAuditEvent(e tobab.AuditEvent) error {
+	_, err := db.db.Exec("INSERT INTO audit_events (time, type, user, host, client_ip, outcome, detail) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		e.Time.UnixNano(), e.Type, e.User, e.Host, e.ClientIP, e.Outcome, e.Detail)
+	return err
+}
+
+func (db *sqliteDB) SaveSigningKey(k tobab.SigningKey) error {
+	var retired, validUntil int64
+	if !k.RetiredAt.IsZero() {
+		retired = k.RetiredAt.UnixNano()
+	}
+	if !k.ValidUntil.IsZero() {
+		validUntil = k.ValidUntil.UnixNano()
+	}
+	_, err := db.db.Exec("INSERT OR REPLACE INTO signing_keys (id, key_data, created_at, retired_at, valid_until) VALUES (?, ?, ?, ?, ?)",
+		k.ID, k.Key, k.CreatedAt.UnixNano(), retired, validUntil)
+	return err
+}
+
+func (db *sqliteDB) GetSigningKeys() ([]tobab.SigningKey, error) {
+	rows, err := db.db.Query("SELECT id, key_data, created_at, retired_at, valid_until FROM signing_keys ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []tobab.SigningKey
+	for rows.Next() {
+		var k tobab.SigningKey
+		var created, retired, validUntil int64
+		if err := rows.Scan(&k.ID, &k.Key, &created, &retired, &validUntil); err != nil {
+			return nil, err
+		}
+		k.CreatedAt = time.Unix(0, created)
+		if retired != 0 {
+			k.RetiredAt = time.Unix(0, retired)
+		}
+		if validUntil != 0 {
+			k.ValidUntil = time.Unix(0, validUntil)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (db *sqliteDB) DeleteSigningKey(id string) error {
+	res, err := db.db.Exec("DELETE FROM signing_keys WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %s", tobab.ErrSigningKeyNotFound, id)
+	}
+	return nil
+}
+
+func (db *sqliteDB) GetKeyParams() (*tobab.KeyParams, error) {
+	var b string
+	err := db.db.QueryRow("SELECT params FROM key_params WHERE id = 1").Scan(&b)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p tobab.KeyParams
+	if err := json.Unmarshal([]byte(b), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (db *sqliteDB) SaveKeyParams(p tobab.KeyParams) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("INSERT OR REPLACE INTO key_params (id, params) VALUES (1, ?)", string(b))
+	return err
+}
+
+func (db *sqliteDB) Ping() error {
+	return db.db.Ping()
+}
+
+func (db *sqliteDB) Close() {
+	db.db.Close()
+}
@@ -0,0 +1,28 @@
+package sqlite
+
+import (
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/dbtest"
+)
+
+func TestSQLiteDB(t *testing.T) {
+	if !registered() {
+		t.Skip("built without -tags sqlite")
+	}
+	dbtest.Run(t, func(path string) (tobab.Database, error) {
+		return New(path)
+	})
+}
+
+func TestSQLiteDB_ReadOnly(t *testing.T) {
+	if !registered() {
+		t.Skip("built without -tags sqlite")
+	}
+	dbtest.RunReadOnly(t, func(path string) (tobab.Database, error) {
+		return New(path)
+	}, func(path string) (tobab.Database, error) {
+		return NewReadOnly(path)
+	})
+}
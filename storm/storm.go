@@ -1,8 +1,15 @@
 package storm
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
 	"github.com/asdine/storm"
 	"github.com/gnur/tobab"
+	bolt "go.etcd.io/bbolt"
 )
 
 type stormDB struct {
@@ -22,6 +29,23 @@ func New(path string) (*stormDB, error) {
 	return &database, nil
 }
 
+// NewReadOnly opens an existing database without the option to change it. Bolt locks the file of a database
+// that is open for writing, so it can't be opened while tobab is running.
+func NewReadOnly(path string) (*stormDB, error) {
+	//bolt creates a file that doesn't exist, even read-only
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := storm.Open(path, storm.BoltOptions(0600, &bolt.Options{ReadOnly: true, Timeout: time.Second}))
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is locked, it is probably in use by a running tobab: %w", path, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stormDB{db: db}, nil
+}
+
 func (db *stormDB) AddHost(h tobab.Host) error {
 	return db.db.Save(&h)
 }
@@ -29,7 +53,13 @@ func (db *stormDB) AddHost(h tobab.Host) error {
 func (db *stormDB) GetHost(hostname string) (*tobab.Host, error) {
 	var h tobab.Host
 	err := db.db.One("Hostname", hostname, &h)
-	return &h, err
+	if err == storm.ErrNotFound {
+		return nil, fmt.Errorf("%w: %s", tobab.ErrHostNotFound, hostname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
 }
 func (db *stormDB) GetHosts() ([]tobab.Host, error) {
 	var hosts []tobab.Host
@@ -44,6 +74,156 @@ func (db *stormDB) DeleteHost(hostname string) error {
 	return db.db.DeleteStruct(h)
 }
 
+type revokedToken struct {
+	ID        string `storm:"id"`
+	RevokedAt time.Time
+}
+
+type revokedUser struct {
+	Email  string `storm:"id"`
+	Before time.Time
+}
+
+func (db *stormDB) RevokeToken(tokenID string) error {
+	return db.db.Save(&revokedToken{ID: tokenID, RevokedAt: time.Now()})
+}
+
+func (db *stormDB) IsRevoked(tokenID string) (bool, error) {
+	var t revokedToken
+	err := db.db.One("ID", tokenID, &t)
+	if err == storm.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *stormDB) RevokeUserTokens(email string, before time.Time) error {
+	return db.db.Save(&revokedUser{Email: email, Before: before})
+}
+
+func (db *stormDB) UserTokensRevokedBefore(email string) (time.Time, error) {
+	var u revokedUser
+	err := db.db.One("Email", email, &u)
+	if err == storm.ErrNotFound {
+		return time.Time{}, nil
+	}
+	return u.Before, err
+}
+
+func (db *stormDB) SaveToken(t tobab.IssuedToken) error {
+	return db.db.Save(&t)
+}
+
+func (db *stormDB) ListTokens(expiresAfter time.Time) ([]tobab.IssuedToken, error) {
+	var all []tobab.IssuedToken
+	if err := db.db.All(&all); err != nil {
+		return nil, err
+	}
+	var tokens []tobab.IssuedToken
+	for _, t := range all {
+		if t.ExpiresAt.After(expiresAfter) {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].IssuedAt.Before(tokens[j].IssuedAt)
+	})
+	return tokens, nil
+}
+
+func (db *stormDB) SaveCredential(c tobab.ServiceCredential) error {
+	c.ID = tobab.ServiceCredentialID(c.Host, c.Username)
+	return db.db.Save(&c)
+}
+
+func (db *stormDB) GetCredential(host, username string) (*tobab.ServiceCredential, error) {
+	var c tobab.ServiceCredential
+	err := db.db.One("ID", tobab.ServiceCredentialID(host, username), &c)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (db *stormDB) DeleteCredential(host, username string) error {
+	var c tobab.ServiceCredential
+	err := db.db.One("ID", tobab.ServiceCredentialID(host, username), &c)
+	if err == storm.ErrNotFound {
+		return fmt.Errorf("%w: %s on %s", tobab.ErrCredentialNotFound, username, host)
+	}
+	if err != nil {
+		return err
+	}
+	return db.db.DeleteStruct(&c)
+}
+
+func (db *stormDB) SaveAuditEvent(e tobab.AuditEvent) error {
+	//the id is assigned by storm, events are never replaced
+	e.ID = 0
+	return db.db.Save(&e)
+}
+
+func (db *stormDB) SaveSigningKey(k tobab.SigningKey) error {
+	return db.db.Save(&k)
+}
+
+func (db *stormDB) GetSigningKeys() ([]tobab.SigningKey, error) {
+	var keys []tobab.SigningKey
+	if err := db.db.All(&keys); err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (db *stormDB) DeleteSigningKey(id string) error {
+	var k tobab.SigningKey
+	err := db.db.One("ID", id, &k)
+	if err == storm.ErrNotFound {
+		return fmt.Errorf("%w: %s", tobab.ErrSigningKeyNotFound, id)
+	}
+	if err != nil {
+		return err
+	}
+	return db.db.DeleteStruct(&k)
+}
+
+// keyParams is stored once, with a fixed id
+type keyParams struct {
+	ID int `storm:"id"`
+	tobab.KeyParams
+}
+
+const keyParamsID = 1
+
+func (db *stormDB) GetKeyParams() (*tobab.KeyParams, error) {
+	var p keyParams
+	err := db.db.One("ID", keyParamsID, &p)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p.KeyParams, nil
+}
+
+func (db *stormDB) SaveKeyParams(p tobab.KeyParams) error {
+	return db.db.Save(&keyParams{ID: keyParamsID, KeyParams: p})
+}
+
+func (db *stormDB) Ping() error {
+	//a read transaction fails once the file is closed
+	return db.db.Bolt.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
 func (db *stormDB) Close() {
 	db.db.Close()
 }
@@ -0,0 +1,22 @@
+package storm
+
+import (
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/dbtest"
+)
+
+func TestStormDB(t *testing.T) {
+	dbtest.Run(t, func(path string) (tobab.Database, error) {
+		return New(path)
+	})
+}
+
+func TestStormDB_ReadOnly(t *testing.T) {
+	dbtest.RunReadOnly(t, func(path string) (tobab.Database, error) {
+		return New(path)
+	}, func(path string) (tobab.Database, error) {
+		return NewReadOnly(path)
+	})
+}
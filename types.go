@@ -1,15 +1,21 @@
 package tobab
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/textproto"
 	"net/url"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/asaskevich/govalidator"
 	"github.com/logrusorgru/aurora"
 	matcher "github.com/ryanuber/go-glob"
+	"golang.org/x/net/http/httpguts"
 )
 
 type Config struct {
@@ -22,19 +28,589 @@ type Config struct {
 	CertDir         string `valid:"required"`
 	Email           string `valid:"email"`
 	Staging         bool
-	GoogleKey       string `valid:"required"`
-	GoogleSecret    string `valid:"required"`
+	GoogleKey       string
+	GoogleSecret    string
 	Loglevel        string
 	DatabasePath    string `valid:"required"`
+	DatabaseType    string
 	AdminGlobs      []Glob `valid:"required"`
+	AssetsDir       string
+	TemplatesDir    string
+	RBACMode        string
+	MaxURILength    int
+	MetricsListen   string
+	Defaults        Timeouts
+
+	//PreviousSecret keeps tokens signed before a secret rotation valid during SecretGracePeriod
+	PreviousSecret    string
+	SecretRotatedAt   time.Time
+	SecretGracePeriod string
+
+	//AuthFailureThreshold alerts when there are more authentication failures than this within AuthFailureWindow
+	AuthFailureThreshold int
+	AuthFailureWindow    string
+	AuthFailureWebhook   string
+
+	//SessionTicketKeyRotation replaces the in memory TLS session ticket key this often, DisableSessionTickets turns off resumption
+	SessionTicketKeyRotation string
+	DisableSessionTickets    bool
+
+	//DNSCacheTTL caches backend lookups for this long, at most 5m and "0s" disables it. DNSRetries retries transient lookup failures
+	DNSCacheTTL string
+	DNSRetries  int
+
+	//ServedByHeader is the name of a response header with the InstanceID, off when empty
+	ServedByHeader string
+	InstanceID     string
+
+	//DevMode enables features that are only meant for testing, like InjectDelay on hosts
+	DevMode bool
+
+	//ShutdownTimeout is how long in flight requests get to finish on shutdown, defaults to 30s
+	ShutdownTimeout string
+	//UpgradedShutdownTimeout is how long websockets and other upgraded connections get to close after the
+	//requests are drained, they are closed right away by default
+	UpgradedShutdownTimeout string
+
+	//Groups are named lists of user globs, used by the AllowedGroups of hosts
+	Groups map[string][]Glob
+
+	//RPCListen is where the management rpc listens, like tcp://127.0.0.1:1234 or unix:///var/run/tobab.sock
+	RPCListen string
+	//RPCSecret has to be provided with every rpc call, the cli reads it from the config or $TOBAB_RPC_SECRET
+	RPCSecret string
+
+	//ReadTimeout and WriteTimeout limit reading a request and writing its response for every host, both
+	//default to 15s and "0s" turns them off, like for hosts with long streaming responses
+	ReadTimeout  string
+	WriteTimeout string
+
+	//DNSProvider enables the DNS-01 challenge, which is needed for Wildcards, with "cloudflare" or "route53".
+	//Credentials that are left empty are read from the environment.
+	DNSProvider            string
+	CloudflareAPIToken     string
+	Route53AccessKeyID     string
+	Route53SecretAccessKey string
+	Route53HostedZoneID    string
+	//Wildcards like *.apps.example.com get a single certificate that is used for every host they cover
+	Wildcards []string
+
+	//StrictTransportSecurity adds a HSTS header to every https response, StrictTransportSecurityMaxAge defaults to a year
+	StrictTransportSecurity       bool
+	StrictTransportSecurityMaxAge string
+
+	//TrustedProxies are ips or ranges of load balancers in front of tobab, X-Forwarded-For is only used when
+	//a request comes from one of them
+	TrustedProxies []string
+
+	//KeyDerivation are the argon2id parameters the token key is derived with, unset ones use DefaultKeyDerivation
+	KeyDerivation KeyDerivation
+
+	//LogFormat is "text" (default) or "json"
+	LogFormat string
+
+	//RequestIDHeader carries the id of a request to the backend and back to the client, defaults to X-Request-Id
+	RequestIDHeader string
+
+	//Providers are the identity providers users can choose from on the login page, GoogleKey and GoogleSecret
+	//add google to them
+	Providers []Provider
+
+	//CompressionExcludeTypes are content types that are never compressed, like image/png or video/*, they
+	//replace the default list of compressed formats. Responses smaller than CompressionMinSize bytes (1024 by
+	//default) are not compressed either
+	CompressionExcludeTypes []string
+	CompressionMinSize      int
+
+	//AuditLog records logins, logouts, issued tokens and denied requests as json lines in this file, or in the
+	//database when it is "database". Off when empty
+	AuditLog string
 }
 
+// Provider is an oauth application of an identity provider, Label is shown on the login page and defaults to
+// the name of the provider. Groups looks up the groups of users when they log in, which needs an extra scope.
+type Provider struct {
+	Name   string
+	Key    string
+	Secret string
+	Label  string
+	Groups bool
+}
+
+// Identity providers users can log in with
+const (
+	ProviderGoogle = "google"
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+)
+
+// ProviderClientCert is the provider of users that are identified by a client certificate, so rules can be
+// limited to them
+const ProviderClientCert = "client-cert"
+
+// ProviderBasicAuth is the provider of users that log in with a ServiceCredential
+const ProviderBasicAuth = "basic-auth"
+
+var providerLabels = map[string]string{
+	ProviderGoogle: "Google",
+	ProviderGitHub: "GitHub",
+	ProviderGitLab: "GitLab",
+}
+
+// DisplayName returns the label of the provider for the login page
+func (p Provider) DisplayName() string {
+	if p.Label != "" {
+		return p.Label
+	}
+	return providerLabels[p.Name]
+}
+
+// Database backends, storm is used when DatabaseType is empty
+const (
+	DatabaseTypeStorm  = "storm"
+	DatabaseTypeSQLite = "sqlite"
+)
+
+// DNS providers that can solve the DNS-01 challenge
+const (
+	DNSProviderCloudflare = "cloudflare"
+	DNSProviderRoute53    = "route53"
+)
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// DefaultRPCListen only accepts rpc connections from the machine tobab runs on
+const DefaultRPCListen = "tcp://127.0.0.1:1234"
+
 type Host struct {
-	Hostname string `storm:"id" valid:"dns"`
-	Backend  string `valid:"required"`
+	Hostname string `storm:"id" valid:"dns,required"`
+	Backend  string
 	Type     string `valid:"required"`
 	Public   bool
 	Globs    []Glob
+	Rules    []Rule
+	RBACMode string
+	Timeouts
+
+	CleanPath          bool
+	RejectEncodedSlash bool
+
+	//Enabled is a pointer so hosts stored before this field existed stay enabled
+	Enabled *bool
+
+	//CSPNonce injects a per request nonce in the Content-Security-Policy header and all script tags
+	CSPNonce         bool
+	CSPNonceMaxBytes int64
+
+	//BufferResponse reads the complete backend response, up to BufferMaxBytes, before sending it
+	BufferResponse bool
+	BufferMaxBytes int64
+
+	//Decompress unpacks gzipped backend responses for clients that don't accept gzip
+	Decompress bool
+
+	//HeaderCasing lists request header names that are sent to the backend with exactly this casing
+	HeaderCasing []string
+
+	//Set-Cookie handling for cookies set by the backend
+	CookiePrefix string
+	CookiePath   string
+	DropCookies  []string
+
+	//MaxConcurrent limits in flight requests for this host, MaxConcurrentPerUser limits them per user
+	MaxConcurrent        int
+	MaxConcurrentPerUser int
+
+	//ClientCAFile is a pem file with the CAs that client certificates for this host must be signed by
+	ClientCAFile string
+	ClientAuth   string
+	//ClientCertIdentity lets a verified client certificate log in as the common name ("cn") or the first email
+	//address ("email") of the certificate, without a login at an identity provider
+	ClientCertIdentity string
+
+	//DisableSessionTickets turns off TLS session resumption for connections to this host
+	DisableSessionTickets bool
+
+	//BackendCAFile is a pem file with the CAs to verify an https backend with, defaults to the system roots
+	BackendCAFile string
+	//BackendCertGrace keeps accepting an expired backend certificate for this long after it expired
+	BackendCertGrace string
+	//BackendCertWarnDays logs a warning when the backend certificate expires within this many days, defaults to 14
+	BackendCertWarnDays int
+
+	//PublicPaths are reachable without authentication on a host that is not public
+	PublicPaths []string
+	//AllowedGroups restricts paths to users in one of the groups of the config, the most specific matching
+	//path of PublicPaths and AllowedGroups decides
+	AllowedGroups []PathGroups
+
+	//InjectDelay delays every request by a fixed ("200ms") or random ("100ms-500ms") time, for latency
+	//testing only, it is ignored unless DevMode is set
+	InjectDelay string
+
+	//Backends spreads requests over multiple backends with Strategy, Backend is used when this is empty.
+	//HashKey selects what the consistent-hash strategy hashes: "ip", "user" or "cookie:<name>"
+	Backends []Backend
+	Strategy string
+	HashKey  string
+
+	//VariantHeader and VariantCookie select a backend by name with the variant strategy, they default to
+	//X-Variant and tobab_variant
+	VariantHeader string
+	VariantCookie string
+
+	//HealthCheckPath is requested on every backend each HealthCheckInterval (10s by default), backends that
+	//don't respond with a 2xx get no requests until they do
+	HealthCheckPath     string
+	HealthCheckInterval string
+
+	//Listen is the address a tcp host listens on, connections are only accepted from AllowedIPs (ips or
+	//CIDR ranges) because there is no login for raw tcp
+	Listen     string
+	AllowedIPs []string
+
+	//RequireProtocol rejects clients that don't use this protocol, "http/2" or "http/1"
+	RequireProtocol string
+
+	//AllowCIDRs only lets clients from these ips or ranges in, before they log in. DenyCIDRs blocks clients
+	//and wins when a client is in both
+	AllowCIDRs []string
+	DenyCIDRs  []string
+
+	//RateLimitRPS limits every user, or client ip without a login, to this many requests per second,
+	//RateLimitBurst is how many requests can be done at once and defaults to RateLimitRPS
+	RateLimitRPS   float64
+	RateLimitBurst int
+
+	//SPAFallback serves the index.html of a static host for paths that don't exist, DirectoryListing lists
+	//the files of directories without an index.html
+	SPAFallback      bool
+	DirectoryListing bool
+
+	//SetRequestHeaders are set on requests to the backend and SetResponseHeaders on responses to the client,
+	//${user} in a value is replaced with the email address of the user. RemoveResponseHeaders are removed
+	//from responses of the backend
+	SetRequestHeaders     map[string]string
+	SetResponseHeaders    map[string]string
+	RemoveResponseHeaders []string
+
+	//BasicAuth accepts the ServiceCredentials of this host from clients without a session, like cli tools
+	//and monitoring agents that can't follow the login redirect
+	BasicAuth bool
+
+	//RetryAttempts is how many times a GET, HEAD or OPTIONS request is sent to another healthy backend when
+	//the backend it was sent to can't be connected to or resets the connection
+	RetryAttempts int
+
+	//TokenAge replaces DefaultTokenAge for users that log in to this host, it can't be longer than MaxTokenAge
+	TokenAge string
+
+	//Maintenance serves the maintenance page with a 503 instead of proxying the host, health checks of the
+	//backends keep running
+	Maintenance bool
+
+	//MaxBodyBytes rejects requests with a larger body with a 413, 0 allows bodies of any size
+	MaxBodyBytes int64
+
+	//CORSAllowedOrigins are origins like https://app.example.com, or *, that can call this host from a browser.
+	//Preflight requests are answered by tobab. CORSAllowedMethods defaults to GET, HEAD and POST and
+	//CORSAllowCredentials lets the browser send cookies, which can't be combined with *
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSAllowCredentials bool
+
+	//CacheSizeMB keeps cacheable GET responses of the backend in memory, up to this many megabytes. Responses
+	//to logged in users are only cached when the backend marks them public. 0 disables the cache.
+	CacheSizeMB int
+}
+
+// Backend is one of multiple backends of a host, Weight is used by the weighted and variant strategies and
+// Name by the variant strategy
+type Backend struct {
+	URL    string
+	Weight int
+	Name   string
+}
+
+// UnmarshalJSON accepts a plain url as well as an object, so "Backends": ["http://a", "http://b"] works
+func (b *Backend) UnmarshalJSON(data []byte) error {
+	var u string
+	if err := json.Unmarshal(data, &u); err == nil {
+		*b = Backend{URL: u}
+		return nil
+	}
+	//a different type so this method isn't called again
+	type backend Backend
+	return json.Unmarshal(data, (*backend)(b))
+}
+
+const (
+	//ProtocolHTTP2 requires clients to use HTTP/2 or newer
+	ProtocolHTTP2 = "http/2"
+	//ProtocolHTTP1 requires clients to use HTTP/1.x
+	ProtocolHTTP1 = "http/1"
+)
+
+const (
+	//StrategyRoundRobin sends requests to every backend in turn
+	StrategyRoundRobin = "round-robin"
+	//StrategyWeighted sends requests to backends in proportion to their weight
+	StrategyWeighted = "weighted"
+	//StrategyConsistentHash sends requests with the same HashKey to the same backend
+	StrategyConsistentHash = "consistent-hash"
+	//StrategyVariant sends requests to the backend named in the variant header or cookie, new clients get a
+	//weighted random backend that is remembered in the variant cookie
+	StrategyVariant = "variant"
+	//StrategyLeastConnections sends requests to the backend with the fewest requests in flight
+	StrategyLeastConnections = "least-connections"
+)
+
+// AllBackends returns the backends of this host, a host with only Backend set has a single backend
+func (h Host) AllBackends() []Backend {
+	if len(h.Backends) > 0 {
+		return h.Backends
+	}
+	return []Backend{{URL: h.Backend, Weight: 1}}
+}
+
+const (
+	//ClientAuthRequire rejects connections without a valid client certificate
+	ClientAuthRequire = "require"
+	//ClientAuthVerifyIfGiven only verifies client certificates that are provided
+	ClientAuthVerifyIfGiven = "verify-if-given"
+)
+
+const (
+	//ClientCertIdentityCN identifies clients by the common name of the subject of their certificate
+	ClientCertIdentityCN = "cn"
+	//ClientCertIdentityEmail identifies clients by the first email address of their certificate
+	ClientCertIdentityEmail = "email"
+)
+
+// reservedRequestHeader reports whether tobab sets this header on requests to backends itself, backends rely
+// on them to tell who the client and the user are
+func reservedRequestHeader(name string) bool {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	return strings.HasPrefix(name, "X-Forwarded-") || strings.HasPrefix(name, "X-Tobab-") || name == "X-Origin-Host"
+}
+
+func (h *Host) validateCORS() error {
+	if len(h.CORSAllowedOrigins) == 0 && (len(h.CORSAllowedMethods) > 0 || len(h.CORSAllowedHeaders) > 0 || h.CORSAllowCredentials) {
+		return errors.New("CORSAllowedOrigins is required for the other CORS settings")
+	}
+	for _, o := range h.CORSAllowedOrigins {
+		if o == "*" {
+			if h.CORSAllowCredentials {
+				return errors.New("CORSAllowCredentials can't be used with * in CORSAllowedOrigins, any site could make requests as the user, list the origins instead")
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("CORSAllowedOrigins: '%s' is not an origin like https://app.example.com", o)
+		}
+	}
+	for _, m := range h.CORSAllowedMethods {
+		if !httpguts.ValidHeaderFieldName(m) {
+			return fmt.Errorf("CORSAllowedMethods: '%s' is not a valid method", m)
+		}
+	}
+	for _, name := range h.CORSAllowedHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("CORSAllowedHeaders: '%s' is not a valid header name", name)
+		}
+	}
+	return nil
+}
+
+// IsEnabled reports whether requests for this host should be proxied
+func (h Host) IsEnabled() bool {
+	return h.Enabled == nil || *h.Enabled
+}
+
+// KeyDerivation are the parameters of argon2id, Memory is in KiB
+type KeyDerivation struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+}
+
+// DefaultKeyDerivation are the parameters tobab used before they could be configured
+var DefaultKeyDerivation = KeyDerivation{Time: 4, Memory: 4 * 1024, Threads: 2, KeyLen: 32}
+
+// WithDefaults returns the parameters with the unset ones taken from DefaultKeyDerivation
+func (k KeyDerivation) WithDefaults() KeyDerivation {
+	if k.Time == 0 {
+		k.Time = DefaultKeyDerivation.Time
+	}
+	if k.Memory == 0 {
+		k.Memory = DefaultKeyDerivation.Memory
+	}
+	if k.Threads == 0 {
+		k.Threads = DefaultKeyDerivation.Threads
+	}
+	if k.KeyLen == 0 {
+		k.KeyLen = DefaultKeyDerivation.KeyLen
+	}
+	return k
+}
+
+func (k KeyDerivation) Validate() error {
+	k = k.WithDefaults()
+	//paseto v2 local tokens are encrypted with a 256 bit key
+	if k.KeyLen != 32 {
+		return fmt.Errorf("KeyDerivation: KeyLen is %d, tokens need a key of 32 bytes", k.KeyLen)
+	}
+	if k.Memory < 8*uint32(k.Threads) {
+		return fmt.Errorf("KeyDerivation: Memory should be at least 8 KiB per thread, got %d KiB for %d threads", k.Memory, k.Threads)
+	}
+	return nil
+}
+
+// KeyParams are the key derivation parameters that were used with the salt that hashes to SaltHash
+type KeyParams struct {
+	SaltHash string
+	KeyDerivation
+}
+
+// IssuedToken is a token that was handed out with the login flow. Host is where the user was going when they
+// logged in and IP the address they logged in from.
+type IssuedToken struct {
+	ID        string `storm:"id"`
+	Email     string
+	Host      string
+	IP        string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// ServiceCredential is a basic auth user of a host. The password is generated by tobab, only its hash is
+// stored. ID is ServiceCredentialID of the host and username.
+type ServiceCredential struct {
+	ID        string `storm:"id"`
+	Host      string
+	Username  string
+	Hash      string
+	CreatedAt time.Time
+}
+
+// AuditLogDatabase stores the audit log in the database instead of a file
+const AuditLogDatabase = "database"
+
+// Audit event types
+const (
+	AuditLogin       = "login"
+	AuditLogout      = "logout"
+	AuditTokenIssued = "token_issued"
+	AuditDenied      = "denied"
+)
+
+// Audit outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEvent is an entry of the audit log. Detail is the provider of a login, the id of an issued token, or why
+// something failed or was denied. ClientIP is empty for tokens created with the cli.
+type AuditEvent struct {
+	ID       int       `storm:"id,increment" json:"-"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	User     string    `json:"user"`
+	Host     string    `json:"host"`
+	ClientIP string    `json:"client_ip"`
+	Outcome  string    `json:"outcome"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// SigningKey is a token key that was added by rotating the key, or the key derived from a secret once it is
+// retired. Key is encrypted with the key derived from the secret, so the database alone isn't enough to create
+// tokens. The key without RetiredAt is the one new tokens are signed with, retired keys are accepted until
+// ValidUntil.
+type SigningKey struct {
+	ID         string `storm:"id"`
+	Key        []byte
+	CreatedAt  time.Time
+	RetiredAt  time.Time
+	ValidUntil time.Time
+}
+
+// ServiceCredentialID is the id of the credential of username for host, hostnames are case insensitive
+func ServiceCredentialID(host, username string) string {
+	return strings.ToLower(host) + "/" + username
+}
+
+// Timeouts for requests to a backend, all values are parsed with time.ParseDuration.
+// Unset values of a host are inherited from the global defaults.
+type Timeouts struct {
+	DialTimeout     string
+	ResponseTimeout string
+	IdleTimeout     string
+	RequestTimeout  string
+}
+
+// DefaultTimeouts are used when neither the host nor the global defaults set a timeout
+var DefaultTimeouts = Timeouts{
+	DialTimeout: "600s",
+	IdleTimeout: "90s",
+}
+
+// Merge returns t with every unset timeout taken from defaults
+func (t Timeouts) Merge(defaults Timeouts) Timeouts {
+	if t.DialTimeout == "" {
+		t.DialTimeout = defaults.DialTimeout
+	}
+	if t.ResponseTimeout == "" {
+		t.ResponseTimeout = defaults.ResponseTimeout
+	}
+	if t.IdleTimeout == "" {
+		t.IdleTimeout = defaults.IdleTimeout
+	}
+	if t.RequestTimeout == "" {
+		t.RequestTimeout = defaults.RequestTimeout
+	}
+	return t
+}
+
+// Validate checks that all set timeouts are valid durations
+func (t Timeouts) Validate() error {
+	for name, v := range map[string]string{
+		"DialTimeout":     t.DialTimeout,
+		"ResponseTimeout": t.ResponseTimeout,
+		"IdleTimeout":     t.IdleTimeout,
+		"RequestTimeout":  t.RequestTimeout,
+	} {
+		if v == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(v); err != nil {
+			return fmt.Errorf("%s: '%s' is not a valid duration: %w", name, v, err)
+		}
+	}
+	return nil
+}
+
+// EffectiveTimeouts returns the timeouts of this host merged with the global and builtin defaults
+func (h Host) EffectiveTimeouts(defaults Timeouts) Timeouts {
+	return h.Timeouts.Merge(defaults).Merge(DefaultTimeouts)
+}
+
+const (
+	//RBACModeEnforce denies requests that are not allowed by the host rules
+	RBACModeEnforce = "enforce"
+	//RBACModeAudit only logs requests that would have been denied
+	RBACModeAudit = "audit"
+)
+
+func validRBACMode(mode string) bool {
+	return mode == "" || mode == RBACModeEnforce || mode == RBACModeAudit
 }
 
 func (h *Host) Print() {
@@ -44,7 +620,10 @@ Backend: %s
 Type: %s
 Public: %t
 Globs: %s
-`, aurora.Magenta(aurora.Bold(h.Hostname)), h.Backend, h.Type, h.Public, h.Globs)
+Rules: %v
+RBACMode: %s
+Enabled: %t
+`, aurora.Magenta(aurora.Bold(h.Hostname)), h.Backend, h.Type, h.Public, h.Globs, h.Rules, h.RBACMode, h.IsEnabled())
 }
 
 func (h *Host) Validate(cookiescope string) (bool, error) {
@@ -52,49 +631,463 @@ func (h *Host) Validate(cookiescope string) (bool, error) {
 	if !ok {
 		return ok, err
 	}
-	if h.Type != "http" {
-		return false, errors.New("host type must be http")
+	if h.Type == "tcp" {
+		return h.validateTCP()
 	}
-	u, err := url.ParseRequestURI(h.Backend)
-	if err != nil {
-		return false, fmt.Errorf("%s failed to parse as a url: %w", h.Backend, err)
+	if h.Type != "http" && h.Type != "static" {
+		return false, errors.New("host type must be http, static or tcp")
 	}
-	if !strings.HasPrefix(u.Scheme, "http") {
-		return false, fmt.Errorf("%s has invalid or missing scheme", h.Backend)
+	if h.Type == "static" {
+		if h.Backend == "" || len(h.Backends) > 0 {
+			return false, errors.New("Backend: a static host serves a single directory, set it as Backend")
+		}
+	} else if ok, err := h.validateBackends(); !ok {
+		return ok, err
 	}
 	if !strings.HasSuffix(h.Hostname, cookiescope) && !h.Public {
 		return false, fmt.Errorf("'%s' won't be accessible because the cookiescope ('%s') does not match this domain", h.Hostname, cookiescope)
 	}
-	if !h.Public && len(h.Globs) == 0 {
+	if !h.Public && len(h.Globs) == 0 && len(h.Rules) == 0 {
 		return false, fmt.Errorf("%s will not be accessible by anybody", h.Hostname)
 	}
+	if !validRBACMode(h.RBACMode) {
+		return false, fmt.Errorf("'%s' is not a valid rbac mode, use '%s' or '%s'", h.RBACMode, RBACModeEnforce, RBACModeAudit)
+	}
+	if err := h.Timeouts.Validate(); err != nil {
+		return false, err
+	}
+	if h.BackendCertGrace != "" {
+		if _, err := time.ParseDuration(h.BackendCertGrace); err != nil {
+			return false, fmt.Errorf("BackendCertGrace: '%s' is not a valid duration: %w", h.BackendCertGrace, err)
+		}
+	}
+
+	if h.InjectDelay != "" {
+		if _, _, err := ParseDelay(h.InjectDelay); err != nil {
+			return false, fmt.Errorf("InjectDelay: %w", err)
+		}
+	}
+
+	if h.RequireProtocol != "" && h.RequireProtocol != ProtocolHTTP2 && h.RequireProtocol != ProtocolHTTP1 {
+		return false, fmt.Errorf("'%s' is not a valid protocol, use '%s' or '%s'", h.RequireProtocol, ProtocolHTTP2, ProtocolHTTP1)
+	}
+
+	if h.RetryAttempts < 0 {
+		return false, errors.New("RetryAttempts can't be negative")
+	}
+
+	if h.MaxBodyBytes < 0 {
+		return false, errors.New("MaxBodyBytes can't be negative, use 0 for no limit")
+	}
+
+	if h.CacheSizeMB < 0 {
+		return false, errors.New("CacheSizeMB can't be negative, use 0 to disable the cache")
+	}
+	if h.CacheSizeMB > 0 && h.CSPNonce {
+		return false, errors.New("CacheSizeMB can't be used with CSPNonce, every cached response would have the same nonce")
+	}
+	if h.CacheSizeMB > 0 && h.Strategy == StrategyVariant {
+		return false, errors.New("CacheSizeMB can't be used with the variant strategy, the responses of the variants would be mixed up")
+	}
+
+	if h.TokenAge != "" {
+		if d, err := time.ParseDuration(h.TokenAge); err != nil {
+			return false, fmt.Errorf("TokenAge: '%s' is not a valid duration: %w", h.TokenAge, err)
+		} else if d <= 0 {
+			return false, fmt.Errorf("TokenAge: '%s' should be longer than 0", h.TokenAge)
+		}
+	}
+
+	if h.RateLimitRPS < 0 || h.RateLimitBurst < 0 {
+		return false, errors.New("RateLimitRPS and RateLimitBurst can't be negative")
+	}
+	if h.RateLimitBurst > 0 && h.RateLimitRPS == 0 {
+		return false, errors.New("RateLimitBurst requires a RateLimitRPS")
+	}
+	if _, err := ParseIPNets(h.AllowCIDRs); err != nil {
+		return false, fmt.Errorf("AllowCIDRs: %w", err)
+	}
+	if _, err := ParseIPNets(h.DenyCIDRs); err != nil {
+		return false, fmt.Errorf("DenyCIDRs: %w", err)
+	}
+
+	if h.HealthCheckPath != "" && !strings.HasPrefix(h.HealthCheckPath, "/") {
+		return false, fmt.Errorf("health check path '%s' should start with a /", h.HealthCheckPath)
+	}
+	if h.HealthCheckInterval != "" {
+		if d, err := time.ParseDuration(h.HealthCheckInterval); err != nil || d <= 0 {
+			return false, fmt.Errorf("HealthCheckInterval: '%s' is not a valid duration", h.HealthCheckInterval)
+		}
+	}
+
+	for _, p := range h.PublicPaths {
+		if !strings.HasPrefix(p, "/") {
+			return false, fmt.Errorf("public path '%s' should start with a /", p)
+		}
+	}
+	for _, pg := range h.AllowedGroups {
+		if !strings.HasPrefix(pg.Path, "/") {
+			return false, fmt.Errorf("restricted path '%s' should start with a /", pg.Path)
+		}
+		if len(pg.Groups) == 0 {
+			return false, fmt.Errorf("restricted path '%s' has no groups and won't be accessible by anybody", pg.Path)
+		}
+	}
+
+	for name, v := range h.SetRequestHeaders {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(v) {
+			return false, fmt.Errorf("SetRequestHeaders: '%s' is not a valid header", name)
+		}
+		if reservedRequestHeader(name) {
+			return false, fmt.Errorf("SetRequestHeaders: '%s' is set by tobab and can't be changed", name)
+		}
+	}
+	for name, v := range h.SetResponseHeaders {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(v) {
+			return false, fmt.Errorf("SetResponseHeaders: '%s' is not a valid header", name)
+		}
+	}
+	for _, name := range h.RemoveResponseHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return false, fmt.Errorf("RemoveResponseHeaders: '%s' is not a valid header name", name)
+		}
+	}
+	if err := h.validateCORS(); err != nil {
+		return false, err
+	}
+
+	if h.ClientAuth != "" {
+		if h.ClientCAFile == "" {
+			return false, errors.New("ClientAuth requires a ClientCAFile")
+		}
+		if h.ClientAuth != ClientAuthRequire && h.ClientAuth != ClientAuthVerifyIfGiven {
+			return false, fmt.Errorf("'%s' is not a valid client auth mode, use '%s' or '%s'", h.ClientAuth, ClientAuthRequire, ClientAuthVerifyIfGiven)
+		}
+	}
+	if h.ClientCertIdentity != "" {
+		if h.ClientCAFile == "" {
+			return false, errors.New("ClientCertIdentity requires a ClientCAFile")
+		}
+		if h.ClientCertIdentity != ClientCertIdentityCN && h.ClientCertIdentity != ClientCertIdentityEmail {
+			return false, fmt.Errorf("'%s' is not a valid client certificate identity, use '%s' or '%s'", h.ClientCertIdentity, ClientCertIdentityCN, ClientCertIdentityEmail)
+		}
+	}
 
 	return ok, err
 }
 
+// validateBackends checks the backend urls of an http host and how requests are spread over them
+func (h *Host) validateBackends() (bool, error) {
+	if h.Backend == "" && len(h.Backends) == 0 {
+		return false, errors.New("Backend: non zero value required")
+	}
+	for _, b := range h.AllBackends() {
+		u, err := url.ParseRequestURI(b.URL)
+		if err != nil {
+			return false, fmt.Errorf("%s failed to parse as a url: %w", b.URL, err)
+		}
+		if !strings.HasPrefix(u.Scheme, "http") && u.Scheme != "ws" && u.Scheme != "wss" {
+			return false, fmt.Errorf("%s has invalid or missing scheme", b.URL)
+		}
+		if b.Weight < 0 {
+			return false, fmt.Errorf("%s has a negative weight", b.URL)
+		}
+	}
+	switch h.Strategy {
+	case "", StrategyRoundRobin, StrategyWeighted, StrategyLeastConnections:
+	case StrategyConsistentHash:
+		if h.HashKey != "ip" && h.HashKey != "user" && !strings.HasPrefix(h.HashKey, "cookie:") {
+			return false, fmt.Errorf("'%s' is not a valid hash key, use 'ip', 'user' or 'cookie:<name>'", h.HashKey)
+		}
+	case StrategyVariant:
+		names := map[string]bool{}
+		for _, b := range h.Backends {
+			if b.Name == "" || names[b.Name] {
+				return false, fmt.Errorf("every backend needs a unique name for the variant strategy, '%s' is not", b.Name)
+			}
+			names[b.Name] = true
+		}
+	default:
+		return false, fmt.Errorf("'%s' is not a valid strategy, use '%s', '%s', '%s', '%s' or '%s'", h.Strategy, StrategyRoundRobin, StrategyWeighted, StrategyLeastConnections, StrategyConsistentHash, StrategyVariant)
+	}
+	return true, nil
+}
+
+// validateTCP checks a tcp host, which only uses the hostname as its name and has no authentication, so
+// the AllowedIPs are required
+func (h *Host) validateTCP() (bool, error) {
+	if _, _, err := net.SplitHostPort(h.Listen); err != nil {
+		return false, fmt.Errorf("Listen: '%s' should be an address like :5432: %w", h.Listen, err)
+	}
+	if _, _, err := net.SplitHostPort(h.Backend); err != nil || strings.Contains(h.Backend, "/") {
+		return false, fmt.Errorf("Backend: '%s' should be an address like db.internal:5432 for a tcp host", h.Backend)
+	}
+	if len(h.AllowedIPs) == 0 {
+		return false, errors.New("a tcp host has no authentication and requires AllowedIPs, use 0.0.0.0/0 to allow everybody")
+	}
+	if _, err := ParseIPNets(h.AllowedIPs); err != nil {
+		return false, err
+	}
+	if err := h.Timeouts.Validate(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ParseIPNets parses ips and ranges in CIDR notation, a single ip is a range with only that ip
+func ParseIPNets(ips []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range ips {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("'%s' is not a valid ip address", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid ip range: %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ParseRPCListen splits a listen address of the management rpc in the network and address for net.Listen,
+// an empty address results in DefaultRPCListen
+func ParseRPCListen(s string) (network, address string, err error) {
+	if s == "" {
+		s = DefaultRPCListen
+	}
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return "", "", fmt.Errorf("'%s' has no network, use tcp://host:port or unix:///path/to/socket", s)
+	}
+	network, address = s[:i], s[i+3:]
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("'%s' is not a valid tcp address: %w", address, err)
+		}
+	case "unix":
+		if address == "" {
+			return "", "", fmt.Errorf("'%s' has no socket path", s)
+		}
+	default:
+		return "", "", fmt.Errorf("'%s' is not a supported network, use tcp or unix", network)
+	}
+	return network, address, nil
+}
+
+// PathGroups limits the paths matching Path to users in one of Groups
+type PathGroups struct {
+	Path   string
+	Groups []string
+}
+
+// IsPublicPath reports whether p is one of the PublicPaths of this host. Paths with a * are matched as a
+// glob, other paths match themselves and everything below them, so /health matches /health/live but not
+// /healthz.
+func (h Host) IsPublicPath(p string) bool {
+	public, _ := h.PathAccess(p)
+	return public
+}
+
+// PathAccess returns whether p is public or restricted to groups. When a public path and a restricted path
+// both match, the longest pattern wins, so /api/* restricted with /api/public/* public keeps the public
+// part open, and a restricted path wins a tie.
+func (h Host) PathAccess(p string) (public bool, groups []string) {
+	if len(h.PublicPaths) == 0 && len(h.AllowedGroups) == 0 {
+		return false, nil
+	}
+	p = path.Clean("/" + p)
+	publicLen := -1
+	for _, pattern := range h.PublicPaths {
+		if matchPath(pattern, p) && len(pattern) > publicLen {
+			publicLen = len(pattern)
+		}
+	}
+	restrictedLen := -1
+	for _, pg := range h.AllowedGroups {
+		if matchPath(pg.Path, p) && len(pg.Path) > restrictedLen {
+			restrictedLen = len(pg.Path)
+			groups = pg.Groups
+		}
+	}
+	if restrictedLen >= publicLen && restrictedLen >= 0 {
+		return false, groups
+	}
+	return publicLen >= 0, nil
+}
+
+func matchPath(pattern, p string) bool {
+	if strings.Contains(pattern, "*") {
+		return Glob(pattern).Match(p)
+	}
+	pattern = strings.TrimSuffix(pattern, "/")
+	return p == pattern || strings.HasPrefix(p, pattern+"/") || pattern == ""
+}
+
+// ParseDelay parses a fixed delay like "200ms" or a range like "100ms-500ms" into its bounds
+func ParseDelay(s string) (min, max time.Duration, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err = time.ParseDuration(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("'%s' is not a valid delay: %w", s, err)
+	}
+	max = min
+	if len(parts) == 2 {
+		max, err = time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return 0, 0, fmt.Errorf("'%s' is not a valid delay: %w", s, err)
+		}
+	}
+	if min < 0 || max < min {
+		return 0, 0, fmt.Errorf("'%s' is not a valid delay range", s)
+	}
+	return min, max, nil
+}
+
 type Glob string
 
 func (g Glob) Match(s string) bool {
 	return matcher.Glob(string(g), s)
 }
 
+// Rule grants access to all users matching one of its globs, the name is used in logs. With Providers the
+// rule only applies to users that logged in with one of these identity providers.
+type Rule struct {
+	Name      string
+	Globs     []Glob
+	Providers []string
+}
+
 func (h Host) HasAccess(user string) bool {
+	_, ok := h.MatchRule(user)
+	return ok
+}
+
+// MatchRule returns the name of the first rule that grants user access to this host. Globs are checked
+// before rules, unnamed rules and globs are identified by their position.
+func (h Host) MatchRule(user string) (string, bool) {
+	return h.MatchProviderRule(user, "")
+}
+
+// MatchProviderRule is MatchRule for a user that logged in with provider, rules limited to other providers
+// are skipped
+func (h Host) MatchProviderRule(user, provider string) (string, bool) {
 
 	if h.Public {
-		return true
+		return "public", true
 	} else if user == "" {
-		return false
+		return "", false
 	}
 
-	for _, g := range h.Globs {
+	for i, g := range h.Globs {
 		if g.Match(user) {
+			return fmt.Sprintf("globs[%d]", i), true
+		}
+	}
+
+	for i, rule := range h.Rules {
+		if len(rule.Providers) > 0 && !containsString(rule.Providers, provider) {
+			continue
+		}
+		for _, g := range rule.Globs {
+			if g.Match(user) {
+				if rule.Name != "" {
+					return rule.Name, true
+				}
+				return fmt.Sprintf("rules[%d]", i), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
 			return true
 		}
 	}
+	return false
+}
+
+// EffectiveRBACMode returns the rbac mode for this host, falling back to the provided global mode
+func (h Host) EffectiveRBACMode(global string) string {
+	if h.RBACMode != "" {
+		return h.RBACMode
+	}
+	if global != "" {
+		return global
+	}
+	return RBACModeEnforce
+}
+
+// InGroups reports whether user matches the globs of one of the groups
+func (c Config) InGroups(user string, groups []string) bool {
+	if user == "" {
+		return false
+	}
+	for _, g := range groups {
+		for _, glob := range c.Groups[g] {
+			if glob.Match(user) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
+// HasIdentityProvider reports whether users are able to log in. Without an identity provider only public
+// hosts and paths, and tokens created with the cli, work.
+func (c Config) HasIdentityProvider() bool {
+	return len(c.IdentityProviders()) > 0
+}
+
+// IdentityProviders returns the Providers, with google first when GoogleKey and GoogleSecret are set
+func (c Config) IdentityProviders() []Provider {
+	var providers []Provider
+	if c.GoogleKey != "" && c.GoogleSecret != "" {
+		providers = append(providers, Provider{Name: ProviderGoogle, Key: c.GoogleKey, Secret: c.GoogleSecret})
+	}
+	return append(providers, c.Providers...)
+}
+
+// ProviderGroups reports whether the groups of users of the provider are looked up when they log in
+func (c Config) ProviderGroups(name string) bool {
+	for _, p := range c.IdentityProviders() {
+		if p.Name == name {
+			return p.Groups
+		}
+	}
 	return false
 }
 
+// CertificateName returns the name of the certificate for hostname, the wildcard that covers it or the
+// hostname itself
+func (c Config) CertificateName(hostname string) string {
+	h := strings.ToLower(hostname)
+	for _, w := range c.Wildcards {
+		suffix := strings.ToLower(strings.TrimPrefix(w, "*"))
+		if !strings.HasSuffix(h, suffix) {
+			continue
+		}
+		//a wildcard only covers a single label
+		if label := strings.TrimSuffix(h, suffix); label != "" && !strings.Contains(label, ".") {
+			return w
+		}
+	}
+	return hostname
+}
+
 func (c *Config) Validate() (bool, error) {
 	ok, err := govalidator.ValidateStruct(c)
 	if !ok {
@@ -105,6 +1098,131 @@ func (c *Config) Validate() (bool, error) {
 		return false, fmt.Errorf("Hostname: '%s' should be in the same domain as the cookiescope: '%s'", c.Hostname, c.CookieScope)
 	}
 
+	if (c.GoogleKey == "") != (c.GoogleSecret == "") {
+		return false, errors.New("GoogleKey and GoogleSecret should both be set to use google as identity provider")
+	}
+	seen := map[string]bool{}
+	for _, p := range c.IdentityProviders() {
+		if _, ok := providerLabels[p.Name]; !ok {
+			return false, fmt.Errorf("Providers: '%s' is not supported, use '%s', '%s' or '%s'", p.Name, ProviderGoogle, ProviderGitHub, ProviderGitLab)
+		}
+		if p.Key == "" || p.Secret == "" {
+			return false, fmt.Errorf("Providers: %s needs a Key and Secret", p.Name)
+		}
+		//the name is part of the callback url, a second application of the same provider can't be told apart
+		if seen[p.Name] {
+			return false, fmt.Errorf("Providers: %s is configured more than once, GoogleKey also configures google", p.Name)
+		}
+		seen[p.Name] = true
+	}
+
+	if c.PreviousSecret != "" {
+		if c.SecretRotatedAt.IsZero() {
+			return false, errors.New("SecretRotatedAt is required when PreviousSecret is set")
+		}
+		if c.SecretGracePeriod != "" {
+			if _, err := time.ParseDuration(c.SecretGracePeriod); err != nil {
+				return false, fmt.Errorf("SecretGracePeriod: '%s' is not a valid duration: %w", c.SecretGracePeriod, err)
+			}
+		}
+	}
+
+	if c.AuthFailureWindow != "" {
+		if _, err := time.ParseDuration(c.AuthFailureWindow); err != nil {
+			return false, fmt.Errorf("AuthFailureWindow: '%s' is not a valid duration: %w", c.AuthFailureWindow, err)
+		}
+	}
+	if c.AuthFailureWebhook != "" && !govalidator.IsURL(c.AuthFailureWebhook) {
+		return false, fmt.Errorf("AuthFailureWebhook: '%s' is not a valid url", c.AuthFailureWebhook)
+	}
+	if c.CompressionMinSize < 0 {
+		return false, errors.New("CompressionMinSize can't be negative")
+	}
+	for _, t := range c.CompressionExcludeTypes {
+		if parts := strings.Split(t, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return false, fmt.Errorf("CompressionExcludeTypes: '%s' is not a content type like image/png or video/*", t)
+		}
+	}
+	if c.RequestIDHeader != "" && !httpguts.ValidHeaderFieldName(c.RequestIDHeader) {
+		return false, fmt.Errorf("RequestIDHeader: '%s' is not a valid header name", c.RequestIDHeader)
+	}
+	if c.ServedByHeader != "" && !httpguts.ValidHeaderFieldName(c.ServedByHeader) {
+		return false, fmt.Errorf("ServedByHeader: '%s' is not a valid header name", c.ServedByHeader)
+	}
+	if c.DNSCacheTTL != "" {
+		if _, err := time.ParseDuration(c.DNSCacheTTL); err != nil {
+			return false, fmt.Errorf("DNSCacheTTL: '%s' is not a valid duration: %w", c.DNSCacheTTL, err)
+		}
+	}
+	if c.ShutdownTimeout != "" {
+		if _, err := time.ParseDuration(c.ShutdownTimeout); err != nil {
+			return false, fmt.Errorf("ShutdownTimeout: '%s' is not a valid duration: %w", c.ShutdownTimeout, err)
+		}
+	}
+	if c.UpgradedShutdownTimeout != "" {
+		if _, err := time.ParseDuration(c.UpgradedShutdownTimeout); err != nil {
+			return false, fmt.Errorf("UpgradedShutdownTimeout: '%s' is not a valid duration: %w", c.UpgradedShutdownTimeout, err)
+		}
+	}
+	if c.ReadTimeout != "" {
+		if _, err := time.ParseDuration(c.ReadTimeout); err != nil {
+			return false, fmt.Errorf("ReadTimeout: '%s' is not a valid duration: %w", c.ReadTimeout, err)
+		}
+	}
+	if c.WriteTimeout != "" {
+		if _, err := time.ParseDuration(c.WriteTimeout); err != nil {
+			return false, fmt.Errorf("WriteTimeout: '%s' is not a valid duration: %w", c.WriteTimeout, err)
+		}
+	}
+	if c.StrictTransportSecurityMaxAge != "" {
+		if d, err := time.ParseDuration(c.StrictTransportSecurityMaxAge); err != nil || d < 0 {
+			return false, fmt.Errorf("StrictTransportSecurityMaxAge: '%s' is not a valid duration", c.StrictTransportSecurityMaxAge)
+		}
+	}
+	if c.LogFormat != "" && c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		return false, fmt.Errorf("LogFormat: '%s' is not supported, use '%s' or '%s'", c.LogFormat, LogFormatText, LogFormatJSON)
+	}
+	if err := c.KeyDerivation.Validate(); err != nil {
+		return false, err
+	}
+	if _, err := ParseIPNets(c.TrustedProxies); err != nil {
+		return false, fmt.Errorf("TrustedProxies: %w", err)
+	}
+	switch c.DatabaseType {
+	case "", DatabaseTypeStorm, DatabaseTypeSQLite:
+	default:
+		return false, fmt.Errorf("DatabaseType: '%s' is not supported, use '%s' or '%s'", c.DatabaseType, DatabaseTypeStorm, DatabaseTypeSQLite)
+	}
+	switch c.DNSProvider {
+	case "", DNSProviderCloudflare, DNSProviderRoute53:
+	default:
+		return false, fmt.Errorf("DNSProvider: '%s' is not supported, use '%s' or '%s'", c.DNSProvider, DNSProviderCloudflare, DNSProviderRoute53)
+	}
+	for _, w := range c.Wildcards {
+		if !strings.HasPrefix(w, "*.") || !govalidator.IsDNSName(w[2:]) {
+			return false, fmt.Errorf("Wildcards: '%s' is not a valid wildcard, use something like *.apps.example.com", w)
+		}
+		if c.DNSProvider == "" {
+			return false, fmt.Errorf("Wildcards: '%s' needs a DNSProvider, wildcard certificates can only be obtained with the DNS-01 challenge", w)
+		}
+	}
+	if _, _, err := ParseRPCListen(c.RPCListen); err != nil {
+		return false, fmt.Errorf("RPCListen: %w", err)
+	}
+	if c.SessionTicketKeyRotation != "" {
+		if _, err := time.ParseDuration(c.SessionTicketKeyRotation); err != nil {
+			return false, fmt.Errorf("SessionTicketKeyRotation: '%s' is not a valid duration: %w", c.SessionTicketKeyRotation, err)
+		}
+	}
+
+	if err := c.Defaults.Validate(); err != nil {
+		return false, fmt.Errorf("Defaults: %w", err)
+	}
+
+	if !validRBACMode(c.RBACMode) {
+		return false, fmt.Errorf("RBACMode: '%s' is not valid, use '%s' or '%s'", c.RBACMode, RBACModeEnforce, RBACModeAudit)
+	}
+
 	return ok, err
 }
 
@@ -1,6 +1,10 @@
 package tobab
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
 
 func TestHost_Validate(t *testing.T) {
 	cookiescope := "example.com"
@@ -10,6 +14,16 @@ func TestHost_Validate(t *testing.T) {
 		Type     string
 		Public   bool
 		Globs    []Glob
+
+		ClientCAFile string
+		ClientAuth   string
+
+		Backends []Backend
+		Strategy string
+		HashKey  string
+
+		AllowCIDRs []string
+		DenyCIDRs  []string
 	}
 	tests := []struct {
 		name    string
@@ -61,6 +75,38 @@ func TestHost_Validate(t *testing.T) {
 			want:    false,
 			wantErr: true,
 		},
+		{
+			name: "static",
+			fields: fields{
+				Hostname: "test.example.com",
+				Backend:  "/srv/www",
+				Type:     "static",
+				Public:   true,
+			},
+			want:    true,
+			wantErr: false,
+		},
+		{
+			name: "static without directory",
+			fields: fields{
+				Hostname: "test.example.com",
+				Type:     "static",
+				Public:   true,
+			},
+			want:    false,
+			wantErr: true,
+		},
+		{
+			name: "static with multiple backends",
+			fields: fields{
+				Hostname: "test.example.com",
+				Backends: []Backend{{URL: "/srv/a"}, {URL: "/srv/b"}},
+				Type:     "static",
+				Public:   true,
+			},
+			want:    false,
+			wantErr: true,
+		},
 		{
 			name: "missing hostname",
 			fields: fields{
@@ -106,6 +152,105 @@ func TestHost_Validate(t *testing.T) {
 			want:    false,
 			wantErr: true,
 		},
+		{
+			name: "client auth without ca",
+			fields: fields{
+				Hostname:   "test.example.com",
+				Backend:    "http://localhost:1234",
+				Type:       "http",
+				Public:     true,
+				ClientAuth: "require",
+			},
+			want:    false,
+			wantErr: true,
+		},
+		{
+			name: "invalid client auth",
+			fields: fields{
+				Hostname:     "test.example.com",
+				Backend:      "http://localhost:1234",
+				Type:         "http",
+				Public:       true,
+				ClientCAFile: "ca.pem",
+				ClientAuth:   "sometimes",
+			},
+			want:    false,
+			wantErr: true,
+		},
+		{
+			name: "optional client auth",
+			fields: fields{
+				Hostname:     "test.example.com",
+				Backend:      "http://localhost:1234",
+				Type:         "http",
+				Public:       true,
+				ClientCAFile: "ca.pem",
+				ClientAuth:   "verify-if-given",
+			},
+			want:    true,
+			wantErr: false,
+		},
+		{
+			name: "multiple backends",
+			fields: fields{
+				Hostname: "test.example.com",
+				Type:     "http",
+				Public:   true,
+				Backends: []Backend{{URL: "http://a:80"}, {URL: "http://b:80"}},
+				Strategy: StrategyConsistentHash,
+				HashKey:  "cookie:session",
+			},
+			want:    true,
+			wantErr: false,
+		},
+		{
+			name: "consistent hash without hash key",
+			fields: fields{
+				Hostname: "test.example.com",
+				Type:     "http",
+				Public:   true,
+				Backends: []Backend{{URL: "http://a:80"}, {URL: "http://b:80"}},
+				Strategy: StrategyConsistentHash,
+			},
+			want:    false,
+			wantErr: true,
+		},
+		{
+			name: "invalid backend in list",
+			fields: fields{
+				Hostname: "test.example.com",
+				Type:     "http",
+				Public:   true,
+				Backends: []Backend{{URL: "http://a:80"}, {URL: "b:80"}},
+			},
+			want:    false,
+			wantErr: true,
+		},
+		{
+			name: "ip filter",
+			fields: fields{
+				Hostname:   "test.example.com",
+				Backend:    "https://localhost:1234",
+				Type:       "http",
+				Public:     true,
+				AllowCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"},
+				DenyCIDRs:  []string{"10.0.66.1"},
+			},
+			want:    true,
+			wantErr: false,
+		},
+		{
+			name: "invalid ip filter",
+			fields: fields{
+				Hostname:   "test.example.com",
+				Backend:    "https://localhost:1234",
+				Type:       "http",
+				Public:     true,
+				AllowCIDRs: []string{"10.0.0.0/40"},
+			},
+			want:    false,
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -115,6 +260,16 @@ func TestHost_Validate(t *testing.T) {
 				Type:     tt.fields.Type,
 				Public:   tt.fields.Public,
 				Globs:    tt.fields.Globs,
+
+				ClientCAFile: tt.fields.ClientCAFile,
+				ClientAuth:   tt.fields.ClientAuth,
+
+				Backends: tt.fields.Backends,
+				Strategy: tt.fields.Strategy,
+				HashKey:  tt.fields.HashKey,
+
+				AllowCIDRs: tt.fields.AllowCIDRs,
+				DenyCIDRs:  tt.fields.DenyCIDRs,
 			}
 			got, err := h.Validate(cookiescope)
 			if (err != nil) != tt.wantErr {
@@ -127,3 +282,437 @@ func TestHost_Validate(t *testing.T) {
 		})
 	}
 }
+
+func TestHost_EffectiveTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     Timeouts
+		defaults Timeouts
+		want     Timeouts
+	}{
+		{
+			name: "builtin defaults",
+			want: Timeouts{DialTimeout: "600s", IdleTimeout: "90s"},
+		},
+		{
+			name:     "inherits global defaults",
+			defaults: Timeouts{DialTimeout: "5s", ResponseTimeout: "30s", RequestTimeout: "1m"},
+			want:     Timeouts{DialTimeout: "5s", ResponseTimeout: "30s", IdleTimeout: "90s", RequestTimeout: "1m"},
+		},
+		{
+			name:     "host overrides global defaults",
+			host:     Timeouts{DialTimeout: "1s", IdleTimeout: "10s"},
+			defaults: Timeouts{DialTimeout: "5s", ResponseTimeout: "30s", IdleTimeout: "1m"},
+			want:     Timeouts{DialTimeout: "1s", ResponseTimeout: "30s", IdleTimeout: "10s"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Host{Timeouts: tt.host}
+			if got := h.EffectiveTimeouts(tt.defaults); got != tt.want {
+				t.Errorf("Host.EffectiveTimeouts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHost_IsPublicPath(t *testing.T) {
+	h := Host{PublicPaths: []string{"/health", "/hooks/", "/api/*/public"}}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/health", want: true},
+		{path: "/health/live", want: true},
+		{path: "/healthz", want: false},
+		{path: "/hooks/github", want: true},
+		{path: "/hooks", want: true},
+		{path: "/api/v1/public", want: true},
+		{path: "/api/v1/private", want: false},
+		{path: "/health/../admin", want: false},
+		{path: "/", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := h.IsPublicPath(tt.path); got != tt.want {
+				t.Errorf("Host.IsPublicPath(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDelay(t *testing.T) {
+	tests := []struct {
+		in      string
+		min     time.Duration
+		max     time.Duration
+		wantErr bool
+	}{
+		{in: "200ms", min: 200 * time.Millisecond, max: 200 * time.Millisecond},
+		{in: "100ms-1s", min: 100 * time.Millisecond, max: time.Second},
+		{in: "1s-100ms", wantErr: true},
+		{in: "fast", wantErr: true},
+		{in: "100ms-", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			min, max, err := ParseDelay(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDelay() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if min != tt.min || max != tt.max {
+				t.Errorf("ParseDelay() = %s, %s, want %s, %s", min, max, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateIdentityProvider(t *testing.T) {
+	base := Config{
+		Hostname:     "login.example.com",
+		CookieScope:  "example.com",
+		Secret:       "secret",
+		Salt:         "salt",
+		CertDir:      "/tmp",
+		DatabasePath: "/tmp/tobab.db",
+		AdminGlobs:   []Glob{"admin@example.com"},
+	}
+	tests := []struct {
+		name         string
+		key          string
+		secret       string
+		providers    []Provider
+		wantErr      bool
+		wantProvider bool
+	}{
+		{name: "no identity provider", wantErr: false},
+		{name: "google", key: "key", secret: "secret", wantProvider: true},
+		{name: "google without secret", key: "key", wantErr: true},
+		{name: "google without key", secret: "secret", wantErr: true},
+		{name: "providers", providers: []Provider{{Name: ProviderGitHub, Key: "id", Secret: "secret"}, {Name: ProviderGitLab, Key: "id", Secret: "secret"}}, wantProvider: true},
+		{name: "google and github", key: "key", secret: "secret", providers: []Provider{{Name: ProviderGitHub, Key: "id", Secret: "secret"}}, wantProvider: true},
+		{name: "unsupported provider", providers: []Provider{{Name: "myspace", Key: "id", Secret: "secret"}}, wantErr: true, wantProvider: true},
+		{name: "provider without secret", providers: []Provider{{Name: ProviderGitHub, Key: "id"}}, wantErr: true, wantProvider: true},
+		{name: "google twice", key: "key", secret: "secret", providers: []Provider{{Name: ProviderGoogle, Key: "id", Secret: "secret"}}, wantErr: true, wantProvider: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base
+			c.GoogleKey = tt.key
+			c.GoogleSecret = tt.secret
+			c.Providers = tt.providers
+			_, err := c.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := c.HasIdentityProvider(); got != tt.wantProvider {
+				t.Errorf("Config.HasIdentityProvider() = %v, want %v", got, tt.wantProvider)
+			}
+		})
+	}
+}
+
+func TestBackend_UnmarshalJSON(t *testing.T) {
+	var h Host
+	err := json.Unmarshal([]byte(`{"Backends": ["http://a:80", {"URL": "http://b:80", "Weight": 2}]}`), &h)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []Backend{{URL: "http://a:80"}, {URL: "http://b:80", Weight: 2}}
+	if len(h.Backends) != 2 || h.Backends[0] != want[0] || h.Backends[1] != want[1] {
+		t.Errorf("Backends = %+v, want %+v", h.Backends, want)
+	}
+}
+
+func TestHost_ValidateTCP(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    Host
+		wantErr bool
+	}{
+		{name: "valid", host: Host{Listen: ":5432", Backend: "db.internal:5432", AllowedIPs: []string{"10.0.0.0/8", "192.168.1.10"}}},
+		{name: "allowlist required", host: Host{Listen: ":5432", Backend: "db.internal:5432"}, wantErr: true},
+		{name: "invalid range", host: Host{Listen: ":5432", Backend: "db.internal:5432", AllowedIPs: []string{"10.0.0.0/33"}}, wantErr: true},
+		{name: "listen address required", host: Host{Backend: "db.internal:5432", AllowedIPs: []string{"10.0.0.1"}}, wantErr: true},
+		{name: "url backend", host: Host{Listen: ":5432", Backend: "http://db.internal", AllowedIPs: []string{"10.0.0.1"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.host.Hostname = "db.example.com"
+			tt.host.Type = "tcp"
+			_, err := tt.host.Validate("example.com")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Host.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHost_ValidateHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    Host
+		wantErr bool
+	}{
+		{name: "valid", host: Host{SetRequestHeaders: map[string]string{"Authorization": "Basic abc", "X-User": "${user}"}, SetResponseHeaders: map[string]string{"Cache-Control": "no-store"}, RemoveResponseHeaders: []string{"Server"}}},
+		{name: "forwarded header", host: Host{SetRequestHeaders: map[string]string{"x-forwarded-for": "10.0.0.1"}}, wantErr: true},
+		{name: "tobab user", host: Host{SetRequestHeaders: map[string]string{"X-Tobab-User": "admin@example.com"}}, wantErr: true},
+		{name: "invalid name", host: Host{SetRequestHeaders: map[string]string{"X User": "a"}}, wantErr: true},
+		{name: "invalid value", host: Host{SetResponseHeaders: map[string]string{"X-A": "a\r\nX-B: b"}}, wantErr: true},
+		{name: "invalid removed name", host: Host{RemoveResponseHeaders: []string{"Server:"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.host.Hostname = "app.example.com"
+			tt.host.Backend = "http://localhost:8080"
+			tt.host.Type = "http"
+			tt.host.Public = true
+			_, err := tt.host.Validate("example.com")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Host.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHost_ValidateClientCertIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		caFile   string
+		identity string
+		wantErr  bool
+	}{
+		{name: "common name", caFile: "ca.pem", identity: ClientCertIdentityCN},
+		{name: "email", caFile: "ca.pem", identity: ClientCertIdentityEmail},
+		{name: "requires client cas", identity: ClientCertIdentityCN, wantErr: true},
+		{name: "unknown identity", caFile: "ca.pem", identity: "serial", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Host{Hostname: "api.example.com", Backend: "http://localhost:8080", Type: "http", Globs: []Glob{"billing-service"}, ClientCAFile: tt.caFile, ClientCertIdentity: tt.identity}
+			_, err := h.Validate("example.com")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Host.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHost_ValidateTokenAge(t *testing.T) {
+	for _, tt := range []struct {
+		age     string
+		wantErr bool
+	}{
+		{age: ""},
+		{age: "15m"},
+		{age: "0s", wantErr: true},
+		{age: "-1h", wantErr: true},
+		{age: "a day", wantErr: true},
+	} {
+		h := Host{Hostname: "admin.example.com", Backend: "http://localhost:8080", Type: "http", Globs: []Glob{"*@example.com"}, TokenAge: tt.age}
+		if _, err := h.Validate("example.com"); (err != nil) != tt.wantErr {
+			t.Errorf("Host.Validate() with TokenAge '%s' error = %v, wantErr %v", tt.age, err, tt.wantErr)
+		}
+	}
+}
+
+func TestHost_ValidateCORS(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(h *Host)
+		wantErr bool
+	}{
+		{name: "no cors", change: func(h *Host) {}},
+		{name: "origins", change: func(h *Host) {
+			h.CORSAllowedOrigins = []string{"https://spa.example.com", "http://localhost:3000"}
+			h.CORSAllowedMethods = []string{"GET", "PUT"}
+			h.CORSAllowedHeaders = []string{"Content-Type"}
+			h.CORSAllowCredentials = true
+		}},
+		{name: "any origin", change: func(h *Host) { h.CORSAllowedOrigins = []string{"*"} }},
+		{name: "any origin with credentials", change: func(h *Host) { h.CORSAllowedOrigins = []string{"*"}; h.CORSAllowCredentials = true }, wantErr: true},
+		{name: "origin with a path", change: func(h *Host) { h.CORSAllowedOrigins = []string{"https://spa.example.com/app"} }, wantErr: true},
+		{name: "origin without scheme", change: func(h *Host) { h.CORSAllowedOrigins = []string{"spa.example.com"} }, wantErr: true},
+		{name: "invalid method", change: func(h *Host) { h.CORSAllowedOrigins = []string{"*"}; h.CORSAllowedMethods = []string{"GET PUT"} }, wantErr: true},
+		{name: "invalid header", change: func(h *Host) { h.CORSAllowedOrigins = []string{"*"}; h.CORSAllowedHeaders = []string{"X:Y"} }, wantErr: true},
+		{name: "methods without origins", change: func(h *Host) { h.CORSAllowedMethods = []string{"GET"} }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Host{Hostname: "api.example.com", Backend: "http://localhost:8080", Type: "http", Globs: []Glob{"*@example.com"}}
+			tt.change(&h)
+			if _, err := h.Validate("example.com"); (err != nil) != tt.wantErr {
+				t.Errorf("Host.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHost_ValidateCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(h *Host)
+		wantErr bool
+	}{
+		{name: "cache", change: func(h *Host) { h.CacheSizeMB = 64 }},
+		{name: "negative size", change: func(h *Host) { h.CacheSizeMB = -1 }, wantErr: true},
+		{name: "csp nonce", change: func(h *Host) { h.CacheSizeMB = 64; h.CSPNonce = true }, wantErr: true},
+		{name: "variants", change: func(h *Host) {
+			h.CacheSizeMB = 64
+			h.Strategy = StrategyVariant
+			h.Backend = ""
+			h.Backends = []Backend{{URL: "http://localhost:8080", Name: "a"}, {URL: "http://localhost:8081", Name: "b"}}
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Host{Hostname: "api.example.com", Backend: "http://localhost:8080", Type: "http", Globs: []Glob{"*@example.com"}}
+			tt.change(&h)
+			if _, err := h.Validate("example.com"); (err != nil) != tt.wantErr {
+				t.Errorf("Host.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRPCListen(t *testing.T) {
+	tests := []struct {
+		in          string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{in: "", wantNetwork: "tcp", wantAddress: "127.0.0.1:1234"},
+		{in: "tcp://127.0.0.1:4321", wantNetwork: "tcp", wantAddress: "127.0.0.1:4321"},
+		{in: "tcp://:1234", wantNetwork: "tcp", wantAddress: ":1234"},
+		{in: "unix:///var/run/tobab.sock", wantNetwork: "unix", wantAddress: "/var/run/tobab.sock"},
+		{in: ":1234", wantErr: true},
+		{in: "tcp://localhost", wantErr: true},
+		{in: "unix://", wantErr: true},
+		{in: "udp://127.0.0.1:1234", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			network, address, err := ParseRPCListen(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRPCListen() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if network != tt.wantNetwork || address != tt.wantAddress {
+				t.Errorf("ParseRPCListen() = %s, %s, want %s, %s", network, address, tt.wantNetwork, tt.wantAddress)
+			}
+		})
+	}
+}
+
+func TestConfig_CertificateName(t *testing.T) {
+	c := Config{Wildcards: []string{"*.apps.example.com"}}
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{hostname: "grafana.apps.example.com", want: "*.apps.example.com"},
+		{hostname: "Grafana.Apps.Example.com", want: "*.apps.example.com"},
+		{hostname: "apps.example.com", want: "apps.example.com"},
+		{hostname: "a.b.apps.example.com", want: "a.b.apps.example.com"},
+		{hostname: "login.example.com", want: "login.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			if got := c.CertificateName(tt.hostname); got != tt.want {
+				t.Errorf("Config.CertificateName() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateWildcards(t *testing.T) {
+	base := Config{
+		Hostname:     "login.example.com",
+		CookieScope:  "example.com",
+		Secret:       "secret",
+		Salt:         "salt",
+		CertDir:      "/tmp",
+		DatabasePath: "/tmp/tobab.db",
+		AdminGlobs:   []Glob{"admin@example.com"},
+	}
+	tests := []struct {
+		name      string
+		provider  string
+		wildcards []string
+		wantErr   bool
+	}{
+		{name: "no wildcards"},
+		{name: "wildcard", provider: DNSProviderCloudflare, wildcards: []string{"*.apps.example.com"}},
+		{name: "provider without wildcards", provider: DNSProviderRoute53},
+		{name: "wildcard without provider", wildcards: []string{"*.apps.example.com"}, wantErr: true},
+		{name: "unknown provider", provider: "digitalocean", wantErr: true},
+		{name: "not a wildcard", provider: DNSProviderCloudflare, wildcards: []string{"apps.example.com"}, wantErr: true},
+		{name: "wildcard in the middle", provider: DNSProviderCloudflare, wildcards: []string{"apps.*.example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base
+			c.DNSProvider = tt.provider
+			c.Wildcards = tt.wildcards
+			_, err := c.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateCompression(t *testing.T) {
+	base := Config{
+		Hostname:     "login.example.com",
+		CookieScope:  "example.com",
+		Secret:       "secret",
+		Salt:         "salt",
+		CertDir:      "/tmp",
+		DatabasePath: "/tmp/tobab.db",
+		AdminGlobs:   []Glob{"admin@example.com"},
+	}
+	tests := []struct {
+		name    string
+		types   []string
+		minSize int
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "types and size", types: []string{"image/png", "video/*"}, minSize: 512},
+		{name: "negative size", minSize: -1, wantErr: true},
+		{name: "not a content type", types: []string{"png"}, wantErr: true},
+		{name: "empty subtype", types: []string{"image/"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base
+			c.CompressionExcludeTypes = tt.types
+			c.CompressionMinSize = tt.minSize
+			_, err := c.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyDerivation_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		k       KeyDerivation
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "stronger", k: KeyDerivation{Time: 8, Memory: 256 * 1024, Threads: 8, KeyLen: 32}},
+		{name: "short key", k: KeyDerivation{KeyLen: 16}, wantErr: true},
+		{name: "too little memory", k: KeyDerivation{Memory: 16, Threads: 4}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.k.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("KeyDerivation.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}